@@ -36,23 +36,26 @@ type RedisConfig struct {
 }
 
 type Config struct {
-	BillingAddr  string        `toml:"billing-addr"`
-	BasePath     string        `toml:"base-path"`
-	ListenPort   string        `toml:"listen-port"`
-	LogLevel     string        `toml:"log-level"`
-	LogFile      string        `toml:"log-file"`
-	ServerConfig *ServerConfig `toml:"server-config"`
-	DBConfig     *DBConfig     `toml:"db-config"`
-	RedisConfig  *RedisConfig  `toml:"redis-config"`
+	BillingAddr string `toml:"billing-addr"`
+	BasePath    string `toml:"base-path"`
+	ListenPort  string `toml:"listen-port"`
+	LogLevel    string `toml:"log-level"`
+	LogFile     string `toml:"log-file"`
+	// ShutdownTimeout дедлайн остановки: за это время сервис дорабатывает запросы и сообщения, дописывает очереди и закрывает соединения
+	ShutdownTimeout time.Duration `toml:"shutdown-timeout"`
+	ServerConfig    *ServerConfig `toml:"server-config"`
+	DBConfig        *DBConfig     `toml:"db-config"`
+	RedisConfig     *RedisConfig  `toml:"redis-config"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BillingAddr: "arch.homework/billing",
-		BasePath:    "auth",
-		ListenPort:  "8000",
-		LogLevel:    "info",
-		LogFile:     "stdout",
+		BillingAddr:     "arch.homework/billing",
+		BasePath:        "auth",
+		ListenPort:      "8000",
+		LogLevel:        "info",
+		LogFile:         "stdout",
+		ShutdownTimeout: 25 * time.Second,
 		DBConfig: &DBConfig{
 			Port: 5432,
 		},
@@ -51,3 +51,8 @@ func Init(config *config.DBConfig) error {
 func GetConn() *sql.DB {
 	return conn
 }
+
+// Close закрывает пул соединений, вызывается при остановке сервиса
+func Close() error {
+	return conn.Close()
+}
@@ -39,3 +39,7 @@ require (
 	go.uber.org/zap v1.27.0
 	golang.org/x/crypto v0.32.0
 )
+
+require lifecycle v0.0.0
+
+replace lifecycle => ../lifecycle
@@ -6,6 +6,7 @@ import (
 	"auth/logging"
 	"auth/redis"
 	"auth/service"
+	"lifecycle"
 	"log"
 	"os"
 	"path/filepath"
@@ -35,7 +36,13 @@ func main() {
 
 	redis.Init(config.RedisConfig)
 
-	server := service.NewServer(config)
+	// при остановке сервер дорабатывает текущие запросы, затем закрываются БД и Redis
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config), ":"+config.ListenPort)
+	lc.OnStop("database", db.Close)
+	lc.OnStop("redis", redis.Close)
 
-	log.Fatalf("serve: %s", server.ListenAndServe(":"+config.ListenPort))
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"kafka"
 	"time"
 )
 
@@ -53,13 +54,18 @@ type KafkaConsumerConfig struct {
 	GroupID string   `toml:"group-id"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Workers число воркеров на партицию, сообщения одного заказа обрабатывает один воркер по порядку
+	Workers int `toml:"workers"`
+	kafka.ClientConfig
 }
 
 func NewKafkaConsumerConfig() *KafkaConsumerConfig {
 	return &KafkaConsumerConfig{
-		Brokers: []string{"kafka:9092"},
-		GroupID: "payments",
-		Topic:   "payments",
+		Brokers:      []string{"kafka:9092"},
+		GroupID:      "payments",
+		Topic:        "payments",
+		Workers:      8,
+		ClientConfig: kafka.ClientConfig{ClientID: "billing"},
 	}
 }
 
@@ -67,35 +73,131 @@ type KafkaProducerConfig struct {
 	Brokers []string `toml:"brokers"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Retries сколько раз повторить отправку сообщений, которые брокер не подтвердил, с паузой RetryDelay
+	Retries    int           `toml:"retries"`
+	RetryDelay time.Duration `toml:"retry-delay"`
+	// QueueTimeout сколько консьюмер ждет места в заполненной очереди ответов, после этого сообщение обрабатывается повторно
+	QueueTimeout time.Duration `toml:"queue-timeout"`
+	kafka.ClientConfig
 }
 
 func NewKafkaProducerConfig() *KafkaProducerConfig {
 	return &KafkaProducerConfig{
-		Brokers: []string{"kafka:9092"},
-		Topic:   "payments_status",
+		Brokers:      []string{"kafka:9092"},
+		Topic:        "payments_status",
+		Retries:      3,
+		RetryDelay:   500 * time.Millisecond,
+		QueueTimeout: 5 * time.Second,
+		ClientConfig: kafka.ClientConfig{ClientID: "billing"},
+	}
+}
+
+// DeadLetterConfig сообщения, которые не удалось обработать, попадают в топик <topic><topic-suffix>
+type DeadLetterConfig struct {
+	Brokers     []string `toml:"brokers"`
+	Version     string   `toml:"version"`
+	TopicSuffix string   `toml:"topic-suffix"`
+	Service     string   `toml:"service"`
+	kafka.ClientConfig
+}
+
+func NewDeadLetterConfig() *DeadLetterConfig {
+	return &DeadLetterConfig{
+		Brokers:      []string{"kafka:9092"},
+		TopicSuffix:  ".dlq",
+		Service:      "billing",
+		ClientConfig: kafka.ClientConfig{ClientID: "billing"},
+	}
+}
+
+// RetryTopicsConfig сообщения, упавшие с временной ошибкой, обрабатываются повторно через топики
+// <topic><topic-suffix><delay> с нарастающей задержкой, например payments.retry.10s, payments.retry.1m
+type RetryTopicsConfig struct {
+	Brokers     []string        `toml:"brokers"`
+	Version     string          `toml:"version"`
+	TopicSuffix string          `toml:"topic-suffix"`
+	Delays      []time.Duration `toml:"delays"`
+	kafka.ClientConfig
+}
+
+func NewRetryTopicsConfig() *RetryTopicsConfig {
+	return &RetryTopicsConfig{
+		Brokers:      []string{"kafka:9092"},
+		TopicSuffix:  ".retry.",
+		Delays:       []time.Duration{10 * time.Second, time.Minute, 10 * time.Minute},
+		ClientConfig: kafka.ClientConfig{ClientID: "billing"},
+	}
+}
+
+// HoldConfig заморозки платежей pay: незавершенная заморозка снимается через TTL,
+// истекшие заморозки ищутся раз в CheckInterval
+type HoldConfig struct {
+	TTL           time.Duration `toml:"ttl"`
+	CheckInterval time.Duration `toml:"check-interval"`
+	// BatchSize сколько заморозок снимается за одну проверку
+	BatchSize int `toml:"batch-size"`
+}
+
+func NewHoldConfig() *HoldConfig {
+	return &HoldConfig{
+		TTL:           time.Hour,
+		CheckInterval: time.Minute,
+		BatchSize:     100,
+	}
+}
+
+// ProviderConfig платежный провайдер, через которого пользователи пополняют счет.
+// Провайдер подписывает вебхуки общим секретом из SecretFile
+type ProviderConfig struct {
+	// Name реализация провайдера, fake - локальный сервис fakeprovider для разработки и тестов
+	Name       string        `toml:"name"`
+	Addr       string        `toml:"addr"`
+	SecretFile string        `toml:"secret-file"`
+	Timeout    time.Duration `toml:"timeout"`
+	// ReturnURL куда провайдер вернет пользователя после оплаты
+	ReturnURL string `toml:"return-url"`
+	// WebhookTolerance на сколько время подписи вебхука может отличаться от текущего, старые вебхуки отклоняются
+	WebhookTolerance time.Duration `toml:"webhook-tolerance"`
+}
+
+func NewProviderConfig() *ProviderConfig {
+	return &ProviderConfig{
+		Name:             "fake",
+		Addr:             "http://fakeprovider:8000",
+		SecretFile:       "/secret/payment-provider/webhook-secret",
+		Timeout:          10 * time.Second,
+		ReturnURL:        "http://arch.homework/",
+		WebhookTolerance: 5 * time.Minute,
 	}
 }
 
 type Config struct {
-	BasePath       string               `toml:"base-path"`
-	AuthAddr       string               `toml:"auth-addr"`
-	ListenPort     string               `toml:"listen-port"`
-	LogLevel       string               `toml:"log-level"`
-	LogFile        string               `toml:"log-file"`
-	ServerConfig   *ServerConfig        `toml:"server-config"`
-	DBConfig       *DBConfig            `toml:"db-config"`
-	RedisConfig    *RedisConfig         `toml:"redis-config"`
-	ConsumerConfig *KafkaConsumerConfig `toml:"consumer-config"`
-	ProducerConfig *KafkaProducerConfig `toml:"producer-config"`
+	BasePath   string `toml:"base-path"`
+	AuthAddr   string `toml:"auth-addr"`
+	ListenPort string `toml:"listen-port"`
+	LogLevel   string `toml:"log-level"`
+	LogFile    string `toml:"log-file"`
+	// ShutdownTimeout дедлайн остановки: за это время сервис дорабатывает запросы и сообщения, дописывает очереди и закрывает соединения
+	ShutdownTimeout   time.Duration        `toml:"shutdown-timeout"`
+	ServerConfig      *ServerConfig        `toml:"server-config"`
+	DBConfig          *DBConfig            `toml:"db-config"`
+	RedisConfig       *RedisConfig         `toml:"redis-config"`
+	ConsumerConfig    *KafkaConsumerConfig `toml:"consumer-config"`
+	ProducerConfig    *KafkaProducerConfig `toml:"producer-config"`
+	DeadLetterConfig  *DeadLetterConfig    `toml:"dead-letter-config"`
+	RetryTopicsConfig *RetryTopicsConfig   `toml:"retry-topics-config"`
+	HoldConfig        *HoldConfig          `toml:"hold-config"`
+	ProviderConfig    *ProviderConfig      `toml:"provider-config"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BasePath:   "users",
-		AuthAddr:   "arch.homework",
-		ListenPort: "8000",
-		LogLevel:   "info",
-		LogFile:    "stdout",
+		BasePath:        "users",
+		AuthAddr:        "arch.homework",
+		ListenPort:      "8000",
+		LogLevel:        "info",
+		LogFile:         "stdout",
+		ShutdownTimeout: 25 * time.Second,
 		DBConfig: &DBConfig{
 			Port:  5432,
 			Retry: NewRetryConfig(),
@@ -105,8 +207,12 @@ func NewConfig() *Config {
 			Port: 6379,
 			DB:   0,
 		},
-		ServerConfig:   NewServerConfig(),
-		ConsumerConfig: NewKafkaConsumerConfig(),
-		ProducerConfig: NewKafkaProducerConfig(),
+		ServerConfig:      NewServerConfig(),
+		ConsumerConfig:    NewKafkaConsumerConfig(),
+		ProducerConfig:    NewKafkaProducerConfig(),
+		DeadLetterConfig:  NewDeadLetterConfig(),
+		RetryTopicsConfig: NewRetryTopicsConfig(),
+		HoldConfig:        NewHoldConfig(),
+		ProviderConfig:    NewProviderConfig(),
 	}
 }
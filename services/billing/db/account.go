@@ -4,12 +4,13 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"math"
+	"money"
 )
 
 var (
 	ErrNoUser         = errors.New("user not found")
 	ErrNotEnoughFunds = errors.New("not enough funds")
+	ErrBadAmount      = errors.New("amount must be positive")
 )
 
 func CreateAccount(userId int64) (int64, error) {
@@ -26,23 +27,35 @@ func CreateAccount(userId int64) (int64, error) {
 	return id, nil
 }
 
-func AddMoney(userId int64, amount float64) error {
-	rounded := math.Floor(amount*100) / 100
-	if _, err := GetConn().Exec(`update accounts set balance = balance + $1 where user_id = $2`, rounded, userId); err != nil {
-		return fmt.Errorf("add money: %w", err)
+// AddMoney пополняет счет пользователя и проводит пополнение по книге из cash_in в одной транзакции
+func AddMoney(userId int64, amount money.Money) error {
+	if !amount.IsPositive() {
+		return ErrBadAmount
 	}
 
-	return nil
+	return InTx(func(tx *sql.Tx) error {
+		var accountID int64
+		if err := tx.QueryRow(`update accounts set balance = balance + $1, mtime = NOW() where user_id = $2 returning id`,
+			amount, userId).Scan(&accountID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrNoUser
+			}
+			return fmt.Errorf("add money: %w", err)
+		}
+
+		return postEntry(tx, EntryDeposit, 0, debitSystem(SystemAccountCashIn, amount), creditAccount(accountID, amount))
+	})
 }
 
-func GetBalance(userId int64) (float64, error) {
-	var balance float64
-	if err := GetConn().QueryRow(`select balance from accounts where user_id = $1`, userId).Scan(&balance); err != nil {
+// GetBalance возвращает баланс счета и доступную для оплаты сумму: баланс без замороженных платежей
+func GetBalance(userId int64) (balance, available money.Money, err error) {
+	var held money.Money
+	if err := GetConn().QueryRow(`select balance, held from accounts where user_id = $1`, userId).Scan(&balance, &held); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return 0, ErrNoUser
+			return money.Money{}, money.Money{}, ErrNoUser
 		}
-		return 0, fmt.Errorf("get account balance: %w", err)
+		return money.Money{}, money.Money{}, fmt.Errorf("get account balance: %w", err)
 	}
 
-	return balance, nil
+	return balance, balance.Sub(held), nil
 }
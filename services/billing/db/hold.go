@@ -0,0 +1,214 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"money"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// статусы заморозки payment_holds
+const (
+	HoldStatusHeld     = "held"
+	HoldStatusCaptured = "captured"
+	HoldStatusVoided   = "voided"
+	HoldStatusExpired  = "expired"
+)
+
+var ErrHoldNotActive = errors.New("payment hold is not active")
+
+// account счет пользователя, mtime - версия для оптимистичной блокировки
+type account struct {
+	id      int64
+	balance money.Money
+	held    money.Money
+	mtime   time.Time
+}
+
+// updateAccount меняет баланс и замороженную сумму счета, если его не меняли с момента чтения.
+// Конфликт возвращает sql.ErrNoRows
+func updateAccount(tx *sql.Tx, acc *account, balanceDelta, heldDelta money.Money) error {
+	if err := tx.QueryRow(
+		`update accounts set balance = balance + $1, held = held + $2, mtime = NOW() where id = $3 and mtime = $4 returning mtime`,
+		balanceDelta, heldDelta, acc.id, acc.mtime).Scan(&acc.mtime); err != nil {
+		return fmt.Errorf("update account balance: %w", err)
+	}
+
+	acc.balance = acc.balance.Add(balanceDelta)
+	acc.held = acc.held.Add(heldDelta)
+
+	zap.L().Info(
+		"account updated",
+		zap.Int64("account_id", acc.id),
+		zap.Stringer("balance", acc.balance),
+		zap.Stringer("held", acc.held),
+	)
+
+	return nil
+}
+
+// authorizePayment замораживает сумму платежа pay на ttl: доступный баланс уменьшается, баланс не меняется
+func authorizePayment(tx *sql.Tx, paymentID int64, acc *account, amount money.Money, ttl time.Duration) error {
+	if acc.balance.Sub(acc.held).Cmp(amount) < 0 {
+		return ErrInsufficientFunds
+	}
+
+	if err := updateAccount(tx, acc, money.Money{}, amount); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(
+		`insert into payment_holds(payment_id, account_id, amount, expires_at) values($1, $2, $3, NOW() + make_interval(secs => $4))`,
+		paymentID, acc.id, amount, ttl.Seconds()); err != nil {
+		return fmt.Errorf("create payment hold: %w", err)
+	}
+
+	return nil
+}
+
+// lockHold блокирует заморозку платежа pay до конца транзакции
+func lockHold(tx *sql.Tx, authorizationID int64) (money.Money, string, error) {
+	var (
+		amount money.Money
+		status string
+	)
+	err := tx.QueryRow(`select amount, status from payment_holds where payment_id = $1 for update`, authorizationID).
+		Scan(&amount, &status)
+
+	return amount, status, err
+}
+
+func setHoldStatus(tx *sql.Tx, authorizationID int64, status string) error {
+	if _, err := tx.Exec(`update payment_holds set status = $1, mtime = NOW() where payment_id = $2`,
+		status, authorizationID); err != nil {
+		return fmt.Errorf("update payment hold: %w", err)
+	}
+
+	return nil
+}
+
+// capturePayment списывает замороженную сумму платежа pay в revenue. Снятую или истекшую заморозку списать нельзя
+func capturePayment(tx *sql.Tx, paymentID, authorizationID int64, acc *account) error {
+	amount, status, err := lockHold(tx, authorizationID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// платеж pay проведен до перехода на заморозки, деньги уже списаны
+			zap.L().Warn("no hold for payment, it was charged immediately", zap.Int64("authorization_id", authorizationID))
+			return nil
+		}
+
+		return fmt.Errorf("lock payment hold: %w", err)
+	}
+
+	if status != HoldStatusHeld {
+		return fmt.Errorf("%w: hold of payment %d is %s", ErrHoldNotActive, authorizationID, status)
+	}
+
+	if err := updateAccount(tx, acc, amount.Neg(), amount.Neg()); err != nil {
+		return err
+	}
+
+	if err := setHoldStatus(tx, authorizationID, HoldStatusCaptured); err != nil {
+		return err
+	}
+
+	return postEntry(tx, EntryPay, paymentID, debitAccount(acc.id, amount), creditSystem(SystemAccountRevenue, amount))
+}
+
+// voidPayment снимает заморозку платежа pay. Если деньги уже списаны, возвращает их на счет
+func voidPayment(tx *sql.Tx, paymentID, authorizationID int64, acc *account, amount money.Money) error {
+	held, status, err := lockHold(tx, authorizationID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// платеж pay проведен до перехода на заморозки и сразу списал деньги
+			return refundPayment(tx, paymentID, acc, amount)
+		}
+
+		return fmt.Errorf("lock payment hold: %w", err)
+	}
+
+	switch status {
+	case HoldStatusHeld:
+		if err := updateAccount(tx, acc, money.Money{}, held.Neg()); err != nil {
+			return err
+		}
+
+		return setHoldStatus(tx, authorizationID, HoldStatusVoided)
+	case HoldStatusCaptured:
+		return refundPayment(tx, paymentID, acc, held)
+	default:
+		// заморозку уже сняли
+		return nil
+	}
+}
+
+// ExpireHolds снимает заморозки, которые не списали и не сняли до expires_at, возвращает число снятых.
+// Заморозку, счет которой меняли конкурентно, снимет следующий вызов
+func ExpireHolds(limit int) (int, error) {
+	rows, err := GetConn().Query(
+		`select payment_id from payment_holds where status = 'held' and expires_at < NOW() order by expires_at limit $1`, limit)
+	if err != nil {
+		return 0, fmt.Errorf("get expired holds: %w", err)
+	}
+
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan expired holds: %w", err)
+		}
+
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("read expired holds: %w", err)
+	}
+
+	expired := 0
+	for _, id := range ids {
+		if err := expireHold(id); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+
+			return expired, err
+		}
+
+		expired++
+	}
+
+	return expired, nil
+}
+
+func expireHold(authorizationID int64) error {
+	return InTx(func(tx *sql.Tx) error {
+		var (
+			acc    account
+			amount money.Money
+		)
+		if err := tx.QueryRow(
+			`select a.id, a.balance, a.held, a.mtime, h.amount from payment_holds h join accounts a on h.account_id = a.id
+			where h.payment_id = $1 and h.status = 'held' and h.expires_at < NOW() for update of h`, authorizationID).
+			Scan(&acc.id, &acc.balance, &acc.held, &acc.mtime, &amount); err != nil {
+			return err
+		}
+
+		if err := updateAccount(tx, &acc, money.Money{}, amount.Neg()); err != nil {
+			return err
+		}
+
+		if err := setHoldStatus(tx, authorizationID, HoldStatusExpired); err != nil {
+			return err
+		}
+
+		zap.L().Info("payment hold expired", zap.Int64("payment_id", authorizationID), zap.Stringer("amount", amount))
+
+		return nil
+	})
+}
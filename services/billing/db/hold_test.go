@@ -0,0 +1,161 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"money"
+	"os"
+	"saga"
+	"testing"
+	"time"
+)
+
+const testConsumer = "billing.test"
+
+// openTestDB подключается к базе из TEST_DATABASE_URL, в ней должны быть таблицы сервисов и миграции services/order/migrations, затем services/billing/migrations
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	if err := Open(dsn); err != nil {
+		t.Fatalf("open database: %s", err)
+	}
+}
+
+// testOrder счет нового пользователя с балансом 1000 и заказ, по которому создаются платежи
+type testOrder struct {
+	userID  int64
+	orderID int64
+}
+
+func newTestOrder(t *testing.T) *testOrder {
+	t.Helper()
+
+	o := &testOrder{userID: time.Now().UnixNano() % 1_000_000_000}
+	if _, err := CreateAccount(o.userID); err != nil {
+		t.Fatalf("create account: %s", err)
+	}
+	if err := AddMoney(o.userID, money.FromMinor(100000)); err != nil {
+		t.Fatalf("add money: %s", err)
+	}
+
+	if err := GetConn().QueryRow(
+		`insert into orders(user_id, items, work_date, hour_mask, subtotal, total) values($1, '[]', current_date, 1, $2, $2) returning id`,
+		o.userID, money.FromMinor(10000)).Scan(&o.orderID); err != nil {
+		t.Fatalf("create order: %s", err)
+	}
+
+	return o
+}
+
+// process создает платеж action по заказу так же, как order, и проводит его
+func (o *testOrder) process(t *testing.T, action saga.PaymentAction, authorizationID int64, holdTTL time.Duration) (int64, error) {
+	t.Helper()
+
+	var paymentID int64
+	if err := GetConn().QueryRow(
+		`insert into payments(order_id, action, amount, authorization_id) values($1, $2, $3, $4) returning id`,
+		o.orderID, string(action), money.FromMinor(10000), sql.NullInt64{Int64: authorizationID, Valid: authorizationID != 0}).
+		Scan(&paymentID); err != nil {
+		t.Fatalf("create %s payment: %s", action, err)
+	}
+
+	messageID := fmt.Sprintf("test-%d-%d", paymentID, time.Now().UnixNano())
+
+	return paymentID, ProcessPayment(testConsumer, messageID, paymentID, action, holdTTL)
+}
+
+func (o *testOrder) mustProcess(t *testing.T, action saga.PaymentAction, authorizationID int64) int64 {
+	t.Helper()
+
+	paymentID, err := o.process(t, action, authorizationID, time.Hour)
+	if err != nil {
+		t.Fatalf("process %s payment: %s", action, err)
+	}
+
+	return paymentID
+}
+
+// check сверяет баланс, заморозку и статус заморозки платежа pay, а книга не должна расходиться ни с одним счетом
+func (o *testOrder) check(t *testing.T, payID int64, wantBalance, wantHeld int64, wantHold string) {
+	t.Helper()
+
+	balance, available, err := GetBalance(o.userID)
+	if err != nil {
+		t.Fatalf("get balance: %s", err)
+	}
+	if balance.Minor() != wantBalance || balance.Sub(available).Minor() != wantHeld {
+		t.Errorf("balance = %s, held = %s, want %s, %s",
+			balance, balance.Sub(available), money.FromMinor(wantBalance), money.FromMinor(wantHeld))
+	}
+
+	var status string
+	if err := GetConn().QueryRow(`select status from payment_holds where payment_id = $1`, payID).Scan(&status); err != nil {
+		t.Fatalf("get hold status: %s", err)
+	}
+	if status != wantHold {
+		t.Errorf("hold status = %s, want %s", status, wantHold)
+	}
+
+	mismatches, err := GetBalanceMismatches()
+	if err != nil {
+		t.Fatalf("get balance mismatches: %s", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("balance mismatches: %+v", mismatches)
+	}
+}
+
+func TestPaymentHolds(t *testing.T) {
+	openTestDB(t)
+
+	t.Run("pay then capture", func(t *testing.T) {
+		o := newTestOrder(t)
+
+		payID := o.mustProcess(t, saga.PaymentPay, 0)
+		o.check(t, payID, 100000, 10000, HoldStatusHeld)
+
+		o.mustProcess(t, saga.PaymentCapture, payID)
+		o.check(t, payID, 90000, 0, HoldStatusCaptured)
+	})
+
+	t.Run("pay then void", func(t *testing.T) {
+		o := newTestOrder(t)
+
+		payID := o.mustProcess(t, saga.PaymentPay, 0)
+		o.mustProcess(t, saga.PaymentVoid, payID)
+		o.check(t, payID, 100000, 0, HoldStatusVoided)
+	})
+
+	t.Run("expired hold cannot be captured", func(t *testing.T) {
+		o := newTestOrder(t)
+
+		payID, err := o.process(t, saga.PaymentPay, 0, -time.Second)
+		if err != nil {
+			t.Fatalf("process pay payment: %s", err)
+		}
+
+		if err := expireHold(payID); err != nil {
+			t.Fatalf("expire hold: %s", err)
+		}
+		o.check(t, payID, 100000, 0, HoldStatusExpired)
+
+		if _, err := o.process(t, saga.PaymentCapture, payID, time.Hour); !errors.Is(err, ErrHoldNotActive) {
+			t.Fatalf("capture expired hold: %v, want ErrHoldNotActive", err)
+		}
+		o.check(t, payID, 100000, 0, HoldStatusExpired)
+	})
+
+	t.Run("captured payment is refunded with deposit", func(t *testing.T) {
+		o := newTestOrder(t)
+
+		payID := o.mustProcess(t, saga.PaymentPay, 0)
+		o.mustProcess(t, saga.PaymentCapture, payID)
+		o.mustProcess(t, saga.PaymentDeposit, 0)
+		o.check(t, payID, 100000, 0, HoldStatusCaptured)
+	})
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"billing/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"money"
+)
+
+// виды проводок главной книги
+const (
+	EntryDeposit = "deposit"
+	EntryPay     = "pay"
+	EntryRefund  = "refund"
+)
+
+// системные счета главной книги
+const (
+	SystemAccountCashIn  = "cash_in"
+	SystemAccountRevenue = "revenue"
+	SystemAccountRefunds = "refunds"
+)
+
+var ErrUnbalancedEntry = errors.New("unbalanced journal entry")
+
+// journalLine строка проводки: дебет или кредит счета пользователя accountID либо системного счета systemAccount
+type journalLine struct {
+	accountID     int64
+	systemAccount string
+	debit         money.Money
+	credit        money.Money
+}
+
+func debitAccount(accountID int64, amount money.Money) journalLine {
+	return journalLine{accountID: accountID, debit: amount}
+}
+
+func creditAccount(accountID int64, amount money.Money) journalLine {
+	return journalLine{accountID: accountID, credit: amount}
+}
+
+func debitSystem(account string, amount money.Money) journalLine {
+	return journalLine{systemAccount: account, debit: amount}
+}
+
+func creditSystem(account string, amount money.Money) journalLine {
+	return journalLine{systemAccount: account, credit: amount}
+}
+
+// postEntry добавляет в книгу проводку kind в транзакции, которая меняет accounts.balance.
+// paymentID 0 - проводка не связана с платежом. Суммы дебета и кредита должны совпадать
+func postEntry(tx *sql.Tx, kind string, paymentID int64, lines ...journalLine) error {
+	return insertEntry(tx, kind, paymentID, 0, lines)
+}
+
+// postTopUpEntry проводит зачисление пополнения topUpID через провайдера
+func postTopUpEntry(tx *sql.Tx, topUpID int64, lines ...journalLine) error {
+	return insertEntry(tx, EntryDeposit, 0, topUpID, lines)
+}
+
+func insertEntry(tx *sql.Tx, kind string, paymentID, topUpID int64, lines []journalLine) error {
+	var debit, credit money.Money
+	for _, l := range lines {
+		debit = debit.Add(l.debit)
+		credit = credit.Add(l.credit)
+	}
+
+	if len(lines) < 2 || !debit.Equal(credit) || debit.IsZero() {
+		return fmt.Errorf("post %s entry: %w", kind, ErrUnbalancedEntry)
+	}
+
+	var entryID int64
+	if err := tx.QueryRow(`insert into journal_entries(kind, payment_id, topup_id) values($1, $2, $3) returning id`,
+		kind,
+		sql.NullInt64{Int64: paymentID, Valid: paymentID != 0},
+		sql.NullInt64{Int64: topUpID, Valid: topUpID != 0},
+	).Scan(&entryID); err != nil {
+		return fmt.Errorf("post %s entry: %w", kind, err)
+	}
+
+	for _, l := range lines {
+		if _, err := tx.Exec(
+			`insert into journal_lines(entry_id, account_id, system_account, debit, credit) values($1, $2, $3, $4, $5)`,
+			entryID,
+			sql.NullInt64{Int64: l.accountID, Valid: l.accountID != 0},
+			sql.NullString{String: l.systemAccount, Valid: l.systemAccount != ""},
+			l.debit,
+			l.credit,
+		); err != nil {
+			return fmt.Errorf("post %s entry line: %w", kind, err)
+		}
+	}
+
+	return nil
+}
+
+// GetBalanceMismatches сверяет accounts.balance с книгой и возвращает счета, баланс которых с ней расходится
+func GetBalanceMismatches() ([]types.BalanceMismatch, error) {
+	rows, err := GetConn().Query(
+		`select a.id, a.user_id, a.balance, coalesce(sum(l.credit - l.debit), 0) from accounts a
+		left join journal_lines l on l.account_id = a.id
+		group by a.id, a.user_id, a.balance
+		having a.balance <> coalesce(sum(l.credit - l.debit), 0)
+		order by a.id`)
+	if err != nil {
+		return nil, fmt.Errorf("get balance mismatches: %w", err)
+	}
+	defer rows.Close()
+
+	mismatches := make([]types.BalanceMismatch, 0)
+	for rows.Next() {
+		var m types.BalanceMismatch
+		if err := rows.Scan(&m.AccountID, &m.UserID, &m.Balance, &m.LedgerBalance); err != nil {
+			return nil, fmt.Errorf("scan balance mismatches: %w", err)
+		}
+
+		mismatches = append(mismatches, m)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read balance mismatches: %w", err)
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"money"
+	"testing"
+)
+
+func TestInsertEntryUnbalanced(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []journalLine
+	}{
+		{name: "no lines"},
+		{name: "single line", lines: []journalLine{debitSystem(SystemAccountCashIn, money.FromMinor(100))}},
+		{
+			name: "debit and credit differ",
+			lines: []journalLine{
+				debitSystem(SystemAccountCashIn, money.FromMinor(100)),
+				creditSystem(SystemAccountRevenue, money.FromMinor(99)),
+			},
+		},
+		{
+			name: "zero amount",
+			lines: []journalLine{
+				debitSystem(SystemAccountCashIn, money.Money{}),
+				creditSystem(SystemAccountRevenue, money.Money{}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// несбалансированная проводка отклоняется до записи в базу
+			err := insertEntry(nil, EntryDeposit, 0, 0, tt.lines)
+			if !errors.Is(err, ErrUnbalancedEntry) {
+				t.Fatalf("insertEntry() = %v, want ErrUnbalancedEntry", err)
+			}
+		})
+	}
+}
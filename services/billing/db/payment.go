@@ -4,134 +4,141 @@ import (
 	"billing/types"
 	"context"
 	"database/sql"
+	"dbutil"
 	"errors"
 	"fmt"
-	"math"
+	"money"
+	"saga"
 	"time"
 
 	"github.com/sethvargo/go-retry"
 	"go.uber.org/zap"
 )
 
-const (
-	Deposit = iota
-	Pay
-)
-
 var (
 	ErrUnsupportedPaymentAction = errors.New("unsupported payment action")
 	ErrInsufficientFunds        = errors.New("insufficient funds")
 )
 
-func ProcessPayment(paymentID int64, action int8) error {
-	if action != Deposit && action != Pay {
+// ProcessPayment проводит платеж и подтверждает его в одной транзакции с отметкой об обработке сообщения:
+// pay замораживает сумму на счете на holdTTL, capture списывает замороженную сумму, void снимает заморозку,
+// deposit возвращает деньги на счет. Повторно доставленное сообщение вернет dbutil.ErrDuplicateMessage
+func ProcessPayment(consumer, messageID string, paymentID int64, action saga.PaymentAction, holdTTL time.Duration) error {
+	switch action {
+	case saga.PaymentPay, saga.PaymentCapture, saga.PaymentVoid, saga.PaymentDeposit:
+	default:
 		return ErrUnsupportedPaymentAction
 	}
 
+	actionName := string(action)
+
 	backoff := retry.WithMaxRetries(retryCount, retry.NewConstant(retryDelay))
 	if err := retry.Do(context.Background(), backoff, func(_ context.Context) error {
-		var (
-			accountID int64
-			balance   float64
-			amount    float64
-			mtime     time.Time
-		)
-
-		actionName := "deposit"
-		if action == Pay {
-			actionName = "pay"
-		}
-
-		if err := GetConn().QueryRow(
-			`select a.id, a.balance, p.amount, a.mtime from payments p join orders o on p.order_id = o.id join accounts a on o.user_id = a.user_id 
-		where p.id = $1 and p.status = 'pending' and p.action = $2`, paymentID, actionName).
-			Scan(&accountID, &balance, &amount, &mtime); err != nil {
-			return fmt.Errorf("get account balance: %w", err)
-		}
+		return InTx(func(tx *sql.Tx) error {
+			if err := dbutil.MarkMessageProcessed(tx, consumer, messageID); err != nil {
+				return err
+			}
 
-		if action == Pay && int64(math.Floor(balance*100)) < int64(math.Ceil(amount*100)) {
-			return ErrInsufficientFunds
-		}
+			var (
+				acc             account
+				amount          money.Money
+				authorizationID sql.NullInt64
+			)
+
+			if err := tx.QueryRow(
+				`select a.id, a.balance, a.held, a.mtime, p.amount, p.authorization_id from payments p
+				join orders o on p.order_id = o.id join accounts a on o.user_id = a.user_id
+				where p.id = $1 and p.status = 'pending' and p.action = $2 for update of p`, paymentID, actionName).
+				Scan(&acc.id, &acc.balance, &acc.held, &acc.mtime, &amount, &authorizationID); err != nil {
+				return fmt.Errorf("get account balance: %w", err)
+			}
 
-		if err := processPayment(accountID, amount, action, mtime); err != nil {
-			actionName := "pay"
-			if action == Deposit {
-				actionName = "deposit"
+			var err error
+			switch action {
+			case saga.PaymentPay:
+				err = authorizePayment(tx, paymentID, &acc, amount, holdTTL)
+			case saga.PaymentCapture:
+				err = capturePayment(tx, paymentID, authorizationID.Int64, &acc)
+			case saga.PaymentVoid:
+				err = voidPayment(tx, paymentID, authorizationID.Int64, &acc, amount)
+			case saga.PaymentDeposit:
+				err = refundPayment(tx, paymentID, &acc, amount)
 			}
 
-			if errors.Is(err, sql.ErrNoRows) {
-				zap.L().Warn("optimistic lock conflict, retrying",
-					zap.Int64("payment_id", paymentID),
-					zap.Int64("amount", int64(amount)),
-				)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					zap.L().Warn("optimistic lock conflict, retrying",
+						zap.Int64("payment_id", paymentID),
+						zap.Stringer("amount", amount),
+					)
 
-				return retry.RetryableError(fmt.Errorf("process payment type "+actionName+": %w", err))
-			}
+					return retry.RetryableError(fmt.Errorf("process payment type "+actionName+": %w", dbutil.ErrConcurrentUpdate))
+				}
 
-			return fmt.Errorf("process payment type "+actionName+": %w", err)
-		}
+				return fmt.Errorf("process payment type "+actionName+": %w", err)
+			}
 
-		return nil
+			return approvePayment(tx, paymentID)
+		})
 	}); err != nil {
 		return err
 	}
 
-	zap.L().Info("payment processed", zap.Int64("payment_id", paymentID), zap.Int8("action", action))
+	zap.L().Info("payment processed", zap.Int64("payment_id", paymentID), zap.String("action", string(action)))
 
 	return nil
 }
 
-func ApprovePayment(paymentID int64) {
-	if _, err := GetConn().Exec(`update payments set status = 'ok', mtime = NOW() where id = $1`, paymentID); err != nil {
-		zap.L().Error("failed to approve payment", zap.Error(err))
-		return
+func approvePayment(tx *sql.Tx, paymentID int64) error {
+	if _, err := tx.Exec(`update payments set status = 'ok', mtime = NOW() where id = $1`, paymentID); err != nil {
+		return fmt.Errorf("approve payment: %w", err)
 	}
 
 	zap.L().Info("payment approved", zap.Int64("payment_id", paymentID))
+
+	return nil
 }
 
-func processPayment(accountID int64, amount float64, action int8, mtime time.Time) error {
-	actionType := "-"
-	if action == Deposit {
-		actionType = "+"
+// refundPayment возвращает деньги на счет пользователя из refunds
+func refundPayment(tx *sql.Tx, paymentID int64, acc *account, amount money.Money) error {
+	if err := updateAccount(tx, acc, amount, money.Money{}); err != nil {
+		return err
 	}
 
-	tx, err := GetConn().BeginTx(context.Background(), nil)
-	if err != nil {
-		return fmt.Errorf("begin tx for payment: %w", err)
-	}
-	defer tx.Rollback()
+	return postEntry(tx, EntryRefund, paymentID, debitSystem(SystemAccountRefunds, amount), creditAccount(acc.id, amount))
+}
 
-	var id int64
-	if err := GetConn().QueryRow(`update accounts set balance = balance `+actionType+` $1 where id = $2 and mtime = $3 returning id`,
-		amount, accountID, mtime).Scan(&id); err != nil {
-		return fmt.Errorf("update account balance: %w", err)
-	}
+// RejectPayment отклоняет платеж и отмечает сообщение обработанным в одной транзакции
+func RejectPayment(consumer, messageID string, paymentID int64, reason string) error {
+	if err := InTx(func(tx *sql.Tx) error {
+		if err := dbutil.MarkMessageProcessed(tx, consumer, messageID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`update payments set status = 'failed', error = $1, mtime = NOW() where id = $2 and status = 'pending'`,
+			reason, paymentID); err != nil {
+			return fmt.Errorf("reject payment: %w", err)
+		}
 
-	// если обновилось — коммитим
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit tx: %w", err)
+		return nil
+	}); err != nil {
+		return err
 	}
 
-	zap.L().Info(
-		"account updated",
-		zap.Int64("account_id", accountID),
-		zap.Int8("action", action),
-		zap.Float64("amount", amount),
-	)
+	zap.L().Info("payment rejected", zap.Int64("payment_id", paymentID), zap.String("reason", reason))
 
 	return nil
 }
 
-func RejectPayment(paymentID int64, reason string) {
-	if _, err := GetConn().Exec(
-		`update payments set status = 'failed', error = $1, mtime = NOW() where id = $2 and status = 'pending'`,
-		reason, paymentID); err != nil {
-		zap.L().Error("failed to reject payment", zap.Error(err))
-		return
+// GetPaymentStatus статус платежа: pending, ok или failed
+func GetPaymentStatus(paymentID int64) (string, error) {
+	var status string
+	if err := GetConn().QueryRow(`select status from payments where id = $1`, paymentID).Scan(&status); err != nil {
+		return "", fmt.Errorf("get payment status: %w", err)
 	}
 
-	zap.L().Info("payment rejected", zap.Int64("payment_id", paymentID), zap.String("reason", reason))
+	return status, nil
 }
 
 func GetAllPayments() ([]types.Payment, error) {
@@ -146,7 +153,7 @@ func GetAllPayments() ([]types.Payment, error) {
 		var (
 			id, orderID  int64
 			action       string
-			amount       float64
+			amount       money.Money
 			status       string
 			ctime, mtime time.Time
 			Error        string
@@ -187,7 +194,7 @@ func GetPaymentsByOrderID(orderID int64) ([]types.Payment, error) {
 		var (
 			id           int64
 			action       string
-			amount       float64
+			amount       money.Money
 			status       string
 			ctime, mtime time.Time
 			Error        string
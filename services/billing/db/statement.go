@@ -0,0 +1,76 @@
+package db
+
+import (
+	"billing/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"money"
+)
+
+// GetStatement строит выписку по счету пользователя из строк главной книги за период filter.
+// Остаток после каждого движения считается от баланса на начало периода, а не от начала страницы
+func GetStatement(userID int64, filter *types.StatementFilter) (*types.Statement, error) {
+	var accountID int64
+	if err := GetConn().QueryRow(`select id from accounts where user_id = $1`, userID).Scan(&accountID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoUser
+		}
+		return nil, fmt.Errorf("get account: %w", err)
+	}
+
+	to := sql.NullTime{Time: filter.To, Valid: !filter.To.IsZero()}
+
+	statement := &types.Statement{Movements: make([]types.StatementMovement, 0)}
+	if err := GetConn().QueryRow(
+		`select coalesce(sum(l.credit - l.debit) filter (where e.ctime < $2), 0),
+			coalesce(sum(l.credit - l.debit) filter (where $3::timestamp is null or e.ctime < $3), 0)
+		from journal_lines l join journal_entries e on e.id = l.entry_id
+		where l.account_id = $1`, accountID, filter.From, to).
+		Scan(&statement.OpeningBalance, &statement.ClosingBalance); err != nil {
+		return nil, fmt.Errorf("get statement balances: %w", err)
+	}
+
+	after := types.StatementCursor{}
+	if filter.After != nil {
+		after = *filter.After
+	}
+
+	limit := sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+
+	rows, err := GetConn().Query(
+		`select id, kind, order_id, amount, running, ctime from (
+			select e.id, e.kind, coalesce(p.order_id, 0) as order_id, l.credit - l.debit as amount, e.ctime,
+				sum(l.credit - l.debit) over (order by e.ctime, e.id) as running
+			from journal_lines l join journal_entries e on e.id = l.entry_id
+			left join payments p on p.id = e.payment_id
+			where l.account_id = $1 and e.ctime >= $2 and ($3::timestamp is null or e.ctime < $3)
+		) m
+		where (ctime, id) > ($4, $5)
+		order by ctime, id
+		limit $6`, accountID, filter.From, to, after.CTime, after.ID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get statement movements: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			movement types.StatementMovement
+			running  money.Money
+		)
+		if err := rows.Scan(&movement.EntryID, &movement.Kind, &movement.OrderID, &movement.Amount, &running, &movement.CTime); err != nil {
+			return nil, fmt.Errorf("scan statement movement: %w", err)
+		}
+
+		movement.Balance = statement.OpeningBalance.Add(running)
+
+		statement.Movements = append(statement.Movements, movement)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read statement movements: %w", err)
+	}
+
+	return statement, nil
+}
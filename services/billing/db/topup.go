@@ -0,0 +1,175 @@
+package db
+
+import (
+	"billing/types"
+	"database/sql"
+	"errors"
+	"fmt"
+	"money"
+
+	"go.uber.org/zap"
+)
+
+// статусы пополнения topups
+const (
+	TopUpStatusPending   = "pending"
+	TopUpStatusSucceeded = "succeeded"
+	TopUpStatusCanceled  = "canceled"
+	// TopUpStatusFailed платеж у провайдера создать не удалось
+	TopUpStatusFailed = "failed"
+)
+
+var (
+	ErrTopUpNotFound = errors.New("top-up not found")
+	ErrTopUpMismatch = errors.New("provider payment does not match top-up")
+)
+
+// CreateTopUp создает пополнение счета пользователя в статусе pending, платеж у провайдера создается после
+func CreateTopUp(userID int64, amount money.Money, provider string) (*types.TopUp, error) {
+	if !amount.IsPositive() {
+		return nil, ErrBadAmount
+	}
+
+	topUp := &types.TopUp{Amount: amount}
+	if err := GetConn().QueryRow(
+		`insert into topups(account_id, amount, provider) select id, $2, $3 from accounts where user_id = $1
+		returning id, status, ctime, mtime`, userID, amount, provider).
+		Scan(&topUp.ID, &topUp.Status, &topUp.CTime, &topUp.MTime); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoUser
+		}
+		return nil, fmt.Errorf("create top-up: %w", err)
+	}
+
+	return topUp, nil
+}
+
+// SetTopUpPayment сохраняет платеж провайдера, созданный для пополнения
+func SetTopUpPayment(topUpID int64, externalID, redirectURL string) error {
+	if _, err := GetConn().Exec(
+		`update topups set external_id = $1, redirect_url = $2, mtime = NOW() where id = $3`,
+		externalID, redirectURL, topUpID); err != nil {
+		return fmt.Errorf("set top-up payment: %w", err)
+	}
+
+	return nil
+}
+
+// FailTopUp помечает пополнение, платеж для которого провайдер не создал
+func FailTopUp(topUpID int64) error {
+	if _, err := GetConn().Exec(`update topups set status = 'failed', mtime = NOW() where id = $1 and status = 'pending'`,
+		topUpID); err != nil {
+		return fmt.Errorf("fail top-up: %w", err)
+	}
+
+	return nil
+}
+
+// GetTopUp возвращает пополнение пользователя
+func GetTopUp(userID, topUpID int64) (*types.TopUp, error) {
+	var (
+		topUp       types.TopUp
+		redirectURL sql.NullString
+	)
+	if err := GetConn().QueryRow(
+		`select t.id, t.amount, t.status, t.redirect_url, t.ctime, t.mtime from topups t
+		join accounts a on a.id = t.account_id
+		where t.id = $1 and a.user_id = $2`, topUpID, userID).
+		Scan(&topUp.ID, &topUp.Amount, &topUp.Status, &redirectURL, &topUp.CTime, &topUp.MTime); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrTopUpNotFound
+		}
+		return nil, fmt.Errorf("get top-up: %w", err)
+	}
+
+	topUp.RedirectURL = redirectURL.String
+
+	return &topUp, nil
+}
+
+// lockTopUp блокирует пополнение провайдера до конца транзакции. Вебхук может прийти раньше,
+// чем сохранен платеж, поэтому пополнение ищется по id, а платеж провайдера сверяется с сохраненным
+func lockTopUp(tx *sql.Tx, topUpID int64, provider, externalID string) (accountID int64, amount money.Money, status string, err error) {
+	var savedID sql.NullString
+	if err := tx.QueryRow(
+		`select account_id, amount, status, external_id from topups where id = $1 and provider = $2 for update`,
+		topUpID, provider).Scan(&accountID, &amount, &status, &savedID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, money.Money{}, "", ErrTopUpNotFound
+		}
+		return 0, money.Money{}, "", fmt.Errorf("lock top-up: %w", err)
+	}
+
+	if savedID.Valid && savedID.String != externalID {
+		return 0, money.Money{}, "", fmt.Errorf("%w: top-up %d has payment %s, got %s",
+			ErrTopUpMismatch, topUpID, savedID.String, externalID)
+	}
+
+	return accountID, amount, status, nil
+}
+
+// CompleteTopUp зачисляет пополнение, оплату которого подтвердил провайдер. Повторное подтверждение
+// ничего не меняет: зачисление и проводка делаются один раз, возвращает false, если пополнение уже зачислено
+func CompleteTopUp(topUpID int64, provider, externalID string, paid money.Money) (bool, error) {
+	credited := false
+
+	err := InTx(func(tx *sql.Tx) error {
+		accountID, amount, status, err := lockTopUp(tx, topUpID, provider, externalID)
+		if err != nil {
+			return err
+		}
+
+		if status == TopUpStatusSucceeded {
+			return nil
+		}
+
+		if !paid.Equal(amount) {
+			return fmt.Errorf("%w: top-up %d amount %s, paid %s", ErrTopUpMismatch, topUpID, amount, paid)
+		}
+
+		// провайдер списал деньги, зачисляем даже отмененное у нас пополнение
+		if status != TopUpStatusPending {
+			zap.L().Warn("provider confirmed finished top-up", zap.Int64("topup_id", topUpID), zap.String("status", status))
+		}
+
+		if _, err := tx.Exec(`update topups set status = 'succeeded', external_id = $1, mtime = NOW() where id = $2`,
+			externalID, topUpID); err != nil {
+			return fmt.Errorf("complete top-up: %w", err)
+		}
+
+		if _, err := tx.Exec(`update accounts set balance = balance + $1, mtime = NOW() where id = $2`,
+			amount, accountID); err != nil {
+			return fmt.Errorf("credit top-up: %w", err)
+		}
+
+		credited = true
+
+		return postTopUpEntry(tx, topUpID, debitSystem(SystemAccountCashIn, amount), creditAccount(accountID, amount))
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return credited, nil
+}
+
+// CancelTopUp отменяет пополнение, оплату которого отменили у провайдера. Зачисленное пополнение не меняется
+func CancelTopUp(topUpID int64, provider, externalID string) error {
+	return InTx(func(tx *sql.Tx) error {
+		_, _, status, err := lockTopUp(tx, topUpID, provider, externalID)
+		if err != nil {
+			return err
+		}
+
+		if status != TopUpStatusPending {
+			return nil
+		}
+
+		if _, err := tx.Exec(`update topups set status = 'canceled', external_id = $1, mtime = NOW() where id = $2`,
+			externalID, topUpID); err != nil {
+			return fmt.Errorf("cancel top-up: %w", err)
+		}
+
+		return nil
+	})
+}
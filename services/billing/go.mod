@@ -28,6 +28,9 @@ require (
 	github.com/pierrec/lz4/v4 v4.1.22 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.2.0 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
 	golang.org/x/crypto v0.42.0 // indirect
 )
 
@@ -55,3 +58,21 @@ require (
 	golang.org/x/tools v0.36.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+require (
+	bus v0.0.0
+	dbutil v0.0.0
+	kafka v0.0.0
+	lifecycle v0.0.0
+	money v0.0.0
+	saga v0.0.0
+)
+
+replace (
+	bus => ../bus
+	dbutil => ../dbutil
+	kafka => ../kafka
+	lifecycle => ../lifecycle
+	money => ../money
+	saga => ../saga
+)
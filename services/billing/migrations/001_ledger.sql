@@ -0,0 +1,80 @@
+-- миграции биллинга применяются по номерам после order/migrations: проводки и заморозки ссылаются на payments.
+-- главная книга биллинга: каждое изменение баланса - проводка из строк дебета и кредита с равными суммами.
+-- Строка относится либо к счету пользователя (accounts), либо к системному счету:
+-- cash_in - пополнения, revenue - оплаты заказов, refunds - возвраты, opening_balance - остатки до появления книги.
+-- Баланс счета пользователя равен сумме credit - debit его строк, accounts.balance сверяется с ней
+CREATE TABLE IF NOT EXISTS journal_entries (
+    id         BIGSERIAL   PRIMARY KEY,
+    kind       VARCHAR(16) NOT NULL CHECK (kind IN ('deposit', 'pay', 'refund', 'opening')),
+    payment_id BIGINT      REFERENCES payments (id),
+    ctime      TIMESTAMP   NOT NULL DEFAULT NOW()
+);
+
+-- по платежу проводится не больше одной проводки
+CREATE UNIQUE INDEX IF NOT EXISTS journal_entries_payment_id_idx ON journal_entries (payment_id) WHERE payment_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS journal_lines (
+    id             BIGSERIAL     PRIMARY KEY,
+    entry_id       BIGINT        NOT NULL REFERENCES journal_entries (id),
+    account_id     BIGINT        REFERENCES accounts (id),
+    system_account VARCHAR(32)   CHECK (system_account IN ('cash_in', 'revenue', 'refunds', 'opening_balance')),
+    debit          NUMERIC(12,2) NOT NULL DEFAULT 0 CHECK (debit >= 0),
+    credit         NUMERIC(12,2) NOT NULL DEFAULT 0 CHECK (credit >= 0),
+    CHECK ((account_id IS NULL) <> (system_account IS NULL)),
+    CHECK ((debit = 0) <> (credit = 0))
+);
+
+CREATE INDEX IF NOT EXISTS journal_lines_entry_id_idx ON journal_lines (entry_id);
+CREATE INDEX IF NOT EXISTS journal_lines_account_id_idx ON journal_lines (account_id) WHERE account_id IS NOT NULL;
+
+-- книга только дополняется, исправления делаются новыми проводками
+CREATE OR REPLACE FUNCTION journal_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'journal is append-only: % on %', TG_OP, TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_entries_append_only ON journal_entries;
+CREATE TRIGGER journal_entries_append_only BEFORE UPDATE OR DELETE ON journal_entries
+    FOR EACH ROW EXECUTE FUNCTION journal_append_only();
+
+DROP TRIGGER IF EXISTS journal_lines_append_only ON journal_lines;
+CREATE TRIGGER journal_lines_append_only BEFORE UPDATE OR DELETE ON journal_lines
+    FOR EACH ROW EXECUTE FUNCTION journal_append_only();
+
+-- сбалансированность проводки проверяется при коммите, когда добавлены все ее строки
+CREATE OR REPLACE FUNCTION journal_entry_balanced() RETURNS trigger AS $$
+BEGIN
+    IF (SELECT SUM(debit) <> SUM(credit) FROM journal_lines WHERE entry_id = NEW.entry_id) THEN
+        RAISE EXCEPTION 'journal entry % is not balanced', NEW.entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS journal_lines_balanced ON journal_lines;
+CREATE CONSTRAINT TRIGGER journal_lines_balanced AFTER INSERT ON journal_lines
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION journal_entry_balanced();
+
+-- остатки существующих счетов переносятся в книгу проводками opening
+DO $$
+DECLARE
+    a        RECORD;
+    entry_id BIGINT;
+BEGIN
+    IF EXISTS (SELECT 1 FROM journal_entries WHERE kind = 'opening') THEN
+        RETURN;
+    END IF;
+
+    FOR a IN SELECT id, balance FROM accounts WHERE balance <> 0 LOOP
+        INSERT INTO journal_entries (kind) VALUES ('opening') RETURNING id INTO entry_id;
+
+        INSERT INTO journal_lines (entry_id, system_account, debit, credit)
+        VALUES (entry_id, 'opening_balance', GREATEST(a.balance, 0), GREATEST(-a.balance, 0));
+
+        INSERT INTO journal_lines (entry_id, account_id, debit, credit)
+        VALUES (entry_id, a.id, GREATEST(-a.balance, 0), GREATEST(a.balance, 0));
+    END LOOP;
+END;
+$$;
@@ -0,0 +1,16 @@
+-- замороженная сумма, доступно для оплаты balance - held.
+-- Платеж pay замораживает сумму, capture и void ссылаются на него через payments.authorization_id из order/migrations
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS held NUMERIC(12,2) NOT NULL DEFAULT 0;
+
+-- заморозка по платежу pay, незавершенная заморозка снимается после expires_at
+CREATE TABLE IF NOT EXISTS payment_holds (
+    payment_id BIGINT        PRIMARY KEY REFERENCES payments (id),
+    account_id BIGINT        NOT NULL REFERENCES accounts (id),
+    amount     NUMERIC(12,2) NOT NULL CHECK (amount > 0),
+    status     VARCHAR(16)   NOT NULL DEFAULT 'held' CHECK (status IN ('held', 'captured', 'voided', 'expired')),
+    expires_at TIMESTAMP     NOT NULL,
+    ctime      TIMESTAMP     NOT NULL DEFAULT NOW(),
+    mtime      TIMESTAMP     NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS payment_holds_expires_at_idx ON payment_holds (expires_at) WHERE status = 'held';
@@ -0,0 +1,21 @@
+-- пополнение счета через платежного провайдера: биллинг создает платеж у провайдера,
+-- счет пополняется, когда провайдер подтвердит оплату подписанным вебхуком
+CREATE TABLE IF NOT EXISTS topups (
+    id           BIGSERIAL     PRIMARY KEY,
+    account_id   BIGINT        NOT NULL REFERENCES accounts (id),
+    amount       NUMERIC(12,2) NOT NULL CHECK (amount > 0),
+    status       VARCHAR(16)   NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'succeeded', 'canceled', 'failed')),
+    provider     VARCHAR(32)   NOT NULL,
+    external_id  VARCHAR(128),
+    redirect_url TEXT,
+    ctime        TIMESTAMP     NOT NULL DEFAULT NOW(),
+    mtime        TIMESTAMP     NOT NULL DEFAULT NOW()
+);
+
+-- платеж провайдера относится к одному пополнению
+CREATE UNIQUE INDEX IF NOT EXISTS topups_provider_external_id_idx ON topups (provider, external_id) WHERE external_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS topups_account_id_idx ON topups (account_id);
+
+-- проводка пополнения ссылается на него, пополнение зачисляется не больше одного раза
+ALTER TABLE journal_entries ADD COLUMN IF NOT EXISTS topup_id BIGINT REFERENCES topups (id);
+CREATE UNIQUE INDEX IF NOT EXISTS journal_entries_topup_id_idx ON journal_entries (topup_id) WHERE topup_id IS NOT NULL;
@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"billing/config"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"money"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// заголовки подписи вебхука fakeprovider: подписывается строка "<timestamp>.<body>" ключом HMAC-SHA256
+const (
+	fakeHeaderTimestamp   = "X-Webhook-Timestamp"
+	fakeHeaderSignature   = "X-Webhook-Signature"
+	fakeHeaderIdempotency = "Idempotence-Key"
+)
+
+// fakePayment платеж в API fakeprovider, reference - id пополнения в биллинге
+type fakePayment struct {
+	ID              string      `json:"id"`
+	Status          string      `json:"status"`
+	Amount          money.Money `json:"amount"`
+	Currency        string      `json:"currency"`
+	Reference       string      `json:"reference"`
+	Description     string      `json:"description,omitempty"`
+	ReturnURL       string      `json:"return_url,omitempty"`
+	ConfirmationURL string      `json:"confirmation_url,omitempty"`
+}
+
+type fakeWebhook struct {
+	Event   string      `json:"event"`
+	Payment fakePayment `json:"payment"`
+}
+
+// FakeProvider клиент локального провайдера fakeprovider, API повторяет устройство реальных провайдеров:
+// платеж создается с ключом идемпотентности, результат оплаты приходит подписанным вебхуком
+type FakeProvider struct {
+	client    *fasthttp.Client
+	addr      string
+	returnURL string
+	timeout   time.Duration
+	tolerance time.Duration
+	secret    []byte
+}
+
+func NewFakeProvider(config *config.ProviderConfig, secret []byte) *FakeProvider {
+	return &FakeProvider{
+		client:    &fasthttp.Client{},
+		addr:      config.Addr,
+		returnURL: config.ReturnURL,
+		timeout:   config.Timeout,
+		tolerance: config.WebhookTolerance,
+		secret:    secret,
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) CreatePayment(ctx context.Context, req *PaymentRequest) (*Payment, error) {
+	body, err := json.Marshal(fakePayment{
+		Amount:      req.Amount,
+		Currency:    string(req.Amount.Currency()),
+		Reference:   strconv.FormatInt(req.TopUpID, 10),
+		Description: req.Description,
+		ReturnURL:   p.returnURL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("marshal payment: %w", err)
+	}
+
+	httpReq := fasthttp.AcquireRequest()
+	httpResp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(httpReq)
+	defer fasthttp.ReleaseResponse(httpResp)
+
+	httpReq.SetRequestURI(p.addr + "/payments")
+	httpReq.Header.SetMethod(fasthttp.MethodPost)
+	httpReq.Header.SetContentType("application/json")
+	// повтор запроса после таймаута не создаст у провайдера второй платеж
+	httpReq.Header.Set(fakeHeaderIdempotency, "topup-"+strconv.FormatInt(req.TopUpID, 10))
+	httpReq.SetBody(body)
+
+	timeout := p.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+
+	if err := p.client.DoTimeout(httpReq, httpResp, timeout); err != nil {
+		return nil, fmt.Errorf("%w: create payment: %w", ErrProviderFailed, err)
+	}
+
+	if status := httpResp.StatusCode(); status != fasthttp.StatusOK && status != fasthttp.StatusCreated {
+		return nil, fmt.Errorf("%w: create payment: status %d: %s", ErrProviderFailed, status, httpResp.Body())
+	}
+
+	var payment fakePayment
+	if err := json.Unmarshal(httpResp.Body(), &payment); err != nil {
+		return nil, fmt.Errorf("%w: unmarshal payment: %w", ErrProviderFailed, err)
+	}
+
+	if payment.ID == "" || payment.ConfirmationURL == "" {
+		return nil, fmt.Errorf("%w: payment without id or confirmation url", ErrProviderFailed)
+	}
+
+	return &Payment{ID: payment.ID, RedirectURL: payment.ConfirmationURL}, nil
+}
+
+func (p *FakeProvider) ParseWebhook(header func(key string) string, body []byte) (*Event, error) {
+	ts, err := strconv.ParseInt(header(fakeHeaderTimestamp), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no timestamp", ErrBadSignature)
+	}
+
+	// подпись старого вебхука могли перехватить, такие вебхуки не принимаем
+	if age := time.Since(time.Unix(ts, 0)); age > p.tolerance || age < -p.tolerance {
+		return nil, fmt.Errorf("%w: timestamp is out of tolerance", ErrBadSignature)
+	}
+
+	signature, err := hex.DecodeString(header(fakeHeaderSignature))
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrBadSignature)
+	}
+
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+	mac.Write(body)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrBadSignature
+	}
+
+	var webhook fakeWebhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBadWebhook, err)
+	}
+
+	topUpID, err := strconv.ParseInt(webhook.Payment.Reference, 10, 64)
+	if err != nil || webhook.Payment.ID == "" {
+		return nil, fmt.Errorf("%w: bad payment id or reference", ErrBadWebhook)
+	}
+
+	// сумма читается без валюты, платеж в другой валюте нельзя сравнивать с пополнением
+	if money.Currency(webhook.Payment.Currency) != money.DefaultCurrency {
+		return nil, fmt.Errorf("%w: unsupported currency %q", ErrBadWebhook, webhook.Payment.Currency)
+	}
+
+	return &Event{
+		PaymentID: webhook.Payment.ID,
+		TopUpID:   topUpID,
+		Status:    webhook.Payment.Status,
+		Amount:    webhook.Payment.Amount,
+	}, nil
+}
@@ -0,0 +1,133 @@
+package provider
+
+import (
+	"billing/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("webhook-secret")
+
+// signFakeWebhook подписывает тело вебхука так же, как fakeprovider
+func signFakeWebhook(secret []byte, ts int64, body string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(ts, 10) + "."))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestFakeProviderParseWebhook(t *testing.T) {
+	p := NewFakeProvider(&config.ProviderConfig{WebhookTolerance: 5 * time.Minute}, testSecret)
+
+	const body = `{"event":"payment.succeeded","payment":{"id":"pay-1","status":"succeeded","amount":12.5,"currency":"RUB","reference":"42"}}`
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name      string
+		body      string
+		timestamp string
+		signature string
+		wantErr   error
+	}{
+		{
+			name:      "valid",
+			body:      body,
+			timestamp: strconv.FormatInt(now, 10),
+			signature: signFakeWebhook(testSecret, now, body),
+		},
+		{
+			name:      "wrong secret",
+			body:      body,
+			timestamp: strconv.FormatInt(now, 10),
+			signature: signFakeWebhook([]byte("other"), now, body),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "body changed after signing",
+			body:      `{"event":"payment.succeeded","payment":{"id":"pay-1","status":"succeeded","amount":1250,"currency":"RUB","reference":"42"}}`,
+			timestamp: strconv.FormatInt(now, 10),
+			signature: signFakeWebhook(testSecret, now, body),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "malformed signature",
+			body:      body,
+			timestamp: strconv.FormatInt(now, 10),
+			signature: "not hex",
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "no timestamp",
+			body:      body,
+			signature: signFakeWebhook(testSecret, now, body),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "stale timestamp",
+			body:      body,
+			timestamp: strconv.FormatInt(now-600, 10),
+			signature: signFakeWebhook(testSecret, now-600, body),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "timestamp in the future",
+			body:      body,
+			timestamp: strconv.FormatInt(now+600, 10),
+			signature: signFakeWebhook(testSecret, now+600, body),
+			wantErr:   ErrBadSignature,
+		},
+		{
+			name:      "foreign currency",
+			body:      `{"event":"payment.succeeded","payment":{"id":"pay-1","status":"succeeded","amount":12.5,"currency":"USD","reference":"42"}}`,
+			timestamp: strconv.FormatInt(now, 10),
+			wantErr:   ErrBadWebhook,
+		},
+		{
+			name:      "no reference",
+			body:      `{"event":"payment.succeeded","payment":{"id":"pay-1","status":"succeeded","amount":12.5,"currency":"RUB"}}`,
+			timestamp: strconv.FormatInt(now, 10),
+			wantErr:   ErrBadWebhook,
+		},
+		{
+			name:      "malformed json",
+			body:      `{"payment":`,
+			timestamp: strconv.FormatInt(now, 10),
+			wantErr:   ErrBadWebhook,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := tt.signature
+			if signature == "" {
+				ts, _ := strconv.ParseInt(tt.timestamp, 10, 64)
+				signature = signFakeWebhook(testSecret, ts, tt.body)
+			}
+
+			headers := map[string]string{
+				fakeHeaderTimestamp: tt.timestamp,
+				fakeHeaderSignature: signature,
+			}
+
+			event, err := p.ParseWebhook(func(key string) string { return headers[key] }, []byte(tt.body))
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ParseWebhook() = %+v, %v, want %v", event, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWebhook(): %s", err)
+			}
+
+			if event.PaymentID != "pay-1" || event.TopUpID != 42 || event.Status != StatusSucceeded || event.Amount.Minor() != 1250 {
+				t.Errorf("unexpected event %+v", event)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Package provider платежные провайдеры, через которых пользователи пополняют счет: биллинг создает у провайдера
+// платеж на сумму пополнения, пользователь оплачивает его на странице провайдера, провайдер сообщает результат
+// подписанным вебхуком
+package provider
+
+import (
+	"billing/config"
+	"context"
+	"errors"
+	"fmt"
+	"money"
+	"os"
+	"strings"
+)
+
+// статусы платежа у провайдера, о которых он сообщает вебхуком
+const (
+	StatusSucceeded = "succeeded"
+	StatusCanceled  = "canceled"
+)
+
+var (
+	ErrBadSignature   = errors.New("bad webhook signature")
+	ErrBadWebhook     = errors.New("bad webhook")
+	ErrProviderFailed = errors.New("payment provider error")
+)
+
+// PaymentRequest платеж, который биллинг создает у провайдера для пополнения TopUpID
+type PaymentRequest struct {
+	TopUpID     int64
+	Amount      money.Money
+	Description string
+}
+
+// Payment платеж у провайдера: ID платежа и страница, на которой пользователь его оплачивает
+type Payment struct {
+	ID          string
+	RedirectURL string
+}
+
+// Event уведомление провайдера об изменении статуса платежа ID, созданного для пополнения TopUpID
+type Event struct {
+	PaymentID string
+	TopUpID   int64
+	Status    string
+	Amount    money.Money
+}
+
+// PaymentProvider платежный провайдер. Вебхук разбирается только после проверки подписи,
+// один и тот же вебхук провайдер может прислать несколько раз
+type PaymentProvider interface {
+	// Name имя провайдера, под которым сохраняются его платежи
+	Name() string
+	// CreatePayment создает платеж, повторный вызов для того же пополнения возвращает тот же платеж
+	CreatePayment(ctx context.Context, req *PaymentRequest) (*Payment, error)
+	// ParseWebhook проверяет подпись вебхука и возвращает событие, header возвращает заголовок запроса
+	ParseWebhook(header func(key string) string, body []byte) (*Event, error)
+}
+
+// New возвращает провайдера config.Name
+func New(config *config.ProviderConfig) (PaymentProvider, error) {
+	data, err := os.ReadFile(config.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("read webhook secret: %w", err)
+	}
+
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, errors.New("webhook secret is empty")
+	}
+
+	switch config.Name {
+	case "fake":
+		return NewFakeProvider(config, secret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", config.Name)
+	}
+}
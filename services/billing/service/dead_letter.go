@@ -0,0 +1,133 @@
+package service
+
+import (
+	"billing/config"
+	"billing/types"
+	"bus"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// NewDeadLetters dead letter топики сервиса, reader читает их для просмотра и повторной отправки
+func NewDeadLetters(config *config.Config, publisher bus.Publisher, reader bus.TopicReader, topics ...string) *bus.DeadLetters {
+	dlc := config.DeadLetterConfig
+	return bus.NewDeadLetters(publisher, reader, dlc.Service, dlc.TopicSuffix, topics...)
+}
+
+// sendToDeadLetters отправляет сообщение, которое не удалось обработать, в dead letter топик.
+// Ошибку отправки обработчик возвращает подписчику, чтобы сообщение не закоммитилось
+func sendToDeadLetters(ctx context.Context, deadLetters *bus.DeadLetters, msg *bus.Message, cause error) error {
+	if err := deadLetters.Send(ctx, msg, cause); err != nil {
+		zap.L().Error("failed to send message to dead letter topic", zap.Error(err), zap.String("value", string(msg.Value)))
+		return err
+	}
+
+	partition, offset := bus.OriginalPosition(msg)
+	zap.L().Warn("message sent to dead letter topic", zap.Error(cause), zap.String("topic", bus.OriginalTopic(msg)),
+		zap.Int32("partition", partition), zap.Int64("offset", offset))
+
+	return nil
+}
+
+var (
+	ErrGetDeadLetters    = errors.New("get dead letters error")
+	ErrRedriveDeadLetter = errors.New("redrive dead letter error")
+)
+
+// dead_letters godoc
+//
+//	@Summary		dead_letters
+//	@Description	list messages which consumers failed to process, newest first (admin only)
+//	@Tags			dead letters
+//	@Produce		json
+//	@Param			topic	query		string	true	"original topic"
+//	@Param			limit	query		int		false	"max messages, default 50, max 500"
+//	@Success		200		{object}	[]types.DeadLetter
+//	@Failure		400		{object}	types.HTTPError
+//	@Failure		401		{object}	types.HTTPError
+//	@Failure		403		{object}	types.HTTPError
+//	@Failure		405		{object}	types.HTTPError
+//	@Failure		500		{object}	types.HTTPError
+//	@Router			/dead_letters [get]
+func handleGetDeadLetters(deadLetters *bus.DeadLetters, ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := string(ctx.QueryArgs().Peek("topic"))
+
+	limit := bus.DefaultDeadLettersLimit
+	if ctx.QueryArgs().Has("limit") {
+		var err error
+		if limit, err = ctx.QueryArgs().GetUint("limit"); err != nil || limit == 0 || limit > bus.MaxDeadLettersLimit {
+			handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
+			return
+		}
+	}
+
+	letters, err := deadLetters.List(topic, limit)
+	if err != nil {
+		if errors.Is(err, bus.ErrUnknownDeadLetterTopic) {
+			handleError(ctx, err, fasthttp.StatusBadRequest)
+			return
+		}
+
+		zap.L().Error(fmt.Errorf("list dead letters: %w", err).Error())
+		handleError(ctx, ErrGetDeadLetters, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(letters)
+}
+
+// redrive_dead_letter godoc
+//
+//	@Summary		redrive_dead_letter
+//	@Description	send dead letter back to its original topic (admin only)
+//	@Tags			dead letters
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body	types.RedriveDeadLetterRequest	true	"dead letter position"
+//	@Success		200
+//	@Failure		400	{object}	types.HTTPError
+//	@Failure		401	{object}	types.HTTPError
+//	@Failure		403	{object}	types.HTTPError
+//	@Failure		404	{object}	types.HTTPError
+//	@Failure		405	{object}	types.HTTPError
+//	@Failure		500	{object}	types.HTTPError
+//	@Router			/redrive_dead_letter [post]
+func handleRedriveDeadLetter(deadLetters *bus.DeadLetters, ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.RedriveDeadLetterRequest
+	if err := json.Unmarshal(ctx.Request.Body(), &req); err != nil {
+		handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := deadLetters.Redrive(ctx, req.Topic, req.Partition, req.Offset); err != nil {
+		switch {
+		case errors.Is(err, bus.ErrUnknownDeadLetterTopic):
+			handleError(ctx, err, fasthttp.StatusBadRequest)
+		case errors.Is(err, bus.ErrDeadLetterNotFound):
+			handleError(ctx, err, fasthttp.StatusNotFound)
+		default:
+			zap.L().Error(fmt.Errorf("redrive dead letter: %w", err).Error())
+			handleError(ctx, ErrRedriveDeadLetter, fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
@@ -74,7 +74,7 @@ func getBalance(ctx *fasthttp.RequestCtx, userId int64) {
 		return
 	}
 
-	balance, err := db.GetBalance(userId)
+	balance, available, err := db.GetBalance(userId)
 	if err != nil {
 		zap.L().Error(err.Error())
 		handleError(ctx, ErrGetBalance, fasthttp.StatusBadRequest)
@@ -83,38 +83,52 @@ func getBalance(ctx *fasthttp.RequestCtx, userId int64) {
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.SetContentType("application/json")
-	json.NewEncoder(ctx).Encode(types.BalanceResponse{Balance: balance})
+	json.NewEncoder(ctx).Encode(types.BalanceResponse{Balance: balance, Available: available})
 }
 
 // addMoney godoc
 //
 //	@Summary		add money
-//	@Description	add money
+//	@Description	manual balance adjustment of the user_id account (admin only), users top up through create_topup
 //	@Tags			billing
 //	@Accept			json
+//	@Param			request	body		types.AddMoneyRequest	true	"target user and amount"
 //	@Success		200	{object}	nil
 //	@Failure		400	{object}	types.HTTPError
 //	@Failure		401	{object}	types.HTTPError
+//	@Failure		403	{object}	types.HTTPError
 //	@Failure		404	{object}	types.HTTPError
 //	@Failure		405	{object}	types.HTTPError
 //	@Failure		500	{object}	types.HTTPError
 //	@Router			/add_money [post]
-func addMoney(ctx *fasthttp.RequestCtx, userId int64) {
+func addMoney(ctx *fasthttp.RequestCtx) {
 	if string(ctx.Method()) != fasthttp.MethodPost {
 		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
 		return
 	}
 
-	var deposit types.Deposit
-	if err := json.Unmarshal(ctx.Request.Body(), &deposit); err != nil {
+	var req types.AddMoneyRequest
+	if err := json.Unmarshal(ctx.Request.Body(), &req); err != nil {
 		zap.L().Error(err.Error())
 		handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
 		return
 	}
 
-	if err := db.AddMoney(userId, deposit.Amount); err != nil {
-		zap.L().Error(err.Error())
-		handleError(ctx, ErrAddMoney, fasthttp.StatusBadRequest)
+	if req.UserID <= 0 {
+		handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if err := db.AddMoney(req.UserID, req.Amount); err != nil {
+		switch {
+		case errors.Is(err, db.ErrBadAmount):
+			handleError(ctx, err, fasthttp.StatusBadRequest)
+		case errors.Is(err, db.ErrNoUser):
+			handleError(ctx, err, fasthttp.StatusNotFound)
+		default:
+			zap.L().Error(err.Error())
+			handleError(ctx, ErrAddMoney, fasthttp.StatusBadRequest)
+		}
 		return
 	}
 
@@ -191,6 +205,40 @@ func getAllPayments(ctx *fasthttp.RequestCtx) {
 	json.NewEncoder(ctx).Encode(payments)
 }
 
+// reconcile godoc
+//
+//	@Summary		reconcile
+//	@Description	list accounts whose balance differs from the sum of their ledger lines (admin only)
+//	@Tags			billing
+//	@Produce		json
+//	@Success		200	{object}	[]types.BalanceMismatch
+//	@Failure		401	{object}	types.HTTPError
+//	@Failure		403	{object}	types.HTTPError
+//	@Failure		405	{object}	types.HTTPError
+//	@Failure		500	{object}	types.HTTPError
+//	@Router			/reconcile [get]
+func reconcile(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	mismatches, err := db.GetBalanceMismatches()
+	if err != nil {
+		zap.L().Error(err.Error())
+		handleError(ctx, ErrInternal, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	if len(mismatches) > 0 {
+		zap.L().Warn("account balances differ from ledger", zap.Int("accounts", len(mismatches)))
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(mismatches)
+}
+
 func handleError(ctx *fasthttp.RequestCtx, err error, status int) {
 	ctx.SetStatusCode(status)
 	ctx.SetContentType("application/json")
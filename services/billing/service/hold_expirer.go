@@ -0,0 +1,59 @@
+package service
+
+import (
+	"billing/config"
+	"billing/db"
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HoldExpirer снимает заморозки платежей, которые сага не списала и не сняла до истечения TTL
+type HoldExpirer struct {
+	checkInterval time.Duration
+	batchSize     int
+}
+
+func NewHoldExpirer(config *config.Config) *HoldExpirer {
+	return &HoldExpirer{
+		checkInterval: config.HoldConfig.CheckInterval,
+		batchSize:     config.HoldConfig.BatchSize,
+	}
+}
+
+// Run проверяет заморозки по таймеру, пока не отменен ctx
+func (e *HoldExpirer) Run(ctx context.Context) error {
+	zap.L().Info("hold expirer started")
+
+	ticker := time.NewTicker(e.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.expire(ctx)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// expire снимает истекшие заморозки пачками, пока они не закончатся
+func (e *HoldExpirer) expire(ctx context.Context) {
+	for ctx.Err() == nil {
+		expired, err := db.ExpireHolds(e.batchSize)
+		if err != nil {
+			zap.L().Error("failed to expire payment holds", zap.Error(err))
+			return
+		}
+
+		if expired > 0 {
+			zap.L().Info("payment holds expired", zap.Int("count", expired))
+		}
+
+		if expired < e.batchSize {
+			return
+		}
+	}
+}
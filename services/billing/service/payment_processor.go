@@ -3,262 +3,297 @@ package service
 import (
 	"billing/config"
 	"billing/db"
+	"bus"
 	"context"
+	"crypto/rand"
 	"database/sql"
-	"encoding/json"
+	"dbutil"
 	"errors"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	"fmt"
+	"lifecycle"
+	"saga"
+	"time"
 
-	"github.com/IBM/sarama"
 	"go.uber.org/zap"
 )
 
 type PaymentsProcessor struct {
-	consumer     sarama.ConsumerGroup
+	subscriber   bus.Subscriber
 	consumeTopic string
 
-	producer     sarama.AsyncProducer
+	retryTopics *bus.RetryTopics
+	deadLetters *bus.DeadLetters
+
+	publisher    bus.Publisher
 	produceTopic string
+
+	// holdTTL срок заморозки по платежу pay
+	holdTTL time.Duration
+
+	// processedMessages ответы, которые консьюмер передает продюсеру
+	processedMessages chan reply
+	queueTimeout      time.Duration
 }
 
-func NewPaymentsProcessor(config *config.Config) *PaymentsProcessor {
-	cConfig := sarama.NewConfig()
-	version, err := sarama.ParseKafkaVersion(config.ConsumerConfig.Version)
-	if err != nil {
-		zap.L().Fatal("failed to parse kafka version", zap.Error(err))
-	}
-	cConfig.Version = version
-	cConfig.Net.TLS.Enable = false
+// ErrQueueFull очередь ответов заполнена дольше queueTimeout
+var ErrQueueFull = errors.New("reply queue is full")
 
-	c, err := sarama.NewConsumerGroup(config.ConsumerConfig.Brokers, config.ConsumerConfig.GroupID, cConfig)
-	if err != nil {
-		zap.L().Fatal("failed to start consumer", zap.Error(err))
-	}
+// errReplyNotSent ответ не отправлен: сообщение не подтверждается, при повторной доставке
+// ответ повторится по сохраненному статусу платежа
+var errReplyNotSent = errors.New("reply not sent")
 
-	pConfig := sarama.NewConfig()
-	version, err = sarama.ParseKafkaVersion(config.ProducerConfig.Version)
-	if err != nil {
-		zap.L().Fatal("failed to parse kafka version", zap.Error(err))
-	}
-	pConfig.Version = version
-	pConfig.Net.TLS.Enable = false
+// reply ответ консьюмера в очереди, результат отправки продюсер возвращает в sent
+type reply struct {
+	msg  *saga.PaymentMessage
+	sent chan error
+}
 
-	p, err := sarama.NewAsyncProducer(config.ProducerConfig.Brokers, pConfig)
-	if err != nil {
-		zap.L().Fatal("failed to start producer", zap.Error(err))
+func NewPaymentsProcessor(config *config.Config, subscriber bus.Subscriber, publisher bus.Publisher,
+	retryTopics *bus.RetryTopics, deadLetters *bus.DeadLetters) *PaymentsProcessor {
+	p := &PaymentsProcessor{
+		subscriber:        subscriber,
+		retryTopics:       retryTopics,
+		deadLetters:       deadLetters,
+		consumeTopic:      config.ConsumerConfig.Topic,
+		produceTopic:      config.ProducerConfig.Topic,
+		holdTTL:           config.HoldConfig.TTL,
+		processedMessages: make(chan reply, 256),
+		queueTimeout:      config.ProducerConfig.QueueTimeout,
 	}
 
-	return &PaymentsProcessor{
-		consumer:     c,
-		consumeTopic: config.ConsumerConfig.Topic,
-		producer:     p,
-		produceTopic: config.ProducerConfig.Topic,
-	}
+	metrics := bus.NewMetrics("payments", func() int { return len(p.processedMessages) })
+	p.publisher = bus.NewReliablePublisher(publisher, metrics, config.ProducerConfig.Retries, config.ProducerConfig.RetryDelay)
+
+	return p
 }
 
-func (p *PaymentsProcessor) Run() {
+// Run обрабатывает сообщения, пока не отменен ctx. После отмены консьюмер дорабатывает текущие сообщения,
+// а ответы, оставшиеся в очереди, отправляются до дедлайна остановки
+func (p *PaymentsProcessor) Run(ctx context.Context) error {
 	zap.L().Info("payment processor started")
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	keepRunning := true
-
 	consumer := Consumer{
-		ready:             make(chan bool),
-		processedMessages: make(chan *PaymentMessage, 256),
+		processedMessages: p.processedMessages,
+		queueTimeout:      p.queueTimeout,
+		retryTopics:       p.retryTopics,
+		deadLetters:       p.deadLetters,
+		holdTTL:           p.holdTTL,
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	// сообщения с временной ошибкой возвращаются через топики ретраев
+	topics := append([]string{p.consumeTopic}, p.retryTopics.Topics(p.consumeTopic)...)
+
+	consumed := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		for {
-			// `Consume` should be called inside an infinite loop, when a
-			// server-side rebalance happens, the consumer session will need to be
-			// recreated to get the new claims
-			if err := p.consumer.Consume(ctx, []string{p.consumeTopic}, &consumer); err != nil {
-				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
-					return
-				}
-				zap.L().Fatal("error from consumer: " + err.Error())
-			}
-			// check if context was cancelled, signaling that the consumer should stop
-			if ctx.Err() != nil {
-				return
-			}
-			consumer.ready = make(chan bool)
-		}
+		consumed <- p.subscriber.Subscribe(ctx, topics, consumer.handleMessage)
 	}()
 
-	<-consumer.ready // Await till the consumer has been set up
-	zap.L().Info("Sarama consumer up and running!...")
+	var err error
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for err := range p.producer.Errors() {
-			zap.L().Error("failed to produce message", zap.Error(err))
+ProducerLoop:
+	for {
+		select {
+		case r := <-consumer.processedMessages:
+			r.sent <- p.produce(lifecycle.StopContext(ctx), r.msg)
+		case err = <-consumed:
+			break ProducerLoop
 		}
-	}()
+	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-	ProducerLoop:
-		for {
-			select {
-			case msg := <-consumer.processedMessages:
-				bytes, err := json.Marshal(msg)
-				if err != nil {
-					zap.L().Error("failed to marshal payment message", zap.Error(err))
-					continue
-				}
-				zap.L().Sugar().Infof("producing message: %s", string(bytes))
-				p.producer.Input() <- &sarama.ProducerMessage{Topic: p.produceTopic, Value: sarama.StringEncoder(string(bytes))}
-			case <-ctx.Done():
-				p.producer.AsyncClose() // Trigger a shutdown of the producer.
-				break ProducerLoop
-			}
-		}
-	}()
+	p.flush(lifecycle.StopContext(ctx), consumer.processedMessages)
+
+	if closeErr := p.subscriber.Close(); closeErr != nil {
+		zap.L().Error("error closing consumer", zap.Error(closeErr))
+	}
+	if closeErr := p.publisher.Close(); closeErr != nil {
+		zap.L().Error("error closing producer", zap.Error(closeErr))
+	}
+
+	return err
+}
+
+func (p *PaymentsProcessor) produce(ctx context.Context, msg *saga.PaymentMessage) error {
+	bytes, err := saga.Encode(msg)
+	if err != nil {
+		zap.L().Error("failed to marshal payment message", zap.Error(err))
+		return err
+	}
+	zap.L().Sugar().Infof("producing message: %s", string(bytes))
+	if err := p.publisher.Publish(ctx, &bus.Message{
+		Topic: p.produceTopic,
+		Key:   []byte(saga.Key(msg.OrderID)),
+		Value: bytes,
+	}); err != nil {
+		zap.L().Error("failed to produce message",
+			zap.Error(err), zap.Int64("order_id", msg.OrderID), zap.Int64("payment_id", msg.PaymentID))
+		return err
+	}
 
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	return nil
+}
 
-	for keepRunning {
+// flush отправляет ответы, оставшиеся в очереди после остановки консьюмера, пока не истечет ctx
+func (p *PaymentsProcessor) flush(ctx context.Context, queue chan reply) {
+	for ctx.Err() == nil {
 		select {
-		case <-ctx.Done():
-			zap.L().Info("terminating: context cancelled")
-			keepRunning = false
-		case <-sigterm:
-			zap.L().Info("terminating: via signal")
-			keepRunning = false
+		case r := <-queue:
+			r.sent <- p.produce(ctx, r.msg)
+		default:
+			return
 		}
 	}
 
-	cancel()
-	wg.Wait()
-	if err := p.consumer.Close(); err != nil {
-		zap.L().Fatal("error closing consumer: " + err.Error())
-	}
+	zap.L().Error("shutdown deadline exceeded, dropping queued messages", zap.Int("count", len(queue)))
 }
 
-// Consumer represents a Sarama consumer group consumer
+// Consumer обрабатывает сообщения подписки, ответы передает в processedMessages
 type Consumer struct {
-	ready             chan bool
-	processedMessages chan *PaymentMessage
-}
+	processedMessages chan reply
+	queueTimeout      time.Duration
+	holdTTL           time.Duration
 
-// Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	// Mark the consumer as ready
-	close(consumer.ready)
-	return nil
+	retryTopics *bus.RetryTopics
+	deadLetters *bus.DeadLetters
 }
 
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
-	return nil
+// paymentsConsumerName имя консьюмера, под которым отмечаются обработанные сообщения
+const paymentsConsumerName = "billing.payments"
+
+// newMessageID генерирует уникальный id сообщения саги, по нему получатель отбрасывает повторную доставку
+func newMessageID() string {
+	return rand.Text()
 }
 
-const (
-	PaymentStatusPending int8 = iota
-	PaymentStatusOK
-	PaymentStatusFailed
-)
+// handleMessage обрабатывает сообщение подписки, ошибка - подписка завершилась до обработки,
+// ответ не отправлен или сообщение не удалось отправить в dead letter топик
+func (consumer *Consumer) handleMessage(ctx context.Context, message *bus.Message) error {
+	zap.L().Sugar().Infof("message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+	if err := consumer.retryTopics.Wait(ctx, message); err != nil {
+		return err
+	}
 
-const (
-	Deposit = iota
-	Pay
-)
+	err := consumer.processPayment(ctx, message.Value)
+	if errors.Is(err, errReplyNotSent) {
+		zap.L().Error("failed to reply to payment message", zap.Error(err))
+		return err
+	}
 
-type PaymentMessage struct {
-	PaymentID      int64   `json:"payment_id"`
-	OrderID        int64   `json:"order_id"`
-	StockChangeIDs []int64 `json:"stock_change_ids"`
-	Action         int8    `json:"action"`
-	Status         int8    `json:"status"` // 0 - pending, 1 - ok, 2 - failed
-}
+	if err != nil && dbutil.IsTransient(err) {
+		err = scheduleRetry(ctx, consumer.retryTopics, message, err)
+	}
 
-// ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
-// Once the Messages() channel is closed, the Handler must finish its processing
-// loop and exit.
-func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	// NOTE:
-	// Do not move the code below to a goroutine.
-	// The `ConsumeClaim` itself is called within a goroutine, see:
-	// https://github.com/IBM/sarama/blob/main/consumer_group.go#L27-L29
-	for {
-		select {
-		case message, ok := <-claim.Messages():
-			if !ok {
-				zap.L().Info("message channel was closed")
-				return nil
-			}
-			zap.L().Sugar().Infof("message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
-			if err := consumer.processPayment(message.Value); err != nil {
-				zap.L().Error("failed to process payment message", zap.Error(err))
-			}
-			session.MarkMessage(message, "")
-		// Should return when `session.Context()` is done.
-		// If not, will raise `ErrRebalanceInProgress` or `read tcp <ip>:<port>: i/o timeout` when kafka rebalance. see:
-		// https://github.com/IBM/sarama/issues/1192
-		case <-session.Context().Done():
-			return nil
-		}
+	if err != nil {
+		zap.L().Error("failed to process payment message", zap.Error(err))
+		return sendToDeadLetters(ctx, consumer.deadLetters, message, err)
 	}
+
+	return nil
 }
 
-func (consumer *Consumer) processPayment(data []byte) error {
-	var msg PaymentMessage
-	if err := json.Unmarshal(data, &msg); err != nil {
+func (consumer *Consumer) processPayment(ctx context.Context, data []byte) error {
+	var msg saga.PaymentMessage
+	if err := saga.Decode(data, &msg); err != nil {
 		return err
 	}
 
-	if msg.Status != PaymentStatusPending || msg.PaymentID == 0 || msg.OrderID == 0 {
+	if msg.Status != saga.StatusPending {
 		zap.L().Warn("received bad payment message",
 			zap.Int64("payment_id", msg.PaymentID),
 			zap.Int64("order_id", msg.OrderID),
-			zap.Int8("status", msg.Status))
+			zap.String("status", string(msg.Status)))
 		return nil
 	}
 
-	produce := func(msg *PaymentMessage) {
-		zap.L().Sugar().Infof("processed payment message: %+v", *msg)
-		consumer.processedMessages <- msg
-	}
-
 	switch msg.Action {
-	case Deposit, Pay:
-		if err := db.ProcessPayment(msg.PaymentID, msg.Action); err != nil {
+	case saga.PaymentPay, saga.PaymentCapture, saga.PaymentVoid, saga.PaymentDeposit:
+		if err := db.ProcessPayment(paymentsConsumerName, msg.MessageID, msg.PaymentID, msg.Action, consumer.holdTTL); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil
 			}
 
-			db.RejectPayment(msg.PaymentID, err.Error())
+			if errors.Is(err, dbutil.ErrDuplicateMessage) {
+				return consumer.replyProcessed(ctx, &msg)
+			}
+
+			// платеж остается в ожидании, сообщение обработаем повторно через топик ретраев
+			if dbutil.IsTransient(err) {
+				return err
+			}
+
+			if rejectErr := db.RejectPayment(paymentsConsumerName, msg.MessageID, msg.PaymentID, err.Error()); rejectErr != nil {
+				if errors.Is(rejectErr, dbutil.ErrDuplicateMessage) {
+					return consumer.replyProcessed(ctx, &msg)
+				}
+
+				return rejectErr
+			}
 
 			zap.L().Error(
 				"failed to process payment",
 				zap.Error(err),
 				zap.Int64("payment_id", msg.PaymentID),
 				zap.Int64("order_id", msg.OrderID),
-				zap.Int8("action", msg.Action),
-				zap.Int8("status", msg.Status),
+				zap.String("action", string(msg.Action)),
+				zap.String("status", string(msg.Status)),
 				zap.Int64s("stock_change_ids", msg.StockChangeIDs),
 			)
-			msg.Status = PaymentStatusFailed
-			produce(&msg)
-			return nil
+			msg.Status = saga.StatusFailed
+			return consumer.reply(ctx, &msg)
 		}
-		db.ApprovePayment(msg.PaymentID)
-		msg.Status = PaymentStatusOK
-		produce(&msg)
-		return nil
+		msg.Status = saga.StatusOK
+		return consumer.reply(ctx, &msg)
 	default:
 		return nil
 	}
 }
+
+// reply ставит ответ в очередь продюсера и ждет его отправки. Место в заполненной очереди ждет не дольше queueTimeout,
+// после чего возвращает ErrQueueFull. Ответ уходит уже после коммита в базе, поэтому любая ошибка отправки
+// возвращается как errReplyNotSent, чтобы сообщение не подтверждалось
+func (consumer *Consumer) reply(ctx context.Context, msg *saga.PaymentMessage) error {
+	// ответ — новое сообщение саги со своим id
+	msg.MessageID = newMessageID()
+	zap.L().Sugar().Infof("processed payment message: %+v", *msg)
+
+	r := reply{msg: msg, sent: make(chan error, 1)}
+
+	queueCtx, cancel := context.WithTimeout(ctx, consumer.queueTimeout)
+	defer cancel()
+
+	select {
+	case consumer.processedMessages <- r:
+	case <-queueCtx.Done():
+		return fmt.Errorf("%w: %w: %w", errReplyNotSent, ErrQueueFull, queueCtx.Err())
+	}
+
+	select {
+	case err := <-r.sent:
+		if err != nil {
+			return fmt.Errorf("%w: %w", errReplyNotSent, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errReplyNotSent, ctx.Err())
+	}
+}
+
+// replyProcessed повторяет ответ на уже обработанное сообщение по статусу платежа в базе:
+// предыдущий ответ на него мог не дойти до кафки
+func (consumer *Consumer) replyProcessed(ctx context.Context, msg *saga.PaymentMessage) error {
+	status, err := db.GetPaymentStatus(msg.PaymentID)
+	if err != nil {
+		return err
+	}
+
+	msg.Status = saga.Status(status)
+	if msg.Status != saga.StatusOK && msg.Status != saga.StatusFailed {
+		zap.L().Warn("skip duplicate payment message",
+			zap.Int64("payment_id", msg.PaymentID), zap.String("status", status))
+		return nil
+	}
+
+	zap.L().Warn("duplicate payment message, repeating reply",
+		zap.Int64("payment_id", msg.PaymentID), zap.String("status", status))
+
+	return consumer.reply(ctx, msg)
+}
@@ -0,0 +1,28 @@
+package service
+
+import (
+	"billing/config"
+	"bus"
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// NewRetryTopics топики ретраев сервиса, задержки берутся из RetryTopicsConfig
+func NewRetryTopics(config *config.Config, publisher bus.Publisher) *bus.RetryTopics {
+	rtc := config.RetryTopicsConfig
+	return bus.NewRetryTopics(publisher, rtc.TopicSuffix, rtc.Delays)
+}
+
+// scheduleRetry откладывает сообщение, упавшее с временной ошибкой, в топик ретраев.
+// Если задержки закончились или отправить не удалось, возвращает ошибку для dead letter топика
+func scheduleRetry(ctx context.Context, retryTopics *bus.RetryTopics, msg *bus.Message, cause error) error {
+	if err := retryTopics.Schedule(ctx, msg, cause); err != nil {
+		return err
+	}
+
+	zap.L().Warn("message scheduled for retry", zap.Error(cause),
+		zap.String("topic", bus.OriginalTopic(msg)), zap.Int("attempt", bus.RetryAttempt(msg)+1))
+
+	return nil
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"billing/config"
 	"billing/redis"
+	"bus"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,7 +22,9 @@ var ErrAccessTokenExpired = errors.New("access-token expired")
 var ErrRedis = errors.New("redis error")
 var ErrParseAccessToken = errors.New("failed to parse access-token")
 
-func NewServer(config *config.Config) *fasthttp.Server {
+func NewServer(config *config.Config, deadLetters *bus.DeadLetters) *fasthttp.Server {
+	loadPublicKey()
+
 	basePath := strings.Trim(config.BasePath, "/")
 	s := &fasthttp.Server{
 		Handler: func(ctx *fasthttp.RequestCtx) {
@@ -32,7 +35,7 @@ func NewServer(config *config.Config) *fasthttp.Server {
 			}
 
 			switch parts[1] {
-			case "create_account", "add_money", "get_balance", "get_payments", "get_all_payments":
+			case "create_account", "add_money", "get_balance", "get_payments", "get_all_payments", "dead_letters", "redrive_dead_letter", "reconcile", "statement", "create_topup", "get_topup":
 				switch {
 				case len(parts) == 2:
 					var (
@@ -50,9 +53,21 @@ func NewServer(config *config.Config) *fasthttp.Server {
 					case "create_account":
 						createAccount(ctx, userId)
 					case "add_money":
-						addMoney(ctx, userId)
+						// ручная корректировка баланса счета user_id из запроса, пользователи пополняют счет через create_topup
+						if isAdmin {
+							addMoney(ctx)
+						} else {
+							ctx.Error("Forbidden", fasthttp.StatusForbidden)
+							return
+						}
 					case "get_balance":
 						getBalance(ctx, userId)
+					case "statement":
+						getStatement(ctx, userId)
+					case "create_topup":
+						GetTopUps().create(ctx, userId)
+					case "get_topup":
+						GetTopUps().get(ctx, userId)
 					case "get_payments":
 						if isAdmin {
 							getPayments(ctx)
@@ -67,13 +82,45 @@ func NewServer(config *config.Config) *fasthttp.Server {
 							ctx.Error("Forbidden", fasthttp.StatusForbidden)
 							return
 						}
+					case "dead_letters":
+						if isAdmin {
+							handleGetDeadLetters(deadLetters, ctx)
+						} else {
+							ctx.Error("Forbidden", fasthttp.StatusForbidden)
+							return
+						}
+					case "redrive_dead_letter":
+						if isAdmin {
+							handleRedriveDeadLetter(deadLetters, ctx)
+						} else {
+							ctx.Error("Forbidden", fasthttp.StatusForbidden)
+							return
+						}
+					case "reconcile":
+						if isAdmin {
+							reconcile(ctx)
+						} else {
+							ctx.Error("Forbidden", fasthttp.StatusForbidden)
+							return
+						}
 					}
 				default:
 					ctx.Error("not found", fasthttp.StatusNotFound)
 					return
 				}
+			case "topup_webhook":
+				// вызывает платежный провайдер, вместо токена пользователя проверяется подпись вебхука
+				if len(parts) != 2 {
+					ctx.Error("not found", fasthttp.StatusNotFound)
+					return
+				}
+				GetTopUps().webhook(ctx)
 			case "health":
 				healthCheckHandler(ctx)
+			case "metrics":
+				// метрики продюсеров: {"producers": {...}}
+				ctx.SetContentType("application/json")
+				bus.WriteMetrics(ctx)
 			default:
 				ctx.Error("not found", fasthttp.StatusNotFound)
 			}
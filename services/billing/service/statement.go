@@ -0,0 +1,224 @@
+package service
+
+import (
+	"billing/db"
+	"billing/types"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStatementPageSize = 50
+	maxStatementPageSize     = 500
+)
+
+var (
+	ErrBadStatementQuery = errors.New("bad statement query")
+	ErrGetStatement      = errors.New("get statement error")
+)
+
+// statement godoc
+//
+//	@Summary		statement
+//	@Description	account statement for a period: opening balance, movements (deposit, pay, refund) with running balance and closing balance.
+//	@Description	With Accept: text/csv all movements of the period are returned as a CSV file, limit and cursor are ignored
+//	@Tags			billing
+//	@Produce		json
+//	@Produce		text/csv
+//	@Param			from	query		string	false	"period start, RFC3339 or date"
+//	@Param			to		query		string	false	"period end, RFC3339 or date (the whole day is included)"
+//	@Param			limit	query		int		false	"movements per page, default 50, max 500"
+//	@Param			cursor	query		string	false	"next_cursor from previous page"
+//	@Success		200		{object}	types.Statement
+//	@Failure		400		{object}	types.HTTPError
+//	@Failure		401		{object}	types.HTTPError
+//	@Failure		404		{object}	types.HTTPError
+//	@Failure		405		{object}	types.HTTPError
+//	@Failure		500		{object}	types.HTTPError
+//	@Router			/statement [get]
+func getStatement(ctx *fasthttp.RequestCtx, userId int64) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseStatementFilter(ctx.QueryArgs())
+	if err != nil {
+		handleError(ctx, fmt.Errorf("%w: %w", ErrBadStatementQuery, err), fasthttp.StatusBadRequest)
+		return
+	}
+
+	asCSV := strings.Contains(string(ctx.Request.Header.Peek(fasthttp.HeaderAccept)), "text/csv")
+
+	// выгрузка в CSV отдает весь период, в JSON берем на одно движение больше, чтобы понять, есть ли следующая страница
+	limit := filter.Limit
+	if asCSV {
+		filter.Limit = 0
+		filter.After = nil
+	} else {
+		filter.Limit++
+	}
+
+	statement, err := db.GetStatement(userId, filter)
+	if err != nil {
+		if errors.Is(err, db.ErrNoUser) {
+			handleError(ctx, err, fasthttp.StatusNotFound)
+			return
+		}
+
+		zap.L().Error(fmt.Errorf("get statement: %w", err).Error())
+		handleError(ctx, ErrGetStatement, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	if !filter.From.IsZero() {
+		statement.From = &filter.From
+	}
+	if !filter.To.IsZero() {
+		statement.To = &filter.To
+	}
+
+	if asCSV {
+		writeStatementCSV(ctx, statement)
+		return
+	}
+
+	if len(statement.Movements) > limit {
+		statement.Movements = statement.Movements[:limit]
+		last := statement.Movements[limit-1]
+		statement.NextCursor = encodeStatementCursor(&types.StatementCursor{CTime: last.CTime, ID: last.EntryID})
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(statement)
+}
+
+// writeStatementCSV пишет выписку файлом: движения, затем остатки на начало и конец периода
+func writeStatementCSV(ctx *fasthttp.RequestCtx, statement *types.Statement) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("text/csv; charset=utf-8")
+	ctx.Response.Header.Set(fasthttp.HeaderContentDisposition, `attachment; filename="statement.csv"`)
+
+	w := csv.NewWriter(ctx)
+	w.Write([]string{"entry_id", "ctime", "kind", "order_id", "amount", "balance"})
+	w.Write([]string{"", formatStatementTime(statement.From), "opening_balance", "", "", statement.OpeningBalance.String()})
+
+	for _, m := range statement.Movements {
+		orderID := ""
+		if m.OrderID != 0 {
+			orderID = strconv.FormatInt(m.OrderID, 10)
+		}
+
+		w.Write([]string{
+			strconv.FormatInt(m.EntryID, 10),
+			m.CTime.Format(time.RFC3339),
+			m.Kind,
+			orderID,
+			m.Amount.String(),
+			m.Balance.String(),
+		})
+	}
+
+	w.Write([]string{"", formatStatementTime(statement.To), "closing_balance", "", "", statement.ClosingBalance.String()})
+	w.Flush()
+
+	if err := w.Error(); err != nil {
+		zap.L().Error(fmt.Errorf("write statement csv: %w", err).Error())
+	}
+}
+
+func formatStatementTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func parseStatementFilter(args *fasthttp.Args) (*types.StatementFilter, error) {
+	filter := &types.StatementFilter{Limit: defaultStatementPageSize}
+
+	var err error
+	if from := string(args.Peek("from")); len(from) > 0 {
+		if filter.From, err = parseStatementTime(from, false); err != nil {
+			return nil, fmt.Errorf("parse from: %w", err)
+		}
+	}
+
+	if to := string(args.Peek("to")); len(to) > 0 {
+		if filter.To, err = parseStatementTime(to, true); err != nil {
+			return nil, fmt.Errorf("parse to: %w", err)
+		}
+	}
+
+	if !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return nil, errors.New("from must be before to")
+	}
+
+	if limit := string(args.Peek("limit")); len(limit) > 0 {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > maxStatementPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxStatementPageSize)
+		}
+	}
+
+	if cursor := string(args.Peek("cursor")); len(cursor) > 0 {
+		if filter.After, err = decodeStatementCursor(cursor); err != nil {
+			return nil, fmt.Errorf("parse cursor: %w", err)
+		}
+	}
+
+	return filter, nil
+}
+
+// parseStatementTime принимает RFC3339 или дату, дата в правой границе включается целиком
+func parseStatementTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// курсор непрозрачен для клиента: ключ последнего движения страницы в base64
+func encodeStatementCursor(cursor *types.StatementCursor) string {
+	data, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeStatementCursor(value string) (*types.StatementCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor types.StatementCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+
+	if cursor.ID <= 0 || cursor.CTime.IsZero() {
+		return nil, errors.New("malformed cursor")
+	}
+
+	return &cursor, nil
+}
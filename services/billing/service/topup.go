@@ -0,0 +1,229 @@
+package service
+
+import (
+	"billing/config"
+	"billing/db"
+	"billing/provider"
+	"billing/types"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+var (
+	topUpsOnce sync.Once
+	topUps     *TopUps
+)
+
+var (
+	ErrCreateTopUp = errors.New("create top-up error")
+	ErrGetTopUp    = errors.New("get top-up error")
+	ErrTopUpFailed = errors.New("payment provider is unavailable, try again later")
+)
+
+// TopUps пополнения счета через платежного провайдера
+type TopUps struct {
+	provider provider.PaymentProvider
+	timeout  time.Duration
+}
+
+func NewTopUps(config *config.Config, paymentProvider provider.PaymentProvider) {
+	topUpsOnce.Do(func() {
+		topUps = &TopUps{
+			provider: paymentProvider,
+			timeout:  config.ProviderConfig.Timeout,
+		}
+	})
+}
+
+func GetTopUps() *TopUps {
+	return topUps
+}
+
+// create_topup godoc
+//
+//	@Summary		create top-up
+//	@Description	create a top-up intent and a payment at the payment provider, the user pays it at redirect_url.
+//	@Description	The account is credited when the provider confirms the payment with a webhook
+//	@Tags			billing
+//	@Accept			json
+//	@Produce		json
+//	@Param			deposit	body		types.Deposit	true	"top-up amount"
+//	@Success		201		{object}	types.TopUp
+//	@Failure		400		{object}	types.HTTPError
+//	@Failure		401		{object}	types.HTTPError
+//	@Failure		404		{object}	types.HTTPError
+//	@Failure		405		{object}	types.HTTPError
+//	@Failure		500		{object}	types.HTTPError
+//	@Failure		502		{object}	types.HTTPError
+//	@Router			/create_topup [post]
+func (t *TopUps) create(ctx *fasthttp.RequestCtx, userId int64) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	var deposit types.Deposit
+	if err := json.Unmarshal(ctx.Request.Body(), &deposit); err != nil {
+		zap.L().Error(err.Error())
+		handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
+		return
+	}
+
+	topUp, err := db.CreateTopUp(userId, deposit.Amount, t.provider.Name())
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrBadAmount):
+			handleError(ctx, err, fasthttp.StatusBadRequest)
+		case errors.Is(err, db.ErrNoUser):
+			handleError(ctx, err, fasthttp.StatusNotFound)
+		default:
+			zap.L().Error(err.Error())
+			handleError(ctx, ErrCreateTopUp, fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+
+	payment, err := t.provider.CreatePayment(reqCtx, &provider.PaymentRequest{
+		TopUpID:     topUp.ID,
+		Amount:      topUp.Amount,
+		Description: fmt.Sprintf("top-up %d", topUp.ID),
+	})
+	if err != nil {
+		zap.L().Error("failed to create provider payment", zap.Int64("topup_id", topUp.ID), zap.Error(err))
+		if err := db.FailTopUp(topUp.ID); err != nil {
+			zap.L().Error(err.Error())
+		}
+		handleError(ctx, ErrTopUpFailed, fasthttp.StatusBadGateway)
+		return
+	}
+
+	if err := db.SetTopUpPayment(topUp.ID, payment.ID, payment.RedirectURL); err != nil {
+		zap.L().Error(err.Error())
+		handleError(ctx, ErrCreateTopUp, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	topUp.RedirectURL = payment.RedirectURL
+
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(topUp)
+}
+
+// get_topup godoc
+//
+//	@Summary		get top-up
+//	@Description	get top-up status: pending, succeeded, canceled or failed
+//	@Tags			billing
+//	@Produce		json
+//	@Param			id	query		int	true	"top-up id"
+//	@Success		200	{object}	types.TopUp
+//	@Failure		400	{object}	types.HTTPError
+//	@Failure		401	{object}	types.HTTPError
+//	@Failure		404	{object}	types.HTTPError
+//	@Failure		405	{object}	types.HTTPError
+//	@Failure		500	{object}	types.HTTPError
+//	@Router			/get_topup [get]
+func (t *TopUps) get(ctx *fasthttp.RequestCtx, userId int64) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(string(ctx.QueryArgs().Peek("id")), 10, 64)
+	if err != nil {
+		handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
+		return
+	}
+
+	topUp, err := db.GetTopUp(userId, id)
+	if err != nil {
+		if errors.Is(err, db.ErrTopUpNotFound) {
+			handleError(ctx, err, fasthttp.StatusNotFound)
+			return
+		}
+
+		zap.L().Error(err.Error())
+		handleError(ctx, ErrGetTopUp, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(topUp)
+}
+
+// topup_webhook godoc
+//
+//	@Summary		top-up webhook
+//	@Description	payment provider notification about a top-up payment, signed by the provider.
+//	@Description	A succeeded payment credits the account once, repeated notifications are acknowledged without changes
+//	@Tags			billing
+//	@Accept			json
+//	@Success		200	{object}	nil
+//	@Failure		400	{object}	types.HTTPError
+//	@Failure		401	{object}	types.HTTPError
+//	@Failure		404	{object}	types.HTTPError
+//	@Failure		405	{object}	types.HTTPError
+//	@Failure		500	{object}	types.HTTPError
+//	@Router			/topup_webhook [post]
+func (t *TopUps) webhook(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	event, err := t.provider.ParseWebhook(func(key string) string {
+		return string(ctx.Request.Header.Peek(key))
+	}, ctx.Request.Body())
+	if err != nil {
+		zap.L().Warn("rejected top-up webhook", zap.Error(err))
+		if errors.Is(err, provider.ErrBadSignature) {
+			handleError(ctx, provider.ErrBadSignature, fasthttp.StatusUnauthorized)
+			return
+		}
+		handleError(ctx, provider.ErrBadWebhook, fasthttp.StatusBadRequest)
+		return
+	}
+
+	// на ошибку провайдер пришлет вебхук повторно, поэтому 500 только для ошибок, которые могут пройти
+	switch event.Status {
+	case provider.StatusSucceeded:
+		var credited bool
+		if credited, err = db.CompleteTopUp(event.TopUpID, t.provider.Name(), event.PaymentID, event.Amount); err == nil {
+			zap.L().Info("top-up webhook processed",
+				zap.Int64("topup_id", event.TopUpID), zap.String("payment_id", event.PaymentID), zap.Bool("credited", credited))
+		}
+	case provider.StatusCanceled:
+		err = db.CancelTopUp(event.TopUpID, t.provider.Name(), event.PaymentID)
+	default:
+		zap.L().Info("ignored top-up webhook", zap.Int64("topup_id", event.TopUpID), zap.String("status", event.Status))
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrTopUpNotFound):
+			handleError(ctx, err, fasthttp.StatusNotFound)
+		case errors.Is(err, db.ErrTopUpMismatch):
+			zap.L().Error(err.Error())
+			handleError(ctx, db.ErrTopUpMismatch, fasthttp.StatusBadRequest)
+		default:
+			zap.L().Error(fmt.Errorf("process top-up webhook: %w", err).Error())
+			handleError(ctx, ErrInternal, fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"billing/config"
+	"billing/db"
+	"billing/provider"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"money"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var testWebhookSecret = []byte("webhook-secret")
+
+func newTestTopUps() *TopUps {
+	return &TopUps{
+		provider: provider.NewFakeProvider(&config.ProviderConfig{WebhookTolerance: 5 * time.Minute}, testWebhookSecret),
+		timeout:  time.Second,
+	}
+}
+
+func webhookBody(status, paymentID string, topUpID int64, amount, currency string) string {
+	return fmt.Sprintf(`{"event":"payment.%s","payment":{"id":%q,"status":%q,"amount":%s,"currency":%q,"reference":"%d"}}`,
+		status, paymentID, status, amount, currency, topUpID)
+}
+
+// callWebhook отправляет вебхук в обработчик, подписанный секретом secret в момент ts
+func callWebhook(topUps *TopUps, body string, secret []byte, ts time.Time) int {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(ts.Unix(), 10) + "."))
+	mac.Write([]byte(body))
+
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(ts.Unix(), 10))
+	ctx.Request.Header.Set("X-Webhook-Signature", hex.EncodeToString(mac.Sum(nil)))
+	ctx.Request.SetBody([]byte(body))
+
+	topUps.webhook(&ctx)
+
+	return ctx.Response.StatusCode()
+}
+
+func TestTopUpWebhookRejected(t *testing.T) {
+	topUps := newTestTopUps()
+	body := webhookBody(provider.StatusSucceeded, "pay-1", 1, "100", "RUB")
+
+	tests := []struct {
+		name   string
+		body   string
+		secret []byte
+		ts     time.Time
+		want   int
+	}{
+		{name: "bad signature", body: body, secret: []byte("other"), ts: time.Now(), want: fasthttp.StatusUnauthorized},
+		{name: "stale timestamp", body: body, secret: testWebhookSecret, ts: time.Now().Add(-time.Hour), want: fasthttp.StatusUnauthorized},
+		{
+			name:   "foreign currency",
+			body:   webhookBody(provider.StatusSucceeded, "pay-1", 1, "100", "USD"),
+			secret: testWebhookSecret,
+			ts:     time.Now(),
+			want:   fasthttp.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callWebhook(topUps, tt.body, tt.secret, tt.ts); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// openTestDB подключается к базе из TEST_DATABASE_URL, в ней должны быть таблицы сервисов и миграции services/order/migrations, затем services/billing/migrations
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	if err := db.Open(dsn); err != nil {
+		t.Fatalf("open database: %s", err)
+	}
+}
+
+// newTestTopUp создает счет нового пользователя и пополнение на 100 с платежом paymentID у провайдера
+func newTestTopUp(t *testing.T, paymentID string) (userID, topUpID int64) {
+	t.Helper()
+
+	userID = time.Now().UnixNano() % 1_000_000_000
+	if _, err := db.CreateAccount(userID); err != nil {
+		t.Fatalf("create account: %s", err)
+	}
+
+	topUp, err := db.CreateTopUp(userID, money.FromMinor(10000), "fake")
+	if err != nil {
+		t.Fatalf("create top-up: %s", err)
+	}
+	if err := db.SetTopUpPayment(topUp.ID, paymentID, "http://fakeprovider/pay"); err != nil {
+		t.Fatalf("set top-up payment: %s", err)
+	}
+
+	return userID, topUp.ID
+}
+
+func checkTopUp(t *testing.T, userID, topUpID int64, wantStatus string, wantBalance int64, wantEntries int) {
+	t.Helper()
+
+	topUp, err := db.GetTopUp(userID, topUpID)
+	if err != nil {
+		t.Fatalf("get top-up: %s", err)
+	}
+	if topUp.Status != wantStatus {
+		t.Errorf("top-up status = %s, want %s", topUp.Status, wantStatus)
+	}
+
+	balance, _, err := db.GetBalance(userID)
+	if err != nil {
+		t.Fatalf("get balance: %s", err)
+	}
+	if balance.Minor() != wantBalance {
+		t.Errorf("balance = %s, want %s", balance, money.FromMinor(wantBalance))
+	}
+
+	var entries int
+	if err := db.GetConn().QueryRow(`select count(*) from journal_entries where topup_id = $1`, topUpID).Scan(&entries); err != nil {
+		t.Fatalf("count journal entries: %s", err)
+	}
+	if entries != wantEntries {
+		t.Errorf("journal entries = %d, want %d", entries, wantEntries)
+	}
+
+	mismatches, err := db.GetBalanceMismatches()
+	if err != nil {
+		t.Fatalf("get balance mismatches: %s", err)
+	}
+	if len(mismatches) != 0 {
+		t.Errorf("balance mismatches: %+v", mismatches)
+	}
+}
+
+func TestTopUpWebhook(t *testing.T) {
+	openTestDB(t)
+	topUps := newTestTopUps()
+
+	t.Run("duplicate webhook credits once", func(t *testing.T) {
+		userID, topUpID := newTestTopUp(t, "pay-dup")
+		body := webhookBody(provider.StatusSucceeded, "pay-dup", topUpID, "100", "RUB")
+
+		for i := 0; i < 2; i++ {
+			if got := callWebhook(topUps, body, testWebhookSecret, time.Now()); got != fasthttp.StatusOK {
+				t.Fatalf("webhook %d: status = %d, want %d", i+1, got, fasthttp.StatusOK)
+			}
+		}
+
+		checkTopUp(t, userID, topUpID, db.TopUpStatusSucceeded, 10000, 1)
+	})
+
+	t.Run("amount mismatch", func(t *testing.T) {
+		userID, topUpID := newTestTopUp(t, "pay-amount")
+		body := webhookBody(provider.StatusSucceeded, "pay-amount", topUpID, "99.99", "RUB")
+
+		if got := callWebhook(topUps, body, testWebhookSecret, time.Now()); got != fasthttp.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", got, fasthttp.StatusBadRequest)
+		}
+
+		checkTopUp(t, userID, topUpID, db.TopUpStatusPending, 0, 0)
+	})
+
+	t.Run("external id mismatch", func(t *testing.T) {
+		userID, topUpID := newTestTopUp(t, "pay-saved")
+		body := webhookBody(provider.StatusSucceeded, "pay-other", topUpID, "100", "RUB")
+
+		if got := callWebhook(topUps, body, testWebhookSecret, time.Now()); got != fasthttp.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", got, fasthttp.StatusBadRequest)
+		}
+
+		checkTopUp(t, userID, topUpID, db.TopUpStatusPending, 0, 0)
+	})
+
+	t.Run("cancel after success changes nothing", func(t *testing.T) {
+		userID, topUpID := newTestTopUp(t, "pay-cancel")
+
+		succeeded := webhookBody(provider.StatusSucceeded, "pay-cancel", topUpID, "100", "RUB")
+		if got := callWebhook(topUps, succeeded, testWebhookSecret, time.Now()); got != fasthttp.StatusOK {
+			t.Fatalf("succeeded webhook: status = %d, want %d", got, fasthttp.StatusOK)
+		}
+
+		canceled := webhookBody(provider.StatusCanceled, "pay-cancel", topUpID, "100", "RUB")
+		if got := callWebhook(topUps, canceled, testWebhookSecret, time.Now()); got != fasthttp.StatusOK {
+			t.Fatalf("canceled webhook: status = %d, want %d", got, fasthttp.StatusOK)
+		}
+
+		checkTopUp(t, userID, topUpID, db.TopUpStatusSucceeded, 10000, 1)
+	})
+}
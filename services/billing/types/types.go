@@ -1,6 +1,10 @@
 package types
 
-import "time"
+import (
+	"bus"
+	"money"
+	"time"
+)
 
 type Account struct {
 	Id      int64  `db:"id"`
@@ -9,28 +13,99 @@ type Account struct {
 }
 
 type Payment struct {
-	ID      int64     `json:"id,omitempty"`
-	OrderID int64     `json:"order_id"`
-	Amount  float64   `json:"amount"`
-	Status  string    `json:"status,omitempty"`
-	Action  string    `json:"action,omitempty"`
-	CTime   time.Time `json:"ctime"`
-	MTime   time.Time `json:"mtime"`
-	Error   string    `json:"error,omitempty"`
+	ID      int64       `json:"id,omitempty"`
+	OrderID int64       `json:"order_id"`
+	Amount  money.Money `json:"amount" swaggertype:"number"`
+	Status  string      `json:"status,omitempty"`
+	Action  string      `json:"action,omitempty"`
+	CTime   time.Time   `json:"ctime"`
+	MTime   time.Time   `json:"mtime"`
+	Error   string      `json:"error,omitempty"`
 }
 
 type PaymentsListRequest struct {
 	OrderID int64 `json:"order_id"`
 }
 
+// AddMoneyRequest ручная корректировка баланса: админ пополняет счет пользователя UserID
+type AddMoneyRequest struct {
+	UserID int64       `json:"user_id"`
+	Amount money.Money `json:"amount" swaggertype:"number"`
+}
+
 type Deposit struct {
-	Amount float64 `json:"amount"`
+	Amount money.Money `json:"amount" swaggertype:"number"`
 }
 
 type HTTPError struct {
 	Error string `json:"error"`
 }
 
+// BalanceResponse баланс счета и доступная для оплаты сумма, замороженные платежи из нее вычтены
 type BalanceResponse struct {
-	Balance float64 `json:"balance"`
+	Balance   money.Money `json:"balance" swaggertype:"number"`
+	Available money.Money `json:"available" swaggertype:"number"`
+}
+
+// DeadLetter сообщение из dead letter топика, описано в общем модуле bus
+type DeadLetter = bus.DeadLetter
+
+type RedriveDeadLetterRequest struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// BalanceMismatch счет, баланс которого расходится с суммой его строк в главной книге
+type BalanceMismatch struct {
+	AccountID     int64       `json:"account_id"`
+	UserID        int64       `json:"user_id"`
+	Balance       money.Money `json:"balance" swaggertype:"number"`
+	LedgerBalance money.Money `json:"ledger_balance" swaggertype:"number"`
+}
+
+// StatementFilter период выписки и страница движений, After - ключ последнего движения предыдущей страницы.
+// Limit 0 - все движения периода
+type StatementFilter struct {
+	From  time.Time
+	To    time.Time
+	Limit int
+	After *StatementCursor
+}
+
+type StatementCursor struct {
+	CTime time.Time `json:"ctime"`
+	ID    int64     `json:"id"`
+}
+
+// Statement выписка по счету: баланс на начало периода, движения с остатком после каждого и баланс на конец периода
+type Statement struct {
+	From           *time.Time          `json:"from,omitempty"`
+	To             *time.Time          `json:"to,omitempty"`
+	OpeningBalance money.Money         `json:"opening_balance" swaggertype:"number"`
+	Movements      []StatementMovement `json:"movements"`
+	ClosingBalance money.Money         `json:"closing_balance" swaggertype:"number"`
+	NextCursor     string              `json:"next_cursor,omitempty"`
+}
+
+// StatementMovement проводка по счету: пополнение deposit, оплата заказа pay, возврат refund или перенос остатка opening.
+// Amount положительна для зачислений и отрицательна для списаний
+type StatementMovement struct {
+	EntryID int64       `json:"entry_id"`
+	Kind    string      `json:"kind"`
+	OrderID int64       `json:"order_id,omitempty"`
+	Amount  money.Money `json:"amount" swaggertype:"number"`
+	Balance money.Money `json:"balance" swaggertype:"number"`
+	CTime   time.Time   `json:"ctime"`
+}
+
+// TopUp пополнение счета через платежного провайдера: пользователь оплачивает его по RedirectURL,
+// счет пополняется, когда провайдер подтвердит оплату
+type TopUp struct {
+	ID          int64       `json:"id"`
+	Amount      money.Money `json:"amount" swaggertype:"number"`
+	Status      string      `json:"status"`
+	RedirectURL string      `json:"redirect_url,omitempty"`
+	CTime       time.Time   `json:"ctime"`
+	MTime       time.Time   `json:"mtime"`
 }
@@ -0,0 +1,63 @@
+// Package bus описывает шину сообщений, от которой зависят процессоры саги.
+// Kafka-реализация лежит в модуле kafka, реализация в памяти (Memory) нужна, чтобы прогнать сагу без брокера
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Message сообщение шины. Partition и Offset заполняются при чтении
+type Message struct {
+	Topic     string
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+	Partition int32
+	Offset    int64
+	Timestamp time.Time
+}
+
+// Header возвращает значение заголовка или пустую строку
+func (m *Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// Handler обрабатывает сообщение. Ошибка означает, что сообщение не обработано и его нельзя коммитить,
+// например подписка завершилась во время ожидания или сообщение не удалось отправить в dead letter топик:
+// подписчик обработает его повторно. Ошибки обработки самого сообщения (ретраи, dead letter)
+// обработчик разбирает сам и возвращает nil
+type Handler func(ctx context.Context, msg *Message) error
+
+// Publisher отправляет сообщения и дожидается подтверждения брокера
+type Publisher interface {
+	// Publish возвращает *PublishError со списком неотправленных сообщений, если отправить удалось не все
+	Publish(ctx context.Context, msgs ...*Message) error
+	Close() error
+}
+
+// Subscriber читает топики группой консьюмеров.
+// Сообщения с одним ключом обрабатываются строго по порядку, с разными ключами - параллельно
+type Subscriber interface {
+	// Subscribe блокируется, пока не отменен ctx или не закрыт Subscriber, после отмены ctx возвращает nil
+	Subscribe(ctx context.Context, topics []string, handler Handler) error
+	Close() error
+}
+
+var ErrClosed = errors.New("bus closed")
+
+// PublishError сообщения, которые брокер не подтвердил
+type PublishError struct {
+	Failed []*Message
+	Err    error
+}
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("failed to publish %d messages: %s", len(e.Failed), e.Err)
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
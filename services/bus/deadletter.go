@@ -0,0 +1,199 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrUnknownDeadLetterTopic = errors.New("unknown dead letter topic")
+	ErrDeadLetterNotFound     = errors.New("dead letter not found")
+	// ErrMessageNotFound сообщения с таким оффсетом в топике нет
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+// заголовки, с которыми сообщение попадает в dead letter топик
+const (
+	deadLetterHeaderError     = "dlq-error"
+	deadLetterHeaderService   = "dlq-service"
+	deadLetterHeaderAttempt   = "dlq-attempt"
+	deadLetterHeaderTopic     = "dlq-original-topic"
+	deadLetterHeaderPartition = "dlq-original-partition"
+	deadLetterHeaderOffset    = "dlq-original-offset"
+)
+
+// размер страницы dead_letters: по умолчанию и наибольший
+const (
+	DefaultDeadLettersLimit = 50
+	MaxDeadLettersLimit     = 500
+)
+
+// TopicReader читает сообщения топика по оффсетам, через него смотрят dead letter топики
+type TopicReader interface {
+	// Tail возвращает до limit последних сообщений каждой партиции топика, для несуществующего топика - пустой список
+	Tail(topic string, limit int) ([]*Message, error)
+	// ReadAt возвращает сообщение партиции по оффсету или ErrMessageNotFound
+	ReadAt(topic string, partition int32, offset int64) (*Message, error)
+	Close() error
+}
+
+// DeadLetter сообщение, которое не удалось обработать, с причиной и позицией в исходном топике
+type DeadLetter struct {
+	Partition         int32     `json:"partition"`
+	Offset            int64     `json:"offset"`
+	OriginalTopic     string    `json:"original_topic"`
+	OriginalPartition int32     `json:"original_partition"`
+	OriginalOffset    int64     `json:"original_offset"`
+	Service           string    `json:"service"`
+	Error             string    `json:"error"`
+	Attempt           int       `json:"attempt"`
+	Key               string    `json:"key,omitempty"`
+	Payload           string    `json:"payload"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// DeadLetters складывает сообщения, которые не удалось обработать, в топик <topic><suffix>
+// и позволяет посмотреть их и отправить повторно в исходный топик
+type DeadLetters struct {
+	publisher Publisher
+	reader    TopicReader
+
+	service string
+	suffix  string
+	topics  []string
+}
+
+// NewDeadLetters dead letter топики сервиса service для topics. Смотреть и отправлять повторно можно только сообщения topics
+func NewDeadLetters(publisher Publisher, reader TopicReader, service, suffix string, topics ...string) *DeadLetters {
+	return &DeadLetters{
+		publisher: publisher,
+		reader:    reader,
+		service:   service,
+		suffix:    suffix,
+		topics:    topics,
+	}
+}
+
+// Close закрывает продюсер и читателя топиков
+func (d *DeadLetters) Close() error {
+	return errors.Join(d.publisher.Close(), d.reader.Close())
+}
+
+// Send публикует сообщение в dead letter топик, дожидаясь подтверждения брокера.
+// Если сообщение не отправлено, его нельзя коммитить: обработчик возвращает ошибку, и сообщение обработается повторно
+func (d *DeadLetters) Send(ctx context.Context, msg *Message, cause error) error {
+	attempt := 1
+	if prev, err := strconv.Atoi(msg.Header(deadLetterHeaderAttempt)); err == nil {
+		attempt = prev + 1
+	}
+
+	// сообщение из топика ретраев складываем в dead letter топик исходного топика с позицией в нем
+	topic := OriginalTopic(msg)
+	partition, offset := OriginalPosition(msg)
+
+	dlqMsg := &Message{
+		Topic: topic + d.suffix,
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: map[string]string{
+			deadLetterHeaderError:     cause.Error(),
+			deadLetterHeaderService:   d.service,
+			deadLetterHeaderAttempt:   strconv.Itoa(attempt),
+			deadLetterHeaderTopic:     topic,
+			deadLetterHeaderPartition: strconv.FormatInt(int64(partition), 10),
+			deadLetterHeaderOffset:    strconv.FormatInt(offset, 10),
+		},
+	}
+
+	if err := d.publisher.Publish(ctx, dlqMsg); err != nil {
+		return fmt.Errorf("send message from %s offset %d to dead letter topic: %w", topic, offset, err)
+	}
+
+	return nil
+}
+
+// List возвращает последние limit сообщений из dead letter топика для topic, новые первыми
+func (d *DeadLetters) List(topic string, limit int) ([]DeadLetter, error) {
+	if !slices.Contains(d.topics, topic) {
+		return nil, ErrUnknownDeadLetterTopic
+	}
+
+	msgs, err := d.reader.Tail(topic+d.suffix, limit)
+	if err != nil {
+		return nil, fmt.Errorf("read dead letter topic: %w", err)
+	}
+
+	letters := make([]DeadLetter, 0, len(msgs))
+	for _, msg := range msgs {
+		letters = append(letters, toDeadLetter(msg))
+	}
+
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].Timestamp.After(letters[j].Timestamp)
+	})
+
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+
+	return letters, nil
+}
+
+// Redrive отправляет сообщение из dead letter топика обратно в исходный топик.
+// Заголовок с номером попытки сохраняется, при повторной ошибке счетчик увеличится
+func (d *DeadLetters) Redrive(ctx context.Context, topic string, partition int32, offset int64) error {
+	if !slices.Contains(d.topics, topic) {
+		return ErrUnknownDeadLetterTopic
+	}
+
+	msg, err := d.reader.ReadAt(topic+d.suffix, partition, offset)
+	if err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			return ErrDeadLetterNotFound
+		}
+
+		return fmt.Errorf("read dead letter: %w", err)
+	}
+
+	redriven := &Message{
+		Topic:   topic,
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: map[string]string{},
+	}
+
+	if attempt := msg.Header(deadLetterHeaderAttempt); attempt != "" {
+		redriven.Headers[deadLetterHeaderAttempt] = attempt
+	}
+
+	if err := d.publisher.Publish(ctx, redriven); err != nil {
+		return fmt.Errorf("redrive message: %w", err)
+	}
+
+	return nil
+}
+
+func toDeadLetter(msg *Message) DeadLetter {
+	letter := DeadLetter{
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		Key:           string(msg.Key),
+		Payload:       string(msg.Value),
+		Timestamp:     msg.Timestamp,
+		Error:         msg.Header(deadLetterHeaderError),
+		Service:       msg.Header(deadLetterHeaderService),
+		OriginalTopic: msg.Header(deadLetterHeaderTopic),
+	}
+
+	letter.Attempt, _ = strconv.Atoi(msg.Header(deadLetterHeaderAttempt))
+	partition, _ := strconv.ParseInt(msg.Header(deadLetterHeaderPartition), 10, 32)
+	letter.OriginalPartition = int32(partition)
+	letter.OriginalOffset, _ = strconv.ParseInt(msg.Header(deadLetterHeaderOffset), 10, 64)
+
+	return letter
+}
@@ -0,0 +1,72 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestDeadLetterAfterRetries dead letter указывает на позицию сообщения в исходном топике, а не в топике ретраев
+func TestDeadLetterAfterRetries(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	retries := NewRetryTopics(m, ".retry.", []time.Duration{time.Second, time.Minute})
+	deadLetters := NewDeadLetters(m, m, "test", ".dlq", "payments")
+
+	// перед сообщением в исходном топике лежат другие, чтобы его оффсет отличался от оффсетов в топиках ретраев
+	for _, value := range []string{"first", "second", "failed"} {
+		if err := m.Publish(ctx, &Message{Topic: "payments", Key: []byte("42"), Value: []byte(value)}); err != nil {
+			t.Fatalf("publish: %s", err)
+		}
+	}
+
+	msg := lastMessage(t, m, "payments")
+	cause := errors.New("transient")
+	for _, topic := range retries.Topics("payments") {
+		if err := retries.Schedule(ctx, msg, cause); err != nil {
+			t.Fatalf("schedule retry: %s", err)
+		}
+		msg = lastMessage(t, m, topic)
+	}
+
+	if err := retries.Schedule(ctx, msg, cause); !errors.Is(err, ErrRetriesExhausted) {
+		t.Fatalf("schedule after last retry: %v, want ErrRetriesExhausted", err)
+	}
+	if err := deadLetters.Send(ctx, msg, cause); err != nil {
+		t.Fatalf("send dead letter: %s", err)
+	}
+
+	letters, err := deadLetters.List("payments", DefaultDeadLettersLimit)
+	if err != nil {
+		t.Fatalf("list dead letters: %s", err)
+	}
+	if len(letters) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(letters))
+	}
+
+	letter := letters[0]
+	if letter.OriginalTopic != "payments" || letter.OriginalPartition != 0 || letter.OriginalOffset != 2 {
+		t.Errorf("dead letter points at %s/%d/%d, want payments/0/2",
+			letter.OriginalTopic, letter.OriginalPartition, letter.OriginalOffset)
+	}
+
+	original, err := m.ReadAt(letter.OriginalTopic, letter.OriginalPartition, letter.OriginalOffset)
+	if err != nil {
+		t.Fatalf("read original message: %s", err)
+	}
+	if string(original.Value) != "failed" {
+		t.Errorf("original message = %q, want %q", original.Value, "failed")
+	}
+}
+
+func lastMessage(t *testing.T, m *Memory, topic string) *Message {
+	t.Helper()
+
+	msgs := m.Messages(topic)
+	if len(msgs) == 0 {
+		t.Fatalf("no messages in %s", topic)
+	}
+
+	return &msgs[len(msgs)-1]
+}
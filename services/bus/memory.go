@@ -0,0 +1,186 @@
+package bus
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// пауза перед повторной обработкой сообщения, которое обработчик вернул с ошибкой
+const memoryRetryDelay = 10 * time.Millisecond
+
+// Memory брокер в памяти: у топика одна партиция, каждая группа читает топик со своего оффсета.
+// Сообщения группы обрабатываются последовательно, поэтому порядок внутри заказа сохраняется
+type Memory struct {
+	mu      sync.Mutex
+	topics  map[string][]*Message
+	offsets map[string]map[string]int64 // группа -> топик -> следующий оффсет
+	notify  chan struct{}
+	closed  bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		topics:  make(map[string][]*Message),
+		offsets: make(map[string]map[string]int64),
+		notify:  make(chan struct{}),
+	}
+}
+
+func (m *Memory) Publish(_ context.Context, msgs ...*Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return &PublishError{Failed: msgs, Err: ErrClosed}
+	}
+
+	for _, msg := range msgs {
+		stored := *msg
+		stored.Partition = 0
+		stored.Offset = int64(len(m.topics[msg.Topic]))
+		stored.Timestamp = time.Now()
+		m.topics[msg.Topic] = append(m.topics[msg.Topic], &stored)
+	}
+
+	m.wakeUp()
+
+	return nil
+}
+
+// Subscriber возвращает подписчика группы group, подписчики одной группы делят оффсеты
+func (m *Memory) Subscriber(group string) Subscriber {
+	return &memorySubscriber{memory: m, group: group}
+}
+
+// Messages возвращает копию всех сообщений топика, удобно для проверок в тестах
+func (m *Memory) Messages(topic string) []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgs := make([]Message, 0, len(m.topics[topic]))
+	for _, msg := range m.topics[topic] {
+		msgs = append(msgs, *msg)
+	}
+
+	return msgs
+}
+
+// Tail возвращает до limit последних сообщений топика, Memory реализует TopicReader для dead letter топиков
+func (m *Memory) Tail(topic string, limit int) ([]*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := m.topics[topic]
+	stored = stored[max(0, len(stored)-limit):]
+
+	msgs := make([]*Message, 0, len(stored))
+	for _, msg := range stored {
+		copied := *msg
+		msgs = append(msgs, &copied)
+	}
+
+	return msgs, nil
+}
+
+func (m *Memory) ReadAt(topic string, partition int32, offset int64) (*Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := m.topics[topic]
+	if partition != 0 || offset < 0 || offset >= int64(len(stored)) {
+		return nil, ErrMessageNotFound
+	}
+
+	msg := *stored[offset]
+
+	return &msg, nil
+}
+
+// Close останавливает подписчиков, дальнейшие Publish возвращают ErrClosed
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.closed {
+		m.closed = true
+		m.wakeUp()
+	}
+
+	return nil
+}
+
+// wakeUp будит подписчиков, вызывается под m.mu
+func (m *Memory) wakeUp() {
+	close(m.notify)
+	m.notify = make(chan struct{})
+}
+
+// next возвращает следующее непрочитанное группой сообщение и канал, который закроется при появлении новых
+func (m *Memory) next(group string, topics []string) (*Message, <-chan struct{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, nil, false
+	}
+
+	offsets := m.offsets[group]
+	for _, topic := range topics {
+		if offset := offsets[topic]; offset < int64(len(m.topics[topic])) {
+			msg := *m.topics[topic][offset]
+			return &msg, nil, true
+		}
+	}
+
+	return nil, m.notify, true
+}
+
+func (m *Memory) commit(group string, msg *Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.offsets[group] == nil {
+		m.offsets[group] = make(map[string]int64)
+	}
+	m.offsets[group][msg.Topic] = msg.Offset + 1
+}
+
+type memorySubscriber struct {
+	memory *Memory
+	group  string
+}
+
+func (s *memorySubscriber) Subscribe(ctx context.Context, topics []string, handler Handler) error {
+	for {
+		msg, wait, ok := s.memory.next(s.group, topics)
+		if !ok {
+			return nil
+		}
+
+		if msg == nil {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		// как и kafka-подписчик, необработанное сообщение обрабатываем повторно и не коммитим
+		if err := handler(ctx, msg); err != nil {
+			select {
+			case <-time.After(memoryRetryDelay):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		s.memory.commit(s.group, msg)
+	}
+}
+
+func (s *memorySubscriber) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package bus
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// producers метрики продюсеров всех процессоров сервиса, отдаются через expvar как {"producers": {"<processor>": {...}}}
+var producers = expvar.NewMap("producers")
+
+// Metrics метрики продюсера процессора:
+// queue_depth - сообщений в очереди процессора, sent/failed - подтвержденные и потерянные после всех попыток сообщения,
+// retries - повторные попытки, dropped - сообщения, не попавшие в заполненную очередь,
+// publish_latency_ms_sum/_max и publishes - время отправки до подтверждения брокером
+type Metrics struct {
+	sent      expvar.Int
+	failed    expvar.Int
+	retries   expvar.Int
+	dropped   expvar.Int
+	publishes expvar.Int
+
+	mu         sync.Mutex
+	latencySum time.Duration
+	latencyMax time.Duration
+}
+
+// WriteMetrics пишет {"producers": {...}} для /metrics. Остальные переменные expvar, cmdline и memstats, наружу не отдаются
+func WriteMetrics(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `{"producers": %s}`, producers.String())
+	return err
+}
+
+// NewMetrics регистрирует метрики процессора name, queueDepth возвращает текущую длину его очереди и может быть nil
+func NewMetrics(name string, queueDepth func() int) *Metrics {
+	m := &Metrics{}
+
+	vars := new(expvar.Map)
+	vars.Set("sent", &m.sent)
+	vars.Set("failed", &m.failed)
+	vars.Set("retries", &m.retries)
+	vars.Set("dropped", &m.dropped)
+	vars.Set("publishes", &m.publishes)
+	vars.Set("publish_latency_ms_sum", expvar.Func(func() any {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.latencySum.Milliseconds()
+	}))
+	vars.Set("publish_latency_ms_max", expvar.Func(func() any {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.latencyMax.Milliseconds()
+	}))
+	if queueDepth != nil {
+		vars.Set("queue_depth", expvar.Func(func() any {
+			return queueDepth()
+		}))
+	}
+
+	producers.Set(name, vars)
+
+	return m
+}
+
+// Dropped учитывает сообщение, которое не удалось поставить в очередь
+func (m *Metrics) Dropped() {
+	m.dropped.Add(1)
+}
+
+func (m *Metrics) observe(start time.Time) {
+	latency := time.Since(start)
+
+	m.publishes.Add(1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.latencySum += latency
+	m.latencyMax = max(m.latencyMax, latency)
+}
@@ -0,0 +1,70 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ReliablePublisher отправляет повторно сообщения, которые брокер не подтвердил, и считает метрики продюсера.
+// Ошибка возвращается, только если сообщения не подтверждены после всех попыток
+type ReliablePublisher struct {
+	publisher Publisher
+	metrics   *Metrics
+	retries   int
+	delay     time.Duration
+}
+
+// NewReliablePublisher оборачивает publisher: до retries повторных попыток с паузой delay
+func NewReliablePublisher(publisher Publisher, metrics *Metrics, retries int, delay time.Duration) *ReliablePublisher {
+	return &ReliablePublisher{
+		publisher: publisher,
+		metrics:   metrics,
+		retries:   retries,
+		delay:     delay,
+	}
+}
+
+func (p *ReliablePublisher) Publish(ctx context.Context, msgs ...*Message) error {
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		err := p.publisher.Publish(ctx, msgs...)
+		p.metrics.observe(start)
+
+		if err == nil {
+			p.metrics.sent.Add(int64(len(msgs)))
+			return nil
+		}
+
+		// повторяем только неподтвержденные сообщения
+		var publishErr *PublishError
+		if errors.As(err, &publishErr) {
+			p.metrics.sent.Add(int64(len(msgs) - len(publishErr.Failed)))
+			msgs = publishErr.Failed
+		}
+
+		if attempt >= p.retries || !p.wait(ctx) {
+			p.metrics.failed.Add(int64(len(msgs)))
+			return err
+		}
+
+		p.metrics.retries.Add(1)
+	}
+}
+
+// wait ждет паузу перед повтором, false - ctx отменен
+func (p *ReliablePublisher) wait(ctx context.Context) bool {
+	timer := time.NewTimer(p.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *ReliablePublisher) Close() error {
+	return p.publisher.Close()
+}
@@ -0,0 +1,155 @@
+package bus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrRetriesExhausted = errors.New("retries exhausted")
+
+// заголовки, с которыми сообщение попадает в топик ретраев
+const (
+	retryHeaderAttempt   = "retry-attempt"
+	retryHeaderAt        = "retry-at"
+	retryHeaderTopic     = "retry-original-topic"
+	retryHeaderPartition = "retry-original-partition"
+	retryHeaderOffset    = "retry-original-offset"
+)
+
+// RetryTopics откладывает сообщения, упавшие с временной ошибкой, в топики <topic><suffix><delay>.
+// Консьюмер читает их той же группой и обрабатывает сообщение, когда наступит время ретрая
+type RetryTopics struct {
+	publisher Publisher
+
+	suffix string
+	delays []time.Duration
+}
+
+// NewRetryTopics топики ретраев с задержками delays, по одной на попытку
+func NewRetryTopics(publisher Publisher, suffix string, delays []time.Duration) *RetryTopics {
+	return &RetryTopics{
+		publisher: publisher,
+		suffix:    suffix,
+		delays:    delays,
+	}
+}
+
+func (r *RetryTopics) Close() error {
+	return r.publisher.Close()
+}
+
+// Topics возвращает топики ретраев для topic, их нужно читать вместе с самим topic
+func (r *RetryTopics) Topics(topic string) []string {
+	topics := make([]string, 0, len(r.delays))
+	for _, delay := range r.delays {
+		topics = append(topics, r.topic(topic, delay))
+	}
+
+	return topics
+}
+
+// Schedule отправляет сообщение в топик со следующей задержкой.
+// Если задержки закончились, возвращает ErrRetriesExhausted вместе с исходной ошибкой
+func (r *RetryTopics) Schedule(ctx context.Context, msg *Message, cause error) error {
+	attempt := RetryAttempt(msg)
+	if attempt >= len(r.delays) {
+		return fmt.Errorf("%w after %d attempts: %w", ErrRetriesExhausted, attempt, cause)
+	}
+
+	topic := OriginalTopic(msg)
+	partition, offset := OriginalPosition(msg)
+	delay := r.delays[attempt]
+
+	retryMsg := &Message{
+		Topic: r.topic(topic, delay),
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: map[string]string{
+			retryHeaderAttempt:   strconv.Itoa(attempt + 1),
+			retryHeaderAt:        strconv.FormatInt(time.Now().Add(delay).UnixMilli(), 10),
+			retryHeaderTopic:     topic,
+			retryHeaderPartition: strconv.FormatInt(int64(partition), 10),
+			retryHeaderOffset:    strconv.FormatInt(offset, 10),
+		},
+	}
+
+	if err := r.publisher.Publish(ctx, retryMsg); err != nil {
+		return fmt.Errorf("send message to retry topic: %w", err)
+	}
+
+	return nil
+}
+
+// Wait ждет, пока не наступит время повторной обработки сообщения из топика ретраев.
+// В топике задержка у всех сообщений одна, поэтому следующие сообщения партиции готовы не раньше текущего
+func (r *RetryTopics) Wait(ctx context.Context, msg *Message) error {
+	at, err := strconv.ParseInt(msg.Header(retryHeaderAt), 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	wait := time.Until(time.UnixMilli(at))
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *RetryTopics) topic(topic string, delay time.Duration) string {
+	return topic + r.suffix + formatDelay(delay)
+}
+
+// RetryAttempt номер попытки сообщения из топика ретраев, для сообщения из исходного топика - 0
+func RetryAttempt(msg *Message) int {
+	attempt, _ := strconv.Atoi(msg.Header(retryHeaderAttempt))
+	return attempt
+}
+
+// OriginalTopic возвращает топик, в который сообщение было отправлено изначально
+func OriginalTopic(msg *Message) string {
+	if topic := msg.Header(retryHeaderTopic); topic != "" {
+		return topic
+	}
+
+	return msg.Topic
+}
+
+// OriginalPosition возвращает партицию и оффсет сообщения в исходном топике,
+// у сообщения из топика ретраев собственные партиция и оффсет указывают на топик ретраев
+func OriginalPosition(msg *Message) (int32, int64) {
+	partition, err := strconv.ParseInt(msg.Header(retryHeaderPartition), 10, 32)
+	if err != nil {
+		return msg.Partition, msg.Offset
+	}
+
+	offset, err := strconv.ParseInt(msg.Header(retryHeaderOffset), 10, 64)
+	if err != nil {
+		return msg.Partition, msg.Offset
+	}
+
+	return int32(partition), offset
+}
+
+// formatDelay печатает задержку для имени топика: 10s, 1m, 2h
+func formatDelay(delay time.Duration) string {
+	switch {
+	case delay%time.Hour == 0:
+		return strconv.FormatInt(int64(delay/time.Hour), 10) + "h"
+	case delay%time.Minute == 0:
+		return strconv.FormatInt(int64(delay/time.Minute), 10) + "m"
+	default:
+		return strconv.FormatInt(int64(delay/time.Second), 10) + "s"
+	}
+}
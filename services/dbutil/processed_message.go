@@ -0,0 +1,35 @@
+package dbutil
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// MarkMessageProcessed отмечает сообщение обработанным, должно вызываться в той же транзакции, что и побочный эффект.
+// Для уже обработанного сообщения возвращает ErrDuplicateMessage, транзакцию нужно откатить.
+// Сообщения без id не отмечаются
+func MarkMessageProcessed(tx *sql.Tx, consumer, messageID string) error {
+	if messageID == "" {
+		return nil
+	}
+
+	res, err := tx.Exec(`insert into processed_messages(consumer, message_id) values($1, $2) on conflict do nothing`,
+		consumer, messageID)
+	if err != nil {
+		return fmt.Errorf("mark message processed: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("mark message processed: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: %s %s", ErrDuplicateMessage, consumer, messageID)
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+// Package dbutil общие для сервисов помощники работы с базой: классификация ошибок и учет обработанных сообщений
+package dbutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/lib/pq"
+)
+
+// ErrConcurrentUpdate строки меняли конкурентно, и оптимистичная блокировка не прошла ни в одной из попыток
+var ErrConcurrentUpdate = errors.New("concurrent update")
+
+// IsTransient определяет временные ошибки: база недоступна, соединение оборвалось, конфликт блокировок.
+// Такой запрос стоит повторить позже, а не отклонять
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrConcurrentUpdate) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		// connection exception, transaction rollback, insufficient resources, operator intervention
+		case "08", "40", "53", "57":
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"kafka"
 	"time"
 )
 
@@ -53,13 +54,18 @@ type KafkaConsumerConfig struct {
 	GroupID string   `toml:"group-id"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Workers число воркеров на партицию, сообщения одного заказа обрабатывает один воркер по порядку
+	Workers int `toml:"workers"`
+	kafka.ClientConfig
 }
 
 func NewKafkaConsumerConfig() *KafkaConsumerConfig {
 	return &KafkaConsumerConfig{
-		Brokers: []string{"kafka:9092"},
-		GroupID: "payments",
-		Topic:   "payments",
+		Brokers:      []string{"kafka:9092"},
+		GroupID:      "payments",
+		Topic:        "payments",
+		Workers:      8,
+		ClientConfig: kafka.ClientConfig{ClientID: "delivery"},
 	}
 }
 
@@ -67,36 +73,69 @@ type KafkaProducerConfig struct {
 	Brokers []string `toml:"brokers"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Retries сколько раз повторить отправку сообщений, которые брокер не подтвердил, с паузой RetryDelay
+	Retries    int           `toml:"retries"`
+	RetryDelay time.Duration `toml:"retry-delay"`
+	// QueueTimeout сколько ждать места в заполненной очереди процессора: AddMessage после этого отбрасывает уведомление,
+	// а консьюмер резервов не подтверждает сообщение и обработает его повторно
+	QueueTimeout time.Duration `toml:"queue-timeout"`
+	kafka.ClientConfig
 }
 
 func NewKafkaProducerConfig() *KafkaProducerConfig {
 	return &KafkaProducerConfig{
-		Brokers: []string{"kafka:9092"},
-		Topic:   "payments_status",
+		Brokers:      []string{"kafka:9092"},
+		Topic:        "payments_status",
+		Retries:      3,
+		RetryDelay:   500 * time.Millisecond,
+		QueueTimeout: 5 * time.Second,
+		ClientConfig: kafka.ClientConfig{ClientID: "delivery"},
+	}
+}
+
+// DeadLetterConfig сообщения, которые не удалось обработать, попадают в топик <topic><topic-suffix>
+type DeadLetterConfig struct {
+	Brokers     []string `toml:"brokers"`
+	Version     string   `toml:"version"`
+	TopicSuffix string   `toml:"topic-suffix"`
+	Service     string   `toml:"service"`
+	kafka.ClientConfig
+}
+
+func NewDeadLetterConfig() *DeadLetterConfig {
+	return &DeadLetterConfig{
+		Brokers:      []string{"kafka:9092"},
+		TopicSuffix:  ".dlq",
+		Service:      "delivery",
+		ClientConfig: kafka.ClientConfig{ClientID: "delivery"},
 	}
 }
 
 type Config struct {
-	BasePath                    string               `toml:"base-path"`
-	AuthAddr                    string               `toml:"auth-addr"`
-	ListenPort                  string               `toml:"listen-port"`
-	LogLevel                    string               `toml:"log-level"`
-	LogFile                     string               `toml:"log-file"`
+	BasePath   string `toml:"base-path"`
+	AuthAddr   string `toml:"auth-addr"`
+	ListenPort string `toml:"listen-port"`
+	LogLevel   string `toml:"log-level"`
+	LogFile    string `toml:"log-file"`
+	// ShutdownTimeout дедлайн остановки: за это время сервис дорабатывает запросы и сообщения, дописывает очереди и закрывает соединения
+	ShutdownTimeout             time.Duration        `toml:"shutdown-timeout"`
 	ServerConfig                *ServerConfig        `toml:"server-config"`
 	DBConfig                    *DBConfig            `toml:"db-config"`
 	RedisConfig                 *RedisConfig         `toml:"redis-config"`
 	CourReserveConsumerConfig   *KafkaConsumerConfig `toml:"cour-reserve-consumer-config"`
 	CourReserveProducerConfig   *KafkaProducerConfig `toml:"cour-reserve-producer-config"`
 	NotificationsProducerConfig *KafkaProducerConfig `toml:"notifications-producer-config"`
+	DeadLetterConfig            *DeadLetterConfig    `toml:"dead-letter-config"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BasePath:   "users",
-		AuthAddr:   "arch.homework",
-		ListenPort: "8000",
-		LogLevel:   "info",
-		LogFile:    "stdout",
+		BasePath:        "users",
+		AuthAddr:        "arch.homework",
+		ListenPort:      "8000",
+		LogLevel:        "info",
+		LogFile:         "stdout",
+		ShutdownTimeout: 25 * time.Second,
 		DBConfig: &DBConfig{
 			Port:  5432,
 			Retry: NewRetryConfig(),
@@ -110,5 +149,6 @@ func NewConfig() *Config {
 		CourReserveConsumerConfig:   NewKafkaConsumerConfig(),
 		CourReserveProducerConfig:   NewKafkaProducerConfig(),
 		NotificationsProducerConfig: NewKafkaProducerConfig(),
+		DeadLetterConfig:            NewDeadLetterConfig(),
 	}
 }
@@ -3,98 +3,97 @@ package db
 import (
 	"context"
 	"database/sql"
+	"dbutil"
 	"delivery/types"
 	"errors"
 	"fmt"
+	"saga"
 	"time"
 
 	"github.com/sethvargo/go-retry"
 	"go.uber.org/zap"
 )
 
-const (
-	RevertCourReserve = iota
-	CourReserve
-)
-
 var ErrUnsupportedCourReserveAction = errors.New("usupported cour_reserve action")
 var ErrSlotReserved = errors.New("slot is already reserved")
 
-func ProcessReserveCourier(courReserveID int64, action int8) error {
-	if action != RevertCourReserve && action != CourReserve {
+// ProcessReserveCourier меняет расписание курьера, подтверждает резерв и отмечает сообщение обработанным в одной транзакции.
+// Повторно доставленное сообщение вернет dbutil.ErrDuplicateMessage
+func ProcessReserveCourier(consumer, messageID string, courReserveID int64, action saga.CourReserveAction) error {
+	if action != saga.CourReserveRevert && action != saga.CourReserve {
 		return ErrUnsupportedCourReserveAction
 	}
 
 	backoff := retry.WithMaxRetries(retryCount, retry.NewConstant(retryDelay))
 	if err := retry.Do(context.Background(), backoff, func(_ context.Context) error {
-		var (
-			courID             int64
-			resMask, schedMask int64
-			workDate           string
-			mtime              time.Time
-		)
-
-		query := `
-			SELECT r.courier_id, r.work_date, r.hour_mask, s.hour_mask, s.mtime
-			FROM courier_reservation r
-			JOIN courier_schedule s
-			ON s.courier_id = r.courier_id AND s.work_date = r.work_date
-			WHERE r.id = $1 and r.status = 'pending'
-		`
-
-		err := GetConn().QueryRow(query, courReserveID).
-			Scan(&courID, &workDate, &resMask, &schedMask, &mtime)
-		if err != nil {
-			return err
-		}
+		return InTx(func(tx *sql.Tx) error {
+			if err := dbutil.MarkMessageProcessed(tx, consumer, messageID); err != nil {
+				return err
+			}
 
-		if action == CourReserve && schedMask&resMask != 0 {
-			return ErrSlotReserved
-		}
+			var (
+				courID             int64
+				resMask, schedMask int64
+				workDate           string
+				mtime              time.Time
+			)
+
+			query := `
+				SELECT r.courier_id, r.work_date, r.hour_mask, s.hour_mask, s.mtime
+				FROM courier_reservation r
+				JOIN courier_schedule s
+				ON s.courier_id = r.courier_id AND s.work_date = r.work_date
+				WHERE r.id = $1 and r.status = 'pending'
+			`
+
+			err := tx.QueryRow(query, courReserveID).
+				Scan(&courID, &workDate, &resMask, &schedMask, &mtime)
+			if err != nil {
+				return err
+			}
 
-		if err := processReserveCourier(courID, resMask, workDate, action, mtime); err != nil {
-			actionName := "reserve"
-			if action == RevertCourReserve {
-				actionName = "revert reserve"
+			if action == saga.CourReserve && schedMask&resMask != 0 {
+				return ErrSlotReserved
 			}
 
-			if errors.Is(err, sql.ErrNoRows) {
-				zap.L().Warn("optimistic lock conflict, retrying",
-					zap.Int64("cour_id", courID),
-					zap.String("work_date", workDate),
-					zap.Int64("hour_mask", resMask),
-				)
+			if err := processReserveCourier(tx, courID, resMask, workDate, action, mtime); err != nil {
+				actionName := "reserve"
+				if action == saga.CourReserveRevert {
+					actionName = "revert reserve"
+				}
 
-				return retry.RetryableError(fmt.Errorf("process cour_reserve type "+actionName+": %w", err))
-			}
+				if errors.Is(err, sql.ErrNoRows) {
+					zap.L().Warn("optimistic lock conflict, retrying",
+						zap.Int64("cour_id", courID),
+						zap.String("work_date", workDate),
+						zap.Int64("hour_mask", resMask),
+					)
 
-			return fmt.Errorf("process cour_reserve type "+actionName+": %w", err)
-		}
+					return retry.RetryableError(fmt.Errorf("process cour_reserve type "+actionName+": %w", dbutil.ErrConcurrentUpdate))
+				}
 
-		return nil
+				return fmt.Errorf("process cour_reserve type "+actionName+": %w", err)
+			}
+
+			return approveReserveCourier(tx, courReserveID)
+		})
 	}); err != nil {
 		return err
 	}
 
-	zap.L().Info("cour_reserve processed", zap.Int64("cour_reserve_id", courReserveID), zap.Int8("action", action))
+	zap.L().Info("cour_reserve processed", zap.Int64("cour_reserve_id", courReserveID), zap.String("action", string(action)))
 
 	return nil
 }
 
-func processReserveCourier(courID int64, mask int64, workDate string, action int8, mtime time.Time) error {
+func processReserveCourier(tx *sql.Tx, courID int64, mask int64, workDate string, action saga.CourReserveAction, mtime time.Time) error {
 	actionType := " | "
-	if action == RevertCourReserve {
+	if action == saga.CourReserveRevert {
 		actionType = " & ~"
 	}
 
-	tx, err := GetConn().BeginTx(context.Background(), nil)
-	if err != nil {
-		return fmt.Errorf("begin tx for payment: %w", err)
-	}
-	defer tx.Rollback()
-
 	var id int64
-	if err := GetConn().QueryRow(
+	if err := tx.QueryRow(
 		fmt.Sprintf(`UPDATE courier_schedule
 		SET hour_mask = hour_mask`+actionType+`%d, mtime = now()
 		WHERE courier_id = $1 AND work_date = $2 AND mtime = $3 returning id
@@ -102,43 +101,63 @@ func processReserveCourier(courID int64, mask int64, workDate string, action int
 		return fmt.Errorf("update courier schedule: %w", err)
 	}
 
-	// если обновилось — коммитим
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit tx: %w", err)
-	}
-
 	zap.L().Info("courier schedule updated",
 		zap.Int64("cour_id", courID),
 		zap.Int64("mask", mask),
 		zap.String("work_date", workDate),
-		zap.Int8("action", action),
+		zap.String("action", string(action)),
 	)
 
 	return nil
 }
 
-func ApproveReserveCourier(courReserveID int64) {
-	if _, err := GetConn().Exec(
+func approveReserveCourier(tx *sql.Tx, courReserveID int64) error {
+	if _, err := tx.Exec(
 		`UPDATE courier_reservation 
 		SET status = 'ok', mtime = NOW()
 		WHERE id = $1
         `, courReserveID); err != nil {
-		zap.L().Error("failed to approve cour_reserve", zap.Error(err))
+		return fmt.Errorf("approve cour_reserve: %w", err)
 	}
 
 	zap.L().Info("cour_reserve approved", zap.Int64("cour_reserve_id", courReserveID))
+
+	return nil
 }
 
-func RejectReserveCourier(courReserveID int64, reason string) {
-	if _, err := GetConn().Exec(
-		`UPDATE courier_reservation
-		SET status = 'failed', mtime = NOW(), error = $1
-		WHERE id = $2
-        `, reason, courReserveID); err != nil {
-		zap.L().Error("failed to reject cour_reserve", zap.Error(err))
+// RejectReserveCourier отклоняет резерв курьера и отмечает сообщение обработанным в одной транзакции
+func RejectReserveCourier(consumer, messageID string, courReserveID int64, reason string) error {
+	if err := InTx(func(tx *sql.Tx) error {
+		if err := dbutil.MarkMessageProcessed(tx, consumer, messageID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(
+			`UPDATE courier_reservation
+			SET status = 'failed', mtime = NOW(), error = $1
+			WHERE id = $2
+			`, reason, courReserveID); err != nil {
+			return fmt.Errorf("reject cour_reserve: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	zap.L().Info("cour_reserve rejected", zap.Int64("cour_reserve_id", courReserveID), zap.String("reason", reason))
+
+	return nil
+}
+
+// GetCourReserveStatus статус резерва курьера: pending, ok или failed
+func GetCourReserveStatus(courReserveID int64) (string, error) {
+	var status string
+	if err := GetConn().QueryRow(`select status from courier_reservation where id = $1`, courReserveID).Scan(&status); err != nil {
+		return "", fmt.Errorf("get cour_reserve status: %w", err)
+	}
+
+	return status, nil
 }
 
 func GetAllCourReservations() ([]types.CourierReservation, error) {
@@ -7,6 +7,7 @@ import (
 	"delivery/redis"
 	"delivery/service"
 	"fmt"
+	"lifecycle"
 	"log"
 	"os"
 	"path/filepath"
@@ -42,15 +43,32 @@ func main() {
 
 	redis.Init(config.RedisConfig)
 
-	service.NewCourReserveProcessor(config)
+	dlc := config.DeadLetterConfig
+	deadLetters := service.NewDeadLetters(config,
+		service.NewKafkaPublisher(dlc.Brokers, dlc.Version, &dlc.ClientConfig),
+		service.NewKafkaReader(dlc.Brokers, dlc.Version, &dlc.ClientConfig),
+		config.CourReserveConsumerConfig.Topic)
 
-	go service.GetCourReserveProcessor().Run()
+	crpc := config.CourReserveProducerConfig
+	courReserveProcessor := service.NewCourReserveProcessor(config,
+		service.NewKafkaSubscriber(config.CourReserveConsumerConfig),
+		service.NewKafkaPublisher(crpc.Brokers, crpc.Version, &crpc.ClientConfig),
+		deadLetters)
 
-	service.NewNotificationsProcessor(config)
+	npc := config.NotificationsProducerConfig
+	service.NewNotificationsProcessor(config, service.NewKafkaPublisher(npc.Brokers, npc.Version, &npc.ClientConfig))
 
-	go service.GetNotificationsProcessor().Run()
+	// компоненты останавливаются в порядке регистрации: HTTP-сервер, консьюмер, продюсер уведомлений,
+	// затем закрываются dead letters, БД и Redis
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config, deadLetters), ":"+config.ListenPort)
+	lc.Go("cour_reserve processor", courReserveProcessor.Run)
+	lc.Go("notifications processor", service.GetNotificationsProcessor().Run)
+	lc.OnStop("dead letters", deadLetters.Close)
+	lc.OnStop("database", db.Close)
+	lc.OnStop("redis", redis.Close)
 
-	server := service.NewServer(config)
-
-	log.Fatalf("serve: %s", server.ListenAndServe(":"+config.ListenPort))
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
 }
@@ -1,258 +1,203 @@
 package service
 
 import (
+	"bus"
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"dbutil"
 	"delivery/config"
 	"delivery/db"
-	"encoding/json"
 	"errors"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	"fmt"
+	"lifecycle"
+	"saga"
+	"time"
 
-	"github.com/IBM/sarama"
 	"go.uber.org/zap"
 )
 
-var (
-	courReserveProcessor     *CourReserveProcessor
-	courReserveProcessorOnce sync.Once
-)
-
 type CourReserveProcessor struct {
-	consumer     sarama.ConsumerGroup
+	subscriber   bus.Subscriber
 	consumeTopic string
 
-	producer     sarama.AsyncProducer
+	deadLetters *bus.DeadLetters
+
+	publisher    bus.Publisher
 	produceTopic string
-}
 
-func GetCourReserveProcessor() *CourReserveProcessor {
-	return courReserveProcessor
+	// processedMessages ответы, которые консьюмер передает продюсеру
+	processedMessages chan reply
+	queueTimeout      time.Duration
 }
 
-func NewCourReserveProcessor(config *config.Config) {
-	courReserveProcessorOnce.Do(func() {
-		cConfig := sarama.NewConfig()
-		version, err := sarama.ParseKafkaVersion(config.CourReserveConsumerConfig.Version)
-		if err != nil {
-			zap.L().Fatal("failed to parse kafka version", zap.Error(err))
-		}
-		cConfig.Version = version
-		cConfig.Net.TLS.Enable = false
+// errReplyNotSent ответ не отправлен: сообщение не подтверждается, при повторной доставке
+// ответ повторится по сохраненному статусу резерва
+var errReplyNotSent = errors.New("reply not sent")
 
-		c, err := sarama.NewConsumerGroup(config.CourReserveConsumerConfig.Brokers, config.CourReserveConsumerConfig.GroupID, cConfig)
-		if err != nil {
-			zap.L().Fatal("failed to start consumer", zap.Error(err))
-		}
+// reply ответ консьюмера в очереди, результат отправки продюсер возвращает в sent
+type reply struct {
+	msg  *saga.CourReserveMessage
+	sent chan error
+}
 
-		pConfig := sarama.NewConfig()
-		version, err = sarama.ParseKafkaVersion(config.CourReserveProducerConfig.Version)
-		if err != nil {
-			zap.L().Fatal("failed to parse kafka version", zap.Error(err))
-		}
-		pConfig.Version = version
-		pConfig.Net.TLS.Enable = false
+func NewCourReserveProcessor(config *config.Config, subscriber bus.Subscriber, publisher bus.Publisher,
+	deadLetters *bus.DeadLetters) *CourReserveProcessor {
+	p := &CourReserveProcessor{
+		subscriber:        subscriber,
+		deadLetters:       deadLetters,
+		consumeTopic:      config.CourReserveConsumerConfig.Topic,
+		produceTopic:      config.CourReserveProducerConfig.Topic,
+		processedMessages: make(chan reply, 256),
+		queueTimeout:      config.CourReserveProducerConfig.QueueTimeout,
+	}
 
-		p, err := sarama.NewAsyncProducer(config.CourReserveProducerConfig.Brokers, pConfig)
-		if err != nil {
-			zap.L().Fatal("failed to start producer", zap.Error(err))
-		}
+	pc := config.CourReserveProducerConfig
+	metrics := bus.NewMetrics("cour_reserve", func() int { return len(p.processedMessages) })
+	p.publisher = bus.NewReliablePublisher(publisher, metrics, pc.Retries, pc.RetryDelay)
 
-		courReserveProcessor = &CourReserveProcessor{
-			consumer:     c,
-			consumeTopic: config.CourReserveConsumerConfig.Topic,
-			producer:     p,
-			produceTopic: config.CourReserveProducerConfig.Topic,
-		}
-	})
+	return p
 }
 
-func (p *CourReserveProcessor) Run() {
+// Run обрабатывает сообщения, пока не отменен ctx. После отмены консьюмер дорабатывает текущие сообщения,
+// а ответы, оставшиеся в очереди, отправляются до дедлайна остановки
+func (p *CourReserveProcessor) Run(ctx context.Context) error {
 	zap.L().Info("courReserve processor started")
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	keepRunning := true
-
 	consumer := Consumer{
-		ready:             make(chan bool),
-		processedMessages: make(chan *CourReserveMessage, 256),
+		processedMessages: p.processedMessages,
+		queueTimeout:      p.queueTimeout,
+		deadLetters:       p.deadLetters,
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			// `Consume` should be called inside an infinite loop, when a
-			// server-side rebalance happens, the consumer session will need to be
-			// recreated to get the new claims
-			if err := p.consumer.Consume(ctx, []string{p.consumeTopic}, &consumer); err != nil {
-				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
-					return
-				}
-				zap.L().Fatal("error from consumer: " + err.Error())
-			}
-			// check if context was cancelled, signaling that the consumer should stop
-			if ctx.Err() != nil {
-				return
-			}
-			consumer.ready = make(chan bool)
-		}
-	}()
-
-	<-consumer.ready // Await till the consumer has been set up
-	zap.L().Info("Sarama consumer up and running!...")
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for err := range p.producer.Errors() {
-			zap.L().Error("failed to produce message", zap.Error(err))
-		}
-	}()
-
-	wg.Add(1)
+	consumed := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-
-	ProducerLoop:
-		for {
-			select {
-			case msg := <-consumer.processedMessages:
-				bytes, err := json.Marshal(msg)
-				if err != nil {
-					zap.L().Error("failed to marshal cour_reserve message", zap.Error(err))
-					continue
-				}
-				zap.L().Sugar().Infof("producing message: %s", string(bytes))
-				p.producer.Input() <- &sarama.ProducerMessage{Topic: p.produceTopic, Value: sarama.StringEncoder(string(bytes))}
-			case <-ctx.Done():
-				p.producer.AsyncClose() // Trigger a shutdown of the producer.
-				break ProducerLoop
-			}
-		}
+		consumed <- p.subscriber.Subscribe(ctx, []string{p.consumeTopic}, consumer.handleMessage)
 	}()
 
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+	var err error
 
-	for keepRunning {
+ProducerLoop:
+	for {
 		select {
-		case <-ctx.Done():
-			zap.L().Info("terminating: context cancelled")
-			keepRunning = false
-		case <-sigterm:
-			zap.L().Info("terminating: via signal")
-			keepRunning = false
+		case r := <-consumer.processedMessages:
+			r.sent <- p.produce(lifecycle.StopContext(ctx), r.msg)
+		case err = <-consumed:
+			break ProducerLoop
 		}
 	}
 
-	cancel()
-	wg.Wait()
-	if err := p.consumer.Close(); err != nil {
-		zap.L().Fatal("error closing consumer: " + err.Error())
+	p.flush(lifecycle.StopContext(ctx), consumer.processedMessages)
+
+	if closeErr := p.subscriber.Close(); closeErr != nil {
+		zap.L().Error("error closing consumer", zap.Error(closeErr))
+	}
+	if closeErr := p.publisher.Close(); closeErr != nil {
+		zap.L().Error("error closing producer", zap.Error(closeErr))
 	}
-}
 
-// Consumer represents a Sarama consumer group consumer
-type Consumer struct {
-	ready             chan bool
-	processedMessages chan *CourReserveMessage
+	return err
 }
 
-// Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	// Mark the consumer as ready
-	close(consumer.ready)
+func (p *CourReserveProcessor) produce(ctx context.Context, msg *saga.CourReserveMessage) error {
+	bytes, err := saga.Encode(msg)
+	if err != nil {
+		zap.L().Error("failed to marshal cour_reserve message", zap.Error(err))
+		return err
+	}
+	zap.L().Sugar().Infof("producing message: %s", string(bytes))
+	if err := p.publisher.Publish(ctx, &bus.Message{
+		Topic: p.produceTopic,
+		Key:   []byte(saga.Key(msg.OrderID)),
+		Value: bytes,
+	}); err != nil {
+		zap.L().Error("failed to produce message", zap.Error(err), zap.Int64("order_id", msg.OrderID))
+		return err
+	}
+
 	return nil
 }
 
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
-	return nil
+// flush отправляет ответы, оставшиеся в очереди после остановки консьюмера, пока не истечет ctx
+func (p *CourReserveProcessor) flush(ctx context.Context, queue chan reply) {
+	for ctx.Err() == nil {
+		select {
+		case r := <-queue:
+			r.sent <- p.produce(ctx, r.msg)
+		default:
+			return
+		}
+	}
+
+	zap.L().Error("shutdown deadline exceeded, dropping queued messages", zap.Int("count", len(queue)))
 }
 
-const (
-	CourReserveStatusPending int8 = iota
-	CourReserveStatusOK
-	CourReserveStatusFailed
-)
+// Consumer обрабатывает сообщения подписки, ответы передает в processedMessages
+type Consumer struct {
+	processedMessages chan reply
+	queueTimeout      time.Duration
 
-const (
-	RevertCourReserve = iota
-	CourReserve
-)
+	deadLetters *bus.DeadLetters
+}
+
+// courReserveConsumerName имя консьюмера, под которым отмечаются обработанные сообщения
+const courReserveConsumerName = "delivery.cour_reserve"
 
-type CourReserveMessage struct {
-	PaymentID         int64   `json:"payment_id"`
-	OrderID           int64   `json:"order_id"`
-	StockChangeIDs    []int64 `json:"stock_change_ids"`
-	CourReservationID int64   `json:"cour_reservation_id"`
-	Action            int8    `json:"action"`
-	Status            int8    `json:"status"` // 0 - pending, 1 - ok, 2 - failed
-	RetryCount        int     `json:"retry_count"`
+// newMessageID генерирует уникальный id сообщения саги, по нему получатель отбрасывает повторную доставку
+func newMessageID() string {
+	return rand.Text()
 }
 
-// ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
-// Once the Messages() channel is closed, the Handler must finish its processing
-// loop and exit.
-func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	// NOTE:
-	// Do not move the code below to a goroutine.
-	// The `ConsumeClaim` itself is called within a goroutine, see:
-	// https://github.com/IBM/sarama/blob/main/consumer_group.go#L27-L29
-	for {
-		select {
-		case message, ok := <-claim.Messages():
-			if !ok {
-				zap.L().Info("message channel was closed")
-				return nil
-			}
-			zap.L().Sugar().Infof("message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
-			if err := consumer.processReserveCour(message.Value); err != nil {
-				zap.L().Error("failed to process reserve cour message", zap.Error(err))
-			}
-			session.MarkMessage(message, "")
-		// Should return when `session.Context()` is done.
-		// If not, will raise `ErrRebalanceInProgress` or `read tcp <ip>:<port>: i/o timeout` when kafka rebalance. see:
-		// https://github.com/IBM/sarama/issues/1192
-		case <-session.Context().Done():
-			return nil
-		}
+// handleMessage обрабатывает сообщение подписки, ошибка - подписка завершилась до обработки,
+// ответ не отправлен или сообщение не удалось отправить в dead letter топик
+func (consumer *Consumer) handleMessage(ctx context.Context, message *bus.Message) error {
+	zap.L().Sugar().Infof("message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+	err := consumer.processReserveCour(ctx, message.Value)
+	if errors.Is(err, errReplyNotSent) {
+		zap.L().Error("failed to reply to cour_reserve message", zap.Error(err))
+		return err
+	}
+
+	if err != nil {
+		zap.L().Error("failed to process reserve cour message", zap.Error(err))
+		return sendToDeadLetters(ctx, consumer.deadLetters, message, err)
 	}
+
+	return nil
 }
 
-func (consumer *Consumer) processReserveCour(data []byte) error {
-	var msg CourReserveMessage
-	if err := json.Unmarshal(data, &msg); err != nil {
+func (consumer *Consumer) processReserveCour(ctx context.Context, data []byte) error {
+	var msg saga.CourReserveMessage
+	if err := saga.Decode(data, &msg); err != nil {
 		return err
 	}
 
-	if msg.Status != CourReserveStatusPending || msg.CourReservationID == 0 || msg.OrderID == 0 {
+	if msg.Status != saga.StatusPending {
 		zap.L().Warn("received bad cour_reserve message",
 			zap.Int64("cour_reserve_id", msg.CourReservationID),
 			zap.Int64("order_id", msg.OrderID),
-			zap.Int8("status", msg.Status))
+			zap.String("status", string(msg.Status)))
 		return nil
 	}
 
-	produce := func(msg *CourReserveMessage) {
-		zap.L().Sugar().Infof("processed cour_reserve message: %+v", *msg)
-		consumer.processedMessages <- msg
-	}
-
 	switch msg.Action {
-	case RevertCourReserve, CourReserve:
-		if err := db.ProcessReserveCourier(msg.CourReservationID, msg.Action); err != nil {
+	case saga.CourReserveRevert, saga.CourReserve:
+		if err := db.ProcessReserveCourier(courReserveConsumerName, msg.MessageID, msg.CourReservationID, msg.Action); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return nil
 			}
 
-			db.RejectReserveCourier(msg.CourReservationID, err.Error())
+			if errors.Is(err, dbutil.ErrDuplicateMessage) {
+				return consumer.replyProcessed(ctx, &msg)
+			}
+
+			if rejectErr := db.RejectReserveCourier(courReserveConsumerName, msg.MessageID, msg.CourReservationID, err.Error()); rejectErr != nil {
+				if errors.Is(rejectErr, dbutil.ErrDuplicateMessage) {
+					return consumer.replyProcessed(ctx, &msg)
+				}
+
+				return rejectErr
+			}
 
 			zap.L().Error(
 				"failed to process cour_reserve",
@@ -260,19 +205,67 @@ func (consumer *Consumer) processReserveCour(data []byte) error {
 				zap.Int64("cour_reserve_id", msg.CourReservationID),
 				zap.Int64("payment_id", msg.PaymentID),
 				zap.Int64("order_id", msg.OrderID),
-				zap.Int8("action", msg.Action),
-				zap.Int8("status", msg.Status),
+				zap.String("action", string(msg.Action)),
+				zap.String("status", string(msg.Status)),
 				zap.Int64s("stock_change_ids", msg.StockChangeIDs),
 			)
-			msg.Status = CourReserveStatusFailed
-			produce(&msg)
-			return nil
+			msg.Status = saga.StatusFailed
+			return consumer.reply(ctx, &msg)
 		}
-		db.ApproveReserveCourier(msg.CourReservationID)
-		msg.Status = CourReserveStatusOK
-		produce(&msg)
-		return nil
+		msg.Status = saga.StatusOK
+		return consumer.reply(ctx, &msg)
 	default:
 		return nil
 	}
 }
+
+// reply ставит ответ в очередь продюсера и ждет его отправки. Место в заполненной очереди ждет не дольше queueTimeout,
+// после чего возвращает ErrQueueFull. Ответ уходит уже после коммита в базе, поэтому любая ошибка отправки
+// возвращается как errReplyNotSent, чтобы сообщение не подтверждалось
+func (consumer *Consumer) reply(ctx context.Context, msg *saga.CourReserveMessage) error {
+	// ответ — новое сообщение саги со своим id
+	msg.MessageID = newMessageID()
+	zap.L().Sugar().Infof("processed cour_reserve message: %+v", *msg)
+
+	r := reply{msg: msg, sent: make(chan error, 1)}
+
+	queueCtx, cancel := context.WithTimeout(ctx, consumer.queueTimeout)
+	defer cancel()
+
+	select {
+	case consumer.processedMessages <- r:
+	case <-queueCtx.Done():
+		return fmt.Errorf("%w: %w: %w", errReplyNotSent, ErrQueueFull, queueCtx.Err())
+	}
+
+	select {
+	case err := <-r.sent:
+		if err != nil {
+			return fmt.Errorf("%w: %w", errReplyNotSent, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %w", errReplyNotSent, ctx.Err())
+	}
+}
+
+// replyProcessed повторяет ответ на уже обработанное сообщение по статусу резерва в базе:
+// предыдущий ответ на него мог не дойти до кафки
+func (consumer *Consumer) replyProcessed(ctx context.Context, msg *saga.CourReserveMessage) error {
+	status, err := db.GetCourReserveStatus(msg.CourReservationID)
+	if err != nil {
+		return err
+	}
+
+	msg.Status = saga.Status(status)
+	if msg.Status != saga.StatusOK && msg.Status != saga.StatusFailed {
+		zap.L().Warn("skip duplicate cour_reserve message",
+			zap.Int64("cour_reserve_id", msg.CourReservationID), zap.String("status", status))
+		return nil
+	}
+
+	zap.L().Warn("duplicate cour_reserve message, repeating reply",
+		zap.Int64("cour_reserve_id", msg.CourReservationID), zap.String("status", status))
+
+	return consumer.reply(ctx, msg)
+}
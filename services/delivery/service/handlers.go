@@ -1,6 +1,7 @@
 package service
 
 import (
+	"context"
 	"delivery/db"
 	"delivery/types"
 	"encoding/json"
@@ -92,7 +93,7 @@ func confirmOrderDelivered(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	go NotifyUser(order.OrderID, OrderStatusDelivered)
+	go NotifyUser(context.Background(), order.OrderID, OrderStatusDelivered)
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
 }
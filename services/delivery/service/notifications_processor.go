@@ -1,15 +1,16 @@
 package service
 
 import (
+	"bus"
 	"context"
+	"errors"
+	"fmt"
 	"delivery/config"
-	"encoding/json"
-	"os"
-	"os/signal"
+	"lifecycle"
+	"saga"
 	"sync"
-	"syscall"
+	"time"
 
-	"github.com/IBM/sarama"
 	"go.uber.org/zap"
 )
 
@@ -19,38 +20,30 @@ var (
 )
 
 type NotificationsProcessor struct {
-	producer     sarama.AsyncProducer
+	publisher    bus.Publisher
 	produceTopic string
 
-	queuedMessages chan *NotificationMessage
+	queuedMessages chan *saga.NotificationMessage
+	queueTimeout   time.Duration
+	metrics        *bus.Metrics
 }
 
-type NotificationMessage struct {
-	UserID  int64  `json:"user_id"`
-	OrderID int64  `json:"order_id"`
-	Message string `json:"message"`
-}
+// ErrQueueFull очередь уведомлений или ответов резервов заполнена дольше queueTimeout
+var ErrQueueFull = errors.New("queue is full")
 
-func NewNotificationsProcessor(config *config.Config) {
+func NewNotificationsProcessor(config *config.Config, publisher bus.Publisher) {
 	notificationsProcessorOnce.Do(func() {
-		pConfig := sarama.NewConfig()
-		version, err := sarama.ParseKafkaVersion(config.NotificationsProducerConfig.Version)
-		if err != nil {
-			zap.L().Fatal("failed to parse kafka version", zap.Error(err))
+		npc := config.NotificationsProducerConfig
+		p := &NotificationsProcessor{
+			produceTopic:   npc.Topic,
+			queuedMessages: make(chan *saga.NotificationMessage, 256),
+			queueTimeout:   npc.QueueTimeout,
 		}
-		pConfig.Version = version
-		pConfig.Net.TLS.Enable = false
 
-		p, err := sarama.NewAsyncProducer(config.NotificationsProducerConfig.Brokers, pConfig)
-		if err != nil {
-			zap.L().Fatal("failed to start producer", zap.Error(err))
-		}
+		p.metrics = bus.NewMetrics("notifications", func() int { return len(p.queuedMessages) })
+		p.publisher = bus.NewReliablePublisher(publisher, p.metrics, npc.Retries, npc.RetryDelay)
 
-		notificationsProcessor = &NotificationsProcessor{
-			producer:       p,
-			produceTopic:   config.NotificationsProducerConfig.Topic,
-			queuedMessages: make(chan *NotificationMessage, 256),
-		}
+		notificationsProcessor = p
 	})
 }
 
@@ -58,62 +51,71 @@ func GetNotificationsProcessor() *NotificationsProcessor {
 	return notificationsProcessor
 }
 
-func (p *NotificationsProcessor) AddMessage(msg *NotificationMessage) {
-	p.queuedMessages <- msg
+// AddMessage ставит сообщение в очередь на отправку. Если очередь заполнена, ждет не дольше queueTimeout
+// и до отмены ctx, после чего отбрасывает сообщение и возвращает ErrQueueFull
+func (p *NotificationsProcessor) AddMessage(ctx context.Context, msg *saga.NotificationMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, p.queueTimeout)
+	defer cancel()
+
+	select {
+	case p.queuedMessages <- msg:
+		return nil
+	case <-ctx.Done():
+		p.metrics.Dropped()
+		return fmt.Errorf("%w: %w", ErrQueueFull, ctx.Err())
+	}
 }
 
-func (p *NotificationsProcessor) Run() {
+// Run отправляет сообщения из очереди, пока не отменен ctx. Сервис останавливает процессор после консьюмеров
+// и HTTP-сервера, поэтому после отмены новых сообщений нет: оставшиеся в очереди отправляются до дедлайна остановки
+func (p *NotificationsProcessor) Run(ctx context.Context) error {
 	zap.L().Info("notifications processor started")
 
-	ctx, cancel := context.WithCancel(context.Background())
+ProducerLoop:
+	for {
+		select {
+		case msg := <-p.queuedMessages:
+			p.produce(lifecycle.StopContext(ctx), msg)
+		case <-ctx.Done():
+			break ProducerLoop
+		}
+	}
 
-	keepRunning := true
+	p.flush(lifecycle.StopContext(ctx))
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for err := range p.producer.Errors() {
-			zap.L().Error("failed to produce message", zap.Error(err))
-		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-	ProducerLoop:
-		for {
-			select {
-			case msg := <-p.queuedMessages:
-				bytes, err := json.Marshal(msg)
-				if err != nil {
-					zap.L().Error("failed to marshal notification message", zap.Error(err))
-					continue
-				}
-				zap.L().Sugar().Infof("producing message: %s", string(bytes))
-				p.producer.Input() <- &sarama.ProducerMessage{Topic: p.produceTopic, Value: sarama.StringEncoder(string(bytes))}
-			case <-ctx.Done():
-				p.producer.AsyncClose() // Trigger a shutdown of the producer.
-				break ProducerLoop
-			}
-		}
-	}()
+	if err := p.publisher.Close(); err != nil {
+		zap.L().Error("error closing producer", zap.Error(err))
+	}
+
+	return nil
+}
 
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
+func (p *NotificationsProcessor) produce(ctx context.Context, msg *saga.NotificationMessage) {
+	bytes, err := saga.Encode(msg)
+	if err != nil {
+		zap.L().Error("failed to marshal notification message", zap.Error(err))
+		return
+	}
+	zap.L().Sugar().Infof("producing message: %s", string(bytes))
+	if err := p.publisher.Publish(ctx, &bus.Message{
+		Topic: p.produceTopic,
+		Key:   []byte(saga.Key(msg.OrderID)),
+		Value: bytes,
+	}); err != nil {
+		zap.L().Error("failed to produce message", zap.Error(err), zap.Int64("order_id", msg.OrderID))
+	}
+}
 
-	for keepRunning {
+// flush отправляет сообщения, оставшиеся в очереди, пока не истечет ctx
+func (p *NotificationsProcessor) flush(ctx context.Context) {
+	for ctx.Err() == nil {
 		select {
-		case <-ctx.Done():
-			zap.L().Info("terminating: context cancelled")
-			keepRunning = false
-		case <-sigterm:
-			zap.L().Info("terminating: via signal")
-			keepRunning = false
+		case msg := <-p.queuedMessages:
+			p.produce(ctx, msg)
+		default:
+			return
 		}
 	}
 
-	cancel()
-	wg.Wait()
+	zap.L().Error("shutdown deadline exceeded, dropping queued messages", zap.Int("count", len(p.queuedMessages)))
 }
@@ -1,8 +1,10 @@
 package service
 
 import (
+	"context"
 	"delivery/db"
 	"fmt"
+	"saga"
 
 	"go.uber.org/zap"
 )
@@ -15,7 +17,7 @@ const (
 	OrderStatusDelivered
 )
 
-func NotifyUser(orderID int64, status int8) {
+func NotifyUser(ctx context.Context, orderID int64, status int8) {
 	userID, err := db.GetUserByOrderID(orderID)
 	if err != nil {
 		zap.L().Error("get user by order id", zap.Error(err))
@@ -35,11 +37,14 @@ func NotifyUser(orderID int64, status int8) {
 		statusName = "delivered"
 	}
 
-	GetNotificationsProcessor().AddMessage(&NotificationMessage{
+	if err := GetNotificationsProcessor().AddMessage(ctx, &saga.NotificationMessage{
 		UserID:  userID,
 		Message: fmt.Sprintf("Order #%d status: %s", orderID, statusName),
 		OrderID: orderID,
-	})
+	}); err != nil {
+		zap.L().Error("failed to notify user", zap.Error(err), zap.Int64("order_id", orderID))
+		return
+	}
 
 	zap.L().Sugar().Infof("notify user: orderID %d, status %s", orderID, statusName)
 }
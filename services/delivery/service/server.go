@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bus"
 	"delivery/config"
 	"delivery/redis"
 	"encoding/json"
@@ -21,7 +22,9 @@ var ErrAccessTokenExpired = errors.New("access-token expired")
 var ErrRedis = errors.New("redis error")
 var ErrParseAccessToken = errors.New("failed to parse access-token")
 
-func NewServer(config *config.Config) *fasthttp.Server {
+func NewServer(config *config.Config, deadLetters *bus.DeadLetters) *fasthttp.Server {
+	loadPublicKey()
+
 	basePath := strings.Trim(config.BasePath, "/")
 	s := &fasthttp.Server{
 		Handler: func(ctx *fasthttp.RequestCtx) {
@@ -32,7 +35,7 @@ func NewServer(config *config.Config) *fasthttp.Server {
 			}
 
 			switch parts[1] {
-			case "confirm_delivered", "add_courier", "get_courier_reservations", "get_all_courier_reservations":
+			case "confirm_delivered", "add_courier", "get_courier_reservations", "get_all_courier_reservations", "dead_letters", "redrive_dead_letter":
 				switch {
 				case len(parts) == 2:
 					var (
@@ -59,6 +62,10 @@ func NewServer(config *config.Config) *fasthttp.Server {
 						getCourReservations(ctx)
 					case "get_all_courier_reservations":
 						getAllCourReservations(ctx)
+					case "dead_letters":
+						handleGetDeadLetters(deadLetters, ctx)
+					case "redrive_dead_letter":
+						handleRedriveDeadLetter(deadLetters, ctx)
 					}
 				default:
 					ctx.Error("not found", fasthttp.StatusNotFound)
@@ -66,6 +73,10 @@ func NewServer(config *config.Config) *fasthttp.Server {
 				}
 			case "health":
 				healthCheckHandler(ctx)
+			case "metrics":
+				// метрики продюсеров: {"producers": {...}}
+				ctx.SetContentType("application/json")
+				bus.WriteMetrics(ctx)
 			default:
 				ctx.Error("not found", fasthttp.StatusNotFound)
 			}
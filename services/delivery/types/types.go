@@ -1,6 +1,9 @@
 package types
 
-import "time"
+import (
+	"bus"
+	"time"
+)
 
 type Courier struct {
 	Name string `json:"name"`
@@ -30,3 +33,12 @@ type Order struct {
 type HTTPError struct {
 	Error string `json:"error"`
 }
+
+// DeadLetter сообщение из dead letter топика, описано в общем модуле bus
+type DeadLetter = bus.DeadLetter
+
+type RedriveDeadLetterRequest struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
@@ -0,0 +1,288 @@
+package e2e
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"money"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	billingconfig "billing/config"
+	billingdb "billing/db"
+	billingservice "billing/service"
+	deliveryconfig "delivery/config"
+	deliverydb "delivery/db"
+	deliveryservice "delivery/service"
+	orderconfig "order/config"
+	orderdb "order/db"
+	orderservice "order/service"
+	ordertypes "order/types"
+	stockconfig "stock/config"
+	stockdb "stock/db"
+	stockservice "stock/service"
+	stocktypes "stock/types"
+)
+
+const (
+	stockTopic             = "stock_changes"
+	stockStatusTopic       = "stock_changes_status"
+	paymentsTopic          = "payments"
+	paymentsStatusTopic    = "payments_status"
+	courReserveTopic       = "cour_reserve"
+	courReserveStatusTopic = "cour_reserve_status"
+	notificationsTopic     = "notifications"
+
+	sagaTimeout = 30 * time.Second
+)
+
+// shop сервисы саги, запущенные в одном процессе поверх общей шины
+type shop struct {
+	bus          *bus.Memory
+	orchestrator *orderservice.Orchestrator
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func TestOrderSaga(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	for name, open := range map[string]func(string) error{
+		"order":    orderdb.Open,
+		"stock":    stockdb.Open,
+		"billing":  billingdb.Open,
+		"delivery": deliverydb.Open,
+	} {
+		if err := open(dsn); err != nil {
+			t.Fatalf("open %s database: %s", name, err)
+		}
+	}
+
+	s := startShop(t)
+
+	if err := deliverydb.CreateCourier("e2e"); err != nil {
+		t.Fatalf("create courier: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		deposit    string
+		wantStatus string
+		wantStock  int64
+	}{
+		{
+			name:       "paid order goes to delivery",
+			deposit:    "1000.00",
+			wantStatus: "delivery",
+			wantStock:  8,
+		},
+		{
+			name:       "order without funds is canceled and stock is returned",
+			deposit:    "1.00",
+			wantStatus: "canceled",
+			wantStock:  10,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// user_id уникален для каждого запуска, чтобы тест можно было повторять на той же базе
+			userID := time.Now().UnixNano()%1_000_000_000 + int64(i)
+			itemID := addItem(t, "100.00", 10)
+
+			if _, err := billingdb.CreateAccount(userID); err != nil {
+				t.Fatalf("create account: %s", err)
+			}
+			deposit := mustParse(t, tt.deposit)
+			if err := billingdb.AddMoney(userID, deposit); err != nil {
+				t.Fatalf("add money: %s", err)
+			}
+
+			order := ordertypes.Order{Items: []ordertypes.Item{{Id: itemID, Quantity: 2}}}
+			orderID, err := orderdb.CreateOrder(userID, nil, &order)
+			if err != nil {
+				t.Fatalf("create order: %s", err)
+			}
+			order.ID = orderID
+			s.orchestrator.StartSaga(&order)
+
+			details := waitOrderStatus(t, orderID, tt.wantStatus)
+
+			if got := itemQuantity(t, itemID); got != tt.wantStock {
+				t.Errorf("stock quantity = %d, want %d", got, tt.wantStock)
+			}
+
+			wantBalance := deposit
+			if tt.wantStatus == "delivery" {
+				wantBalance = deposit.Sub(details.Total)
+			}
+			balance, available, err := billingdb.GetBalance(userID)
+			if err != nil {
+				t.Fatalf("get balance: %s", err)
+			}
+			if !balance.Equal(wantBalance) || !available.Equal(wantBalance) {
+				t.Errorf("balance = %s, available = %s, want %s", balance, available, wantBalance)
+			}
+
+			mismatches, err := billingdb.GetBalanceMismatches()
+			if err != nil {
+				t.Fatalf("get balance mismatches: %s", err)
+			}
+			if len(mismatches) != 0 {
+				t.Errorf("balance mismatches: %+v", mismatches)
+			}
+		})
+	}
+
+	s.stop()
+
+	for _, topic := range []string{stockTopic, paymentsTopic, courReserveTopic, stockStatusTopic, paymentsStatusTopic, courReserveStatusTopic} {
+		if msgs := s.bus.Messages(topic + ".dlq"); len(msgs) != 0 {
+			t.Errorf("%d dead letters in %s", len(msgs), topic)
+		}
+	}
+}
+
+// startShop поднимает процессоры всех сервисов так же, как их main, только поверх bus.Memory
+func startShop(t *testing.T) *shop {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &shop{bus: bus.NewMemory(), cancel: cancel}
+	t.Cleanup(s.stop)
+
+	orderConfig := orderconfig.NewConfig()
+	orderConfig.StockProducerConfig.Topic = stockTopic
+	orderConfig.StockConsumerConfig.Topic = stockStatusTopic
+	orderConfig.PaymentsProducerConfig.Topic = paymentsTopic
+	orderConfig.PaymentsConsumerConfig.Topic = paymentsStatusTopic
+	orderConfig.CourReserveProducerConfig.Topic = courReserveTopic
+	orderConfig.CourReserveConsumerConfig.Topic = courReserveStatusTopic
+	orderConfig.NotificationsProducerConfig.Topic = notificationsTopic
+	orderConfig.OutboxConfig.PollInterval = 50 * time.Millisecond
+
+	orderDeadLetters := orderservice.NewDeadLetters(orderConfig, s.bus, s.bus,
+		paymentsStatusTopic, stockStatusTopic, courReserveStatusTopic)
+	notificationsProcessor := orderservice.NewNotificationsProcessor(orderConfig, s.bus)
+	s.orchestrator = orderservice.NewOrchestrator(orderConfig, notificationsProcessor)
+
+	stockConfig := stockconfig.NewConfig()
+	stockConfig.ConsumerConfig.Topic = stockTopic
+	stockConfig.ProducerConfig.Topic = stockStatusTopic
+
+	billingConfig := billingconfig.NewConfig()
+	billingConfig.ConsumerConfig.Topic = paymentsTopic
+	billingConfig.ProducerConfig.Topic = paymentsStatusTopic
+
+	deliveryConfig := deliveryconfig.NewConfig()
+	deliveryConfig.CourReserveConsumerConfig.Topic = courReserveTopic
+	deliveryConfig.CourReserveProducerConfig.Topic = courReserveStatusTopic
+
+	s.run(t, ctx, "order payments processor", orderservice.NewPaymentsProcessor(orderConfig,
+		s.bus.Subscriber("order.payments"), s.orchestrator, orderDeadLetters).Run)
+	s.run(t, ctx, "order stock processor", orderservice.NewStockProcessor(orderConfig,
+		s.bus.Subscriber("order.stock"), s.orchestrator, orderDeadLetters).Run)
+	s.run(t, ctx, "order cour_reserve processor", orderservice.NewCourReserveProcessor(orderConfig,
+		s.bus.Subscriber("order.cour_reserve"), s.orchestrator, orderDeadLetters).Run)
+	s.run(t, ctx, "order notifications processor", notificationsProcessor.Run)
+	s.run(t, ctx, "order outbox relay", orderservice.NewOutboxRelay(orderConfig, s.bus).Run)
+
+	s.run(t, ctx, "stock_changes processor", stockservice.NewStockChangesProcessor(stockConfig,
+		s.bus.Subscriber("stock"), s.bus,
+		stockservice.NewRetryTopics(stockConfig, s.bus),
+		stockservice.NewDeadLetters(stockConfig, s.bus, s.bus, stockTopic)).Run)
+
+	s.run(t, ctx, "payments processor", billingservice.NewPaymentsProcessor(billingConfig,
+		s.bus.Subscriber("billing"), s.bus,
+		billingservice.NewRetryTopics(billingConfig, s.bus),
+		billingservice.NewDeadLetters(billingConfig, s.bus, s.bus, paymentsTopic)).Run)
+
+	s.run(t, ctx, "cour_reserve processor", deliveryservice.NewCourReserveProcessor(deliveryConfig,
+		s.bus.Subscriber("delivery"), s.bus,
+		deliveryservice.NewDeadLetters(deliveryConfig, s.bus, s.bus, courReserveTopic)).Run)
+
+	return s
+}
+
+func (s *shop) run(t *testing.T, ctx context.Context, name string, run func(context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: %s", name, err)
+		}
+	}()
+}
+
+// stop останавливает процессоры и дожидается их завершения, повторный вызов ничего не делает
+func (s *shop) stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func addItem(t *testing.T, price string, quantity int64) int64 {
+	t.Helper()
+
+	item := stocktypes.Item{Name: "e2e", Description: "saga test item", Price: mustParse(t, price)}
+	if err := stockdb.AddItem(&item); err != nil {
+		t.Fatalf("add item: %s", err)
+	}
+	if err := stockdb.ProcessStockChange(&stocktypes.StockChange{ItemID: item.Id, Action: "add", Quantity: quantity}); err != nil {
+		t.Fatalf("add stock: %s", err)
+	}
+
+	return item.Id
+}
+
+func itemQuantity(t *testing.T, itemID int64) int64 {
+	t.Helper()
+
+	items, err := stockdb.GetItems()
+	if err != nil {
+		t.Fatalf("get items: %s", err)
+	}
+	for _, item := range items {
+		if item.Id == itemID {
+			return item.Quantity
+		}
+	}
+
+	t.Fatalf("item %d not found", itemID)
+	return 0
+}
+
+// waitOrderStatus ждет, пока сага доведет заказ до статуса status
+func waitOrderStatus(t *testing.T, orderID int64, status string) *ordertypes.OrderDetails {
+	t.Helper()
+
+	deadline := time.Now().Add(sagaTimeout)
+	for {
+		details, err := orderdb.GetOrder(orderID)
+		if err != nil {
+			t.Fatalf("get order: %s", err)
+		}
+		if details.Status == status {
+			return details
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %d status = %q after %s, want %q", orderID, details.Status, sagaTimeout, status)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func mustParse(t *testing.T, s string) money.Money {
+	t.Helper()
+
+	m, err := money.Parse(s)
+	if err != nil {
+		t.Fatalf("parse %q: %s", s, err)
+	}
+	return m
+}
@@ -0,0 +1,68 @@
+package config
+
+import "time"
+
+type ServerConfig struct {
+	ReadTimeout  time.Duration `toml:"read-timeout"`
+	WriteTimeout time.Duration `toml:"write-timeout"`
+	IdleTimeout  time.Duration `toml:"idle-timeout"`
+	Concurrency  int           `toml:"concurrency"`
+}
+
+func NewServerConfig() *ServerConfig {
+	return &ServerConfig{
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		Concurrency:  100,
+	}
+}
+
+// WebhookConfig вебхуки о статусе платежа: провайдер подписывает их секретом из SecretFile,
+// недоставленный вебхук отправляется повторно Retries раз с паузой RetryDelay
+type WebhookConfig struct {
+	URL        string        `toml:"url"`
+	SecretFile string        `toml:"secret-file"`
+	Timeout    time.Duration `toml:"timeout"`
+	Retries    int           `toml:"retries"`
+	RetryDelay time.Duration `toml:"retry-delay"`
+	// QueueSize сколько вебхуков ждут отправки, при переполнении запрос ждет место в очереди не дольше Timeout
+	QueueSize int `toml:"queue-size"`
+}
+
+func NewWebhookConfig() *WebhookConfig {
+	return &WebhookConfig{
+		URL:        "http://billing:8000/users/topup_webhook",
+		SecretFile: "/secret/payment-provider/webhook-secret",
+		Timeout:    5 * time.Second,
+		Retries:    5,
+		RetryDelay: 2 * time.Second,
+		QueueSize:  100,
+	}
+}
+
+type Config struct {
+	ListenPort string `toml:"listen-port"`
+	LogLevel   string `toml:"log-level"`
+	LogFile    string `toml:"log-file"`
+	// PublicAddr адрес, по которому страница оплаты доступна из браузера пользователя
+	PublicAddr string `toml:"public-addr"`
+	// AutoConfirm подтверждать платежи сразу после создания, без страницы оплаты, для автотестов
+	AutoConfirm bool `toml:"auto-confirm"`
+	// ShutdownTimeout дедлайн остановки: за это время сервис дорабатывает запросы и дописывает очередь вебхуков
+	ShutdownTimeout time.Duration  `toml:"shutdown-timeout"`
+	ServerConfig    *ServerConfig  `toml:"server-config"`
+	WebhookConfig   *WebhookConfig `toml:"webhook-config"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		ListenPort:      "8000",
+		LogLevel:        "info",
+		LogFile:         "stdout",
+		PublicAddr:      "http://localhost:8000",
+		ShutdownTimeout: 25 * time.Second,
+		ServerConfig:    NewServerConfig(),
+		WebhookConfig:   NewWebhookConfig(),
+	}
+}
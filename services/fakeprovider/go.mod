@@ -0,0 +1,26 @@
+module fakeprovider
+
+go 1.24.6
+
+require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/valyala/fasthttp v1.66.0
+	go.uber.org/zap v1.27.0
+)
+
+require (
+	lifecycle v0.0.0
+	money v0.0.0
+)
+
+require (
+	github.com/andybalholm/brotli v1.2.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+)
+
+replace (
+	lifecycle => ../lifecycle
+	money => ../money
+)
@@ -0,0 +1,46 @@
+// fakeprovider локальный платежный провайдер для разработки и тестов пополнения счета: создает платежи,
+// показывает страницу оплаты и отправляет биллингу подписанные вебхуки о результате
+package main
+
+import (
+	"fakeprovider/config"
+	"fakeprovider/logging"
+	"fakeprovider/service"
+	"fmt"
+	"lifecycle"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+func main() {
+	executablePath, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Error getting executable path: %v\n", err)
+		return
+	}
+
+	appName := filepath.Base(executablePath)
+	config := config.NewConfig()
+	if _, err := toml.DecodeFile("/usr/local/etc/"+appName+".conf", config); err != nil {
+		log.Fatalf("loading config: %s", err)
+	}
+
+	logging.Init(appName, config)
+
+	webhooks, err := service.NewWebhookSender(config.WebhookConfig)
+	if err != nil {
+		log.Fatalf("init webhooks: %s", err)
+	}
+
+	// сервер останавливается первым, после него отправитель дописывает очередь вебхуков
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config, service.NewPayments(), webhooks), ":"+config.ListenPort)
+	lc.Go("webhook sender", webhooks.Run)
+
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"money"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const headerIdempotency = "Idempotence-Key"
+
+var (
+	ErrBadInput       = errors.New("bad input")
+	ErrNoIdempotency  = errors.New("Idempotence-Key header is required")
+	ErrBadAmount      = errors.New("amount must be positive")
+	ErrBadCurrency    = errors.New("unsupported currency")
+	ErrWebhookEnqueue = errors.New("webhook queue is full, try again later")
+)
+
+// checkoutPage страница оплаты, на которую магазин перенаправляет пользователя
+var checkoutPage = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Fake payment provider</title></head>
+<body>
+<h1>Payment {{.ID}}</h1>
+<p>{{.Description}}</p>
+<p>Amount: {{.Amount}} {{.Currency}}</p>
+<p>Status: {{.Status}}</p>
+{{if eq .Status "pending"}}
+<form method="post" action="/payments/{{.ID}}/succeed"><button type="submit">Pay</button></form>
+<form method="post" action="/payments/{{.ID}}/cancel"><button type="submit">Cancel</button></form>
+{{end}}
+</body>
+</html>
+`))
+
+func healthCheckHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.WriteString(`{"status":"OK"}`)
+}
+
+// createPayment создает платеж, повтор с тем же Idempotence-Key возвращает уже созданный платеж
+func (s *Server) createPayment(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	key := string(ctx.Request.Header.Peek(headerIdempotency))
+	if key == "" {
+		handleError(ctx, ErrNoIdempotency, fasthttp.StatusBadRequest)
+		return
+	}
+
+	var req Payment
+	if err := json.Unmarshal(ctx.Request.Body(), &req); err != nil {
+		zap.L().Error(err.Error())
+		handleError(ctx, ErrBadInput, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if !req.Amount.IsPositive() {
+		handleError(ctx, ErrBadAmount, fasthttp.StatusBadRequest)
+		return
+	}
+
+	if req.Currency == "" {
+		req.Currency = string(money.DefaultCurrency)
+	}
+	if req.Currency != string(req.Amount.Currency()) {
+		handleError(ctx, ErrBadCurrency, fasthttp.StatusBadRequest)
+		return
+	}
+
+	payment, created := s.payments.Create(key, &Payment{
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		Reference:   req.Reference,
+		Description: req.Description,
+		ReturnURL:   req.ReturnURL,
+	})
+
+	status := fasthttp.StatusOK
+	if created {
+		status = fasthttp.StatusCreated
+		zap.L().Info("payment created",
+			zap.String("payment_id", payment.ID), zap.String("reference", payment.Reference), zap.Stringer("amount", payment.Amount))
+
+		if s.autoConfirm {
+			var err error
+			if payment, err = s.payments.Finish(payment.ID, StatusSucceeded); err == nil && !s.notify(ctx, payment) {
+				return
+			}
+		}
+	}
+
+	payment.ConfirmationURL = s.confirmationURL(payment.ID)
+
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(payment)
+}
+
+func (s *Server) getPayment(ctx *fasthttp.RequestCtx, id string) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	payment, err := s.payments.Get(id)
+	if err != nil {
+		handleError(ctx, err, fasthttp.StatusNotFound)
+		return
+	}
+
+	payment.ConfirmationURL = s.confirmationURL(payment.ID)
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(payment)
+}
+
+// checkout страница оплаты платежа
+func (s *Server) checkout(ctx *fasthttp.RequestCtx, id string) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	payment, err := s.payments.Get(id)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("text/html; charset=utf-8")
+	if err := checkoutPage.Execute(ctx, payment); err != nil {
+		zap.L().Error(fmt.Errorf("render checkout page: %w", err).Error())
+	}
+}
+
+// finishPayment оплачивает или отменяет платеж и отправляет магазину вебхук. Кнопки страницы оплаты
+// возвращают пользователя на return_url магазина, запросы из тестов получают платеж в JSON
+func (s *Server) finishPayment(ctx *fasthttp.RequestCtx, id, status string) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	payment, err := s.payments.Finish(id, status)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPaymentNotFound):
+			handleError(ctx, err, fasthttp.StatusNotFound)
+		case errors.Is(err, ErrPaymentFinished):
+			handleError(ctx, err, fasthttp.StatusConflict)
+		}
+		return
+	}
+
+	zap.L().Info("payment finished", zap.String("payment_id", payment.ID), zap.String("status", payment.Status))
+
+	if !s.notify(ctx, payment) {
+		return
+	}
+
+	s.respondPayment(ctx, payment)
+}
+
+// resendWebhook повторно отправляет вебхук о текущем статусе завершенного платежа,
+// чтобы проверить, что магазин обрабатывает повторы
+func (s *Server) resendWebhook(ctx *fasthttp.RequestCtx, id string) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	payment, err := s.payments.Get(id)
+	if err != nil {
+		handleError(ctx, err, fasthttp.StatusNotFound)
+		return
+	}
+
+	if payment.Status == StatusPending {
+		handleError(ctx, errors.New("payment is not finished"), fasthttp.StatusConflict)
+		return
+	}
+
+	if !s.notify(ctx, payment) {
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusAccepted)
+}
+
+// notify ставит вебхук в очередь, при ошибке отвечает клиенту и возвращает false
+func (s *Server) notify(ctx *fasthttp.RequestCtx, payment Payment) bool {
+	enqueueCtx, cancel := context.WithTimeout(context.Background(), s.enqueueTimeout)
+	defer cancel()
+
+	if err := s.webhooks.Enqueue(enqueueCtx, payment); err != nil {
+		zap.L().Error("failed to enqueue webhook", zap.String("payment_id", payment.ID), zap.Error(err))
+		handleError(ctx, ErrWebhookEnqueue, fasthttp.StatusServiceUnavailable)
+		return false
+	}
+
+	return true
+}
+
+func (s *Server) respondPayment(ctx *fasthttp.RequestCtx, payment Payment) {
+	if payment.ReturnURL != "" && string(ctx.Request.Header.ContentType()) == "application/x-www-form-urlencoded" {
+		ctx.Redirect(payment.ReturnURL, fasthttp.StatusSeeOther)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(payment)
+}
+
+func (s *Server) confirmationURL(id string) string {
+	return s.publicAddr + "/checkout/" + id
+}
+
+type HTTPError struct {
+	Error string `json:"error"`
+}
+
+func handleError(ctx *fasthttp.RequestCtx, err error, status int) {
+	ctx.SetStatusCode(status)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(HTTPError{
+		Error: err.Error(),
+	})
+}
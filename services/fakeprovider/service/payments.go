@@ -0,0 +1,109 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"money"
+	"sync"
+	"time"
+)
+
+// статусы платежа
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusCanceled  = "canceled"
+)
+
+var (
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrPaymentFinished = errors.New("payment is already finished")
+)
+
+// Payment платеж магазина, reference - идентификатор оплаты на стороне магазина, у биллинга id пополнения
+type Payment struct {
+	ID              string      `json:"id"`
+	Status          string      `json:"status"`
+	Amount          money.Money `json:"amount"`
+	Currency        string      `json:"currency"`
+	Reference       string      `json:"reference"`
+	Description     string      `json:"description,omitempty"`
+	ReturnURL       string      `json:"return_url,omitempty"`
+	ConfirmationURL string      `json:"confirmation_url,omitempty"`
+	CTime           time.Time   `json:"ctime"`
+	MTime           time.Time   `json:"mtime"`
+}
+
+// Payments хранит платежи в памяти: провайдер нужен для разработки и тестов, после перезапуска платежи теряются
+type Payments struct {
+	mu         sync.Mutex
+	payments   map[string]*Payment
+	idempotent map[string]string
+}
+
+func NewPayments() *Payments {
+	return &Payments{
+		payments:   make(map[string]*Payment),
+		idempotent: make(map[string]string),
+	}
+}
+
+// Create сохраняет платеж. Для уже использованного ключа идемпотентности возвращает созданный с ним платеж и false
+func (s *Payments) Create(key string, p *Payment) (Payment, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.idempotent[key]; ok {
+		return *s.payments[id], false
+	}
+
+	p.ID = newPaymentID()
+	p.Status = StatusPending
+	p.CTime = time.Now().UTC()
+	p.MTime = p.CTime
+
+	s.payments[p.ID] = p
+	s.idempotent[key] = p.ID
+
+	return *p, true
+}
+
+func (s *Payments) Get(id string) (Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[id]
+	if !ok {
+		return Payment{}, ErrPaymentNotFound
+	}
+
+	return *p, nil
+}
+
+// Finish переводит платеж из pending в status, завершенный платеж не меняется
+func (s *Payments) Finish(id, status string) (Payment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[id]
+	if !ok {
+		return Payment{}, ErrPaymentNotFound
+	}
+
+	if p.Status != StatusPending {
+		return *p, ErrPaymentFinished
+	}
+
+	p.Status = status
+	p.MTime = time.Now().UTC()
+
+	return *p, nil
+}
+
+func newPaymentID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+
+	return "fp_" + hex.EncodeToString(b)
+}
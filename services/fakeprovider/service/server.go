@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fakeprovider/config"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const maxBodySize = 1 << 20 // 1 MB
+
+// Server API провайдера для магазина и страница оплаты для пользователя
+type Server struct {
+	payments       *Payments
+	webhooks       *WebhookSender
+	publicAddr     string
+	autoConfirm    bool
+	enqueueTimeout time.Duration
+}
+
+// NewServer маршруты:
+//
+//	POST /payments                         создать платеж, заголовок Idempotence-Key обязателен
+//	GET  /payments/{id}                    платеж
+//	POST /payments/{id}/succeed            оплатить платеж
+//	POST /payments/{id}/cancel             отменить платеж
+//	POST /payments/{id}/resend_webhook     повторить вебхук завершенного платежа
+//	GET  /checkout/{id}                    страница оплаты
+func NewServer(config *config.Config, payments *Payments, webhooks *WebhookSender) *fasthttp.Server {
+	s := &Server{
+		payments:       payments,
+		webhooks:       webhooks,
+		publicAddr:     strings.TrimRight(config.PublicAddr, "/"),
+		autoConfirm:    config.AutoConfirm,
+		enqueueTimeout: config.WebhookConfig.Timeout,
+	}
+
+	return &fasthttp.Server{
+		Handler:            s.route,
+		MaxRequestBodySize: maxBodySize,
+		ReadTimeout:        config.ServerConfig.ReadTimeout,
+		WriteTimeout:       config.ServerConfig.WriteTimeout,
+		IdleTimeout:        config.ServerConfig.IdleTimeout,
+		Concurrency:        config.ServerConfig.Concurrency,
+	}
+}
+
+func (s *Server) route(ctx *fasthttp.RequestCtx) {
+	parts := strings.Split(strings.Trim(string(ctx.Path()), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "health":
+		healthCheckHandler(ctx)
+	case len(parts) == 1 && parts[0] == "payments":
+		s.createPayment(ctx)
+	case len(parts) == 2 && parts[0] == "payments":
+		s.getPayment(ctx, parts[1])
+	case len(parts) == 3 && parts[0] == "payments":
+		switch parts[2] {
+		case "succeed":
+			s.finishPayment(ctx, parts[1], StatusSucceeded)
+		case "cancel":
+			s.finishPayment(ctx, parts[1], StatusCanceled)
+		case "resend_webhook":
+			s.resendWebhook(ctx, parts[1])
+		default:
+			ctx.Error("not found", fasthttp.StatusNotFound)
+		}
+	case len(parts) == 2 && parts[0] == "checkout":
+		s.checkout(ctx, parts[1])
+	default:
+		ctx.Error("not found", fasthttp.StatusNotFound)
+	}
+}
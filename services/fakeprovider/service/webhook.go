@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fakeprovider/config"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// заголовки подписи вебхука: подписывается строка "<timestamp>.<body>" ключом HMAC-SHA256
+const (
+	headerTimestamp = "X-Webhook-Timestamp"
+	headerSignature = "X-Webhook-Signature"
+)
+
+// Webhook уведомление магазина об изменении статуса платежа
+type Webhook struct {
+	Event   string  `json:"event"`
+	Payment Payment `json:"payment"`
+}
+
+// WebhookSender отправляет вебхуки из очереди по одному, недоставленный вебхук отправляется повторно.
+// Как и реальный провайдер, может доставить один вебхук несколько раз
+type WebhookSender struct {
+	client     *fasthttp.Client
+	url        string
+	secret     []byte
+	timeout    time.Duration
+	retries    int
+	retryDelay time.Duration
+	queue      chan Payment
+}
+
+func NewWebhookSender(config *config.WebhookConfig) (*WebhookSender, error) {
+	data, err := os.ReadFile(config.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("read webhook secret: %w", err)
+	}
+
+	secret := []byte(strings.TrimSpace(string(data)))
+	if len(secret) == 0 {
+		return nil, errors.New("webhook secret is empty")
+	}
+
+	return &WebhookSender{
+		client:     &fasthttp.Client{},
+		url:        config.URL,
+		secret:     secret,
+		timeout:    config.Timeout,
+		retries:    config.Retries,
+		retryDelay: config.RetryDelay,
+		queue:      make(chan Payment, config.QueueSize),
+	}, nil
+}
+
+// Enqueue ставит в очередь вебхук о текущем статусе платежа
+func (s *WebhookSender) Enqueue(ctx context.Context, p Payment) error {
+	select {
+	case s.queue <- p:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run отправляет вебхуки, пока не отменен ctx, после отмены дописывает очередь без повторов
+func (s *WebhookSender) Run(ctx context.Context) error {
+	zap.L().Info("webhook sender started", zap.String("url", s.url))
+
+	for {
+		select {
+		case p := <-s.queue:
+			s.deliver(ctx, p)
+		case <-ctx.Done():
+			for {
+				select {
+				case p := <-s.queue:
+					if err := s.send(p); err != nil {
+						zap.L().Error("webhook is not delivered", zap.String("payment_id", p.ID), zap.Error(err))
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (s *WebhookSender) deliver(ctx context.Context, p Payment) {
+	for attempt := 0; ; attempt++ {
+		err := s.send(p)
+		if err == nil {
+			zap.L().Info("webhook delivered", zap.String("payment_id", p.ID), zap.String("status", p.Status))
+			return
+		}
+
+		if attempt >= s.retries {
+			zap.L().Error("webhook is not delivered", zap.String("payment_id", p.ID), zap.Error(err))
+			return
+		}
+
+		zap.L().Warn("webhook delivery failed, retrying",
+			zap.String("payment_id", p.ID), zap.Int("attempt", attempt+1), zap.Error(err))
+
+		select {
+		case <-time.After(s.retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *WebhookSender) send(p Payment) error {
+	body, err := json.Marshal(Webhook{Event: "payment." + p.Status, Payment: p})
+	if err != nil {
+		return fmt.Errorf("marshal webhook: %w", err)
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(s.url)
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.Header.SetContentType("application/json")
+	req.Header.Set(headerTimestamp, ts)
+	req.Header.Set(headerSignature, s.sign(ts, body))
+	req.SetBody(body)
+
+	if err := s.client.DoTimeout(req, resp, s.timeout); err != nil {
+		return fmt.Errorf("send webhook: %w", err)
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("send webhook: status %d: %s", resp.StatusCode(), resp.Body())
+	}
+
+	return nil
+}
+
+func (s *WebhookSender) sign(ts string, body []byte) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
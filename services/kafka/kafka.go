@@ -0,0 +1,143 @@
+// Package kafka собирает sarama.Config для всех сервисов: версия протокола, client id,
+// TLS и SASL-аутентификация в защищенном кластере
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+var ErrUnknownSASLMechanism = errors.New("unknown sasl mechanism")
+
+// TLSConfig сертификаты читаются из файлов, клиентский сертификат нужен только для mTLS
+type TLSConfig struct {
+	Enable             bool   `toml:"enable"`
+	CAFile             string `toml:"ca-file"`
+	CertFile           string `toml:"cert-file"`
+	KeyFile            string `toml:"key-file"`
+	InsecureSkipVerify bool   `toml:"insecure-skip-verify"`
+}
+
+// SASLConfig пароль читается из файла секрета, чтобы не хранить его в конфиге.
+// Mechanism: PLAIN, SCRAM-SHA-256 или SCRAM-SHA-512
+type SASLConfig struct {
+	Enable       bool   `toml:"enable"`
+	Mechanism    string `toml:"mechanism"`
+	User         string `toml:"user"`
+	PasswordFile string `toml:"password-file"`
+}
+
+// ClientConfig общие настройки подключения консьюмеров и продюсеров
+type ClientConfig struct {
+	ClientID string      `toml:"client-id"`
+	TLS      *TLSConfig  `toml:"tls"`
+	SASL     *SASLConfig `toml:"sasl"`
+}
+
+// NewConfig собирает конфиг sarama с версией протокола и настройками подключения
+func NewConfig(version string, client *ClientConfig) (*sarama.Config, error) {
+	cfg := sarama.NewConfig()
+
+	kafkaVersion, err := sarama.ParseKafkaVersion(version)
+	if err != nil {
+		return nil, fmt.Errorf("parse kafka version: %w", err)
+	}
+	cfg.Version = kafkaVersion
+
+	if client == nil {
+		return cfg, nil
+	}
+
+	if client.ClientID != "" {
+		cfg.ClientID = client.ClientID
+	}
+
+	if err := setTLS(cfg, client.TLS); err != nil {
+		return nil, err
+	}
+
+	if err := setSASL(cfg, client.SASL); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func setTLS(cfg *sarama.Config, tlsConfig *TLSConfig) error {
+	if tlsConfig == nil || !tlsConfig.Enable {
+		cfg.Net.TLS.Enable = false
+		return nil
+	}
+
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+
+	if tlsConfig.CAFile != "" {
+		ca, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return fmt.Errorf("read kafka ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return fmt.Errorf("no certificates in kafka ca %s", tlsConfig.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load kafka client cert: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	cfg.Net.TLS.Enable = true
+	cfg.Net.TLS.Config = conf
+
+	return nil
+}
+
+func setSASL(cfg *sarama.Config, saslConfig *SASLConfig) error {
+	if saslConfig == nil || !saslConfig.Enable {
+		return nil
+	}
+
+	password, err := os.ReadFile(saslConfig.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("read kafka sasl password: %w", err)
+	}
+
+	cfg.Net.SASL.Enable = true
+	cfg.Net.SASL.Handshake = true
+	cfg.Net.SASL.User = saslConfig.User
+	cfg.Net.SASL.Password = strings.TrimSpace(string(password))
+
+	switch strings.ToUpper(saslConfig.Mechanism) {
+	case "", sarama.SASLTypePlaintext:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: sha256Generator}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		cfg.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hashGenerator: sha512Generator}
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownSASLMechanism, saslConfig.Mechanism)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package kafka
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// пауза между повторами сообщения, которое обработчик не смог обработать
+const (
+	minHandleRetryDelay = 500 * time.Millisecond
+	maxHandleRetryDelay = 30 * time.Second
+)
+
+// keyedPool обрабатывает сообщения партиции ограниченным числом воркеров.
+// Сообщения с одним ключом (id заказа) всегда попадают к одному воркеру и обрабатываются по порядку,
+// сообщения разных заказов обрабатываются параллельно.
+// Оффсет двигается только до первого необработанного сообщения, поэтому после ребаланса ничего не теряется
+type keyedPool struct {
+	session sarama.ConsumerGroupSession
+	handle  func(ctx context.Context, msg *sarama.ConsumerMessage) bool
+	queues  []chan *pendingMessage
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	pending []*pendingMessage // сообщения в порядке оффсетов, еще не отмеченные в сессии
+}
+
+type pendingMessage struct {
+	msg  *sarama.ConsumerMessage
+	done bool
+}
+
+// newKeyedPool запускает workers воркеров. handle возвращает false, если сообщение не обработано
+// и его нельзя отмечать: сессия завершилась во время ожидания ретрая или не удалось отправить его в dead letter топик
+func newKeyedPool(session sarama.ConsumerGroupSession, workers int,
+	handle func(ctx context.Context, msg *sarama.ConsumerMessage) bool) *keyedPool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &keyedPool{
+		session: session,
+		handle:  handle,
+		queues:  make([]chan *pendingMessage, workers),
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan *pendingMessage, 16)
+
+		p.wg.Add(1)
+		go p.run(p.queues[i])
+	}
+
+	return p
+}
+
+// Submit передает сообщение воркеру его ключа, блокируется, если очередь воркера заполнена.
+// Возвращает false, если сессия завершилась
+func (p *keyedPool) Submit(msg *sarama.ConsumerMessage) bool {
+	pending := &pendingMessage{msg: msg}
+
+	p.mu.Lock()
+	p.pending = append(p.pending, pending)
+	p.mu.Unlock()
+
+	select {
+	case p.queues[p.worker(msg.Key)] <- pending:
+		return true
+	case <-p.session.Context().Done():
+		return false
+	}
+}
+
+// Close дожидается, пока воркеры разберут свои очереди
+func (p *keyedPool) Close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+
+	p.wg.Wait()
+}
+
+func (p *keyedPool) run(queue chan *pendingMessage) {
+	defer p.wg.Done()
+
+	for pending := range queue {
+		// после завершения сессии сообщения не обрабатываем, их заново получит новый владелец партиции
+		if p.session.Context().Err() != nil {
+			continue
+		}
+
+		if p.handleUntilDone(pending.msg) {
+			p.complete(pending)
+		}
+	}
+}
+
+// handleUntilDone повторяет обработку, пока обработчик не справится с сообщением или не завершится сессия.
+// Необработанное сообщение, например не отправленное в dead letter топик, нельзя пропускать:
+// следующие сообщения партиции не будут отмечены, пока оно не обработано
+func (p *keyedPool) handleUntilDone(msg *sarama.ConsumerMessage) bool {
+	ctx := p.session.Context()
+	delay := minHandleRetryDelay
+
+	for {
+		if p.handle(ctx, msg) {
+			return true
+		}
+
+		select {
+		case <-time.After(delay):
+			delay = min(2*delay, maxHandleRetryDelay)
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// complete отмечает в сессии непрерывный префикс обработанных сообщений
+func (p *keyedPool) complete(pending *pendingMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending.done = true
+
+	var last *sarama.ConsumerMessage
+	for len(p.pending) > 0 && p.pending[0].done {
+		last = p.pending[0].msg
+		p.pending = p.pending[1:]
+	}
+
+	if last != nil {
+		p.session.MarkMessage(last, "")
+	}
+}
+
+// worker выбирает воркера по ключу, сообщения без ключа обрабатываются последовательно первым воркером
+func (p *keyedPool) worker(key []byte) int {
+	if len(key) == 0 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(key)
+
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
@@ -0,0 +1,296 @@
+package kafka
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+const waitTimeout = 5 * time.Second
+
+// fakeSession сессия, которая запоминает отмеченные оффсеты
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+
+	ctx context.Context
+
+	mu     sync.Mutex
+	marked []int64
+}
+
+func (s *fakeSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func (s *fakeSession) markedOffsets() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.marked)
+}
+
+// testPool пул, обработчик которого ждет, пока тест не отпустит сообщение с нужным оффсетом
+type testPool struct {
+	*keyedPool
+	session  *fakeSession
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+
+	mu      sync.Mutex
+	release map[int64]chan struct{}
+	handled []int64
+}
+
+func newTestPool(t *testing.T, workers int) *testPool {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tp := &testPool{
+		session: &fakeSession{ctx: ctx},
+		cancel:  cancel,
+		release: make(map[int64]chan struct{}),
+	}
+
+	tp.keyedPool = newKeyedPool(tp.session, workers, func(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+		select {
+		case <-tp.releaseChan(msg.Offset):
+		case <-ctx.Done():
+			return false
+		}
+
+		tp.mu.Lock()
+		tp.handled = append(tp.handled, msg.Offset)
+		tp.mu.Unlock()
+
+		return true
+	})
+
+	t.Cleanup(tp.stop)
+
+	return tp
+}
+
+// stop завершает сессию и дожидается воркеров, повторный вызов ничего не делает
+func (tp *testPool) stop() {
+	tp.stopOnce.Do(func() {
+		tp.cancel()
+		tp.Close()
+	})
+}
+
+func (tp *testPool) handledOffsets() []int64 {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	return slices.Clone(tp.handled)
+}
+
+func (tp *testPool) releaseChan(offset int64) chan struct{} {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	if tp.release[offset] == nil {
+		tp.release[offset] = make(chan struct{})
+	}
+
+	return tp.release[offset]
+}
+
+// submitToWorkers отправляет n сообщений с оффсетами от 0, i-е сообщение получает ключ, который достается i-му воркеру
+func (tp *testPool) submitToWorkers(t *testing.T, n int) {
+	t.Helper()
+
+	for i := range n {
+		if !tp.Submit(&sarama.ConsumerMessage{Offset: int64(i), Key: tp.keyForWorker(t, i)}) {
+			t.Fatalf("submit message %d: session is done", i)
+		}
+	}
+}
+
+func (tp *testPool) keyForWorker(t *testing.T, worker int) []byte {
+	t.Helper()
+
+	for i := range 10000 {
+		key := []byte("order-" + strconv.Itoa(i))
+		if tp.worker(key) == worker {
+			return key
+		}
+	}
+
+	t.Fatalf("no key for worker %d", worker)
+	return nil
+}
+
+// complete отпускает сообщение и ждет, пока пул учтет его в очереди неотмеченных
+func (tp *testPool) complete(t *testing.T, offset int64) {
+	t.Helper()
+
+	close(tp.releaseChan(offset))
+	tp.waitDone(t, offset)
+}
+
+func (tp *testPool) waitDone(t *testing.T, offset int64) {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for !tp.isDone(offset) {
+		if time.Now().After(deadline) {
+			t.Fatalf("message %d was not completed after %s", offset, waitTimeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// isDone сообщение обработано: оно отмечено как done или уже ушло из очереди неотмеченных вместе с префиксом
+func (tp *testPool) isDone(offset int64) bool {
+	tp.keyedPool.mu.Lock()
+	defer tp.keyedPool.mu.Unlock()
+
+	for _, pending := range tp.pending {
+		if pending.msg.Offset == offset {
+			return pending.done
+		}
+	}
+
+	return true
+}
+
+func TestKeyedPoolMarksContiguousPrefix(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []int64
+		// отмеченные оффсеты после каждого шага order
+		want [][]int64
+	}{
+		{
+			name:  "in order",
+			order: []int64{0, 1, 2, 3},
+			want:  [][]int64{{0}, {0, 1}, {0, 1, 2}, {0, 1, 2, 3}},
+		},
+		{
+			name:  "reverse order",
+			order: []int64{3, 2, 1, 0},
+			want:  [][]int64{nil, nil, nil, {3}},
+		},
+		{
+			name:  "gap in the middle",
+			order: []int64{0, 2, 3, 1},
+			want:  [][]int64{{0}, {0}, {0}, {0, 3}},
+		},
+		{
+			name:  "gap at the start",
+			order: []int64{1, 0, 3, 2},
+			want:  [][]int64{nil, {1}, {1}, {1, 3}},
+		},
+		{
+			name:  "first message never finishes",
+			order: []int64{1, 2, 3},
+			want:  [][]int64{nil, nil, nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := newTestPool(t, 4)
+			tp.submitToWorkers(t, 4)
+
+			for i, offset := range tt.order {
+				tp.complete(t, offset)
+
+				if got := tp.session.markedOffsets(); !slices.Equal(got, tt.want[i]) {
+					t.Fatalf("after completing %v: marked %v, want %v", tt.order[:i+1], got, tt.want[i])
+				}
+			}
+
+			// после завершения сессии незаконченные сообщения не отмечаются
+			tp.stop()
+
+			if got := tp.session.markedOffsets(); !slices.Equal(got, tt.want[len(tt.want)-1]) {
+				t.Errorf("after session end: marked %v, want %v", got, tt.want[len(tt.want)-1])
+			}
+		})
+	}
+}
+
+func TestKeyedPoolKeepsKeyOrder(t *testing.T) {
+	tp := newTestPool(t, 4)
+
+	key := tp.keyForWorker(t, 2)
+	for i := range 3 {
+		if !tp.Submit(&sarama.ConsumerMessage{Offset: int64(i), Key: key}) {
+			t.Fatalf("submit message %d: session is done", i)
+		}
+	}
+
+	// второе сообщение заказа отпущено раньше первого, но обработано будет только после него
+	close(tp.releaseChan(1))
+	close(tp.releaseChan(2))
+	time.Sleep(50 * time.Millisecond)
+
+	if got := tp.session.markedOffsets(); len(got) != 0 {
+		t.Fatalf("marked %v before the first message of the key was handled", got)
+	}
+
+	tp.complete(t, 0)
+	tp.waitDone(t, 2)
+	tp.stop()
+
+	if handled := tp.handledOffsets(); !slices.Equal(handled, []int64{0, 1, 2}) {
+		t.Errorf("handled %v, want [0 1 2]", handled)
+	}
+	if got := tp.session.markedOffsets(); len(got) == 0 || got[len(got)-1] != 2 {
+		t.Errorf("marked %v, want the last mark at 2", got)
+	}
+}
+
+func TestKeyedPoolDropsWorkAfterSessionEnd(t *testing.T) {
+	tp := newTestPool(t, 2)
+	tp.cancel()
+
+	for i := range 4 {
+		msg := &sarama.ConsumerMessage{Offset: int64(i), Key: []byte("order-" + strconv.Itoa(i))}
+		close(tp.releaseChan(msg.Offset))
+		// сообщение либо не принимается, либо воркер пропускает его, не вызывая обработчик
+		tp.Submit(msg)
+	}
+
+	tp.stop()
+
+	if handled := tp.handledOffsets(); len(handled) != 0 {
+		t.Errorf("handled %v after session end", handled)
+	}
+	if got := tp.session.markedOffsets(); len(got) != 0 {
+		t.Errorf("marked %v after session end", got)
+	}
+}
+
+func TestKeyedPoolWorker(t *testing.T) {
+	p := &keyedPool{queues: make([]chan *pendingMessage, 4)}
+
+	if got := p.worker(nil); got != 0 {
+		t.Errorf("worker(nil) = %d, want 0", got)
+	}
+
+	for i := range 100 {
+		key := []byte("order-" + strconv.Itoa(i))
+		w := p.worker(key)
+		if w < 0 || w >= len(p.queues) {
+			t.Fatalf("worker(%s) = %d, out of range", key, w)
+		}
+		if again := p.worker(key); again != w {
+			t.Fatalf("worker(%s) = %d, then %d", key, w, again)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"bus"
+	"context"
+	"errors"
+
+	"github.com/IBM/sarama"
+)
+
+// Publisher реализация bus.Publisher: синхронный продюсер, ждет подтверждения всех реплик
+type Publisher struct {
+	producer sarama.SyncProducer
+}
+
+func NewPublisher(brokers []string, cfg *sarama.Config) (*Publisher, error) {
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Publisher{producer: producer}, nil
+}
+
+func (p *Publisher) Publish(_ context.Context, msgs ...*bus.Message) error {
+	pMsgs := make([]*sarama.ProducerMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		pMsg := &sarama.ProducerMessage{
+			Topic:    msg.Topic,
+			Value:    sarama.ByteEncoder(msg.Value),
+			Metadata: msg,
+		}
+		if len(msg.Key) > 0 {
+			pMsg.Key = sarama.ByteEncoder(msg.Key)
+		}
+		for key, value := range msg.Headers {
+			pMsg.Headers = append(pMsg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+		}
+
+		pMsgs = append(pMsgs, pMsg)
+	}
+
+	err := p.producer.SendMessages(pMsgs)
+	if err == nil {
+		return nil
+	}
+
+	var producerErrors sarama.ProducerErrors
+	if !errors.As(err, &producerErrors) || len(producerErrors) == 0 {
+		return &bus.PublishError{Failed: msgs, Err: err}
+	}
+
+	failed := make([]*bus.Message, 0, len(producerErrors))
+	for _, producerErr := range producerErrors {
+		failed = append(failed, producerErr.Msg.Metadata.(*bus.Message))
+	}
+
+	return &bus.PublishError{Failed: failed, Err: producerErrors[0].Err}
+}
+
+func (p *Publisher) Close() error {
+	return p.producer.Close()
+}
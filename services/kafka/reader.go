@@ -0,0 +1,130 @@
+package kafka
+
+import (
+	"bus"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// сколько ждем очередное сообщение при чтении топика
+const fetchTimeout = time.Second
+
+// Reader реализация bus.TopicReader: читает партиции топика напрямую, без consumer group
+type Reader struct {
+	client sarama.Client
+}
+
+func NewReader(brokers []string, cfg *sarama.Config) (*Reader, error) {
+	client, err := sarama.NewClient(brokers, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Reader{client: client}, nil
+}
+
+func (r *Reader) Tail(topic string, limit int) ([]*bus.Message, error) {
+	if err := r.client.RefreshMetadata(topic); err != nil {
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			return []*bus.Message{}, nil
+		}
+
+		return nil, fmt.Errorf("refresh metadata: %w", err)
+	}
+
+	partitions, err := r.client.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("get partitions: %w", err)
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(r.client)
+	if err != nil {
+		return nil, fmt.Errorf("create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	msgs := make([]*bus.Message, 0)
+	for _, partition := range partitions {
+		oldest, err := r.client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, fmt.Errorf("get oldest offset: %w", err)
+		}
+
+		newest, err := r.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, fmt.Errorf("get newest offset: %w", err)
+		}
+
+		from := max(oldest, newest-int64(limit))
+		if from >= newest {
+			continue
+		}
+
+		fetched, err := fetchMessages(consumer, topic, partition, from, newest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range fetched {
+			msgs = append(msgs, toMessage(msg))
+		}
+	}
+
+	return msgs, nil
+}
+
+func (r *Reader) ReadAt(topic string, partition int32, offset int64) (*bus.Message, error) {
+	consumer, err := sarama.NewConsumerFromClient(r.client)
+	if err != nil {
+		return nil, fmt.Errorf("create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	msgs, err := fetchMessages(consumer, topic, partition, offset, offset+1)
+	if err != nil {
+		if errors.Is(err, sarama.ErrOffsetOutOfRange) || errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			return nil, bus.ErrMessageNotFound
+		}
+
+		return nil, err
+	}
+
+	if len(msgs) == 0 {
+		return nil, bus.ErrMessageNotFound
+	}
+
+	return toMessage(msgs[0]), nil
+}
+
+func (r *Reader) Close() error {
+	return r.client.Close()
+}
+
+// fetchMessages читает сообщения партиции с from до to не включительно
+func fetchMessages(consumer sarama.Consumer, topic string, partition int32, from, to int64) ([]*sarama.ConsumerMessage, error) {
+	pc, err := consumer.ConsumePartition(topic, partition, from)
+	if err != nil {
+		return nil, fmt.Errorf("consume partition: %w", err)
+	}
+	defer pc.Close()
+
+	msgs := make([]*sarama.ConsumerMessage, 0, to-from)
+	for {
+		select {
+		case msg := <-pc.Messages():
+			if msg.Offset >= to {
+				return msgs, nil
+			}
+
+			msgs = append(msgs, msg)
+			if msg.Offset+1 >= to {
+				return msgs, nil
+			}
+		case <-time.After(fetchTimeout):
+			return msgs, nil
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package kafka
+
+import (
+	"bus"
+	"context"
+	"errors"
+
+	"github.com/IBM/sarama"
+)
+
+// Subscriber реализация bus.Subscriber поверх consumer group.
+// Каждую партицию обрабатывает keyedPool из workers воркеров, сообщения одного ключа идут по порядку
+type Subscriber struct {
+	group   sarama.ConsumerGroup
+	workers int
+}
+
+func NewSubscriber(brokers []string, groupID string, cfg *sarama.Config, workers int) (*Subscriber, error) {
+	group, err := sarama.NewConsumerGroup(brokers, groupID, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Subscriber{group: group, workers: workers}, nil
+}
+
+func (s *Subscriber) Subscribe(ctx context.Context, topics []string, handler bus.Handler) error {
+	consumer := &groupHandler{handler: handler, workers: s.workers}
+
+	for {
+		// `Consume` should be called inside an infinite loop, when a
+		// server-side rebalance happens, the consumer session will need to be
+		// recreated to get the new claims
+		if err := s.group.Consume(ctx, topics, consumer); err != nil {
+			if errors.Is(err, sarama.ErrClosedConsumerGroup) {
+				return nil
+			}
+			return err
+		}
+		// check if context was cancelled, signaling that the consumer should stop
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (s *Subscriber) Close() error {
+	return s.group.Close()
+}
+
+// groupHandler represents a Sarama consumer group consumer
+type groupHandler struct {
+	handler bus.Handler
+	workers int
+}
+
+// Setup is run at the beginning of a new session, before ConsumeClaim
+func (h *groupHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
+func (h *groupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
+// Once the Messages() channel is closed, the Handler must finish its processing
+// loop and exit.
+func (h *groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	// NOTE:
+	// Do not move the code below to a goroutine.
+	// The `ConsumeClaim` itself is called within a goroutine, see:
+	// https://github.com/IBM/sarama/blob/main/consumer_group.go#L27-L29
+	pool := newKeyedPool(session, h.workers, func(ctx context.Context, msg *sarama.ConsumerMessage) bool {
+		return h.handler(ctx, toMessage(msg)) == nil
+	})
+	defer pool.Close()
+
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if !pool.Submit(message) {
+				return nil
+			}
+		// Should return when `session.Context()` is done.
+		// If not, will raise `ErrRebalanceInProgress` or `read tcp <ip>:<port>: i/o timeout` when kafka rebalance. see:
+		// https://github.com/IBM/sarama/issues/1192
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+func toMessage(msg *sarama.ConsumerMessage) *bus.Message {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+
+	return &bus.Message{
+		Topic:     msg.Topic,
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   headers,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: msg.Timestamp,
+	}
+}
@@ -0,0 +1,7 @@
+module lifecycle
+
+go 1.24.4
+
+require go.uber.org/zap v1.27.0
+
+require go.uber.org/multierr v1.10.0 // indirect
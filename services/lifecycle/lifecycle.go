@@ -0,0 +1,176 @@
+// Package lifecycle запускает компоненты сервиса и согласованно их останавливает.
+// По SIGINT/SIGTERM или падению любого компонента компоненты останавливаются по очереди в порядке регистрации
+// (сначала HTTP-сервер, затем консьюмеры, затем продюсеры), после них закрываются ресурсы: БД, Redis.
+// На всю остановку дается один дедлайн
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Manager управляет остановкой сервиса
+type Manager struct {
+	timeout time.Duration
+
+	components []*component
+	closers    []closer
+	failed     chan error
+
+	mu      sync.Mutex
+	stopCtx context.Context
+}
+
+type component struct {
+	name   string
+	run    func(ctx context.Context) error
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+type closer struct {
+	name  string
+	close func() error
+}
+
+type managerKey struct{}
+
+// New создает менеджер, timeout - дедлайн на остановку всех компонентов и закрытие ресурсов
+func New(timeout time.Duration) *Manager {
+	return &Manager{
+		timeout: timeout,
+		failed:  make(chan error, 1),
+	}
+}
+
+// Go регистрирует компонент. run работает, пока не отменен его ctx, и после отмены должен
+// закончить текущую работу и вернуть nil. Ошибка run до остановки сервиса запускает остановку
+func (m *Manager) Go(name string, run func(ctx context.Context) error) {
+	m.components = append(m.components, &component{name: name, run: run})
+}
+
+// Server HTTP-сервер, который при остановке дожидается текущих запросов, например *fasthttp.Server
+type Server interface {
+	ListenAndServe(addr string) error
+	ShutdownWithContext(ctx context.Context) error
+}
+
+// Serve регистрирует HTTP-сервер. При остановке сервер перестает принимать соединения
+// и дожидается текущих запросов до дедлайна
+func (m *Manager) Serve(name string, server Server, addr string) {
+	m.Go(name, func(ctx context.Context) error {
+		serveErr := make(chan error, 1)
+		go func() {
+			serveErr <- server.ListenAndServe(addr)
+		}()
+
+		select {
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+		}
+
+		return server.ShutdownWithContext(StopContext(ctx))
+	})
+}
+
+// OnStop регистрирует закрытие ресурса. Ресурсы закрываются в порядке регистрации после остановки компонентов
+func (m *Manager) OnStop(name string, close func() error) {
+	m.closers = append(m.closers, closer{name: name, close: close})
+}
+
+// Run запускает компоненты и блокируется до сигнала или падения компонента, затем останавливает сервис.
+// Возвращает ошибку упавшего компонента
+func (m *Manager) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for _, c := range m.components {
+		m.start(c)
+	}
+
+	var cause error
+	select {
+	case sig := <-signals:
+		zap.L().Info("terminating: via signal", zap.String("signal", sig.String()))
+	case cause = <-m.failed:
+		zap.L().Error("terminating: component failed", zap.Error(cause))
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	m.mu.Lock()
+	m.stopCtx = stopCtx
+	m.mu.Unlock()
+
+	for _, c := range m.components {
+		c.cancel()
+
+		select {
+		case <-c.done:
+			if c.err != nil && c.err != cause {
+				zap.L().Error("component stopped with error", zap.String("component", c.name), zap.Error(c.err))
+			}
+		case <-stopCtx.Done():
+			zap.L().Error("component did not stop before deadline", zap.String("component", c.name))
+		}
+	}
+
+	for _, cl := range m.closers {
+		if err := cl.close(); err != nil {
+			zap.L().Error("failed to close resource", zap.String("resource", cl.name), zap.Error(err))
+		}
+	}
+
+	zap.L().Info("service stopped")
+
+	return cause
+}
+
+func (m *Manager) start(c *component) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), managerKey{}, m))
+	c.cancel = cancel
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+
+		c.err = c.run(ctx)
+		if c.err != nil && ctx.Err() == nil {
+			c.err = fmt.Errorf("%s: %w", c.name, c.err)
+
+			select {
+			case m.failed <- c.err:
+			default:
+			}
+		}
+	}()
+}
+
+// StopContext возвращает контекст с дедлайном остановки сервиса. Компонент берет его после отмены своего ctx,
+// чтобы дописать очереди и закрыть соединения, не выходя за дедлайн. До начала остановки возвращает context.Background()
+func StopContext(ctx context.Context) context.Context {
+	m, ok := ctx.Value(managerKey{}).(*Manager)
+	if !ok {
+		return context.Background()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopCtx == nil {
+		return context.Background()
+	}
+
+	return m.stopCtx
+}
@@ -0,0 +1,253 @@
+// Package money описывает денежные суммы биллинга, заказов и склада: целое число минимальных единиц валюты
+// (копеек) с явной валютой. Арифметика точная, в JSON и в БД сумма пишется десятичным числом, как раньше float64
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Currency код валюты ISO 4217
+type Currency string
+
+// RUB валюта всех сумм системы: в таблицах и API суммы хранятся без кода валюты
+const RUB Currency = "RUB"
+
+// DefaultCurrency валюта сумм, прочитанных из БД и JSON, и нулевого значения Money
+const DefaultCurrency = RUB
+
+// minorUnits минимальных единиц в основной единице валюты, у всех поддерживаемых валют две цифры после точки
+const (
+	minorUnits     = 100
+	fractionDigits = 2
+	// maxIntDigits цифр целой части, больше не помещается в NUMERIC(12, 2) и не переполняет int64 при умножении
+	maxIntDigits = 10
+)
+
+var (
+	ErrInvalidAmount    = errors.New("invalid money amount")
+	ErrCurrencyMismatch = errors.New("money currency mismatch")
+	ErrOverflow         = errors.New("money amount overflow")
+)
+
+// Money сумма в минимальных единицах валюты. Нулевое значение - ноль в DefaultCurrency.
+// Суммы сравниваются через Equal и Cmp, а не ==
+type Money struct {
+	minor    int64
+	currency Currency
+}
+
+// New возвращает сумму minor минимальных единиц валюты currency
+func New(minor int64, currency Currency) Money {
+	return Money{minor: minor, currency: currency}
+}
+
+// FromMinor возвращает сумму minor минимальных единиц DefaultCurrency
+func FromMinor(minor int64) Money {
+	return New(minor, DefaultCurrency)
+}
+
+// Parse разбирает десятичную запись суммы в DefaultCurrency: "12", "-3.5", "0.05".
+// Больше двух цифр после точки - ошибка, суммы не округляются молча
+func Parse(s string) (Money, error) {
+	digits := strings.TrimPrefix(s, "-")
+	negative := len(digits) != len(s)
+
+	intPart, fracPart, hasFrac := strings.Cut(digits, ".")
+	if intPart == "" || len(intPart) > maxIntDigits || (hasFrac && (fracPart == "" || len(fracPart) > fractionDigits)) {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	units, err := strconv.ParseUint(intPart, 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+
+	var cents uint64
+	if hasFrac {
+		if cents, err = strconv.ParseUint(fracPart+strings.Repeat("0", fractionDigits-len(fracPart)), 10, 64); err != nil {
+			return Money{}, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+	}
+
+	minor := int64(units*minorUnits + cents)
+	if negative {
+		minor = -minor
+	}
+
+	return FromMinor(minor), nil
+}
+
+// Minor сумма в минимальных единицах валюты
+func (m Money) Minor() int64 {
+	return m.minor
+}
+
+func (m Money) Currency() Currency {
+	if m.currency == "" {
+		return DefaultCurrency
+	}
+
+	return m.currency
+}
+
+// Add возвращает m + o. Суммы в разных валютах не складываются, это ошибка программы
+func (m Money) Add(o Money) Money {
+	m.mustMatch(o)
+	return New(m.minor+o.minor, m.Currency())
+}
+
+// Sub возвращает m - o
+func (m Money) Sub(o Money) Money {
+	m.mustMatch(o)
+	return New(m.minor-o.minor, m.Currency())
+}
+
+// Mul возвращает сумму за n единиц товара по цене m. Количество приходит от клиента,
+// поэтому сумма, которая не помещается в int64, возвращается ошибкой ErrOverflow, а не переполняется
+func (m Money) Mul(n int64) (Money, error) {
+	product := m.minor * n
+	if (n != 0 && product/n != m.minor) || (n == -1 && m.minor == math.MinInt64) {
+		return Money{}, fmt.Errorf("%w: %s * %d", ErrOverflow, m, n)
+	}
+
+	return New(product, m.Currency()), nil
+}
+
+// Neg возвращает -m
+func (m Money) Neg() Money {
+	return New(-m.minor, m.Currency())
+}
+
+// Cmp возвращает -1, 0 или 1, если m меньше, равна или больше o
+func (m Money) Cmp(o Money) int {
+	m.mustMatch(o)
+
+	switch {
+	case m.minor < o.minor:
+		return -1
+	case m.minor > o.minor:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Equal true, если суммы и валюты совпадают
+func (m Money) Equal(o Money) bool {
+	return m.minor == o.minor && m.Currency() == o.Currency()
+}
+
+func (m Money) IsZero() bool {
+	return m.minor == 0
+}
+
+func (m Money) IsPositive() bool {
+	return m.minor > 0
+}
+
+func (m Money) IsNegative() bool {
+	return m.minor < 0
+}
+
+func (m Money) mustMatch(o Money) {
+	if m.Currency() != o.Currency() {
+		panic(fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency(), o.Currency()))
+	}
+}
+
+// String десятичная запись суммы с двумя цифрами после точки: "12.50"
+func (m Money) String() string {
+	minor := m.minor
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, minor/minorUnits, minor%minorUnits)
+}
+
+// MarshalJSON пишет сумму числом без лишних нулей, как float64: 12.5, 12, 0.05
+func (m Money) MarshalJSON() ([]byte, error) {
+	s := strings.TrimSuffix(strings.TrimRight(m.String(), "0"), ".")
+	if s == "" || s == "-" {
+		s = "0"
+	}
+
+	return []byte(s), nil
+}
+
+// UnmarshalJSON читает сумму из числа, null оставляет сумму без изменений
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+
+	// 1e3 и подобные записи json допускает, приводим их к десятичной
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidAmount, s)
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+
+	return nil
+}
+
+// Scan читает сумму из колонки NUMERIC, NULL читается как ноль
+func (m *Money) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*m = FromMinor(0)
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case int64:
+		*m = FromMinor(v * minorUnits)
+	case float64:
+		*m = FromMinor(int64(math.Round(v * minorUnits)))
+	default:
+		return fmt.Errorf("%w: unsupported type %T", ErrInvalidAmount, src)
+	}
+
+	return nil
+}
+
+// scanString разбирает значение NUMERIC, у вычисленных колонок вроде sum() цифр после точки может быть больше двух
+func (m *Money) scanString(s string) error {
+	if intPart, fracPart, ok := strings.Cut(s, "."); ok && len(fracPart) > fractionDigits {
+		if strings.Trim(fracPart[fractionDigits:], "0") != "" {
+			return fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+		s = intPart + "." + fracPart[:fractionDigits]
+	}
+
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+
+	return nil
+}
+
+// Value пишет сумму в БД десятичной строкой, Postgres приводит ее к NUMERIC без потери точности
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
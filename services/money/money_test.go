@@ -0,0 +1,207 @@
+package money
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "12", want: 1200},
+		{in: "12.5", want: 1250},
+		{in: "0.05", want: 5},
+		{in: "-0.05", want: -5},
+		{in: "-3.5", want: -350},
+		{in: "9999999999.99", want: 999999999999},
+		{in: "1.", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "+1", wantErr: true},
+		{in: "--1", wantErr: true},
+		{in: "-", wantErr: true},
+		{in: "", wantErr: true},
+		{in: "1.-5", wantErr: true},
+		{in: "1.+5", wantErr: true},
+		{in: "1_0", wantErr: true},
+		{in: "10000000000", wantErr: true},
+		{in: "1.005", wantErr: true},
+		{in: "1.000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAmount) {
+					t.Fatalf("Parse(%q) = %v, %v, want ErrInvalidAmount", tt.in, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse(%q): %s", tt.in, err)
+			}
+			if got.Minor() != tt.want || got.Currency() != DefaultCurrency {
+				t.Errorf("Parse(%q) = %d %s, want %d %s", tt.in, got.Minor(), got.Currency(), tt.want, DefaultCurrency)
+			}
+		})
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "12.5", want: 1250},
+		{in: "-0.05", want: -5},
+		{in: "1e3", want: 100000},
+		{in: "1.5E2", want: 15000},
+		{in: "1e-2", want: 1},
+		{in: "1e-5", wantErr: true},
+		{in: "1e400", wantErr: true},
+		{in: "1e10", wantErr: true},
+		{in: `"12.5"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			var m Money
+			err := m.UnmarshalJSON([]byte(tt.in))
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAmount) {
+					t.Fatalf("UnmarshalJSON(%s) = %v, %v, want ErrInvalidAmount", tt.in, m, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("UnmarshalJSON(%s): %s", tt.in, err)
+			}
+			if m.Minor() != tt.want {
+				t.Errorf("UnmarshalJSON(%s) = %d, want %d", tt.in, m.Minor(), tt.want)
+			}
+		})
+	}
+
+	m := FromMinor(42)
+	if err := m.UnmarshalJSON([]byte("null")); err != nil || m.Minor() != 42 {
+		t.Errorf("UnmarshalJSON(null) = %v, %v, want the amount unchanged", m, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     any
+		want    int64
+		wantErr bool
+	}{
+		{name: "numeric", src: []byte("12.50"), want: 1250},
+		{name: "trailing zeros", src: []byte("12.500000"), want: 1250},
+		{name: "sum with trailing zeros", src: "-0.0500", want: -5},
+		{name: "integer numeric", src: "100", want: 10000},
+		{name: "fraction beyond cents", src: "12.345", wantErr: true},
+		{name: "fraction beyond cents after zeros", src: "12.3401", wantErr: true},
+		{name: "null", src: nil, want: 0},
+		{name: "int64", src: int64(7), want: 700},
+		{name: "float64", src: 0.1 + 0.2, want: 30},
+		{name: "unsupported", src: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m Money
+			err := m.Scan(tt.src)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidAmount) {
+					t.Fatalf("Scan(%v) = %v, %v, want ErrInvalidAmount", tt.src, m, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Scan(%v): %s", tt.src, err)
+			}
+			if m.Minor() != tt.want {
+				t.Errorf("Scan(%v) = %d, want %d", tt.src, m.Minor(), tt.want)
+			}
+		})
+	}
+}
+
+// TestMarshalJSON суммы пишутся так же, как их писал float64 до перехода на Money
+func TestMarshalJSON(t *testing.T) {
+	tests := []struct {
+		minor int64
+		want  string
+	}{
+		{minor: 1250, want: "12.5"},
+		{minor: 1200, want: "12"},
+		{minor: 1000, want: "10"},
+		{minor: 10000, want: "100"},
+		{minor: 5, want: "0.05"},
+		{minor: 10, want: "0.1"},
+		{minor: 0, want: "0"},
+		{minor: -350, want: "-3.5"},
+		{minor: -5, want: "-0.05"},
+		{minor: 999999999999, want: "9999999999.99"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := FromMinor(tt.minor).MarshalJSON()
+			if err != nil {
+				t.Fatalf("MarshalJSON(%d): %s", tt.minor, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("MarshalJSON(%d) = %s, want %s", tt.minor, got, tt.want)
+			}
+
+			var back Money
+			if err := back.UnmarshalJSON(got); err != nil || back.Minor() != tt.minor {
+				t.Errorf("UnmarshalJSON(%s) = %d, %v, want %d", got, back.Minor(), err, tt.minor)
+			}
+		})
+	}
+}
+
+func TestMul(t *testing.T) {
+	tests := []struct {
+		name    string
+		minor   int64
+		n       int64
+		want    int64
+		wantErr bool
+	}{
+		{name: "quantity", minor: 1250, n: 3, want: 3750},
+		{name: "zero quantity", minor: 1250, n: 0, want: 0},
+		{name: "zero price", minor: 0, n: math.MaxInt64, want: 0},
+		{name: "negate", minor: 1250, n: -1, want: -1250},
+		{name: "max price", minor: 999999999999, n: 9000000, want: 8999999999991000000},
+		{name: "overflow", minor: 999999999999, n: 10000000, wantErr: true},
+		{name: "overflow to positive", minor: -2, n: math.MinInt64, wantErr: true},
+		{name: "negate min", minor: math.MinInt64, n: -1, wantErr: true},
+		{name: "min by minus one", minor: -1, n: math.MinInt64, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromMinor(tt.minor).Mul(tt.n)
+			if tt.wantErr {
+				if !errors.Is(err, ErrOverflow) {
+					t.Fatalf("%d * %d = %d, %v, want ErrOverflow", tt.minor, tt.n, got.Minor(), err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%d * %d: %s", tt.minor, tt.n, err)
+			}
+			if got.Minor() != tt.want {
+				t.Errorf("%d * %d = %d, want %d", tt.minor, tt.n, got.Minor(), tt.want)
+			}
+		})
+	}
+}
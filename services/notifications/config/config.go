@@ -1,6 +1,7 @@
 package config
 
 import (
+	"kafka"
 	"time"
 )
 
@@ -40,35 +41,43 @@ type KafkaConsumerConfig struct {
 	GroupID string   `toml:"group-id"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Workers число воркеров на партицию, уведомления одного заказа обрабатывает один воркер по порядку
+	Workers int `toml:"workers"`
+	kafka.ClientConfig
 }
 
 func NewKafkaConsumerConfig() *KafkaConsumerConfig {
 	return &KafkaConsumerConfig{
-		Brokers: []string{"kafka:9092"},
-		GroupID: "payments",
-		Topic:   "payments",
+		Brokers:      []string{"kafka:9092"},
+		GroupID:      "payments",
+		Topic:        "payments",
+		Workers:      8,
+		ClientConfig: kafka.ClientConfig{ClientID: "notifications"},
 	}
 }
 
 type Config struct {
-	BasePath       string               `toml:"base-path"`
-	AuthAddr       string               `toml:"auth-addr"`
-	ListenPort     string               `toml:"listen-port"`
-	LogLevel       string               `toml:"log-level"`
-	LogFile        string               `toml:"log-file"`
-	ServerConfig   *ServerConfig        `toml:"server-config"`
-	DBConfig       *DBConfig            `toml:"db-config"`
-	RedisConfig    *RedisConfig         `toml:"redis-config"`
-	ConsumerConfig *KafkaConsumerConfig `toml:"consumer-config"`
+	BasePath   string `toml:"base-path"`
+	AuthAddr   string `toml:"auth-addr"`
+	ListenPort string `toml:"listen-port"`
+	LogLevel   string `toml:"log-level"`
+	LogFile    string `toml:"log-file"`
+	// ShutdownTimeout дедлайн остановки: за это время сервис дорабатывает запросы и сообщения, дописывает очереди и закрывает соединения
+	ShutdownTimeout time.Duration        `toml:"shutdown-timeout"`
+	ServerConfig    *ServerConfig        `toml:"server-config"`
+	DBConfig        *DBConfig            `toml:"db-config"`
+	RedisConfig     *RedisConfig         `toml:"redis-config"`
+	ConsumerConfig  *KafkaConsumerConfig `toml:"consumer-config"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BasePath:   "notifications",
-		AuthAddr:   "arch.homework/auth",
-		ListenPort: "8000",
-		LogLevel:   "info",
-		LogFile:    "stdout",
+		BasePath:        "notifications",
+		AuthAddr:        "arch.homework/auth",
+		ListenPort:      "8000",
+		LogLevel:        "info",
+		LogFile:         "stdout",
+		ShutdownTimeout: 25 * time.Second,
 		DBConfig: &DBConfig{
 			Port: 5432,
 		},
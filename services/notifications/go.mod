@@ -31,6 +31,9 @@ require (
 	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.2.0 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/crypto v0.42.0 // indirect
 	golang.org/x/mod v0.27.0 // indirect
@@ -43,7 +46,7 @@ require (
 
 require (
 	github.com/BurntSushi/toml v1.5.0
-	github.com/IBM/sarama v1.46.1
+	github.com/IBM/sarama v1.46.1 // indirect
 	github.com/golang-jwt/jwt/v5 v5.3.0
 	github.com/lib/pq v1.10.9
 	github.com/redis/go-redis/v9 v9.14.0
@@ -51,3 +54,17 @@ require (
 	github.com/valyala/fasthttp v1.66.0
 	go.uber.org/zap v1.27.0
 )
+
+require (
+	bus v0.0.0
+	kafka v0.0.0
+	lifecycle v0.0.0
+	saga v0.0.0
+)
+
+replace (
+	bus => ../bus
+	kafka => ../kafka
+	lifecycle => ../lifecycle
+	saga => ../saga
+)
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"lifecycle"
 	"log"
 	"notifications/config"
 	"notifications/db"
@@ -42,11 +43,16 @@ func main() {
 
 	redis.Init(config.RedisConfig)
 
-	go func() {
-		service.NewNotificationsProcessor(config).Run()
-	}()
+	notificationsProcessor := service.NewNotificationsProcessor(config, service.NewKafkaSubscriber(config.ConsumerConfig))
 
-	server := service.NewServer(config)
+	// компоненты останавливаются в порядке регистрации: HTTP-сервер, консьюмер, затем закрываются БД и Redis
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config), ":"+config.ListenPort)
+	lc.Go("notifications processor", notificationsProcessor.Run)
+	lc.OnStop("database", db.Close)
+	lc.OnStop("redis", redis.Close)
 
-	log.Fatalf("serve: %s", server.ListenAndServe(":"+config.ListenPort))
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
 }
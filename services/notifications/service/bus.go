@@ -0,0 +1,24 @@
+package service
+
+import (
+	"bus"
+	"kafka"
+	"notifications/config"
+
+	"go.uber.org/zap"
+)
+
+// NewKafkaSubscriber подписчик на кафку по настройкам консьюмера, процессоры зависят только от bus.Subscriber
+func NewKafkaSubscriber(cfg *config.KafkaConsumerConfig) bus.Subscriber {
+	saramaConfig, err := kafka.NewConfig(cfg.Version, &cfg.ClientConfig)
+	if err != nil {
+		zap.L().Fatal("failed to build kafka config", zap.Error(err))
+	}
+
+	subscriber, err := kafka.NewSubscriber(cfg.Brokers, cfg.GroupID, saramaConfig, cfg.Workers)
+	if err != nil {
+		zap.L().Fatal("failed to start consumer", zap.Error(err))
+	}
+
+	return subscriber
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"kafka"
 	"time"
 )
 
@@ -40,13 +41,18 @@ type KafkaConsumerConfig struct {
 	GroupID string   `toml:"group-id"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Workers число воркеров на партицию, сообщения одного заказа обрабатывает один воркер по порядку
+	Workers int `toml:"workers"`
+	kafka.ClientConfig
 }
 
 func NewKafkaConsumerConfig() *KafkaConsumerConfig {
 	return &KafkaConsumerConfig{
-		Brokers: []string{"kafka:9092"},
-		GroupID: "payments",
-		Topic:   "payments",
+		Brokers:      []string{"kafka:9092"},
+		GroupID:      "payments",
+		Topic:        "payments",
+		Workers:      8,
+		ClientConfig: kafka.ClientConfig{ClientID: "order"},
 	}
 }
 
@@ -54,21 +60,101 @@ type KafkaProducerConfig struct {
 	Brokers []string `toml:"brokers"`
 	Topic   string   `toml:"topic"`
 	Version string   `toml:"version"`
+	// Retries сколько раз повторить отправку сообщений, которые брокер не подтвердил, с паузой RetryDelay
+	Retries    int           `toml:"retries"`
+	RetryDelay time.Duration `toml:"retry-delay"`
+	// QueueTimeout сколько AddMessage ждет места в заполненной очереди процессора, после этого сообщение отбрасывается
+	QueueTimeout time.Duration `toml:"queue-timeout"`
+	kafka.ClientConfig
 }
 
 func NewKafkaProducerConfig() *KafkaProducerConfig {
 	return &KafkaProducerConfig{
-		Brokers: []string{"kafka:9092"},
-		Topic:   "payments_status",
+		Brokers:      []string{"kafka:9092"},
+		Topic:        "payments_status",
+		Retries:      3,
+		RetryDelay:   500 * time.Millisecond,
+		QueueTimeout: 5 * time.Second,
+		ClientConfig: kafka.ClientConfig{ClientID: "order"},
+	}
+}
+
+type OutboxConfig struct {
+	ProducerConfig *KafkaProducerConfig `toml:"producer-config"`
+	PollInterval   time.Duration        `toml:"poll-interval"`
+	BatchSize      int                  `toml:"batch-size"`
+}
+
+func NewOutboxConfig() *OutboxConfig {
+	return &OutboxConfig{
+		ProducerConfig: NewKafkaProducerConfig(),
+		PollInterval:   500 * time.Millisecond,
+		BatchSize:      100,
+	}
+}
+
+// WatchdogConfig таймауты ожидания ответа на каждом шаге саги заказа
+type WatchdogConfig struct {
+	CheckInterval      time.Duration `toml:"check-interval"`
+	CreatedTimeout     time.Duration `toml:"created-timeout"`
+	StockTimeout       time.Duration `toml:"stock-timeout"`
+	PaymentTimeout     time.Duration `toml:"payment-timeout"`
+	CourReserveTimeout time.Duration `toml:"cour-reserve-timeout"`
+	CaptureTimeout     time.Duration `toml:"capture-timeout"`
+	RevertTimeout      time.Duration `toml:"revert-timeout"`
+}
+
+func NewWatchdogConfig() *WatchdogConfig {
+	return &WatchdogConfig{
+		CheckInterval:      10 * time.Second,
+		CreatedTimeout:     time.Minute,
+		StockTimeout:       5 * time.Minute,
+		PaymentTimeout:     5 * time.Minute,
+		CourReserveTimeout: 5 * time.Minute,
+		CaptureTimeout:     5 * time.Minute,
+		RevertTimeout:      5 * time.Minute,
+	}
+}
+
+// QuoteConfig ключ подписи и время жизни токена расчета заказа
+type QuoteConfig struct {
+	SecretFile string        `toml:"secret-file"`
+	TTL        time.Duration `toml:"ttl"`
+}
+
+func NewQuoteConfig() *QuoteConfig {
+	return &QuoteConfig{
+		SecretFile: "/secret/quote/key",
+		TTL:        5 * time.Minute,
+	}
+}
+
+// DeadLetterConfig сообщения, которые не удалось обработать, попадают в топик <topic><topic-suffix>
+type DeadLetterConfig struct {
+	Brokers     []string `toml:"brokers"`
+	Version     string   `toml:"version"`
+	TopicSuffix string   `toml:"topic-suffix"`
+	Service     string   `toml:"service"`
+	kafka.ClientConfig
+}
+
+func NewDeadLetterConfig() *DeadLetterConfig {
+	return &DeadLetterConfig{
+		Brokers:      []string{"kafka:9092"},
+		TopicSuffix:  ".dlq",
+		Service:      "order",
+		ClientConfig: kafka.ClientConfig{ClientID: "order"},
 	}
 }
 
 type Config struct {
-	BasePath                    string               `toml:"base-path"`
-	AuthAddr                    string               `toml:"auth-addr"`
-	ListenPort                  string               `toml:"listen-port"`
-	LogLevel                    string               `toml:"log-level"`
-	LogFile                     string               `toml:"log-file"`
+	BasePath   string `toml:"base-path"`
+	AuthAddr   string `toml:"auth-addr"`
+	ListenPort string `toml:"listen-port"`
+	LogLevel   string `toml:"log-level"`
+	LogFile    string `toml:"log-file"`
+	// ShutdownTimeout дедлайн остановки: за это время сервис дорабатывает запросы и сообщения, дописывает очереди и закрывает соединения
+	ShutdownTimeout             time.Duration        `toml:"shutdown-timeout"`
 	ServerConfig                *ServerConfig        `toml:"server-config"`
 	DBConfig                    *DBConfig            `toml:"db-config"`
 	RedisConfig                 *RedisConfig         `toml:"redis-config"`
@@ -80,15 +166,20 @@ type Config struct {
 	CourReserveConsumerConfig   *KafkaConsumerConfig `toml:"cour-reserve-consumer-config"`
 	CourReserveProducerConfig   *KafkaProducerConfig `toml:"cour-reserve-producer-config"`
 	CourReserveRetryCount       int                  `toml:"cour-reserve-retry-count"`
+	OutboxConfig                *OutboxConfig        `toml:"outbox-config"`
+	WatchdogConfig              *WatchdogConfig      `toml:"watchdog-config"`
+	QuoteConfig                 *QuoteConfig         `toml:"quote-config"`
+	DeadLetterConfig            *DeadLetterConfig    `toml:"dead-letter-config"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		BasePath:   "users",
-		AuthAddr:   "arch.homework",
-		ListenPort: "8000",
-		LogLevel:   "info",
-		LogFile:    "stdout",
+		BasePath:        "users",
+		AuthAddr:        "arch.homework",
+		ListenPort:      "8000",
+		LogLevel:        "info",
+		LogFile:         "stdout",
+		ShutdownTimeout: 25 * time.Second,
 		DBConfig: &DBConfig{
 			Port: 5432,
 		},
@@ -105,5 +196,9 @@ func NewConfig() *Config {
 		CourReserveConsumerConfig: NewKafkaConsumerConfig(),
 		CourReserveProducerConfig: NewKafkaProducerConfig(),
 		CourReserveRetryCount:     3,
+		OutboxConfig:              NewOutboxConfig(),
+		WatchdogConfig:            NewWatchdogConfig(),
+		QuoteConfig:               NewQuoteConfig(),
+		DeadLetterConfig:          NewDeadLetterConfig(),
 	}
 }
@@ -2,51 +2,61 @@ package db
 
 import "fmt"
 
-func CreateCourReserve(orderID int64) (int64, error) {
-	var mask int64
-	if err := GetConn().QueryRow(`select hour_mask from orders where id = $1`, orderID).Scan(&mask); err != nil {
-		return 0, fmt.Errorf("get order hour_mask: %w", err)
+// CreateCourReserve резервирует курьера, свободного в окно доставки заказа.
+// Курьеры, резерв которых по этому заказу уже не удался, пропускаются
+func CreateCourReserve(q querier, orderID int64) (int64, error) {
+	var (
+		workDate string
+		mask     int64
+	)
+	if err := q.QueryRow(`select work_date, hour_mask from orders where id = $1`, orderID).Scan(&workDate, &mask); err != nil {
+		return 0, fmt.Errorf("get order delivery window: %w", err)
 	}
 
 	var courID int64
-	if err := GetConn().QueryRow(`select courier_id from courier_schedule where hour_mask & $1 = 0 limit 1`, mask).Scan(&courID); err != nil {
+	if err := q.QueryRow(
+		`select courier_id from courier_schedule s where work_date = $1 and hour_mask & $2 = 0
+		and not exists(select 1 from courier_reservation r
+			where r.order_id = $3 and r.courier_id = s.courier_id and r.action = 'reserve' and r.status = 'failed')
+		order by courier_id limit 1`, workDate, mask, orderID).Scan(&courID); err != nil {
 		return 0, fmt.Errorf("get free courier: %w", err)
 	}
 
 	var courReserveID int64
-	if err := GetConn().QueryRow(
-		`insert into courier_reservation(order_id, courier_id, action, hour_mask) values($1, $2, 'reserve', $3) returning id`,
-		orderID, courID, mask).Scan(&courReserveID); err != nil {
+	if err := q.QueryRow(
+		`insert into courier_reservation(order_id, courier_id, action, work_date, hour_mask) values($1, $2, 'reserve', $3, $4) returning id`,
+		orderID, courID, workDate, mask).Scan(&courReserveID); err != nil {
 		return 0, fmt.Errorf("create cour_reserve: %w", err)
 	}
 
 	return courReserveID, nil
 }
 
-func buildRevertCourReserve(courReserveID int64) (int64, int64, int64, error) {
+func buildRevertCourReserve(q querier, courReserveID int64) (int64, int64, string, int64, error) {
 	var (
 		orderID, courID int64
+		workDate        string
 		mask            int64
 	)
 
-	if err := GetConn().QueryRow(`select order_id, courier_id, hour_mask from courier_reservation where id = $1 and action = 'reserve'`, courReserveID).
-		Scan(&orderID, &courID, &mask); err != nil {
-		return 0, 0, 0, err
+	if err := q.QueryRow(`select order_id, courier_id, work_date, hour_mask from courier_reservation where id = $1 and action = 'reserve'`, courReserveID).
+		Scan(&orderID, &courID, &workDate, &mask); err != nil {
+		return 0, 0, "", 0, err
 	}
 
-	return orderID, courID, mask, nil
+	return orderID, courID, workDate, mask, nil
 }
 
-func RevertCourReserve(courReserveID int64) (int64, error) {
-	orderID, courID, mask, err := buildRevertCourReserve(courReserveID)
+func RevertCourReserve(q querier, courReserveID int64) (int64, error) {
+	orderID, courID, workDate, mask, err := buildRevertCourReserve(q, courReserveID)
 	if err != nil {
 		return 0, fmt.Errorf("build revert cour_reserve: %w", err)
 	}
 
 	var newID int64
-	if err := GetConn().QueryRow(
-		`insert into courier_reservation(order_id, courier_id, hour_mask, action) values ($1, $2, $3, 'revert_reserve') returning id`,
-		orderID, courID, mask).
+	if err := q.QueryRow(
+		`insert into courier_reservation(order_id, courier_id, work_date, hour_mask, action) values ($1, $2, $3, $4, 'revert_reserve') returning id`,
+		orderID, courID, workDate, mask).
 		Scan(&newID); err != nil {
 		return 0, err
 	}
@@ -16,6 +16,13 @@ var (
 	conn   *sql.DB
 )
 
+// querier общий интерфейс *sql.DB и *sql.Tx
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 func getConnStr(config *config.DBConfig) string {
 	return "host=" + config.Host +
 		" port=" + strconv.Itoa(config.Port) +
@@ -35,9 +42,14 @@ func getPassword() string {
 }
 
 func Init(config *config.DBConfig) error {
+	return Open(getConnStr(config))
+}
+
+// Open подключается к базе по строке подключения, так к тестовой базе подключаются тесты
+func Open(connStr string) error {
 	var err error
 	onceDB.Do(func() {
-		conn, err = sql.Open("postgres", getConnStr(config))
+		conn, err = sql.Open("postgres", connStr)
 		if err != nil {
 			return
 		}
@@ -51,3 +63,8 @@ func Init(config *config.DBConfig) error {
 func GetConn() *sql.DB {
 	return conn
 }
+
+// Close закрывает пул соединений, вызывается при остановке сервиса
+func Close() error {
+	return conn.Close()
+}
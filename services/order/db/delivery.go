@@ -0,0 +1,108 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"order/types"
+	"time"
+)
+
+var (
+	ErrBadDeliveryWindow = errors.New("bad delivery window")
+	ErrNoFreeCourier     = errors.New("no free courier for delivery window")
+)
+
+// часы, в которые работает доставка
+const (
+	deliveryFirstHour = 9
+	deliveryLastHour  = 21
+)
+
+// DeliveryWindow окно доставки в том виде, в котором оно хранится в orders и courier_schedule
+type DeliveryWindow struct {
+	WorkDate string
+	HourMask int64
+}
+
+// NewDeliveryWindow проверяет запрошенное клиентом окно и переводит часы в битовую маску.
+// Без окна возвращает nil, заказ получит ближайший свободный час доставки
+func NewDeliveryWindow(window *types.DeliveryWindow) (*DeliveryWindow, error) {
+	if window == nil {
+		return nil, nil
+	}
+
+	workDate, err := time.Parse(time.DateOnly, window.Date)
+	if err != nil {
+		return nil, fmt.Errorf("%w: date must be YYYY-MM-DD", ErrBadDeliveryWindow)
+	}
+
+	today, _ := time.Parse(time.DateOnly, time.Now().Format(time.DateOnly))
+	if workDate.Before(today) {
+		return nil, fmt.Errorf("%w: date is in the past", ErrBadDeliveryWindow)
+	}
+
+	if window.FromHour < deliveryFirstHour || window.ToHour > deliveryLastHour || window.FromHour >= window.ToHour {
+		return nil, fmt.Errorf("%w: hours must be within %d-%d and from_hour less than to_hour",
+			ErrBadDeliveryWindow, deliveryFirstHour, deliveryLastHour)
+	}
+
+	var mask int64
+	for hour := window.FromHour; hour < window.ToHour; hour++ {
+		mask |= 1 << hour
+	}
+
+	return &DeliveryWindow{WorkDate: window.Date, HourMask: mask}, nil
+}
+
+// toDeliveryWindow переводит сохраненную маску часов обратно в окно доставки
+func toDeliveryWindow(workDate time.Time, mask int64) *types.DeliveryWindow {
+	if mask == 0 {
+		return nil
+	}
+
+	return &types.DeliveryWindow{
+		Date:     workDate.Format(time.DateOnly),
+		FromHour: bits.TrailingZeros64(uint64(mask)),
+		ToHour:   64 - bits.LeadingZeros64(uint64(mask)),
+	}
+}
+
+// checkDeliveryWindow проверяет, что на окно есть свободный курьер
+func checkDeliveryWindow(q querier, window *DeliveryWindow) error {
+	var exists bool
+	if err := q.QueryRow(
+		`select exists(select 1 from courier_schedule where work_date = $1 and hour_mask & $2 = 0)`,
+		window.WorkDate, window.HourMask).Scan(&exists); err != nil {
+		return fmt.Errorf("check courier schedule: %w", err)
+	}
+
+	if !exists {
+		return ErrNoFreeCourier
+	}
+
+	return nil
+}
+
+// nextDeliveryWindow ближайший час доставки, на который есть свободный курьер. Сегодня берутся только часы,
+// которые еще не начались
+func nextDeliveryWindow(q querier) (*DeliveryWindow, error) {
+	slots, err := getDeliverySlots(q)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	today := now.Format(time.DateOnly)
+	for _, slot := range slots {
+		for _, hour := range slot.Hours {
+			if slot.Date == today && hour <= now.Hour() {
+				continue
+			}
+
+			return &DeliveryWindow{WorkDate: slot.Date, HourMask: 1 << hour}, nil
+		}
+	}
+
+	return nil, ErrNoFreeCourier
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"order/types"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrIdempotencyKeyConflict   = errors.New("idempotency key is already used with a different request")
+	ErrIdempotencyKeyInProgress = errors.New("request with this idempotency key is still in progress")
+)
+
+// CreateOrderIdempotent создает заказ не более одного раза на пару (user_id, idempotency_key).
+// При повторе с тем же телом возвращает сохраненный ответ и replayed = true.
+func CreateOrderIdempotent(userID int64, window *DeliveryWindow, order *types.Order, key, requestHash string) ([]byte, bool, error) {
+	tx, err := GetConn().BeginTx(context.Background(), nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("begin tx for order: %w", err)
+	}
+	defer tx.Rollback()
+
+	// конкурентный запрос с тем же ключом будет ждать на уникальном индексе до коммита первого
+	res, err := tx.Exec(
+		`insert into order_idempotency_keys(user_id, idempotency_key, request_hash) values ($1, $2, $3) on conflict do nothing`,
+		userID, key, requestHash)
+	if err != nil {
+		return nil, false, fmt.Errorf("insert idempotency key: %w", err)
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, fmt.Errorf("insert idempotency key: %w", err)
+	}
+
+	if inserted == 0 {
+		response, err := getIdempotentResponse(tx, userID, key, requestHash)
+		if err != nil {
+			return nil, false, err
+		}
+
+		zap.L().Info("order create replayed", zap.Int64("user_id", userID), zap.String("idempotency_key", key))
+
+		return response, true, nil
+	}
+
+	orderID, err := createOrder(tx, userID, window, order)
+	if err != nil {
+		return nil, false, err
+	}
+
+	response, err := json.Marshal(types.CreateOrderResponse{ID: orderID})
+	if err != nil {
+		return nil, false, fmt.Errorf("pack response: %w", err)
+	}
+
+	if _, err := tx.Exec(
+		`update order_idempotency_keys set order_id = $1, response = $2 where user_id = $3 and idempotency_key = $4`,
+		orderID, string(response), userID, key); err != nil {
+		return nil, false, fmt.Errorf("save idempotent response: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, fmt.Errorf("commit tx: %w", err)
+	}
+
+	order.ID = orderID
+
+	zap.L().Sugar().Infof("order %d created", orderID)
+
+	return response, false, nil
+}
+
+// GetIdempotentResponse возвращает сохраненный ответ на запрос с ключом key, found = false, если ключ еще не встречался.
+// Повтор отвечается до проверок расчета и окна доставки, которые к моменту повтора могли устареть
+func GetIdempotentResponse(userID int64, key, requestHash string) ([]byte, bool, error) {
+	response, err := getIdempotentResponse(GetConn(), userID, key, requestHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return response, true, nil
+}
+
+func getIdempotentResponse(q querier, userID int64, key, requestHash string) ([]byte, error) {
+	var (
+		storedHash string
+		response   sql.NullString
+	)
+
+	if err := q.QueryRow(
+		`select request_hash, response from order_idempotency_keys where user_id = $1 and idempotency_key = $2`, userID, key).
+		Scan(&storedHash, &response); err != nil {
+		return nil, fmt.Errorf("get idempotency key: %w", err)
+	}
+
+	if storedHash != requestHash {
+		return nil, ErrIdempotencyKeyConflict
+	}
+
+	if !response.Valid {
+		return nil, ErrIdempotencyKeyInProgress
+	}
+
+	return []byte(response.String), nil
+}
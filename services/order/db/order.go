@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"money"
 	"order/types"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"go.uber.org/zap"
 )
 
@@ -22,14 +25,48 @@ func GetUserByOrderID(orderID int64) (int64, error) {
 	return userID, nil
 }
 
-func GetOrders(userID int64) ([]types.Order, error) {
-	rows, err := GetConn().Query(`select id, items, status, start_time, end_time, error, ctime, mtime from orders where user_id = $1`, userID)
+// GetOrders возвращает страницу заказов пользователя. Пагинация по ключу (ctime, id),
+// поэтому запрос идет по индексу orders_user_ctime_idx без offset
+func GetOrders(userID int64, filter *types.OrdersFilter) ([]types.Order, error) {
+	where := []string{"user_id = $1"}
+	args := []any{userID}
+	addArg := func(arg any) string {
+		args = append(args, arg)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if len(filter.Statuses) > 0 {
+		where = append(where, "status = any("+addArg(pq.Array(filter.Statuses))+")")
+	}
+
+	if !filter.From.IsZero() {
+		where = append(where, "ctime >= "+addArg(filter.From))
+	}
+
+	if !filter.To.IsZero() {
+		where = append(where, "ctime < "+addArg(filter.To))
+	}
+
+	direction, cmp := "asc", ">"
+	if filter.Desc {
+		direction, cmp = "desc", "<"
+	}
+
+	if filter.After != nil {
+		where = append(where, fmt.Sprintf("(ctime, id) %s (%s, %s)", cmp, addArg(filter.After.CTime), addArg(filter.After.ID)))
+	}
+
+	query := fmt.Sprintf(
+		`select id, items, status, start_time, end_time, error, subtotal, total, work_date, hour_mask, ctime, mtime from orders where %s order by ctime %s, id %s limit %s`,
+		strings.Join(where, " and "), direction, direction, addArg(filter.Limit))
+
+	rows, err := GetConn().Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	orders := make([]types.Order, 0)
+	orders := make([]types.Order, 0, filter.Limit)
 	for rows.Next() {
 		var (
 			id            int64
@@ -37,10 +74,14 @@ func GetOrders(userID int64) ([]types.Order, error) {
 			startTime     time.Time
 			endTime       sql.NullTime
 			Error         string
+			subtotal      money.Money
+			total         money.Money
+			workDate      time.Time
+			mask          int64
 			ctime, mtime  time.Time
 		)
 
-		if err := rows.Scan(&id, &items, &status, &startTime, &endTime, &Error, &ctime, &mtime); err != nil {
+		if err := rows.Scan(&id, &items, &status, &startTime, &endTime, &Error, &subtotal, &total, &workDate, &mask, &ctime, &mtime); err != nil {
 			return nil, err
 		}
 
@@ -49,13 +90,15 @@ func GetOrders(userID int64) ([]types.Order, error) {
 			Status:    status,
 			StartTime: startTime.Format(time.DateTime),
 			Error:     Error,
+			Subtotal:  subtotal,
+			Total:     total,
+			Delivery:  toDeliveryWindow(workDate, mask),
 			CTime:     ctime,
 			MTime:     mtime,
 		}
 
 		if err := json.Unmarshal([]byte(items), &order.Items); err != nil {
-			zap.L().Error("failed to unpack items", zap.Error(err), zap.String("data", items))
-			continue
+			return nil, fmt.Errorf("unpack items of order %d: %w", id, err)
 		}
 
 		endTimeStr := "-"
@@ -75,7 +118,22 @@ func GetOrders(userID int64) ([]types.Order, error) {
 	return orders, nil
 }
 
-func CreateOrder(userID, mask int64, order *types.Order) (int64, error) {
+func CreateOrder(userID int64, window *DeliveryWindow, order *types.Order) (int64, error) {
+	var orderID int64
+	if err := InTx(func(tx *sql.Tx) error {
+		var err error
+		orderID, err = createOrder(tx, userID, window, order)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	zap.L().Sugar().Infof("order %d created", orderID)
+
+	return orderID, nil
+}
+
+func createOrder(q querier, userID int64, window *DeliveryWindow, order *types.Order) (int64, error) {
 	if len(order.Items) == 0 {
 		return 0, ErrEmptyOrder
 	}
@@ -85,23 +143,203 @@ func CreateOrder(userID, mask int64, order *types.Order) (int64, error) {
 			return 0, fmt.Errorf("validate item: %w", err)
 		}
 	}
+
+	// клиенты, которые не выбирают окно доставки, получают ближайшее свободное
+	if window == nil {
+		var err error
+		if window, err = nextDeliveryWindow(q); err != nil {
+			return 0, err
+		}
+
+		workDate, _ := time.Parse(time.DateOnly, window.WorkDate)
+		order.Delivery = toDeliveryWindow(workDate, window.HourMask)
+	} else if err := checkDeliveryWindow(q, window); err != nil {
+		return 0, err
+	}
+
+	// фиксируем цены на момент заказа, дальнейшие изменения цен на заказ не влияют
+	subtotal, err := snapshotItemPrices(q, order.Items)
+	if err != nil {
+		return 0, err
+	}
+
+	// доставка и скидки пока не учитываются, итог равен сумме позиций
+	order.Subtotal = subtotal
+	order.Total = subtotal
+
 	packedItems, err := json.Marshal(order.Items)
 	if err != nil {
 		return 0, fmt.Errorf("failed to pack items: %w", err)
 	}
 
 	var orderID int64
-	if err := GetConn().QueryRow(
-		`insert into orders(user_id, items, hour_mask) values($1, $2, $3) returning id`, userID, string(packedItems), mask).
+	if err := q.QueryRow(
+		`insert into orders(user_id, items, work_date, hour_mask, subtotal, total) values($1, $2, $3, $4, $5, $6) returning id`,
+		userID, string(packedItems), window.WorkDate, window.HourMask, order.Subtotal, order.Total).
 		Scan(&orderID); err != nil {
 		return 0, fmt.Errorf("failed to create order: %w", err)
 	}
 
-	zap.L().Sugar().Infof("order %d created", orderID)
+	if err := createSaga(q, orderID); err != nil {
+		return 0, err
+	}
 
 	return orderID, nil
 }
 
+func GetOrderItems(orderID int64) ([]types.Item, error) {
+	var items string
+	if err := GetConn().QueryRow(`select items from orders where id = $1`, orderID).Scan(&items); err != nil {
+		return nil, fmt.Errorf("get order items: %w", err)
+	}
+
+	var orderItems []types.Item
+	if err := json.Unmarshal([]byte(items), &orderItems); err != nil {
+		return nil, fmt.Errorf("unpack order items: %w", err)
+	}
+
+	return orderItems, nil
+}
+
+// GetOrder возвращает заказ с зафиксированными ценами позиций и хронологией всех строк участников саги
+func GetOrder(orderID int64) (*types.OrderDetails, error) {
+	var (
+		items, status string
+		startTime     time.Time
+		endTime       sql.NullTime
+		workDate      time.Time
+		mask          int64
+		order         types.OrderDetails
+	)
+
+	if err := GetConn().QueryRow(
+		`select user_id, items, status, start_time, end_time, error, subtotal, total, work_date, hour_mask, ctime, mtime
+		from orders where id = $1`, orderID).
+		Scan(&order.UserID, &items, &status, &startTime, &endTime, &order.Error, &order.Subtotal, &order.Total,
+			&workDate, &mask, &order.CTime, &order.MTime); err != nil {
+		return nil, fmt.Errorf("get order: %w", err)
+	}
+
+	order.Delivery = toDeliveryWindow(workDate, mask)
+
+	order.ID = orderID
+	order.Status = status
+	order.StartTime = startTime.Format(time.DateTime)
+	order.EndTime = "-"
+	if endTime.Valid {
+		order.EndTime = endTime.Time.Format(time.DateTime)
+	}
+
+	if err := json.Unmarshal([]byte(items), &order.Items); err != nil {
+		return nil, fmt.Errorf("unpack order items: %w", err)
+	}
+
+	timeline, err := getOrderTimeline(orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	order.Timeline = timeline
+
+	return &order, nil
+}
+
+// snapshotItemPrices проставляет позициям текущие цены товаров и возвращает сумму заказа,
+// проставленные заранее цены считаются ценами из расчета заказа и сверяются с текущими
+func snapshotItemPrices(q querier, items []types.Item) (money.Money, error) {
+	itemIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.Id)
+	}
+
+	rows, err := q.Query(`select id, price from items where id = any($1)`, pq.Array(itemIDs))
+	if err != nil {
+		return money.Money{}, fmt.Errorf("get item prices: %w", err)
+	}
+	defer rows.Close()
+
+	prices := make(map[int64]money.Money, len(items))
+	for rows.Next() {
+		var (
+			id    int64
+			price money.Money
+		)
+		if err := rows.Scan(&id, &price); err != nil {
+			return money.Money{}, fmt.Errorf("scan item price: %w", err)
+		}
+
+		prices[id] = price
+	}
+
+	if err := rows.Err(); err != nil {
+		return money.Money{}, fmt.Errorf("read item prices: %w", err)
+	}
+
+	var subtotal money.Money
+	for i := range items {
+		price, ok := prices[items[i].Id]
+		if !ok {
+			return money.Money{}, fmt.Errorf("item %d not exists", items[i].Id)
+		}
+
+		// цена из расчета заказа должна совпадать с текущей
+		if !items[i].Price.IsZero() && !items[i].Price.Equal(price) {
+			return money.Money{}, fmt.Errorf("%w: item %d, quoted %v, current %v", ErrPriceChanged, items[i].Id, items[i].Price, price)
+		}
+
+		items[i].Price = price
+		amount, err := price.Mul(items[i].Quantity)
+		if err != nil {
+			return money.Money{}, fmt.Errorf("item %d: %w", items[i].Id, err)
+		}
+		subtotal = subtotal.Add(amount)
+	}
+
+	return subtotal, nil
+}
+
+func getOrderTimeline(orderID int64) ([]types.TimelineEvent, error) {
+	rows, err := GetConn().Query(
+		`select 'stock_change', id, action, status, error, stock_id, quantity, null::numeric, null::bigint, ctime, mtime
+			from stock_changes where order_id = $1
+		union all
+		select 'payment', id, action, status, error, null::bigint, null::bigint, amount, null::bigint, ctime, mtime
+			from payments where order_id = $1
+		union all
+		select 'courier_reservation', id, action, status, error, null::bigint, null::bigint, null::numeric, courier_id, ctime, mtime
+			from courier_reservation where order_id = $1
+		order by 10, 2`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("get order timeline: %w", err)
+	}
+	defer rows.Close()
+
+	timeline := make([]types.TimelineEvent, 0)
+	for rows.Next() {
+		var (
+			event                        types.TimelineEvent
+			stockID, quantity, courierID sql.NullInt64
+		)
+
+		if err := rows.Scan(&event.Source, &event.ID, &event.Action, &event.Status, &event.Error,
+			&stockID, &quantity, &event.Amount, &courierID, &event.CTime, &event.MTime); err != nil {
+			return nil, fmt.Errorf("scan order timeline: %w", err)
+		}
+
+		event.StockID = stockID.Int64
+		event.Quantity = quantity.Int64
+		event.CourierID = courierID.Int64
+
+		timeline = append(timeline, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read order timeline: %w", err)
+	}
+
+	return timeline, nil
+}
+
 func validateItem(item *types.Item) error {
 	if item.Quantity < 1 {
 		return fmt.Errorf("item %d quantity is non-positive", item.Id)
@@ -115,8 +353,22 @@ func validateItem(item *types.Item) error {
 	return nil
 }
 
-func ApproveOrder(orderID int64) error {
-	if _, err := GetConn().Exec(`update orders set status = 'approved' where id = $1`, orderID); err != nil {
+// LockOrder блокирует заказ до конца транзакции и возвращает его владельца и статус
+func LockOrder(tx *sql.Tx, orderID int64) (int64, string, error) {
+	var (
+		userID int64
+		status string
+	)
+
+	if err := tx.QueryRow(`select user_id, status from orders where id = $1 for update`, orderID).Scan(&userID, &status); err != nil {
+		return 0, "", fmt.Errorf("lock order: %w", err)
+	}
+
+	return userID, status, nil
+}
+
+func ApproveOrder(q querier, orderID int64) error {
+	if _, err := q.Exec(`update orders set status = 'approved' where id = $1`, orderID); err != nil {
 		return fmt.Errorf("approve order: %w", err)
 	}
 
@@ -125,18 +377,32 @@ func ApproveOrder(orderID int64) error {
 	return nil
 }
 
-func RejectOrder(orderID int64) {
-	if _, err := GetConn().Exec(`update orders set status = 'canceled' where id = $1`, orderID); err != nil {
-		zap.L().Sugar().Errorf("failed to reject order %d: %w", orderID, err)
-		return
+func RejectOrder(q querier, orderID int64) error {
+	if _, err := q.Exec(`update orders set status = 'canceled' where id = $1`, orderID); err != nil {
+		return fmt.Errorf("reject order: %w", err)
 	}
+
 	zap.L().Sugar().Infof("order %d rejected", orderID)
+
+	return nil
 }
 
-func OrderSetStatus(orderID int64, status string) {
-	if _, err := GetConn().Exec(`update orders set status = $1 where id = $2`, status, orderID); err != nil {
-		zap.L().Sugar().Errorf("failed to set status '%s'for order %d: %w", status, orderID, err)
-		return
+func OrderSetStatus(q querier, orderID int64, status string) error {
+	if _, err := q.Exec(`update orders set status = $1 where id = $2`, status, orderID); err != nil {
+		return fmt.Errorf("set order status '%s': %w", status, err)
 	}
+
 	zap.L().Sugar().Infof("order %d set status to '%s'", orderID, status)
+
+	return nil
+}
+
+func OrderSetError(q querier, orderID int64, reason string) error {
+	if _, err := q.Exec(`update orders set error = $1 where id = $2`, reason, orderID); err != nil {
+		return fmt.Errorf("set order error: %w", err)
+	}
+
+	zap.L().Sugar().Infof("order %d set error to '%s'", orderID, reason)
+
+	return nil
 }
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+type OutboxMessage struct {
+	ID      int64
+	Topic   string
+	Key     string
+	Payload []byte
+}
+
+// InTx выполняет fn в транзакции, коммитит если fn вернула nil
+func InTx(fn func(tx *sql.Tx) error) error {
+	tx, err := GetConn().BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+
+	return nil
+}
+
+// AddOutboxMessage сохраняет закодированное сообщение в outbox, должно вызываться в той же транзакции, что и изменение состояния
+func AddOutboxMessage(tx *sql.Tx, topic, key string, payload []byte) error {
+	if _, err := tx.Exec(
+		`insert into outbox(topic, msg_key, payload) values($1, $2, $3)`, topic, key, string(payload)); err != nil {
+		return fmt.Errorf("insert outbox message: %w", err)
+	}
+
+	return nil
+}
+
+// RelayOutbox берет пачку неотправленных сообщений, передает их в publish
+// и помечает отправленными те, id которых вернул publish. Возвращает, сколько сообщений взято и сколько отправлено.
+// Строки блокируются до конца транзакции, поэтому несколько реплик не отправят одно сообщение дважды.
+func RelayOutbox(limit int, publish func(msgs []OutboxMessage) []int64) (fetched, sent int, err error) {
+	tx, err := GetConn().BeginTx(context.Background(), nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("begin tx for outbox: %w", err)
+	}
+	defer tx.Rollback()
+
+	msgs, err := getPendingOutboxMessages(tx, limit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(msgs) == 0 {
+		return 0, 0, nil
+	}
+
+	sentIDs := publish(msgs)
+	if len(sentIDs) > 0 {
+		if _, err := tx.Exec(
+			`update outbox set status = 'sent', mtime = NOW() where id = any($1)`, pq.Array(sentIDs)); err != nil {
+			return 0, 0, fmt.Errorf("mark outbox messages sent: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("commit tx: %w", err)
+	}
+
+	zap.L().Debug("outbox relayed", zap.Int("fetched", len(msgs)), zap.Int("sent", len(sentIDs)))
+
+	return len(msgs), len(sentIDs), nil
+}
+
+func getPendingOutboxMessages(tx *sql.Tx, limit int) ([]OutboxMessage, error) {
+	rows, err := tx.Query(
+		`select id, topic, msg_key, payload from outbox where status = 'pending' order by id limit $1 for update skip locked`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get pending outbox messages: %w", err)
+	}
+	defer rows.Close()
+
+	msgs := make([]OutboxMessage, 0, limit)
+	for rows.Next() {
+		var (
+			msg     OutboxMessage
+			payload string
+		)
+		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &payload); err != nil {
+			return nil, fmt.Errorf("scan outbox message: %w", err)
+		}
+
+		msg.Payload = []byte(payload)
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read outbox messages: %w", err)
+	}
+
+	return msgs, nil
+}
+
+// CountPendingOutbox возвращает число неотправленных сообщений, это очередь OutboxRelay
+func CountPendingOutbox() (int, error) {
+	var count int
+	if err := GetConn().QueryRow(`select count(*) from outbox where status = 'pending'`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("count pending outbox messages: %w", err)
+	}
+
+	return count, nil
+}
@@ -2,22 +2,22 @@ package db
 
 import (
 	"fmt"
-	"math"
+	"money"
 	"strconv"
-	"strings"
 
 	"go.uber.org/zap"
 )
 
-func CreatePayment(orderID int64, stockChangeIDs []int64) (int64, error) {
-	totalPrice, err := calculateOrderTotalPrice(stockChangeIDs)
-	if err != nil {
-		return 0, fmt.Errorf("calculate order total price: %w", err)
+// CreatePayment создает платеж на сумму, зафиксированную в заказе при его создании
+func CreatePayment(q querier, orderID int64) (int64, error) {
+	var total money.Money
+	if err := q.QueryRow(`select total from orders where id = $1`, orderID).Scan(&total); err != nil {
+		return 0, fmt.Errorf("get order total: %w", err)
 	}
 
 	var paymentID int64
-	if err := GetConn().QueryRow(
-		`insert into payments(order_id, action, amount) values($1, 'pay', $2) returning id`, orderID, totalPrice).Scan(&paymentID); err != nil {
+	if err := q.QueryRow(
+		`insert into payments(order_id, action, amount) values($1, 'pay', $2) returning id`, orderID, total).Scan(&paymentID); err != nil {
 		return 0, fmt.Errorf("create payment: %w", err)
 	}
 
@@ -26,38 +26,6 @@ func CreatePayment(orderID int64, stockChangeIDs []int64) (int64, error) {
 	return paymentID, nil
 }
 
-func calculateOrderTotalPrice(stockChangeIDs []int64) (float64, error) {
-	changes := changesToStr(stockChangeIDs)
-	rows, err := GetConn().Query(
-		fmt.Sprintf(`select sc.quantity, i.price from stock_changes sc 
-		join stock s on s.id = sc.stock_id 
-		join items i on i.id = s.item_id 
-		where sc.id in (%s)`, strings.Join(changes, ",")))
-	if err != nil {
-		return 0, fmt.Errorf("failed to get stock_changes: %w", err)
-	}
-	defer rows.Close()
-
-	var totalPrice float64
-	for rows.Next() {
-		var (
-			quantity int64
-			price    float64
-		)
-		if err := rows.Scan(&quantity, &price); err != nil {
-			return 0, fmt.Errorf("scan stock_changes: %w", err)
-		}
-
-		totalPrice += float64(quantity) * price
-	}
-
-	if err := rows.Err(); err != nil {
-		return 0, fmt.Errorf("stock changes rows err: %w", err)
-	}
-
-	return math.Ceil(totalPrice*100) / 100, nil
-}
-
 func changesToStr(changes []int64) []string {
 	changesStr := make([]string, 0, len(changes))
 	for _, id := range changes {
@@ -67,30 +35,59 @@ func changesToStr(changes []int64) []string {
 	return changesStr
 }
 
-func buildRevertPayment(paymentID int64) (int64, float64, error) {
+func buildRevertPayment(q querier, paymentID int64, action string) (int64, money.Money, error) {
 	var (
 		orderID int64
-		amount  float64
+		amount  money.Money
 	)
-	if err := GetConn().QueryRow(`select order_id, amount from payments where id = $1 and action = 'pay'`, paymentID).
+	if err := q.QueryRow(`select order_id, amount from payments where id = $1 and action = $2`, paymentID, action).
 		Scan(&orderID, &amount); err != nil {
-		return 0, 0, err
+		return 0, money.Money{}, err
 	}
 
 	return orderID, amount, nil
 }
 
-func RevertPayment(paymentID int64) (int64, error) {
-	orderID, amount, err := buildRevertPayment(paymentID)
+// RevertPayment создает возврат денег, списанных платежом capture
+func RevertPayment(q querier, capturePaymentID int64) (int64, error) {
+	orderID, amount, err := buildRevertPayment(q, capturePaymentID, "capture")
 	if err != nil {
 		return 0, fmt.Errorf("build revert payment: %w", err)
 	}
 
 	var newID int64
-	if err := GetConn().QueryRow(
+	if err := q.QueryRow(
 		`insert into payments(order_id, amount, action) values ($1, $2, 'deposit') returning id`, orderID, amount).Scan(&newID); err != nil {
 		return 0, err
 	}
 
 	return newID, nil
 }
+
+// CapturePayment создает списание суммы, замороженной платежом pay
+func CapturePayment(q querier, authorizationID int64) (int64, error) {
+	return completeAuthorization(q, authorizationID, "capture")
+}
+
+// VoidPayment создает снятие заморозки платежа pay
+func VoidPayment(q querier, authorizationID int64) (int64, error) {
+	return completeAuthorization(q, authorizationID, "void")
+}
+
+func completeAuthorization(q querier, authorizationID int64, action string) (int64, error) {
+	orderID, amount, err := buildRevertPayment(q, authorizationID, "pay")
+	if err != nil {
+		return 0, fmt.Errorf("build %s payment: %w", action, err)
+	}
+
+	var newID int64
+	if err := q.QueryRow(
+		`insert into payments(order_id, amount, action, authorization_id) values ($1, $2, $3, $4) returning id`,
+		orderID, amount, action, authorizationID).Scan(&newID); err != nil {
+		return 0, fmt.Errorf("create %s payment: %w", action, err)
+	}
+
+	zap.L().Info("payment created", zap.Int64("payment_id", newID), zap.String("action", action))
+
+	return newID, nil
+}
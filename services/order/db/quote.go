@@ -0,0 +1,154 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"money"
+	"order/types"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrItemNotFound   = errors.New("item not found")
+	ErrNotEnoughStock = errors.New("not enough items in stock")
+	ErrPriceChanged   = errors.New("item price changed")
+	ErrBadQuantity    = errors.New("item quantity is non-positive")
+)
+
+// QuoteOrder считает стоимость заказа по текущим ценам и проверяет наличие товаров на складе
+func QuoteOrder(items []types.Item) ([]types.QuoteLine, money.Money, error) {
+	if len(items) == 0 {
+		return nil, money.Money{}, ErrEmptyOrder
+	}
+
+	itemIDs := make([]int64, 0, len(items))
+	for _, item := range items {
+		if item.Quantity < 1 {
+			return nil, money.Money{}, fmt.Errorf("%w: item %d", ErrBadQuantity, item.Id)
+		}
+
+		itemIDs = append(itemIDs, item.Id)
+	}
+
+	rows, err := GetConn().Query(
+		`select i.id, i.price, coalesce(sum(s.quantity), 0) from items i left join stock s on s.item_id = i.id
+		where i.id = any($1) group by i.id, i.price`, pq.Array(itemIDs))
+	if err != nil {
+		return nil, money.Money{}, fmt.Errorf("get items: %w", err)
+	}
+	defer rows.Close()
+
+	type stockItem struct {
+		price    money.Money
+		quantity int64
+	}
+
+	stock := make(map[int64]stockItem, len(items))
+	for rows.Next() {
+		var (
+			id   int64
+			item stockItem
+		)
+		if err := rows.Scan(&id, &item.price, &item.quantity); err != nil {
+			return nil, money.Money{}, fmt.Errorf("scan item: %w", err)
+		}
+
+		stock[id] = item
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, money.Money{}, fmt.Errorf("read items: %w", err)
+	}
+
+	// одна позиция может встречаться в заказе несколько раз, наличие проверяем по сумме
+	needed := make(map[int64]int64, len(items))
+	for _, item := range items {
+		needed[item.Id] += item.Quantity
+	}
+
+	lines := make([]types.QuoteLine, 0, len(items))
+	var total money.Money
+	for _, item := range items {
+		stockItem, ok := stock[item.Id]
+		if !ok {
+			return nil, money.Money{}, fmt.Errorf("%w: %d", ErrItemNotFound, item.Id)
+		}
+
+		if needed[item.Id] > stockItem.quantity {
+			return nil, money.Money{}, fmt.Errorf("%w: item %d, requested %d, available %d",
+				ErrNotEnoughStock, item.Id, needed[item.Id], stockItem.quantity)
+		}
+
+		amount, err := stockItem.price.Mul(item.Quantity)
+		if err != nil {
+			return nil, money.Money{}, fmt.Errorf("item %d: %w", item.Id, err)
+		}
+
+		lines = append(lines, types.QuoteLine{
+			ID:       item.Id,
+			Quantity: item.Quantity,
+			Price:    stockItem.price,
+			Amount:   amount,
+		})
+
+		total = total.Add(amount)
+	}
+
+	return lines, total, nil
+}
+
+// GetDeliverySlots возвращает по каждому дню расписания часы, на которые есть хотя бы один свободный курьер
+func GetDeliverySlots() ([]types.DeliverySlot, error) {
+	return getDeliverySlots(GetConn())
+}
+
+func getDeliverySlots(q querier) ([]types.DeliverySlot, error) {
+	rows, err := q.Query(
+		`select work_date, hour_mask from courier_schedule where work_date >= current_date order by work_date`)
+	if err != nil {
+		return nil, fmt.Errorf("get courier schedule: %w", err)
+	}
+	defer rows.Close()
+
+	dates := make([]string, 0)
+	// биты часов, в которые свободен хотя бы один курьер
+	free := make(map[string]int64)
+	for rows.Next() {
+		var (
+			workDate time.Time
+			mask     int64
+		)
+		if err := rows.Scan(&workDate, &mask); err != nil {
+			return nil, fmt.Errorf("scan courier schedule: %w", err)
+		}
+
+		date := workDate.Format(time.DateOnly)
+		if _, ok := free[date]; !ok {
+			dates = append(dates, date)
+		}
+
+		free[date] |= ^mask
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read courier schedule: %w", err)
+	}
+
+	slots := make([]types.DeliverySlot, 0, len(dates))
+	for _, date := range dates {
+		hours := make([]int, 0)
+		for hour := deliveryFirstHour; hour < deliveryLastHour; hour++ {
+			if free[date]&(1<<hour) != 0 {
+				hours = append(hours, hour)
+			}
+		}
+
+		if len(hours) > 0 {
+			slots = append(slots, types.DeliverySlot{Date: date, Hours: hours})
+		}
+	}
+
+	return slots, nil
+}
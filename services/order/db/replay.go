@@ -0,0 +1,161 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ReplayFilter выбирает необработанные строки участников саги: по заказу и/или по времени создания строки.
+// Нулевые поля не ограничивают выборку
+type ReplayFilter struct {
+	OrderID int64
+	From    time.Time
+	To      time.Time
+}
+
+// where условие выборки pending строк таблицы с псевдонимом alias
+func (f *ReplayFilter) where(alias string) (string, []any) {
+	conds := []string{alias + ".status = 'pending'"}
+	args := make([]any, 0, 3)
+
+	if f.OrderID > 0 {
+		args = append(args, f.OrderID)
+		conds = append(conds, fmt.Sprintf("%s.order_id = $%d", alias, len(args)))
+	}
+	if !f.From.IsZero() {
+		args = append(args, f.From)
+		conds = append(conds, fmt.Sprintf("%s.ctime >= $%d", alias, len(args)))
+	}
+	if !f.To.IsZero() {
+		args = append(args, f.To)
+		conds = append(conds, fmt.Sprintf("%s.ctime < $%d", alias, len(args)))
+	}
+
+	return strings.Join(conds, " and "), args
+}
+
+// PendingStockChanges пачка изменений склада заказа, которую склад еще не обработал.
+// Изменения одного заказа и действия отправляются одним сообщением, как их отправляет сага
+type PendingStockChanges struct {
+	OrderID int64
+	IDs     []int64
+	Action  string
+}
+
+func GetPendingStockChanges(filter *ReplayFilter) ([]PendingStockChanges, error) {
+	where, args := filter.where("sc")
+	rows, err := GetConn().Query(
+		`select sc.order_id, sc.action, array_agg(sc.id order by sc.id) from stock_changes sc
+		where `+where+` group by sc.order_id, sc.action order by sc.order_id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("get pending stock_changes: %w", err)
+	}
+	defer rows.Close()
+
+	var changes []PendingStockChanges
+	for rows.Next() {
+		var (
+			change PendingStockChanges
+			ids    pq.Int64Array
+		)
+		if err := rows.Scan(&change.OrderID, &change.Action, &ids); err != nil {
+			return nil, fmt.Errorf("scan pending stock_changes: %w", err)
+		}
+
+		change.IDs = ids
+		changes = append(changes, change)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get pending stock_changes: %w", err)
+	}
+
+	return changes, nil
+}
+
+// PendingPayment платеж, который биллинг еще не обработал, вместе с изменениями склада из саги заказа
+type PendingPayment struct {
+	ID             int64
+	OrderID        int64
+	Action         string
+	StockChangeIDs []int64
+}
+
+func GetPendingPayments(filter *ReplayFilter) ([]PendingPayment, error) {
+	where, args := filter.where("p")
+	rows, err := GetConn().Query(
+		`select p.id, p.order_id, p.action, coalesce(s.stock_change_ids, '{}') from payments p
+		left join order_saga s on s.order_id = p.order_id
+		where `+where+` order by p.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("get pending payments: %w", err)
+	}
+	defer rows.Close()
+
+	var payments []PendingPayment
+	for rows.Next() {
+		var (
+			payment        PendingPayment
+			stockChangeIDs pq.Int64Array
+		)
+		if err := rows.Scan(&payment.ID, &payment.OrderID, &payment.Action, &stockChangeIDs); err != nil {
+			return nil, fmt.Errorf("scan pending payment: %w", err)
+		}
+
+		payment.StockChangeIDs = stockChangeIDs
+		payments = append(payments, payment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get pending payments: %w", err)
+	}
+
+	return payments, nil
+}
+
+// PendingCourReserve резерв курьера, который доставка еще не обработала, вместе с данными саги заказа
+type PendingCourReserve struct {
+	ID             int64
+	OrderID        int64
+	Action         string
+	PaymentID      int64
+	StockChangeIDs []int64
+	RetryCount     int
+}
+
+func GetPendingCourReserves(filter *ReplayFilter) ([]PendingCourReserve, error) {
+	where, args := filter.where("r")
+	rows, err := GetConn().Query(
+		`select r.id, r.order_id, r.action, coalesce(s.payment_id, 0), coalesce(s.stock_change_ids, '{}'), coalesce(s.retry_count, 0)
+		from courier_reservation r
+		left join order_saga s on s.order_id = r.order_id
+		where `+where+` order by r.id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("get pending cour_reserves: %w", err)
+	}
+	defer rows.Close()
+
+	var reserves []PendingCourReserve
+	for rows.Next() {
+		var (
+			reserve        PendingCourReserve
+			stockChangeIDs pq.Int64Array
+		)
+		if err := rows.Scan(&reserve.ID, &reserve.OrderID, &reserve.Action, &reserve.PaymentID, &stockChangeIDs,
+			&reserve.RetryCount); err != nil {
+			return nil, fmt.Errorf("scan pending cour_reserve: %w", err)
+		}
+
+		reserve.StockChangeIDs = stockChangeIDs
+		reserves = append(reserves, reserve)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("get pending cour_reserves: %w", err)
+	}
+
+	return reserves, nil
+}
@@ -0,0 +1,240 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+)
+
+// шаги саги заказа, на каждом шаге ждем ответа от соответствующего сервиса
+const (
+	SagaStepCreated           = "created"
+	SagaStepStockRemove       = "stock_remove"
+	SagaStepPayment           = "payment"
+	SagaStepCourReserve       = "cour_reserve"
+	SagaStepCapture           = "capture"
+	SagaStepRevertCourReserve = "revert_cour_reserve"
+	SagaStepRevertPayment     = "revert_payment"
+	SagaStepRevertStock       = "revert_stock"
+	SagaStepCompleted         = "completed"
+	SagaStepCanceled          = "canceled"
+)
+
+var ErrSagaStepMismatch = errors.New("saga is not on expected step")
+
+type Saga struct {
+	OrderID                 int64
+	Step                    string
+	StockChangeIDs          []int64
+	PaymentID               int64
+	CourReservationID       int64
+	CapturePaymentID        int64
+	RevertStockChangeIDs    []int64
+	RevertPaymentID         int64
+	RevertCourReservationID int64
+	RetryCount              int
+	CTime                   time.Time
+	MTime                   time.Time
+}
+
+// MoveTo переводит сагу на следующий шаг, счетчик повторов считается для каждого шага отдельно
+func (s *Saga) MoveTo(step string) {
+	s.Step = step
+	s.RetryCount = 0
+}
+
+func createSaga(q querier, orderID int64) error {
+	if _, err := q.Exec(`insert into order_saga(order_id) values($1)`, orderID); err != nil {
+		return fmt.Errorf("create saga: %w", err)
+	}
+
+	return nil
+}
+
+const sagaColumns = `order_id, step, stock_change_ids, payment_id, cour_reservation_id, capture_payment_id,
+	revert_stock_change_ids, revert_payment_id, revert_cour_reservation_id, retry_count, ctime, mtime`
+
+func scanSaga(row interface{ Scan(dest ...any) error }) (*Saga, error) {
+	var (
+		saga                                 Saga
+		stockChangeIDs, revertStockChangeIDs pq.Int64Array
+	)
+
+	if err := row.Scan(&saga.OrderID, &saga.Step, &stockChangeIDs, &saga.PaymentID, &saga.CourReservationID, &saga.CapturePaymentID,
+		&revertStockChangeIDs, &saga.RevertPaymentID, &saga.RevertCourReservationID, &saga.RetryCount,
+		&saga.CTime, &saga.MTime); err != nil {
+		return nil, err
+	}
+
+	saga.StockChangeIDs = stockChangeIDs
+	saga.RevertStockChangeIDs = revertStockChangeIDs
+
+	return &saga, nil
+}
+
+// LockSaga блокирует сагу заказа до конца транзакции и проверяет, что она находится на одном из шагов steps
+func LockSaga(tx *sql.Tx, orderID int64, steps ...string) (*Saga, error) {
+	saga, err := scanSaga(tx.QueryRow(`select `+sagaColumns+` from order_saga where order_id = $1 for update`, orderID))
+	if err != nil {
+		return nil, fmt.Errorf("lock saga: %w", err)
+	}
+
+	if len(steps) > 0 && !slices.Contains(steps, saga.Step) {
+		return nil, fmt.Errorf("%w: order %d is on step '%s', expected %v", ErrSagaStepMismatch, orderID, saga.Step, steps)
+	}
+
+	return saga, nil
+}
+
+func UpdateSaga(tx *sql.Tx, saga *Saga) error {
+	if _, err := tx.Exec(
+		`update order_saga set step = $1, stock_change_ids = $2, payment_id = $3, cour_reservation_id = $4, capture_payment_id = $5,
+		revert_stock_change_ids = $6, revert_payment_id = $7, revert_cour_reservation_id = $8, retry_count = $9, mtime = NOW()
+		where order_id = $10`,
+		saga.Step, pq.Array(saga.StockChangeIDs), saga.PaymentID, saga.CourReservationID, saga.CapturePaymentID,
+		pq.Array(saga.RevertStockChangeIDs), saga.RevertPaymentID, saga.RevertCourReservationID, saga.RetryCount,
+		saga.OrderID); err != nil {
+		return fmt.Errorf("update saga: %w", err)
+	}
+
+	zap.L().Info("saga updated", zap.Int64("order_id", saga.OrderID), zap.String("step", saga.Step))
+
+	return nil
+}
+
+func GetUnfinishedSagas() ([]Saga, error) {
+	sagas, err := getSagas(
+		`select `+sagaColumns+` from order_saga where step not in ($1, $2) order by mtime`, SagaStepCompleted, SagaStepCanceled)
+	if err != nil {
+		return nil, fmt.Errorf("get unfinished sagas: %w", err)
+	}
+
+	return sagas, nil
+}
+
+// GetStuckSagas возвращает саги, которые находятся на шаге step и не менялись с момента before
+func GetStuckSagas(step string, before time.Time) ([]Saga, error) {
+	sagas, err := getSagas(
+		`select `+sagaColumns+` from order_saga where step = $1 and mtime < $2 order by mtime`, step, before)
+	if err != nil {
+		return nil, fmt.Errorf("get stuck sagas: %w", err)
+	}
+
+	return sagas, nil
+}
+
+func getSagas(query string, args ...any) ([]Saga, error) {
+	rows, err := GetConn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sagas := make([]Saga, 0)
+	for rows.Next() {
+		saga, err := scanSaga(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan saga: %w", err)
+		}
+
+		sagas = append(sagas, *saga)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read sagas: %w", err)
+	}
+
+	return sagas, nil
+}
+
+// статусы строк участников саги: stock_changes, payments, courier_reservation
+const (
+	ParticipantStatusPending = "pending"
+	ParticipantStatusOK      = "ok"
+	ParticipantStatusFailed  = "failed"
+)
+
+// GetStockChangesStatus возвращает общий статус пачки изменений склада:
+// failed если хоть одно упало, ok если применены все, иначе pending
+func GetStockChangesStatus(q querier, stockChangeIDs []int64) (string, error) {
+	var failed, ok, total int
+	if err := q.QueryRow(
+		`select count(*) filter (where status = 'failed'), count(*) filter (where status = 'ok'), count(*)
+		from stock_changes where id = any($1)`, pq.Array(stockChangeIDs)).Scan(&failed, &ok, &total); err != nil {
+		return "", fmt.Errorf("get stock_changes status: %w", err)
+	}
+
+	switch {
+	case failed > 0:
+		return ParticipantStatusFailed, nil
+	case total > 0 && ok == total:
+		return ParticipantStatusOK, nil
+	default:
+		return ParticipantStatusPending, nil
+	}
+}
+
+// GetPaymentAction возвращает действие платежа: на шаге revert_payment сага либо снимает заморозку, либо возвращает деньги
+func GetPaymentAction(q querier, paymentID int64) (string, error) {
+	var action string
+	if err := q.QueryRow(`select action from payments where id = $1`, paymentID).Scan(&action); err != nil {
+		return "", fmt.Errorf("get payment action: %w", err)
+	}
+
+	return action, nil
+}
+
+func GetPaymentStatus(q querier, paymentID int64) (string, error) {
+	var status string
+	if err := q.QueryRow(`select status from payments where id = $1`, paymentID).Scan(&status); err != nil {
+		return "", fmt.Errorf("get payment status: %w", err)
+	}
+
+	return status, nil
+}
+
+func GetCourReserveStatus(q querier, courReserveID int64) (string, error) {
+	var status string
+	if err := q.QueryRow(`select status from courier_reservation where id = $1`, courReserveID).Scan(&status); err != nil {
+		return "", fmt.Errorf("get cour_reserve status: %w", err)
+	}
+
+	return status, nil
+}
+
+// FailPendingStockChanges помечает еще не обработанные складом изменения упавшими,
+// возвращает количество помеченных строк
+func FailPendingStockChanges(tx *sql.Tx, stockChangeIDs []int64, reason string) (int64, error) {
+	res, err := tx.Exec(`update stock_changes set status = 'failed', error = $1, mtime = NOW()
+		where id = any($2) and status = 'pending'`, reason, pq.Array(stockChangeIDs))
+	if err != nil {
+		return 0, fmt.Errorf("fail pending stock_changes: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+func FailPendingPayment(tx *sql.Tx, paymentID int64, reason string) (int64, error) {
+	res, err := tx.Exec(`update payments set status = 'failed', error = $1, mtime = NOW()
+		where id = $2 and status = 'pending'`, reason, paymentID)
+	if err != nil {
+		return 0, fmt.Errorf("fail pending payment: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+func FailPendingCourReserve(tx *sql.Tx, courReserveID int64, reason string) (int64, error) {
+	res, err := tx.Exec(`update courier_reservation set status = 'failed', error = $1, mtime = NOW()
+		where id = $2 and status = 'pending'`, reason, courReserveID)
+	if err != nil {
+		return 0, fmt.Errorf("fail pending cour_reserve: %w", err)
+	}
+
+	return res.RowsAffected()
+}
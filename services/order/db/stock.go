@@ -12,8 +12,8 @@ import (
 
 var ErrMissingItemsInStock = errors.New("missing items in stock")
 
-func CreateStockChanges(orderID int64, items []types.Item) ([]int64, error) {
-	stockChanges, err := buildStockChanges(orderID, items)
+func CreateStockChanges(q querier, orderID int64, items []types.Item) ([]int64, error) {
+	stockChanges, err := buildStockChanges(q, orderID, items)
 	if err != nil {
 		return nil, fmt.Errorf("build stock_changes: %w", err)
 	}
@@ -24,7 +24,7 @@ func CreateStockChanges(orderID int64, items []types.Item) ([]int64, error) {
 		values = append(values, fmt.Sprintf("(%d, %d, 'remove', %d)", sc.OrderID, sc.StockID, sc.Quantity))
 	}
 
-	rows, err := GetConn().Query(fmt.Sprintf(query, strings.Join(values, ",")))
+	rows, err := q.Query(fmt.Sprintf(query, strings.Join(values, ",")))
 	if err != nil {
 		return nil, fmt.Errorf("insert stock_changes: %w", err)
 	}
@@ -49,7 +49,7 @@ func CreateStockChanges(orderID int64, items []types.Item) ([]int64, error) {
 	return stockChangesIDs, nil
 }
 
-func buildStockChanges(orderID int64, items []types.Item) ([]types.Item, error) {
+func buildStockChanges(q querier, orderID int64, items []types.Item) ([]types.Item, error) {
 	itemIDstr := make([]string, 0, len(items))
 	itemsMap := make(map[int64]int64, len(items))
 	for _, item := range items {
@@ -57,7 +57,7 @@ func buildStockChanges(orderID int64, items []types.Item) ([]types.Item, error)
 		itemsMap[item.Id] = item.Quantity
 	}
 
-	rows, err := GetConn().Query(fmt.Sprintf(`select id, item_id from stock where item_id in (%s)`, strings.Join(itemIDstr, ",")))
+	rows, err := q.Query(fmt.Sprintf(`select id, item_id from stock where item_id in (%s)`, strings.Join(itemIDstr, ",")))
 	if err != nil {
 		return nil, fmt.Errorf("get items from stock: %w", err)
 	}
@@ -92,11 +92,11 @@ func buildStockChanges(orderID int64, items []types.Item) ([]types.Item, error)
 	return stockChanges, nil
 }
 
-func buildRevertChanges(stockChangeIDs []int64) ([]string, error) {
+func buildRevertChanges(q querier, stockChangeIDs []int64) ([]string, error) {
 	changes := changesToStr(stockChangeIDs)
 	failedChanges := fmt.Sprintf(`select order_id, stock_id, quantity from stock_changes where id in (%s) and action = 'remove'`, strings.Join(changes, ","))
 
-	rows, err := GetConn().Query(failedChanges)
+	rows, err := q.Query(failedChanges)
 	if err != nil {
 		return nil, err
 	}
@@ -119,14 +119,14 @@ func buildRevertChanges(stockChangeIDs []int64) ([]string, error) {
 	return values, nil
 }
 
-func RevertStockChanges(stockChangeIDs []int64) ([]int64, error) {
-	values, err := buildRevertChanges(stockChangeIDs)
+func RevertStockChanges(q querier, stockChangeIDs []int64) ([]int64, error) {
+	values, err := buildRevertChanges(q, stockChangeIDs)
 	if err != nil {
 		return nil, fmt.Errorf("build revert changes: %w", err)
 	}
 
 	query := fmt.Sprintf(`insert into stock_changes(order_id, stock_id, quantity, action) values %s returning id`, strings.Join(values, ","))
-	rows, err := GetConn().Query(query)
+	rows, err := q.Query(query)
 	if err != nil {
 		return nil, err
 	}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"lifecycle"
 	"log"
 	"order/config"
 	"order/db"
@@ -40,26 +42,67 @@ func main() {
 		log.Fatalf("init database: %s", err)
 	}
 
-	redis.Init(config.RedisConfig)
-
-	go func() {
-		service.NewPaymentsProcessor(config)
-		service.GetPaymentsProcessor().Run()
-	}()
-
-	service.NewStockProcessor(config)
-
-	go service.GetStockProcessor().Run()
-
-	service.NewNotificationsProcessor(config)
-
-	go service.GetNotificationsProcessor().Run()
-
-	service.NewCourReserveProcessor(config)
+	// order replay [flags] - повторная отправка запросов саги после инцидента, сервис при этом не запускается
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(config, os.Args[2:]); err != nil {
+			log.Fatalf("replay: %s", err)
+		}
+		return
+	}
 
-	go service.GetCourReserveProcessor().Run()
+	redis.Init(config.RedisConfig)
 
-	server := service.NewServer(config)
+	if err := service.InitQuotes(config); err != nil {
+		log.Fatalf("init quotes: %s", err)
+	}
 
-	log.Fatalf("serve: %s", server.ListenAndServe(":"+config.ListenPort))
+	dlc := config.DeadLetterConfig
+	deadLetters := service.NewDeadLetters(config,
+		service.NewKafkaPublisher(dlc.Brokers, dlc.Version, &dlc.ClientConfig),
+		service.NewKafkaReader(dlc.Brokers, dlc.Version, &dlc.ClientConfig),
+		config.PaymentsConsumerConfig.Topic,
+		config.StockConsumerConfig.Topic,
+		config.CourReserveConsumerConfig.Topic)
+
+	npc := config.NotificationsProducerConfig
+	notificationsProcessor := service.NewNotificationsProcessor(config,
+		service.NewKafkaPublisher(npc.Brokers, npc.Version, &npc.ClientConfig))
+
+	orchestrator := service.NewOrchestrator(config, notificationsProcessor)
+
+	paymentsProcessor := service.NewPaymentsProcessor(config,
+		service.NewKafkaSubscriber(config.PaymentsConsumerConfig), orchestrator, deadLetters)
+
+	stockProcessor := service.NewStockProcessor(config,
+		service.NewKafkaSubscriber(config.StockConsumerConfig), orchestrator, deadLetters)
+
+	courReserveProcessor := service.NewCourReserveProcessor(config,
+		service.NewKafkaSubscriber(config.CourReserveConsumerConfig), orchestrator, deadLetters)
+
+	opc := config.OutboxConfig.ProducerConfig
+	outboxRelay := service.NewOutboxRelay(config, service.NewKafkaPublisher(opc.Brokers, opc.Version, &opc.ClientConfig))
+
+	// компоненты останавливаются в порядке регистрации: HTTP-сервер и консьюмеры, чтобы не появлялось новых сообщений,
+	// затем watchdog, очередь уведомлений и outbox relay, который отправляет все, что успели сохранить.
+	// После них закрываются dead letters, БД и Redis
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config, orchestrator, deadLetters), ":"+config.ListenPort)
+	lc.Go("payments processor", paymentsProcessor.Run)
+	lc.Go("stock processor", stockProcessor.Run)
+	lc.Go("cour_reserve processor", courReserveProcessor.Run)
+	// процессоры уже созданы, можно досылать сообщения прерванных саг
+	lc.Go("saga recovery", func(ctx context.Context) error {
+		orchestrator.RecoverSagas(ctx)
+		return nil
+	})
+	lc.Go("watchdog", service.NewWatchdog(config, orchestrator).Run)
+	lc.Go("notifications processor", notificationsProcessor.Run)
+	lc.Go("outbox relay", outboxRelay.Run)
+	lc.OnStop("dead letters", deadLetters.Close)
+	lc.OnStop("database", db.Close)
+	lc.OnStop("redis", redis.Close)
+
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
 }
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS order_idempotency_keys (
+    user_id         BIGINT       NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash    CHAR(64)     NOT NULL,
+    order_id        BIGINT REFERENCES orders(id),
+    response        TEXT,
+    ctime           TIMESTAMP    NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, idempotency_key)
+);
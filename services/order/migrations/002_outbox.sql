@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id      BIGSERIAL PRIMARY KEY,
+    topic   VARCHAR(255) NOT NULL,
+    payload TEXT         NOT NULL,
+    status  VARCHAR(16)  NOT NULL DEFAULT 'pending',
+    ctime   TIMESTAMP    NOT NULL DEFAULT NOW(),
+    mtime   TIMESTAMP    NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE status = 'pending';
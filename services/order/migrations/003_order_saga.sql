@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS order_saga (
+    order_id                   BIGINT PRIMARY KEY REFERENCES orders(id),
+    step                       VARCHAR(32) NOT NULL DEFAULT 'created',
+    stock_change_ids           BIGINT[]    NOT NULL DEFAULT '{}',
+    payment_id                 BIGINT      NOT NULL DEFAULT 0,
+    cour_reservation_id        BIGINT      NOT NULL DEFAULT 0,
+    revert_stock_change_ids    BIGINT[]    NOT NULL DEFAULT '{}',
+    revert_payment_id          BIGINT      NOT NULL DEFAULT 0,
+    revert_cour_reservation_id BIGINT      NOT NULL DEFAULT 0,
+    retry_count                INT         NOT NULL DEFAULT 0,
+    ctime                      TIMESTAMP   NOT NULL DEFAULT NOW(),
+    mtime                      TIMESTAMP   NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_saga_unfinished_idx ON order_saga (mtime) WHERE step NOT IN ('completed', 'canceled');
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS orders_user_ctime_idx ON orders (user_id, ctime, id);
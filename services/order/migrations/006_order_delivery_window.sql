@@ -0,0 +1 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS work_date DATE NOT NULL DEFAULT current_date;
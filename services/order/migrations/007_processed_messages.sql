@@ -0,0 +1,10 @@
+-- обработанные сообщения саги: консьюмер отмечает сообщение в той же транзакции, что и его побочный эффект,
+-- и пропускает повторно доставленные сообщения
+CREATE TABLE IF NOT EXISTS processed_messages (
+    consumer   VARCHAR(64) NOT NULL,
+    message_id VARCHAR(64) NOT NULL,
+    ctime      TIMESTAMP   NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (consumer, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS processed_messages_ctime_idx ON processed_messages (ctime);
@@ -0,0 +1,2 @@
+-- ключ сообщения в кафке, сообщения одного заказа попадают в одну партицию
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS msg_key VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1,6 @@
+-- двухфазная оплата: платеж pay замораживает сумму на счете, capture списывает ее, void снимает заморозку.
+-- capture и void ссылаются на платеж pay, который они завершают
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS authorization_id BIGINT REFERENCES payments (id);
+
+-- платеж capture, которым сага списывает замороженную сумму после резерва курьера
+ALTER TABLE order_saga ADD COLUMN IF NOT EXISTS capture_payment_id BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"order/config"
+	"order/db"
+	"order/service"
+	"os"
+	"time"
+)
+
+// runReplay разбирает аргументы команды replay и заново отправляет необработанные запросы саги:
+//
+//	order replay -order-id 42 -dry-run
+//	order replay -from 2025-01-01T00:00:00Z -to 2025-01-02T00:00:00Z
+func runReplay(config *config.Config, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	orderID := flags.Int64("order-id", 0, "replay pending rows of the order")
+	from := flags.String("from", "", "replay pending rows created at or after this time (RFC3339)")
+	to := flags.String("to", "", "replay pending rows created before this time (RFC3339)")
+	dryRun := flags.Bool("dry-run", false, "print messages without saving them to outbox")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter := &db.ReplayFilter{OrderID: *orderID}
+
+	var err error
+	if *from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, *from); err != nil {
+			return fmt.Errorf("parse -from: %w", err)
+		}
+	}
+	if *to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, *to); err != nil {
+			return fmt.Errorf("parse -to: %w", err)
+		}
+	}
+
+	// без фильтра отправили бы все pending строки, такое лучше делать осознанно через -from
+	if filter.OrderID <= 0 && filter.From.IsZero() && filter.To.IsZero() {
+		return errors.New("set -order-id or -from/-to")
+	}
+
+	count, err := service.Replay(config, filter, *dryRun, os.Stdout)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "dry run: %d messages would be replayed\n", count)
+	} else {
+		fmt.Fprintf(os.Stderr, "%d messages saved to outbox\n", count)
+	}
+
+	return nil
+}
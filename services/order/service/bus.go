@@ -0,0 +1,54 @@
+package service
+
+import (
+	"bus"
+	"kafka"
+	"order/config"
+
+	"go.uber.org/zap"
+)
+
+// NewKafkaSubscriber подписчик на кафку по настройкам консьюмера, процессоры зависят только от bus.Subscriber
+func NewKafkaSubscriber(cfg *config.KafkaConsumerConfig) bus.Subscriber {
+	saramaConfig, err := kafka.NewConfig(cfg.Version, &cfg.ClientConfig)
+	if err != nil {
+		zap.L().Fatal("failed to build kafka config", zap.Error(err))
+	}
+
+	subscriber, err := kafka.NewSubscriber(cfg.Brokers, cfg.GroupID, saramaConfig, cfg.Workers)
+	if err != nil {
+		zap.L().Fatal("failed to start consumer", zap.Error(err))
+	}
+
+	return subscriber
+}
+
+// NewKafkaPublisher продюсер в кафку, процессоры зависят только от bus.Publisher
+func NewKafkaPublisher(brokers []string, version string, client *kafka.ClientConfig) bus.Publisher {
+	saramaConfig, err := kafka.NewConfig(version, client)
+	if err != nil {
+		zap.L().Fatal("failed to build kafka config", zap.Error(err))
+	}
+
+	publisher, err := kafka.NewPublisher(brokers, saramaConfig)
+	if err != nil {
+		zap.L().Fatal("failed to start producer", zap.Error(err))
+	}
+
+	return publisher
+}
+
+// NewKafkaReader читатель топиков кафки, через него смотрят и отправляют повторно dead letters
+func NewKafkaReader(brokers []string, version string, client *kafka.ClientConfig) bus.TopicReader {
+	saramaConfig, err := kafka.NewConfig(version, client)
+	if err != nil {
+		zap.L().Fatal("failed to build kafka config", zap.Error(err))
+	}
+
+	reader, err := kafka.NewReader(brokers, saramaConfig)
+	if err != nil {
+		zap.L().Fatal("failed to create kafka client", zap.Error(err))
+	}
+
+	return reader
+}
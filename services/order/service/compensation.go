@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"order/db"
+	sagamsg "saga"
+)
+
+var (
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrOrderNotCancelable = errors.New("order can not be canceled")
+)
+
+// revertStockChanges создает обратные изменения склада и сообщение для сервиса склада в одной транзакции
+func (o *Orchestrator) revertStockChanges(m *consumedMessage, orderID int64, fromSteps ...string) error {
+	return m.inTx(func(tx *sql.Tx) error {
+		saga, err := db.LockSaga(tx, orderID, fromSteps...)
+		if err != nil {
+			return err
+		}
+
+		return o.revertStockChangesTx(tx, saga)
+	})
+}
+
+func (o *Orchestrator) revertStockChangesTx(tx *sql.Tx, saga *db.Saga) error {
+	newStockChangeIDs, err := db.RevertStockChanges(tx, saga.StockChangeIDs)
+	if err != nil {
+		return fmt.Errorf("revert stock_changes: %w", err)
+	}
+
+	if err := o.addStockMessage(tx, &sagamsg.StockChangeMessage{
+		StockChangeIDs: newStockChangeIDs,
+		OrderID:        saga.OrderID,
+		Action:         sagamsg.StockAdd,
+		Status:         sagamsg.StatusPending,
+	}); err != nil {
+		return err
+	}
+
+	saga.RevertStockChangeIDs = newStockChangeIDs
+	saga.MoveTo(db.SagaStepRevertStock)
+
+	return db.UpdateSaga(tx, saga)
+}
+
+// revertPayment создает отмену оплаты и сообщение для биллинга в одной транзакции
+func (o *Orchestrator) revertPayment(m *consumedMessage, orderID int64, fromSteps ...string) error {
+	return m.inTx(func(tx *sql.Tx) error {
+		saga, err := db.LockSaga(tx, orderID, fromSteps...)
+		if err != nil {
+			return err
+		}
+
+		return o.revertPaymentTx(tx, saga)
+	})
+}
+
+// revertPaymentTx снимает заморозку платежа pay, а если замороженная сумма уже списана, возвращает деньги
+func (o *Orchestrator) revertPaymentTx(tx *sql.Tx, saga *db.Saga) error {
+	captured := false
+	if saga.CapturePaymentID != 0 {
+		status, err := db.GetPaymentStatus(tx, saga.CapturePaymentID)
+		if err != nil {
+			return err
+		}
+
+		captured = status == db.ParticipantStatusOK
+	}
+
+	var (
+		newPaymentID int64
+		action       = sagamsg.PaymentVoid
+		err          error
+	)
+	if captured {
+		action = sagamsg.PaymentDeposit
+		newPaymentID, err = db.RevertPayment(tx, saga.CapturePaymentID)
+	} else {
+		newPaymentID, err = db.VoidPayment(tx, saga.PaymentID)
+	}
+	if err != nil {
+		return fmt.Errorf("revert payment: %w", err)
+	}
+
+	if err := o.addPaymentMessage(tx, &sagamsg.PaymentMessage{
+		StockChangeIDs: saga.StockChangeIDs,
+		OrderID:        saga.OrderID,
+		Action:         action,
+		Status:         sagamsg.StatusPending,
+		PaymentID:      newPaymentID,
+	}); err != nil {
+		return err
+	}
+
+	saga.RevertPaymentID = newPaymentID
+	saga.MoveTo(db.SagaStepRevertPayment)
+
+	return db.UpdateSaga(tx, saga)
+}
+
+// revertCourReserveTx освобождает слот курьера, дальше по цепочке снимется заморозка или вернутся деньги и товары
+func (o *Orchestrator) revertCourReserveTx(tx *sql.Tx, saga *db.Saga) error {
+	newCourReserveID, err := db.RevertCourReserve(tx, saga.CourReservationID)
+	if err != nil {
+		return fmt.Errorf("revert cour_reserve: %w", err)
+	}
+
+	if err := o.addCourReserveMessage(tx, &sagamsg.CourReserveMessage{
+		PaymentID:         saga.PaymentID,
+		OrderID:           saga.OrderID,
+		StockChangeIDs:    saga.StockChangeIDs,
+		CourReservationID: newCourReserveID,
+		Action:            sagamsg.CourReserveRevert,
+		Status:            sagamsg.StatusPending,
+	}); err != nil {
+		return err
+	}
+
+	saga.RevertCourReservationID = newCourReserveID
+	saga.MoveTo(db.SagaStepRevertCourReserve)
+
+	return db.UpdateSaga(tx, saga)
+}
+
+// cancelOrder завершает сагу отменой заказа и уведомляет пользователя
+func (o *Orchestrator) cancelOrder(m *consumedMessage, orderID int64, fromSteps ...string) error {
+	if err := m.inTx(func(tx *sql.Tx) error {
+		saga, err := db.LockSaga(tx, orderID, fromSteps...)
+		if err != nil {
+			return err
+		}
+
+		return cancelOrderTx(tx, saga)
+	}); err != nil {
+		return err
+	}
+
+	go o.NotifyUser(context.Background(), orderID, OrderStatusCanceled)
+
+	return nil
+}
+
+func cancelOrderTx(tx *sql.Tx, saga *db.Saga) error {
+	if err := db.RejectOrder(tx, saga.OrderID); err != nil {
+		return err
+	}
+
+	saga.MoveTo(db.SagaStepCanceled)
+
+	return db.UpdateSaga(tx, saga)
+}
+
+const canceledByUserReason = "canceled by user"
+
+// userCancelOrder прерывает сагу по запросу пользователя и откатывает все сделанные шаги в обратном порядке:
+// слот курьера, деньги, товары на складе. Незавершенный запрос текущего шага помечается упавшим,
+// чтобы участник его уже не обработал. Возвращает true, если заказ отменен сразу
+func (o *Orchestrator) userCancelOrder(userID, orderID int64) (bool, error) {
+	canceled := false
+	if err := db.InTx(func(tx *sql.Tx) error {
+		saga, err := db.LockSaga(tx, orderID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrOrderNotFound
+			}
+
+			return err
+		}
+
+		ownerID, status, err := db.LockOrder(tx, orderID)
+		if err != nil {
+			return err
+		}
+
+		if ownerID != userID {
+			return ErrOrderNotFound
+		}
+
+		switch status {
+		case "pending", "approved", "delivery":
+		default:
+			return ErrOrderNotCancelable
+		}
+
+		if err := db.OrderSetError(tx, orderID, canceledByUserReason); err != nil {
+			return err
+		}
+
+		switch saga.Step {
+		case db.SagaStepCreated:
+			canceled = true
+			return cancelOrderTx(tx, saga)
+		case db.SagaStepStockRemove:
+			status, err := failPendingStep(tx, saga, canceledByUserReason)
+			if err != nil {
+				return err
+			}
+
+			if status == db.ParticipantStatusOK {
+				return o.revertStockChangesTx(tx, saga)
+			}
+
+			canceled = true
+			return cancelOrderTx(tx, saga)
+		case db.SagaStepPayment:
+			status, err := failPendingStep(tx, saga, canceledByUserReason)
+			if err != nil {
+				return err
+			}
+
+			if status == db.ParticipantStatusOK {
+				return o.revertPaymentTx(tx, saga)
+			}
+
+			return o.revertStockChangesTx(tx, saga)
+		case db.SagaStepCourReserve:
+			status, err := failPendingStep(tx, saga, canceledByUserReason)
+			if err != nil {
+				return err
+			}
+
+			if status == db.ParticipantStatusOK {
+				return o.revertCourReserveTx(tx, saga)
+			}
+
+			return o.revertPaymentTx(tx, saga)
+		case db.SagaStepCapture:
+			// курьер уже зарезервирован, списанные к этому моменту деньги вернутся после его освобождения
+			if _, err := failPendingStep(tx, saga, canceledByUserReason); err != nil {
+				return err
+			}
+
+			return o.revertCourReserveTx(tx, saga)
+		case db.SagaStepCompleted:
+			return o.revertCourReserveTx(tx, saga)
+		default:
+			// компенсация уже идет
+			return ErrOrderNotCancelable
+		}
+	}); err != nil {
+		return false, err
+	}
+
+	// если откатывать было нечего, заказ отменен сразу, иначе уведомление придет в конце цепочки компенсаций
+	if canceled {
+		go o.NotifyUser(context.Background(), orderID, OrderStatusCanceled)
+	}
+
+	return canceled, nil
+}
+
+// failPendingStep помечает запрос текущего шага упавшим, если участник его еще не обработал,
+// и возвращает итоговый статус запроса
+func failPendingStep(tx *sql.Tx, saga *db.Saga, reason string) (string, error) {
+	var (
+		failed int64
+		err    error
+	)
+
+	switch saga.Step {
+	case db.SagaStepStockRemove:
+		failed, err = db.FailPendingStockChanges(tx, saga.StockChangeIDs, reason)
+	case db.SagaStepPayment:
+		failed, err = db.FailPendingPayment(tx, saga.PaymentID, reason)
+	case db.SagaStepCapture:
+		failed, err = db.FailPendingPayment(tx, saga.CapturePaymentID, reason)
+	case db.SagaStepCourReserve:
+		failed, err = db.FailPendingCourReserve(tx, saga.CourReservationID, reason)
+	default:
+		return "", fmt.Errorf("saga step '%s' has no participant", saga.Step)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if failed > 0 {
+		return db.ParticipantStatusFailed, nil
+	}
+
+	switch saga.Step {
+	case db.SagaStepStockRemove:
+		return db.GetStockChangesStatus(tx, saga.StockChangeIDs)
+	case db.SagaStepPayment:
+		return db.GetPaymentStatus(tx, saga.PaymentID)
+	case db.SagaStepCapture:
+		return db.GetPaymentStatus(tx, saga.CapturePaymentID)
+	default:
+		return db.GetCourReserveStatus(tx, saga.CourReservationID)
+	}
+}
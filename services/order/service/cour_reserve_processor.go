@@ -1,249 +1,83 @@
 package service
 
 import (
+	"bus"
 	"context"
-	"encoding/json"
+	"database/sql"
+	"dbutil"
 	"errors"
+	"fmt"
 	"order/config"
 	"order/db"
-	"os"
-	"os/signal"
-	"sync"
-	"syscall"
+	sagamsg "saga"
 
-	"github.com/IBM/sarama"
 	"go.uber.org/zap"
 )
 
-var (
-	courReserveProcessorOnce sync.Once
-	courReserveProcessor     *CourReserveProcessor
-
-	courReserveRetryCount int
-)
-
 type CourReserveProcessor struct {
-	consumer     sarama.ConsumerGroup
+	subscriber   bus.Subscriber
 	consumeTopic string
 
-	producer     sarama.AsyncProducer
-	produceTopic string
-
-	queuedMessages chan *CourReserveMessage
+	orchestrator *Orchestrator
+	deadLetters  *bus.DeadLetters
 }
 
-func NewCourReserveProcessor(config *config.Config) {
-	courReserveProcessorOnce.Do(func() {
-		cConfig := sarama.NewConfig()
-		version, err := sarama.ParseKafkaVersion(config.CourReserveConsumerConfig.Version)
-		if err != nil {
-			zap.L().Fatal("failed to parse kafka version", zap.Error(err))
-		}
-		cConfig.Version = version
-		cConfig.Net.TLS.Enable = false
-
-		c, err := sarama.NewConsumerGroup(config.CourReserveConsumerConfig.Brokers, config.CourReserveConsumerConfig.GroupID, cConfig)
-		if err != nil {
-			zap.L().Fatal("failed to start consumer", zap.Error(err))
-		}
-
-		pConfig := sarama.NewConfig()
-		version, err = sarama.ParseKafkaVersion(config.CourReserveProducerConfig.Version)
-		if err != nil {
-			zap.L().Fatal("failed to parse kafka version", zap.Error(err))
-		}
-		pConfig.Version = version
-		pConfig.Net.TLS.Enable = false
-
-		p, err := sarama.NewAsyncProducer(config.CourReserveProducerConfig.Brokers, pConfig)
-		if err != nil {
-			zap.L().Fatal("failed to start producer", zap.Error(err))
-		}
-
-		courReserveProcessor = &CourReserveProcessor{
-			consumer:       c,
-			consumeTopic:   config.CourReserveConsumerConfig.Topic,
-			producer:       p,
-			produceTopic:   config.CourReserveProducerConfig.Topic,
-			queuedMessages: make(chan *CourReserveMessage, 256),
-		}
-
-		courReserveRetryCount = config.CourReserveRetryCount
-	})
-}
-
-func GetCourReserveProcessor() *CourReserveProcessor {
-	return courReserveProcessor
-}
-
-func (p *CourReserveProcessor) AddMessage(msg *CourReserveMessage) {
-	p.queuedMessages <- msg
+func NewCourReserveProcessor(config *config.Config, subscriber bus.Subscriber, orchestrator *Orchestrator,
+	deadLetters *bus.DeadLetters) *CourReserveProcessor {
+	return &CourReserveProcessor{
+		subscriber:   subscriber,
+		consumeTopic: config.CourReserveConsumerConfig.Topic,
+		orchestrator: orchestrator,
+		deadLetters:  deadLetters,
+	}
 }
 
-func (p *CourReserveProcessor) Run() {
+// Run обрабатывает сообщения, пока не отменен ctx. После отмены консьюмер дорабатывает текущие сообщения
+func (p *CourReserveProcessor) Run(ctx context.Context) error {
 	zap.L().Info("cour_reserve processor started")
 
-	ctx, cancel := context.WithCancel(context.Background())
-
-	keepRunning := true
-
 	consumer := CourReserveConsumer{
-		ready: make(chan bool),
+		orchestrator: p.orchestrator,
+		deadLetters:  p.deadLetters,
 	}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			// `Consume` should be called inside an infinite loop, when a
-			// server-side rebalance happens, the consumer session will need to be
-			// recreated to get the new claims
-			if err := p.consumer.Consume(ctx, []string{p.consumeTopic}, &consumer); err != nil {
-				if errors.Is(err, sarama.ErrClosedConsumerGroup) {
-					return
-				}
-				zap.L().Fatal("error from consumer: " + err.Error())
-			}
-			// check if context was cancelled, signaling that the consumer should stop
-			if ctx.Err() != nil {
-				return
-			}
-			consumer.ready = make(chan bool)
-		}
-	}()
-
-	<-consumer.ready // Await till the consumer has been set up
-	zap.L().Info("Sarama consumer up and running!...")
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for err := range p.producer.Errors() {
-			zap.L().Error("failed to produce message", zap.Error(err))
-		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	err := p.subscriber.Subscribe(ctx, []string{p.consumeTopic}, consumer.handleMessage)
 
-	ProducerLoop:
-		for {
-			select {
-			case msg := <-p.queuedMessages:
-				bytes, err := json.Marshal(msg)
-				if err != nil {
-					zap.L().Error("failed to marshal cour_reserve message", zap.Error(err))
-					continue
-				}
-				zap.L().Sugar().Infof("producing message: %s", string(bytes))
-				p.producer.Input() <- &sarama.ProducerMessage{Topic: p.produceTopic, Value: sarama.StringEncoder(string(bytes))}
-			case <-ctx.Done():
-				p.producer.AsyncClose() // Trigger a shutdown of the producer.
-				break ProducerLoop
-			}
-		}
-	}()
-
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
-
-	for keepRunning {
-		select {
-		case <-ctx.Done():
-			zap.L().Info("terminating: context cancelled")
-			keepRunning = false
-		case <-sigterm:
-			zap.L().Info("terminating: via signal")
-			keepRunning = false
-		}
+	if closeErr := p.subscriber.Close(); closeErr != nil {
+		zap.L().Error("error closing consumer", zap.Error(closeErr))
 	}
 
-	cancel()
-	wg.Wait()
-	if err := p.consumer.Close(); err != nil {
-		zap.L().Fatal("error closing consumer: " + err.Error())
-	}
+	return err
 }
 
-// CourReserveConsumer represents a Sarama consumer group consumer
+// CourReserveConsumer обрабатывает сообщения подписки
 type CourReserveConsumer struct {
-	ready chan bool
+	orchestrator *Orchestrator
+	deadLetters  *bus.DeadLetters
 }
 
-// Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *CourReserveConsumer) Setup(sarama.ConsumerGroupSession) error {
-	// Mark the consumer as ready
-	close(consumer.ready)
-	return nil
-}
+// handleMessage обрабатывает сообщение подписки, ошибка - подписка завершилась до обработки
+// или сообщение не удалось отправить в dead letter топик
+func (consumer *CourReserveConsumer) handleMessage(ctx context.Context, message *bus.Message) error {
+	zap.L().Sugar().Infof("message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+	if err := consumer.processCourReserve(message.Value); err != nil {
+		zap.L().Error("failed to process cour_reserve message", zap.Error(err))
+		return sendToDeadLetters(ctx, consumer.deadLetters, message, err)
+	}
 
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *CourReserveConsumer) Cleanup(sarama.ConsumerGroupSession) error {
 	return nil
 }
 
-const (
-	CourReserveStatusPending int8 = iota
-	CourReserveStatusOK
-	CourReserveStatusFailed
-)
-
-const (
-	RevertCourReserve = iota
-	CourReserve
-)
-
-type CourReserveMessage struct {
-	PaymentID         int64   `json:"payment_id"`
-	OrderID           int64   `json:"order_id"`
-	StockChangeIDs    []int64 `json:"stock_change_ids"`
-	CourReservationID int64   `json:"cour_reservation_id"`
-	Action            int8    `json:"action"`
-	Status            int8    `json:"status"` // 0 - pending, 1 - ok, 2 - failed
-	RetryCount        int     `json:"retry_count"`
-}
-
-// ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
-// Once the Messages() channel is closed, the Handler must finish its processing
-// loop and exit.
-func (consumer *CourReserveConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	// NOTE:
-	// Do not move the code below to a goroutine.
-	// The `ConsumeClaim` itself is called within a goroutine, see:
-	// https://github.com/IBM/sarama/blob/main/consumer_group.go#L27-L29
-	for {
-		select {
-		case message, ok := <-claim.Messages():
-			if !ok {
-				zap.L().Info("message channel was closed")
-				return nil
-			}
-			zap.L().Sugar().Infof("message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
-			if err := consumer.processCourReserve(message.Value); err != nil {
-				zap.L().Error("failed to process cour_reserve message", zap.Error(err))
-			}
-			session.MarkMessage(message, "")
-		// Should return when `session.Context()` is done.
-		// If not, will raise `ErrRebalanceInProgress` or `read tcp <ip>:<port>: i/o timeout` when kafka rebalance. see:
-		// https://github.com/IBM/sarama/issues/1192
-		case <-session.Context().Done():
-			return nil
-		}
-	}
-}
-
 func (consumer *CourReserveConsumer) processCourReserve(data []byte) error {
-	var msg CourReserveMessage
-	if err := json.Unmarshal(data, &msg); err != nil {
+	var msg sagamsg.CourReserveMessage
+	if err := sagamsg.Decode(data, &msg); err != nil {
 		return err
 	}
 
-	if msg.Status == CourReserveStatusPending || msg.CourReservationID == 0 {
+	if msg.Status == sagamsg.StatusPending {
 		zap.L().Warn("received bad cour_reserve message",
 			zap.Int64("cour_reserve_id", msg.CourReservationID),
-			zap.Int8("status", msg.Status))
+			zap.String("status", string(msg.Status)))
 		return nil
 	}
 
@@ -251,70 +85,118 @@ func (consumer *CourReserveConsumer) processCourReserve(data []byte) error {
 		zap.L().Sugar().Infof("processed cour_reserve message: %+v", msg)
 	}()
 
+	return skipStaleMessage(consumer.orchestrator.handleCourReserve(&msg))
+}
+
+func (o *Orchestrator) handleCourReserve(msg *sagamsg.CourReserveMessage) error {
+	m := &consumedMessage{consumer: courReserveConsumerName, id: msg.MessageID}
+
 	switch msg.Status {
-	case CourReserveStatusOK:
+	case sagamsg.StatusOK:
 		switch msg.Action {
-		case CourReserve:
-			// подтверждаем заказ и отправляем уведомление на почту
-			db.OrderSetStatus(msg.OrderID, "delivery")
-			go NotifyUser(msg.OrderID, OrderStatusDelivery)
-		case RevertCourReserve:
-			// что-то пошло не так, освободили слот курьеру, возвращаем деньги клиенту
-			// заказ отменится по цепочке после роллбека резерва слота
-			newCourReserveID, err := db.RevertCourReserve(msg.CourReservationID)
-			if err != nil {
-				zap.L().Error("failed to revert cour_reserve", zap.Error(err))
-				return nil
-			}
+		case sagamsg.CourReserve:
+			// курьер зарезервирован, списываем замороженную сумму, заказ уйдет в доставку после списания
+			return m.inTx(func(tx *sql.Tx) error {
+				saga, err := lockCourReserveSaga(tx, msg)
+				if err != nil {
+					return err
+				}
 
-			GetCourReserveProcessor().AddMessage(&CourReserveMessage{
-				StockChangeIDs:    msg.StockChangeIDs,
-				OrderID:           msg.OrderID,
-				Action:            RevertCourReserve,
-				Status:            CourReserveStatusPending,
-				CourReservationID: newCourReserveID,
-			})
-		}
-	case CourReserveStatusFailed:
-		// ретраим
-		if msg.RetryCount < courReserveRetryCount {
-			courReserveID, err := db.CreateCourReserve(msg.OrderID)
-			if err != nil {
-				zap.L().Error("create cour_reserve error", zap.Error(err))
-				return nil
-			}
+				capturePaymentID, err := db.CapturePayment(tx, saga.PaymentID)
+				if err != nil {
+					return err
+				}
+
+				if err := o.addPaymentMessage(tx, &sagamsg.PaymentMessage{
+					PaymentID:      capturePaymentID,
+					OrderID:        msg.OrderID,
+					StockChangeIDs: saga.StockChangeIDs,
+					Action:         sagamsg.PaymentCapture,
+					Status:         sagamsg.StatusPending,
+				}); err != nil {
+					return err
+				}
+
+				saga.CapturePaymentID = capturePaymentID
+				saga.MoveTo(db.SagaStepCapture)
 
-			GetCourReserveProcessor().AddMessage(&CourReserveMessage{
-				OrderID:           msg.OrderID,
-				StockChangeIDs:    msg.StockChangeIDs,
-				PaymentID:         msg.PaymentID,
-				Status:            CourReserveStatusPending,
-				Action:            CourReserve,
-				CourReservationID: courReserveID,
-				RetryCount:        msg.RetryCount + 1,
+				return db.UpdateSaga(tx, saga)
 			})
-			return nil
+		case sagamsg.CourReserveRevert:
+			// освободили слот курьеру, снимаем заморозку или возвращаем списанные деньги
+			// заказ отменится по цепочке после возврата денег и роллбека склада
+			return o.revertPayment(m, msg.OrderID, db.SagaStepRevertCourReserve)
 		}
+	case sagamsg.StatusFailed:
+		switch msg.Action {
+		case sagamsg.CourReserve:
+			if err := m.inTx(func(tx *sql.Tx) error {
+				saga, err := lockCourReserveSaga(tx, msg)
+				if err != nil {
+					return err
+				}
 
-		// что-то пошло не так, все попытки повторить резерв курьера исчерпаны
-		// возвращаем деньги, затем возвращаем товары на склад
-		// заказ отменится по цепочке после роллбека склада
-		newPaymentID, err := db.RevertPayment(msg.PaymentID)
-		if err != nil {
-			zap.L().Error("failed to revert payment", zap.Error(err))
-			return nil
-		}
+				if saga.RetryCount >= o.courReserveRetryCount {
+					// все попытки повторить резерв курьера исчерпаны
+					// снимаем заморозку, затем возвращаем товары на склад
+					// заказ отменится по цепочке после роллбека склада
+					return o.revertPaymentTx(tx, saga)
+				}
+
+				// ретраим
+				courReserveID, err := db.CreateCourReserve(tx, msg.OrderID)
+				if err != nil {
+					return fmt.Errorf("create cour_reserve: %w", err)
+				}
+
+				if err := o.addCourReserveMessage(tx, &sagamsg.CourReserveMessage{
+					OrderID:           msg.OrderID,
+					StockChangeIDs:    saga.StockChangeIDs,
+					PaymentID:         saga.PaymentID,
+					Status:            sagamsg.StatusPending,
+					Action:            sagamsg.CourReserve,
+					CourReservationID: courReserveID,
+					RetryCount:        saga.RetryCount + 1,
+				}); err != nil {
+					return err
+				}
+
+				saga.CourReservationID = courReserveID
+				saga.RetryCount++
 
-		GetPaymentsProcessor().AddMessage(&PaymentMessage{
-			StockChangeIDs: msg.StockChangeIDs,
-			OrderID:        msg.OrderID,
-			Action:         Deposit,
-			Status:         PaymentStatusPending,
-			PaymentID:      newPaymentID,
-		})
+				return db.UpdateSaga(tx, saga)
+			}); err != nil {
+				if errors.Is(err, db.ErrSagaStepMismatch) || errors.Is(err, dbutil.ErrDuplicateMessage) {
+					return err
+				}
+
+				// повторить резерв не удалось, снимаем заморозку, затем возвращаем товары на склад
+				zap.L().Error("create cour_reserve error", zap.Error(err))
+				return o.revertPayment(m, msg.OrderID, db.SagaStepCourReserve)
+			}
+		case sagamsg.CourReserveRevert:
+			// слот освободить не удалось, но оплату клиенту все равно отменяем
+			zap.L().Error("failed to revert cour_reserve", zap.Int64("cour_reserve_id", msg.CourReservationID))
+			return o.revertPayment(m, msg.OrderID, db.SagaStepRevertCourReserve)
+		}
 	default:
-		zap.L().Sugar().Errorf("unknown cour_reserve msg status: %d", msg.Status)
+		zap.L().Sugar().Errorf("unknown cour_reserve msg status: %s", msg.Status)
 	}
 
 	return nil
 }
+
+// lockCourReserveSaga дополнительно сверяет id резерва: после ретрая ответ по старому резерву уже не актуален
+func lockCourReserveSaga(tx *sql.Tx, msg *sagamsg.CourReserveMessage) (*db.Saga, error) {
+	saga, err := db.LockSaga(tx, msg.OrderID, db.SagaStepCourReserve)
+	if err != nil {
+		return nil, err
+	}
+
+	if saga.CourReservationID != msg.CourReservationID {
+		return nil, fmt.Errorf("%w: cour_reserve %d is outdated, current is %d",
+			db.ErrSagaStepMismatch, msg.CourReservationID, saga.CourReservationID)
+	}
+
+	return saga, nil
+}
@@ -1,11 +1,21 @@
 package service
 
 import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"money"
 	"order/db"
 	"order/types"
+	sagamsg "saga"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
@@ -22,25 +32,27 @@ func healthCheckHandler(ctx *fasthttp.RequestCtx) {
 }
 
 var (
-	ErrCreateOrder           = errors.New("create order error")
-	ErrCalculateDeliveryTime = errors.New("calculate delivery time error")
+	ErrCreateOrder       = errors.New("create order error")
+	ErrBadIdempotencyKey = errors.New("idempotency key is too long")
 )
 
 // create_order godoc
 //
 //	@Summary		create order
-//	@Description	create order
+//	@Description	create order delivered on delivery.date within [delivery.from_hour, delivery.to_hour), without delivery the order gets the next free delivery hour; with quote_token from /quote the order is rejected if prices or availability changed since the quote
 //	@Tags			order
 //	@Accept			json
 //	@Produce        json
+//	@Param			Idempotency-Key	header		string	false	"repeated requests with the same key return the original response"
 //	@Success		200	{object}	types.CreateOrderResponse
 //	@Failure		400	{object}	types.HTTPError
 //	@Failure		401	{object}	types.HTTPError
 //	@Failure		404	{object}	types.HTTPError
 //	@Failure		405	{object}	types.HTTPError
+//	@Failure		409	{object}	types.HTTPError
 //	@Failure		500	{object}	types.HTTPError
 //	@Router			/create_order [post]
-func handleCreateOrder(userID int64, ctx *fasthttp.RequestCtx) {
+func handleCreateOrder(o *Orchestrator, userID int64, ctx *fasthttp.RequestCtx) {
 	if string(ctx.Method()) != fasthttp.MethodPost {
 		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
 		return
@@ -52,85 +64,424 @@ func handleCreateOrder(userID int64, ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	mask, err := calculateOrderMaskFromAddress(order.Address)
+	// без расчета цены берутся текущие, присланные клиентом игнорируются
+	for i := range order.Items {
+		order.Items[i].Price = money.Money{}
+	}
+
+	// повтор отвечается сохраненным ответом, даже если расчет истек, цены изменились или дата доставки прошла
+	idempotencyKey := string(ctx.Request.Header.Peek(idempotencyKeyHeader))
+	var requestHash string
+	if len(idempotencyKey) > 0 {
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			handleError(ctx, ErrBadIdempotencyKey, fasthttp.StatusBadRequest)
+			return
+		}
+
+		var err error
+		requestHash, err = hashOrderRequest(&order)
+		if err != nil {
+			zap.L().Error(fmt.Errorf("hash order request: %w", err).Error())
+			handleError(ctx, ErrCreateOrder, fasthttp.StatusBadRequest)
+			return
+		}
+
+		response, found, err := db.GetIdempotentResponse(userID, idempotencyKey, requestHash)
+		if err != nil {
+			handleCreateOrderError(ctx, err)
+			return
+		}
+		if found {
+			writeCreateOrderResponse(ctx, response)
+			return
+		}
+	}
+
+	if len(order.QuoteToken) > 0 {
+		if err := applyQuote(userID, &order); err != nil {
+			switch {
+			case errors.Is(err, ErrQuoteInvalid), errors.Is(err, ErrQuoteMismatch):
+				handleError(ctx, err, fasthttp.StatusBadRequest)
+			case errors.Is(err, ErrQuoteExpired), errors.Is(err, ErrQuoteChanged):
+				handleError(ctx, err, fasthttp.StatusConflict)
+			default:
+				zap.L().Error(fmt.Errorf("apply quote: %w", err).Error())
+				handleError(ctx, ErrCreateOrder, fasthttp.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	window, err := db.NewDeliveryWindow(order.Delivery)
 	if err != nil {
-		zap.L().Error(fmt.Errorf("calculate delivery time: %w", err).Error())
-		handleError(ctx, ErrCreateOrder, fasthttp.StatusBadRequest)
+		handleError(ctx, err, fasthttp.StatusBadRequest)
 		return
 	}
 
-	orderID, err := db.CreateOrder(userID, mask, &order)
+	if len(idempotencyKey) > 0 {
+		createOrderIdempotent(o, userID, window, idempotencyKey, requestHash, &order, ctx)
+		return
+	}
+
+	orderID, err := db.CreateOrder(userID, window, &order)
 	if err != nil {
-		zap.L().Error(fmt.Errorf("create order: %w", err).Error())
-		handleError(ctx, ErrCreateOrder, fasthttp.StatusBadRequest)
+		handleCreateOrderError(ctx, err)
 		return
 	}
 
 	order.ID = orderID
 
-	go postCreateOrder(&order)
+	go o.StartSaga(&order)
 
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.SetContentType("application/json")
 	json.NewEncoder(ctx).Encode(types.CreateOrderResponse{ID: orderID})
 }
 
-// TODO replace with service call
-func calculateOrderMaskFromAddress(_ string) (int64, error) {
-	return 1 << 14, nil
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
+// createOrderIdempotent создает заказ под ключом, который еще не встречался.
+// Конкурентный запрос с тем же ключом получит ответ первого из db.CreateOrderIdempotent
+func createOrderIdempotent(o *Orchestrator, userID int64, window *db.DeliveryWindow, idempotencyKey, requestHash string, order *types.Order, ctx *fasthttp.RequestCtx) {
+	response, replayed, err := db.CreateOrderIdempotent(userID, window, order, idempotencyKey, requestHash)
+	if err != nil {
+		handleCreateOrderError(ctx, err)
+		return
+	}
+
+	if !replayed {
+		go o.StartSaga(order)
+	}
+
+	writeCreateOrderResponse(ctx, response)
 }
 
-func postCreateOrder(order *types.Order) {
-	var (
-		stockChangeIDs []int64
-		err            error
-	)
+func writeCreateOrderResponse(ctx *fasthttp.RequestCtx, response []byte) {
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	ctx.Write(response)
+}
 
-	if stockChangeIDs, err = db.CreateStockChanges(order.ID, order.Items); err != nil {
-		zap.L().Error("create stock changes", zap.Error(err))
-		db.RejectOrder(order.ID)
-		return
+// hashOrderRequest считает хеш от нормализованного тела запроса до применения расчета,
+// чтобы повтор с другим форматированием JSON не считался другим запросом
+func hashOrderRequest(order *types.Order) (string, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return "", err
 	}
 
-	GetStockProcessor().AddMessage(&StockChangeMessage{
-		StockChangeIDs: stockChangeIDs,
-		OrderID:        order.ID,
-		Status:         PaymentStatusPending,
-		Action:         StockRemove,
-	})
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func handleCreateOrderError(ctx *fasthttp.RequestCtx, err error) {
+	switch {
+	case errors.Is(err, db.ErrIdempotencyKeyConflict), errors.Is(err, db.ErrIdempotencyKeyInProgress),
+		errors.Is(err, db.ErrNoFreeCourier):
+		handleError(ctx, err, fasthttp.StatusConflict)
+	case errors.Is(err, db.ErrPriceChanged):
+		handleError(ctx, ErrQuoteChanged, fasthttp.StatusConflict)
+	default:
+		zap.L().Error(fmt.Errorf("create order: %w", err).Error())
+		handleError(ctx, ErrCreateOrder, fasthttp.StatusBadRequest)
+	}
 }
 
-var ErrGetOrders = errors.New("get orders error")
+// StartSaga запускает сагу созданного заказа: резервирует товары на складе
+func (o *Orchestrator) StartSaga(order *types.Order) {
+	if err := db.InTx(func(tx *sql.Tx) error {
+		saga, err := db.LockSaga(tx, order.ID, db.SagaStepCreated)
+		if err != nil {
+			return err
+		}
+
+		stockChangeIDs, err := db.CreateStockChanges(tx, order.ID, order.Items)
+		if err != nil {
+			return fmt.Errorf("create stock changes: %w", err)
+		}
+
+		if err := o.addStockMessage(tx, &sagamsg.StockChangeMessage{
+			StockChangeIDs: stockChangeIDs,
+			OrderID:        order.ID,
+			Status:         sagamsg.StatusPending,
+			Action:         sagamsg.StockRemove,
+		}); err != nil {
+			return err
+		}
+
+		saga.StockChangeIDs = stockChangeIDs
+		saga.MoveTo(db.SagaStepStockRemove)
+
+		return db.UpdateSaga(tx, saga)
+	}); err != nil {
+		if errors.Is(err, db.ErrSagaStepMismatch) {
+			zap.L().Warn("order saga already started", zap.Int64("order_id", order.ID))
+			return
+		}
+
+		zap.L().Error("create stock changes", zap.Error(err))
+		if err := o.cancelOrder(nil, order.ID, db.SagaStepCreated); err != nil {
+			zap.L().Error("cancel order", zap.Error(err))
+		}
+	}
+}
+
+var (
+	ErrGetOrders     = errors.New("get orders error")
+	ErrBadOrderQuery = errors.New("bad orders query")
+)
+
+const (
+	defaultOrdersPageSize = 20
+	maxOrdersPageSize     = 100
+)
 
 // get_orders godoc
 //
 //	@Summary		get orders
-//	@Description	get orders
+//	@Description	get orders page, next page is requested with cursor from next_cursor
+//	@Tags			order
+//	@Produce		json
+//	@Param			status	query		string	false	"comma separated statuses: pending, approved, canceled, delivery, delivered"
+//	@Param			from	query		string	false	"ctime from, RFC3339 or YYYY-MM-DD, inclusive"
+//	@Param			to		query		string	false	"ctime to, RFC3339 or YYYY-MM-DD, exclusive for RFC3339, inclusive for date"
+//	@Param			sort	query		string	false	"asc or desc by ctime, desc by default"
+//	@Param			limit	query		int		false	"page size, 20 by default, 100 max"
+//	@Param			cursor	query		string	false	"next_cursor from previous page"
+//	@Success		200		{object}	types.OrdersPage
+//	@Failure		400		{object}	types.HTTPError
+//	@Failure		401		{object}	types.HTTPError
+//	@Failure		404		{object}	types.HTTPError
+//	@Failure		405		{object}	types.HTTPError
+//	@Failure		500		{object}	types.HTTPError
+//	@Router			/get_orders [get]
+func handleGetOrders(userID int64, ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseOrdersFilter(ctx.QueryArgs())
+	if err != nil {
+		handleError(ctx, fmt.Errorf("%w: %w", ErrBadOrderQuery, err), fasthttp.StatusBadRequest)
+		return
+	}
+
+	// берем на один заказ больше, чтобы понять, есть ли следующая страница
+	limit := filter.Limit
+	filter.Limit++
+
+	orders, err := db.GetOrders(userID, filter)
+	if err != nil {
+		zap.L().Error(fmt.Errorf("get orders: %w", err).Error())
+		handleError(ctx, ErrGetOrders, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	page := types.OrdersPage{Orders: orders}
+	if len(orders) > limit {
+		page.Orders = orders[:limit]
+		last := page.Orders[limit-1]
+		page.NextCursor = encodeOrdersCursor(&types.OrdersCursor{CTime: last.CTime, ID: last.ID})
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(page)
+}
+
+var orderStatuses = []string{"pending", "approved", "canceled", "delivery", "delivered"}
+
+func parseOrdersFilter(args *fasthttp.Args) (*types.OrdersFilter, error) {
+	filter := &types.OrdersFilter{
+		Desc:  true,
+		Limit: defaultOrdersPageSize,
+	}
+
+	if statuses := string(args.Peek("status")); len(statuses) > 0 {
+		for status := range strings.SplitSeq(statuses, ",") {
+			if !slices.Contains(orderStatuses, status) {
+				return nil, fmt.Errorf("unknown status '%s'", status)
+			}
+
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	var err error
+	if from := string(args.Peek("from")); len(from) > 0 {
+		if filter.From, err = parseOrdersTime(from, false); err != nil {
+			return nil, fmt.Errorf("parse from: %w", err)
+		}
+	}
+
+	if to := string(args.Peek("to")); len(to) > 0 {
+		if filter.To, err = parseOrdersTime(to, true); err != nil {
+			return nil, fmt.Errorf("parse to: %w", err)
+		}
+	}
+
+	switch sort := string(args.Peek("sort")); sort {
+	case "", "desc":
+	case "asc":
+		filter.Desc = false
+	default:
+		return nil, fmt.Errorf("unknown sort '%s'", sort)
+	}
+
+	if limit := string(args.Peek("limit")); len(limit) > 0 {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > maxOrdersPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxOrdersPageSize)
+		}
+	}
+
+	if cursor := string(args.Peek("cursor")); len(cursor) > 0 {
+		if filter.After, err = decodeOrdersCursor(cursor); err != nil {
+			return nil, fmt.Errorf("parse cursor: %w", err)
+		}
+	}
+
+	return filter, nil
+}
+
+// parseOrdersTime принимает RFC3339 или дату, дата в правой границе включается целиком
+func parseOrdersTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+
+	return t, nil
+}
+
+// курсор непрозрачен для клиента: ключ последнего заказа страницы в base64
+func encodeOrdersCursor(cursor *types.OrdersCursor) string {
+	data, _ := json.Marshal(cursor)
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeOrdersCursor(value string) (*types.OrdersCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor types.OrdersCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+
+	if cursor.ID <= 0 || cursor.CTime.IsZero() {
+		return nil, errors.New("malformed cursor")
+	}
+
+	return &cursor, nil
+}
+
+var ErrGetOrder = errors.New("get order error")
+
+// get order godoc
+//
+//	@Summary		get order
+//	@Description	get order with item prices and timeline of its stock changes, payments and courier reservations, available to owner and admin
 //	@Tags			order
 //	@Produce		json
-//	@Success		200	{object}	[]types.Order
+//	@Param			id	path		int	true	"order id"
+//	@Success		200	{object}	types.OrderDetails
 //	@Failure		400	{object}	types.HTTPError
 //	@Failure		401	{object}	types.HTTPError
 //	@Failure		404	{object}	types.HTTPError
 //	@Failure		405	{object}	types.HTTPError
 //	@Failure		500	{object}	types.HTTPError
-//	@Router			/get_orders [get]
-func handleGetOrders(userID int64, ctx *fasthttp.RequestCtx) {
+//	@Router			/{id} [get]
+func handleGetOrder(userID int64, isAdmin bool, orderID int64, ctx *fasthttp.RequestCtx) {
 	if string(ctx.Method()) != fasthttp.MethodGet {
 		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
 		return
 	}
 
-	orders, err := db.GetOrders(userID)
+	order, err := db.GetOrder(orderID)
 	if err != nil {
-		zap.L().Error(fmt.Errorf("get orders: %w", err).Error())
-		handleError(ctx, ErrGetOrders, fasthttp.StatusBadRequest)
+		if errors.Is(err, sql.ErrNoRows) {
+			handleError(ctx, ErrOrderNotFound, fasthttp.StatusNotFound)
+			return
+		}
+
+		zap.L().Error(fmt.Errorf("get order: %w", err).Error())
+		handleError(ctx, ErrGetOrder, fasthttp.StatusInternalServerError)
 		return
 	}
 
+	// чужой заказ для пользователя не существует
+	if order.UserID != userID && !isAdmin {
+		handleError(ctx, ErrOrderNotFound, fasthttp.StatusNotFound)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(order)
+}
+
+var ErrCancelOrder = errors.New("cancel order error")
+
+// cancel order godoc
+//
+//	@Summary		cancel order
+//	@Description	cancel pending, approved or in delivery order, reserved stock, payment and courier are reverted
+//	@Tags			order
+//	@Produce		json
+//	@Param			id	path		int	true	"order id"
+//	@Success		200	{object}	types.CancelOrderResponse
+//	@Failure		400	{object}	types.HTTPError
+//	@Failure		401	{object}	types.HTTPError
+//	@Failure		404	{object}	types.HTTPError
+//	@Failure		405	{object}	types.HTTPError
+//	@Failure		409	{object}	types.HTTPError
+//	@Failure		500	{object}	types.HTTPError
+//	@Router			/{id}/cancel [post]
+func handleCancelOrder(o *Orchestrator, userID, orderID int64, ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	canceled, err := o.userCancelOrder(userID, orderID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			handleError(ctx, err, fasthttp.StatusNotFound)
+		case errors.Is(err, ErrOrderNotCancelable):
+			handleError(ctx, err, fasthttp.StatusConflict)
+		default:
+			zap.L().Error(fmt.Errorf("cancel order: %w", err).Error())
+			handleError(ctx, ErrCancelOrder, fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	// отмена с откатом идет асинхронно, итоговый статус придет в уведомлении
+	status := "canceling"
+	if canceled {
+		status = "canceled"
+	}
+
 	ctx.SetStatusCode(fasthttp.StatusOK)
 	ctx.SetContentType("application/json")
-	json.NewEncoder(ctx).Encode(orders)
+	json.NewEncoder(ctx).Encode(types.CancelOrderResponse{ID: orderID, Status: status})
 }
 
 func handleError(ctx *fasthttp.RequestCtx, err error, status int) {
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"order/db"
+	"order/types"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/valyala/fasthttp"
+)
+
+// openTestDB подключается к базе из TEST_DATABASE_URL, в ней должны быть таблицы сервисов и миграции services/order/migrations
+func openTestDB(t *testing.T) {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	if err := db.Open(dsn); err != nil {
+		t.Fatalf("open database: %s", err)
+	}
+}
+
+func callCreateOrder(userID int64, idempotencyKey string, body []byte) (int, []byte) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	if len(idempotencyKey) > 0 {
+		ctx.Request.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+	ctx.Request.SetBody(body)
+
+	// повтор не должен доходить до саги, поэтому оркестратор не нужен
+	handleCreateOrder(nil, userID, &ctx)
+
+	return ctx.Response.StatusCode(), ctx.Response.Body()
+}
+
+func TestCreateOrderReplayAfterQuoteExpiry(t *testing.T) {
+	openTestDB(t)
+
+	prevKey := quoteKey
+	quoteKey = []byte("quote-secret")
+	t.Cleanup(func() { quoteKey = prevKey })
+
+	userID := time.Now().UnixNano() % 1_000_000_000
+	idempotencyKey := fmt.Sprintf("replay-%d", time.Now().UnixNano())
+
+	// расчет истек, а дата доставки уже прошла, как у клиента, который повторяет запрос на следующий день
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, quoteClaims{
+		UserID: userID,
+		Items:  []types.QuoteLine{{ID: 1, Quantity: 2}},
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now().Add(-48 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-24 * time.Hour)),
+		},
+	}).SignedString(quoteKey)
+	if err != nil {
+		t.Fatalf("sign quote: %s", err)
+	}
+
+	order := types.Order{
+		Items:      []types.Item{{Id: 1, Quantity: 2}},
+		QuoteToken: token,
+		Delivery: &types.DeliveryWindow{
+			Date:     time.Now().AddDate(0, 0, -1).Format(time.DateOnly),
+			FromHour: 10,
+			ToHour:   12,
+		},
+	}
+	body, err := json.Marshal(order)
+	if err != nil {
+		t.Fatalf("marshal order: %s", err)
+	}
+
+	// ответ, сохраненный при первом запросе, когда расчет был действителен
+	requestHash, err := hashOrderRequest(&order)
+	if err != nil {
+		t.Fatalf("hash order request: %s", err)
+	}
+	const original = `{"id":4242}`
+	if _, err := db.GetConn().Exec(
+		`insert into order_idempotency_keys(user_id, idempotency_key, request_hash, response) values ($1, $2, $3, $4)`,
+		userID, idempotencyKey, requestHash, original); err != nil {
+		t.Fatalf("insert idempotency key: %s", err)
+	}
+
+	if status, _ := callCreateOrder(userID, "", body); status != fasthttp.StatusConflict {
+		t.Fatalf("without idempotency key: status = %d, want %d", status, fasthttp.StatusConflict)
+	}
+
+	status, response := callCreateOrder(userID, idempotencyKey, body)
+	if status != fasthttp.StatusOK {
+		t.Fatalf("replay: status = %d, body = %s, want %d", status, response, fasthttp.StatusOK)
+	}
+	if string(response) != original {
+		t.Errorf("replay: response = %s, want %s", response, original)
+	}
+}
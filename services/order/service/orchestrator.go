@@ -0,0 +1,67 @@
+package service
+
+import (
+	"database/sql"
+	"order/config"
+	"order/db"
+	sagamsg "saga"
+)
+
+// Orchestrator ведет саги заказов: запросы участникам сохраняет в outbox в одной транзакции с переходом саги,
+// уведомления о статусе заказа ставит в очередь NotificationsProcessor
+type Orchestrator struct {
+	stockTopic       string
+	paymentsTopic    string
+	courReserveTopic string
+
+	courReserveRetryCount int
+
+	notifications *NotificationsProcessor
+}
+
+// NewOrchestrator оркестратор саг, топики запросов участникам берет из конфига продюсеров
+func NewOrchestrator(config *config.Config, notifications *NotificationsProcessor) *Orchestrator {
+	return &Orchestrator{
+		stockTopic:            config.StockProducerConfig.Topic,
+		paymentsTopic:         config.PaymentsProducerConfig.Topic,
+		courReserveTopic:      config.CourReserveProducerConfig.Topic,
+		courReserveRetryCount: config.CourReserveRetryCount,
+		notifications:         notifications,
+	}
+}
+
+// addStockMessage сохраняет запрос складу в outbox в рамках tx, в кафку его отправит OutboxRelay после коммита
+func (o *Orchestrator) addStockMessage(tx *sql.Tx, msg *sagamsg.StockChangeMessage) error {
+	msg.MessageID = newMessageID()
+
+	payload, err := sagamsg.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return db.AddOutboxMessage(tx, o.stockTopic, sagamsg.Key(msg.OrderID), payload)
+}
+
+// addPaymentMessage сохраняет запрос биллингу в outbox в рамках tx
+func (o *Orchestrator) addPaymentMessage(tx *sql.Tx, msg *sagamsg.PaymentMessage) error {
+	msg.MessageID = newMessageID()
+
+	payload, err := sagamsg.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return db.AddOutboxMessage(tx, o.paymentsTopic, sagamsg.Key(msg.OrderID), payload)
+}
+
+// addCourReserveMessage сохраняет запрос доставке в outbox в рамках tx
+func (o *Orchestrator) addCourReserveMessage(tx *sql.Tx, msg *sagamsg.CourReserveMessage) error {
+	msg.MessageID = newMessageID()
+
+	payload, err := sagamsg.Encode(msg)
+	if err != nil {
+		return err
+	}
+
+	return db.AddOutboxMessage(tx, o.courReserveTopic, sagamsg.Key(msg.OrderID), payload)
+}
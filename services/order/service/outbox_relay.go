@@ -0,0 +1,133 @@
+package service
+
+import (
+	"bus"
+	"context"
+	"errors"
+	"lifecycle"
+	"order/config"
+	"order/db"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OutboxRelay публикует сообщения из таблицы outbox в кафку
+// и помечает их отправленными только после подтверждения брокером.
+// Неподтвержденные сообщения остаются в outbox и отправляются повторно на следующем проходе
+type OutboxRelay struct {
+	publisher bus.Publisher
+
+	pollInterval time.Duration
+	batchSize    int
+}
+
+func NewOutboxRelay(config *config.Config, publisher bus.Publisher) *OutboxRelay {
+	pc := config.OutboxConfig.ProducerConfig
+	metrics := bus.NewMetrics("outbox", pendingOutbox)
+
+	return &OutboxRelay{
+		publisher:    bus.NewReliablePublisher(publisher, metrics, pc.Retries, pc.RetryDelay),
+		pollInterval: config.OutboxConfig.PollInterval,
+		batchSize:    config.OutboxConfig.BatchSize,
+	}
+}
+
+// pendingOutbox глубина очереди relay для метрик, -1 если посчитать не удалось
+func pendingOutbox() int {
+	count, err := db.CountPendingOutbox()
+	if err != nil {
+		zap.L().Error("failed to count pending outbox messages", zap.Error(err))
+		return -1
+	}
+
+	return count
+}
+
+// Run отправляет outbox по таймеру, пока не отменен ctx. Сервис останавливает relay последним,
+// после отмены он еще раз вычитывает outbox, чтобы отправить сообщения, сохраненные во время остановки
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	zap.L().Info("outbox relay started")
+
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+RelayLoop:
+	for {
+		select {
+		case <-ticker.C:
+			r.relay(ctx)
+		case <-ctx.Done():
+			break RelayLoop
+		}
+	}
+
+	r.relay(lifecycle.StopContext(ctx))
+
+	if err := r.publisher.Close(); err != nil {
+		zap.L().Error("error closing producer", zap.Error(err))
+	}
+
+	return nil
+}
+
+// relay вычитывает outbox пачками, пока есть неотправленные сообщения. Если из пачки не отправилось
+// ни одно сообщение, брокер недоступен: relay ждет следующего тика, а не перебирает те же строки
+func (r *OutboxRelay) relay(ctx context.Context) {
+	for ctx.Err() == nil {
+		fetched, sent, err := db.RelayOutbox(r.batchSize, func(msgs []db.OutboxMessage) []int64 {
+			return r.publish(ctx, msgs)
+		})
+		if err != nil {
+			zap.L().Error("failed to relay outbox", zap.Error(err))
+			return
+		}
+
+		if fetched > 0 && sent == 0 {
+			zap.L().Warn("no outbox messages published, retrying on next poll", zap.Int("fetched", fetched))
+			return
+		}
+
+		if fetched < r.batchSize {
+			return
+		}
+	}
+}
+
+// publish отправляет пачку и дожидается ответа брокера по каждому сообщению,
+// возвращает id подтвержденных сообщений
+func (r *OutboxRelay) publish(ctx context.Context, msgs []db.OutboxMessage) []int64 {
+	busMsgs := make([]*bus.Message, 0, len(msgs))
+	ids := make(map[*bus.Message]int64, len(msgs))
+	for _, msg := range msgs {
+		zap.L().Sugar().Infof("producing message: %s", string(msg.Payload))
+		busMsg := &bus.Message{
+			Topic: msg.Topic,
+			Key:   []byte(msg.Key),
+			Value: msg.Payload,
+		}
+
+		busMsgs = append(busMsgs, busMsg)
+		ids[busMsg] = msg.ID
+	}
+
+	if err := r.publisher.Publish(ctx, busMsgs...); err != nil {
+		var publishErr *bus.PublishError
+		if !errors.As(err, &publishErr) {
+			zap.L().Error("failed to produce messages", zap.Error(err))
+			return nil
+		}
+
+		for _, failed := range publishErr.Failed {
+			zap.L().Error("failed to produce message", zap.Error(publishErr.Err), zap.Int64("outbox_id", ids[failed]))
+			delete(ids, failed)
+		}
+	}
+
+	sentIDs := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		sentIDs = append(sentIDs, id)
+	}
+
+	return sentIDs
+}
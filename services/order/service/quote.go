@@ -0,0 +1,180 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"money"
+	"order/config"
+	"order/db"
+	"order/types"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrQuoteOrder    = errors.New("quote order error")
+	ErrQuoteInvalid  = errors.New("invalid quote token")
+	ErrQuoteMismatch = errors.New("order does not match quote")
+	ErrQuoteExpired  = errors.New("quote expired")
+	ErrQuoteChanged  = errors.New("prices or availability changed since quote")
+)
+
+var (
+	quoteKey []byte
+	quoteTTL time.Duration
+)
+
+// quoteClaims позиции расчета с ценами, по которым пользователь может создать заказ до истечения токена
+type quoteClaims struct {
+	UserID int64             `json:"user_id"`
+	Items  []types.QuoteLine `json:"items"`
+	Total  money.Money       `json:"total"`
+	jwt.RegisteredClaims
+}
+
+func InitQuotes(config *config.Config) error {
+	data, err := os.ReadFile(config.QuoteConfig.SecretFile)
+	if err != nil {
+		return fmt.Errorf("read quote secret: %w", err)
+	}
+
+	quoteKey = []byte(strings.TrimSpace(string(data)))
+	if len(quoteKey) == 0 {
+		return errors.New("quote secret is empty")
+	}
+
+	quoteTTL = config.QuoteConfig.TTL
+
+	return nil
+}
+
+// quote godoc
+//
+//	@Summary		quote order
+//	@Description	calculate order prices, check items in stock and free delivery slots, returned token can be passed to create_order
+//	@Tags			order
+//	@Accept			json
+//	@Produce		json
+//	@Param			order	body		types.Order	true	"order items"
+//	@Success		200		{object}	types.OrderQuote
+//	@Failure		400		{object}	types.HTTPError
+//	@Failure		401		{object}	types.HTTPError
+//	@Failure		404		{object}	types.HTTPError
+//	@Failure		405		{object}	types.HTTPError
+//	@Failure		409		{object}	types.HTTPError
+//	@Failure		500		{object}	types.HTTPError
+//	@Router			/quote [post]
+func handleQuoteOrder(userID int64, ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodPost {
+		ctx.Error("method not allowed", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	var order types.Order
+	if err := json.Unmarshal(ctx.Request.Body(), &order); err != nil {
+		handleError(ctx, err, fasthttp.StatusBadRequest)
+		return
+	}
+
+	lines, total, err := db.QuoteOrder(order.Items)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrEmptyOrder), errors.Is(err, db.ErrBadQuantity), errors.Is(err, db.ErrItemNotFound):
+			handleError(ctx, err, fasthttp.StatusBadRequest)
+		case errors.Is(err, db.ErrNotEnoughStock):
+			handleError(ctx, err, fasthttp.StatusConflict)
+		default:
+			zap.L().Error(fmt.Errorf("quote order: %w", err).Error())
+			handleError(ctx, ErrQuoteOrder, fasthttp.StatusInternalServerError)
+		}
+		return
+	}
+
+	slots, err := db.GetDeliverySlots()
+	if err != nil {
+		zap.L().Error(fmt.Errorf("get delivery slots: %w", err).Error())
+		handleError(ctx, ErrQuoteOrder, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(quoteTTL)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, quoteClaims{
+		UserID: userID,
+		Items:  lines,
+		Total:  total,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}).SignedString(quoteKey)
+	if err != nil {
+		zap.L().Error(fmt.Errorf("sign quote: %w", err).Error())
+		handleError(ctx, ErrQuoteOrder, fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(fasthttp.StatusOK)
+	ctx.SetContentType("application/json")
+	json.NewEncoder(ctx).Encode(types.OrderQuote{
+		Items:         lines,
+		Total:         total,
+		DeliverySlots: slots,
+		QuoteToken:    token,
+		ExpiresAt:     expiresAt,
+	})
+}
+
+// applyQuote проверяет токен расчета и проставляет позициям заказа цены из него.
+// Заказ отклоняется, если с момента расчета изменились цены или товара не хватает на складе
+func applyQuote(userID int64, order *types.Order) error {
+	var claims quoteClaims
+	if _, err := jwt.ParseWithClaims(order.QuoteToken, &claims, func(token *jwt.Token) (any, error) {
+		return quoteKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired()); err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return ErrQuoteExpired
+		}
+
+		return fmt.Errorf("%w: %w", ErrQuoteInvalid, err)
+	}
+
+	if claims.UserID != userID {
+		return ErrQuoteInvalid
+	}
+
+	if len(claims.Items) != len(order.Items) {
+		return ErrQuoteMismatch
+	}
+
+	for i, line := range claims.Items {
+		if order.Items[i].Id != line.ID || order.Items[i].Quantity != line.Quantity {
+			return ErrQuoteMismatch
+		}
+	}
+
+	lines, _, err := db.QuoteOrder(order.Items)
+	if err != nil {
+		if errors.Is(err, db.ErrNotEnoughStock) || errors.Is(err, db.ErrItemNotFound) {
+			return fmt.Errorf("%w: %w", ErrQuoteChanged, err)
+		}
+
+		return err
+	}
+
+	for i, line := range lines {
+		if !line.Price.Equal(claims.Items[i].Price) {
+			return fmt.Errorf("%w: item %d price %v, quoted %v", ErrQuoteChanged, line.ID, line.Price, claims.Items[i].Price)
+		}
+
+		// цену еще раз сверит создание заказа в одной транзакции со снимком цен
+		order.Items[i].Price = claims.Items[i].Price
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"order/config"
+	"order/db"
+	sagamsg "saga"
+
+	"go.uber.org/zap"
+)
+
+// courReserveActions действия сообщений по courier_reservation.action: отмена резерва хранится в базе как revert_reserve
+var courReserveActions = map[string]sagamsg.CourReserveAction{
+	"reserve":        sagamsg.CourReserve,
+	"revert_reserve": sagamsg.CourReserveRevert,
+}
+
+// replayMessage запрос к участнику саги, который нужно отправить повторно
+type replayMessage struct {
+	topic   string
+	orderID int64
+	msg     sagamsg.Message
+}
+
+// Replay заново отправляет запросы участникам саги по строкам stock_changes, payments и courier_reservation,
+// которые все еще в статусе pending. Сообщения получают новые id и сохраняются в outbox, в кафку их отправит OutboxRelay.
+// Участник обрабатывает только pending строки, поэтому повторная отправка безопасна.
+// Каждое сообщение печатается в out, в режиме dryRun в outbox ничего не сохраняется. Возвращает число сообщений
+func Replay(config *config.Config, filter *db.ReplayFilter, dryRun bool, out io.Writer) (int, error) {
+	msgs, err := buildReplayMessages(config, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	payloads := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		payload, err := sagamsg.Encode(m.msg)
+		if err != nil {
+			return 0, fmt.Errorf("encode message for order %d: %w", m.orderID, err)
+		}
+
+		fmt.Fprintf(out, "%s\t%s\t%s\n", m.topic, sagamsg.Key(m.orderID), payload)
+		payloads = append(payloads, payload)
+	}
+
+	if dryRun || len(msgs) == 0 {
+		return len(msgs), nil
+	}
+
+	if err := db.InTx(func(tx *sql.Tx) error {
+		for i, m := range msgs {
+			if err := db.AddOutboxMessage(tx, m.topic, sagamsg.Key(m.orderID), payloads[i]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	zap.L().Info("saga messages replayed", zap.Int("count", len(msgs)))
+
+	return len(msgs), nil
+}
+
+func buildReplayMessages(config *config.Config, filter *db.ReplayFilter) ([]replayMessage, error) {
+	stockChanges, err := db.GetPendingStockChanges(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	payments, err := db.GetPendingPayments(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	reserves, err := db.GetPendingCourReserves(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]replayMessage, 0, len(stockChanges)+len(payments)+len(reserves))
+	for _, sc := range stockChanges {
+		msgs = append(msgs, replayMessage{
+			topic:   config.StockProducerConfig.Topic,
+			orderID: sc.OrderID,
+			msg: &sagamsg.StockChangeMessage{
+				Header:         sagamsg.Header{MessageID: newMessageID()},
+				OrderID:        sc.OrderID,
+				StockChangeIDs: sc.IDs,
+				Action:         sagamsg.StockAction(sc.Action),
+				Status:         sagamsg.StatusPending,
+			},
+		})
+	}
+
+	for _, p := range payments {
+		msgs = append(msgs, replayMessage{
+			topic:   config.PaymentsProducerConfig.Topic,
+			orderID: p.OrderID,
+			msg: &sagamsg.PaymentMessage{
+				Header:         sagamsg.Header{MessageID: newMessageID()},
+				PaymentID:      p.ID,
+				OrderID:        p.OrderID,
+				StockChangeIDs: p.StockChangeIDs,
+				Action:         sagamsg.PaymentAction(p.Action),
+				Status:         sagamsg.StatusPending,
+			},
+		})
+	}
+
+	for _, r := range reserves {
+		m, err := courReserveReplayMessage(config.CourReserveProducerConfig.Topic, r)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func courReserveReplayMessage(topic string, r db.PendingCourReserve) (replayMessage, error) {
+	action, ok := courReserveActions[r.Action]
+	if !ok {
+		return replayMessage{}, fmt.Errorf("cour_reserve %d: unknown action %q", r.ID, r.Action)
+	}
+
+	return replayMessage{
+		topic:   topic,
+		orderID: r.OrderID,
+		msg: &sagamsg.CourReserveMessage{
+			Header:            sagamsg.Header{MessageID: newMessageID()},
+			PaymentID:         r.PaymentID,
+			OrderID:           r.OrderID,
+			StockChangeIDs:    r.StockChangeIDs,
+			CourReservationID: r.ID,
+			Action:            action,
+			Status:            sagamsg.StatusPending,
+			RetryCount:        r.RetryCount,
+		},
+	}, nil
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"bytes"
+	"money"
+	"order/config"
+	"order/db"
+	sagamsg "saga"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCourReserveReplayMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		wantAction sagamsg.CourReserveAction
+		wantErr    bool
+	}{
+		{name: "pending reserve", action: "reserve", wantAction: sagamsg.CourReserve},
+		{name: "pending revert", action: "revert_reserve", wantAction: sagamsg.CourReserveRevert},
+		{name: "unknown action", action: "revert", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := courReserveReplayMessage("cour_reserve", db.PendingCourReserve{
+				ID:             7,
+				OrderID:        42,
+				Action:         tt.action,
+				PaymentID:      3,
+				StockChangeIDs: []int64{1, 2},
+				RetryCount:     1,
+			})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("action %q: expected error", tt.action)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("action %q: %s", tt.action, err)
+			}
+
+			// сообщение должно пройти проверку участника так же, как при отправке через outbox
+			payload, err := sagamsg.Encode(m.msg)
+			if err != nil {
+				t.Fatalf("encode: %s", err)
+			}
+
+			var got sagamsg.CourReserveMessage
+			if err := sagamsg.Decode(payload, &got); err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if got.Action != tt.wantAction {
+				t.Errorf("action = %q, want %q", got.Action, tt.wantAction)
+			}
+			if got.CourReservationID != 7 || got.OrderID != 42 || got.PaymentID != 3 || got.RetryCount != 1 ||
+				got.Status != sagamsg.StatusPending {
+				t.Errorf("unexpected message %+v", got)
+			}
+			if m.topic != "cour_reserve" || m.orderID != 42 {
+				t.Errorf("topic = %q, order = %d", m.topic, m.orderID)
+			}
+		})
+	}
+}
+
+// newReplayOrder создает заказ с payments pending платежами, ctime платежей - createdAt или NOW()
+func newReplayOrder(t *testing.T, payments int, createdAt time.Time) int64 {
+	t.Helper()
+
+	var orderID int64
+	if err := db.GetConn().QueryRow(
+		`insert into orders(user_id, items, work_date, hour_mask, subtotal, total) values($1, '[]', current_date, 1, $2, $2) returning id`,
+		time.Now().UnixNano()%1_000_000_000, money.FromMinor(10000)).Scan(&orderID); err != nil {
+		t.Fatalf("create order: %s", err)
+	}
+
+	for range payments {
+		if _, err := db.GetConn().Exec(
+			`insert into payments(order_id, action, amount, ctime) values($1, 'pay', $2, coalesce($3::timestamp, NOW()))`,
+			orderID, money.FromMinor(10000), nullTime(createdAt)); err != nil {
+			t.Fatalf("create payment: %s", err)
+		}
+	}
+
+	return orderID
+}
+
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+func outboxCount(t *testing.T, orderID int64) int {
+	t.Helper()
+
+	var count int
+	if err := db.GetConn().QueryRow(`select count(*) from outbox where msg_key = $1`, sagamsg.Key(orderID)).Scan(&count); err != nil {
+		t.Fatalf("count outbox: %s", err)
+	}
+
+	return count
+}
+
+func TestReplay(t *testing.T) {
+	openTestDB(t)
+
+	cfg := config.NewConfig()
+	cfg.PaymentsProducerConfig.Topic = "payments"
+
+	// платежи второго заказа созданы в отдельную секунду в прошлом, чтобы выборка по времени не задела строки других запусков
+	from := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(time.Now().UnixNano()%(365*24*3600)) * time.Second)
+	byOrder := newReplayOrder(t, 2, time.Time{})
+	byTime := newReplayOrder(t, 1, from)
+
+	// шаги выполняются по очереди, число строк в outbox накапливается
+	tests := []struct {
+		name        string
+		filter      db.ReplayFilter
+		dryRun      bool
+		wantCount   int
+		wantByOrder int
+		wantByTime  int
+	}{
+		{
+			name:      "dry run by order",
+			filter:    db.ReplayFilter{OrderID: byOrder},
+			dryRun:    true,
+			wantCount: 2,
+		},
+		{
+			name:        "by order",
+			filter:      db.ReplayFilter{OrderID: byOrder},
+			wantCount:   2,
+			wantByOrder: 2,
+		},
+		{
+			name:        "dry run by time",
+			filter:      db.ReplayFilter{From: from, To: from.Add(time.Second)},
+			dryRun:      true,
+			wantCount:   1,
+			wantByOrder: 2,
+		},
+		{
+			name:        "by time",
+			filter:      db.ReplayFilter{From: from, To: from.Add(time.Second)},
+			wantCount:   1,
+			wantByOrder: 2,
+			wantByTime:  1,
+		},
+		{
+			name:        "time range before the rows",
+			filter:      db.ReplayFilter{From: from.Add(-time.Second), To: from},
+			wantCount:   0,
+			wantByOrder: 2,
+			wantByTime:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			count, err := Replay(cfg, &tt.filter, tt.dryRun, &out)
+			if err != nil {
+				t.Fatalf("replay: %s", err)
+			}
+
+			if count != tt.wantCount {
+				t.Errorf("replayed %d messages, want %d", count, tt.wantCount)
+			}
+			if lines := strings.Count(out.String(), "\n"); lines != tt.wantCount {
+				t.Errorf("printed %d messages, want %d", lines, tt.wantCount)
+			}
+
+			if got := outboxCount(t, byOrder); got != tt.wantByOrder {
+				t.Errorf("outbox rows of order %d = %d, want %d", byOrder, got, tt.wantByOrder)
+			}
+			if got := outboxCount(t, byTime); got != tt.wantByTime {
+				t.Errorf("outbox rows of order %d = %d, want %d", byTime, got, tt.wantByTime)
+			}
+		})
+	}
+}
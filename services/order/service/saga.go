@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"dbutil"
+	"errors"
+	"order/db"
+	"order/types"
+	sagamsg "saga"
+
+	"go.uber.org/zap"
+)
+
+// имена консьюмеров, под которыми отмечаются обработанные ответы участников
+const (
+	stockConsumerName       = "order.stock"
+	paymentsConsumerName    = "order.payments"
+	courReserveConsumerName = "order.cour_reserve"
+)
+
+// consumedMessage ответ участника саги. Его обработка фиксируется в той же транзакции, что и переход саги,
+// поэтому повторно доставленное сообщение не двинет сагу дважды
+type consumedMessage struct {
+	consumer string
+	id       string
+}
+
+// inTx выполняет fn в транзакции вместе с отметкой об обработке сообщения, nil-сообщение ничего не отмечает
+func (m *consumedMessage) inTx(fn func(tx *sql.Tx) error) error {
+	return db.InTx(func(tx *sql.Tx) error {
+		if m != nil {
+			if err := dbutil.MarkMessageProcessed(tx, m.consumer, m.id); err != nil {
+				return err
+			}
+		}
+
+		return fn(tx)
+	})
+}
+
+// newMessageID генерирует уникальный id сообщения саги, по нему участник отбрасывает повторную доставку
+func newMessageID() string {
+	return rand.Text()
+}
+
+// skipStaleMessage гасит ответы, которые не соответствуют текущему шагу саги:
+// дубликаты и ответы, уже обработанные при восстановлении, не должны двигать сагу повторно
+func skipStaleMessage(err error) error {
+	if errors.Is(err, db.ErrSagaStepMismatch) || errors.Is(err, dbutil.ErrDuplicateMessage) {
+		zap.L().Warn("skip stale saga message", zap.Error(err))
+		return nil
+	}
+
+	return err
+}
+
+// RecoverSagas доводит до конца саги, прерванные рестартом сервиса.
+// Если участник уже обработал запрос текущего шага, применяем его результат,
+// иначе отправляем запрос повторно. При остановке сервиса оставшиеся саги восстановит следующий запуск
+func (o *Orchestrator) RecoverSagas(ctx context.Context) {
+	sagas, err := db.GetUnfinishedSagas()
+	if err != nil {
+		zap.L().Error("failed to get unfinished sagas", zap.Error(err))
+		return
+	}
+
+	zap.L().Info("recovering sagas", zap.Int("count", len(sagas)))
+
+	for i := range sagas {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err := skipStaleMessage(o.recoverSaga(&sagas[i])); err != nil {
+			zap.L().Error("failed to recover saga", zap.Error(err),
+				zap.Int64("order_id", sagas[i].OrderID),
+				zap.String("step", sagas[i].Step))
+		}
+	}
+}
+
+func (o *Orchestrator) recoverSaga(saga *db.Saga) error {
+	switch saga.Step {
+	case db.SagaStepCreated:
+		items, err := db.GetOrderItems(saga.OrderID)
+		if err != nil {
+			return err
+		}
+
+		o.StartSaga(&types.Order{ID: saga.OrderID, Items: items})
+	case db.SagaStepStockRemove, db.SagaStepRevertStock:
+		msg := &sagamsg.StockChangeMessage{
+			StockChangeIDs: saga.StockChangeIDs,
+			OrderID:        saga.OrderID,
+			Action:         sagamsg.StockRemove,
+		}
+		if saga.Step == db.SagaStepRevertStock {
+			msg.StockChangeIDs = saga.RevertStockChangeIDs
+			msg.Action = sagamsg.StockAdd
+		}
+
+		status, err := db.GetStockChangesStatus(db.GetConn(), msg.StockChangeIDs)
+		if err != nil {
+			return err
+		}
+
+		if msg.Status = participantStatus(status); msg.Status == sagamsg.StatusPending {
+			return resendSagaStep(saga, func(tx *sql.Tx) error {
+				return o.addStockMessage(tx, msg)
+			})
+		}
+
+		return o.handleStockChange(msg)
+	case db.SagaStepPayment, db.SagaStepCapture, db.SagaStepRevertPayment:
+		msg := &sagamsg.PaymentMessage{
+			PaymentID:      saga.PaymentID,
+			OrderID:        saga.OrderID,
+			StockChangeIDs: saga.StockChangeIDs,
+			Action:         sagamsg.PaymentPay,
+		}
+		switch saga.Step {
+		case db.SagaStepCapture:
+			msg.PaymentID = saga.CapturePaymentID
+			msg.Action = sagamsg.PaymentCapture
+		case db.SagaStepRevertPayment:
+			// откат оплаты - снятие заморозки или возврат денег, смотря что успели сделать
+			action, err := db.GetPaymentAction(db.GetConn(), saga.RevertPaymentID)
+			if err != nil {
+				return err
+			}
+
+			msg.PaymentID = saga.RevertPaymentID
+			msg.Action = sagamsg.PaymentAction(action)
+		}
+
+		status, err := db.GetPaymentStatus(db.GetConn(), msg.PaymentID)
+		if err != nil {
+			return err
+		}
+
+		if msg.Status = participantStatus(status); msg.Status == sagamsg.StatusPending {
+			return resendSagaStep(saga, func(tx *sql.Tx) error {
+				return o.addPaymentMessage(tx, msg)
+			})
+		}
+
+		return o.handlePayment(msg)
+	case db.SagaStepCourReserve, db.SagaStepRevertCourReserve:
+		msg := &sagamsg.CourReserveMessage{
+			PaymentID:         saga.PaymentID,
+			OrderID:           saga.OrderID,
+			StockChangeIDs:    saga.StockChangeIDs,
+			CourReservationID: saga.CourReservationID,
+			Action:            sagamsg.CourReserve,
+			RetryCount:        saga.RetryCount,
+		}
+		if saga.Step == db.SagaStepRevertCourReserve {
+			msg.CourReservationID = saga.RevertCourReservationID
+			msg.Action = sagamsg.CourReserveRevert
+		}
+
+		status, err := db.GetCourReserveStatus(db.GetConn(), msg.CourReservationID)
+		if err != nil {
+			return err
+		}
+
+		if msg.Status = participantStatus(status); msg.Status == sagamsg.StatusPending {
+			return resendSagaStep(saga, func(tx *sql.Tx) error {
+				return o.addCourReserveMessage(tx, msg)
+			})
+		}
+
+		return o.handleCourReserve(msg)
+	}
+
+	return nil
+}
+
+// resendSagaStep повторно отправляет запрос текущего шага, если участник его еще не обработал
+func resendSagaStep(saga *db.Saga, send func(tx *sql.Tx) error) error {
+	return db.InTx(func(tx *sql.Tx) error {
+		locked, err := db.LockSaga(tx, saga.OrderID, saga.Step)
+		if err != nil {
+			return err
+		}
+
+		if err := send(tx); err != nil {
+			return err
+		}
+
+		locked.RetryCount++
+
+		return db.UpdateSaga(tx, locked)
+	})
+}
+
+// participantStatus переводит статус строки участника в статус сообщения саги
+func participantStatus(status string) sagamsg.Status {
+	switch status {
+	case db.ParticipantStatusOK:
+		return sagamsg.StatusOK
+	case db.ParticipantStatusFailed:
+		return sagamsg.StatusFailed
+	default:
+		return sagamsg.StatusPending
+	}
+}
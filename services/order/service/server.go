@@ -1,13 +1,17 @@
 package service
 
 import (
+	"bus"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"order/config"
 	"order/redis"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 )
@@ -19,7 +23,9 @@ var ErrAccessTokenExpired = errors.New("access-token expired")
 var ErrRedis = errors.New("redis error")
 var ErrParseAccessToken = errors.New("failed to parse access-token")
 
-func NewServer(config *config.Config) *fasthttp.Server {
+func NewServer(config *config.Config, orchestrator *Orchestrator, deadLetters *bus.DeadLetters) *fasthttp.Server {
+	loadPublicKey()
+
 	basePath := strings.Trim(config.BasePath, "/")
 	s := &fasthttp.Server{
 		Handler: func(ctx *fasthttp.RequestCtx) {
@@ -30,7 +36,7 @@ func NewServer(config *config.Config) *fasthttp.Server {
 			}
 
 			switch parts[1] {
-			case "create_order", "get_orders":
+			case "create_order", "get_orders", "quote":
 				switch {
 				case len(parts) == 2:
 					var (
@@ -38,25 +44,80 @@ func NewServer(config *config.Config) *fasthttp.Server {
 						err    error
 					)
 
-					if userId, err = authMiddleware(config.AuthAddr, ctx); err != nil {
+					if userId, _, err = authMiddleware(config.AuthAddr, ctx); err != nil {
 						handleError(ctx, err, fasthttp.StatusUnauthorized)
 						return
 					}
 
 					switch parts[1] {
 					case "create_order":
-						handleCreateOrder(userId, ctx)
+						handleCreateOrder(orchestrator, userId, ctx)
 					case "get_orders":
 						handleGetOrders(userId, ctx)
+					case "quote":
+						handleQuoteOrder(userId, ctx)
 					}
 				default:
 					ctx.Error("not found", fasthttp.StatusNotFound)
 					return
 				}
+			case "dead_letters", "redrive_dead_letter":
+				if len(parts) != 2 {
+					ctx.Error("not found", fasthttp.StatusNotFound)
+					return
+				}
+
+				_, isAdmin, err := authMiddleware(config.AuthAddr, ctx)
+				if err != nil {
+					handleError(ctx, err, fasthttp.StatusUnauthorized)
+					return
+				}
+
+				if !isAdmin {
+					ctx.Error("Forbidden", fasthttp.StatusForbidden)
+					return
+				}
+
+				switch parts[1] {
+				case "dead_letters":
+					handleGetDeadLetters(deadLetters, ctx)
+				case "redrive_dead_letter":
+					handleRedriveDeadLetter(deadLetters, ctx)
+				}
 			case "health":
 				healthCheckHandler(ctx)
+			case "metrics":
+				// метрики продюсеров: {"producers": {...}}
+				ctx.SetContentType("application/json")
+				bus.WriteMetrics(ctx)
 			default:
-				ctx.Error("not found", fasthttp.StatusNotFound)
+				// /{id}/...
+				orderID, err := strconv.ParseInt(parts[1], 10, 64)
+				if err != nil || orderID <= 0 {
+					ctx.Error("not found", fasthttp.StatusNotFound)
+					return
+				}
+
+				switch {
+				case len(parts) == 2:
+					userId, isAdmin, err := authMiddleware(config.AuthAddr, ctx)
+					if err != nil {
+						handleError(ctx, err, fasthttp.StatusUnauthorized)
+						return
+					}
+
+					handleGetOrder(userId, isAdmin, orderID, ctx)
+				case len(parts) == 3 && parts[2] == "cancel":
+					userId, _, err := authMiddleware(config.AuthAddr, ctx)
+					if err != nil {
+						handleError(ctx, err, fasthttp.StatusUnauthorized)
+						return
+					}
+
+					handleCancelOrder(orchestrator, userId, orderID, ctx)
+				default:
+					ctx.Error("not found", fasthttp.StatusNotFound)
+				}
 			}
 		},
 
@@ -70,50 +131,66 @@ func NewServer(config *config.Config) *fasthttp.Server {
 	return s
 }
 
-func authMiddleware(addr string, ctx *fasthttp.RequestCtx) (int64, error) {
+func authMiddleware(addr string, ctx *fasthttp.RequestCtx) (int64, bool, error) {
 	authHeader := string(ctx.Request.Header.Peek("Authorization"))
 	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return 0, ErrNoAccessToken
+		return 0, false, ErrNoAccessToken
 	}
 
 	accessToken := strings.TrimPrefix(authHeader, "Bearer ")
 	claims, err := parseToken(accessToken)
 	if err != nil {
 		if !errors.Is(err, ErrTokenExpired) {
-			return 0, fmt.Errorf("failed to parse access token: %w", err)
+			return 0, false, fmt.Errorf("failed to parse access token: %w", err)
 		}
 
 		if accessToken, err = refreshToken(addr, ctx); err != nil {
-			return 0, fmt.Errorf("failed to refresh token: %w", err)
+			return 0, false, fmt.Errorf("failed to refresh token: %w", err)
 		}
 
 		if claims, err = parseToken(accessToken); err != nil {
-			return 0, ErrParseAccessToken
+			return 0, false, ErrParseAccessToken
 		}
 	}
 
 	// Проверка в Redis
 	exists, err := redis.Client.CheckTokenBlacklist(blAtKeyPrefix, claims)
 	if err != nil && !errors.Is(err, redis.ErrNil) {
-		return 0, ErrRedis
+		return 0, false, ErrRedis
 	}
 
 	// Был сделан logout, нужно логиниться заново
 	if exists {
-		return 0, ErrAccessTokenExpired
+		return 0, false, ErrAccessTokenExpired
 	}
 
 	if userId, ok := claims["user_id"]; !ok {
-		return 0, fmt.Errorf("user_id not found in claims")
+		return 0, false, fmt.Errorf("user_id not found in claims")
 	} else {
 		if _, ok := userId.(float64); !ok {
-			return 0, fmt.Errorf("user_id is not a float64")
+			return 0, false, fmt.Errorf("user_id is not a float64")
 		}
 
-		return int64(userId.(float64)), nil
+		return int64(userId.(float64)), checkIsAdmin(claims), nil
 	}
 }
 
+func checkIsAdmin(claims jwt.MapClaims) bool {
+	roles, ok := claims["roles"]
+	if !ok {
+		zap.L().Warn("roles not found in claims")
+		return false
+	}
+
+	rolesSlice, ok := roles.(string)
+	if !ok {
+		zap.L().Warn("roles is not a string", zap.String("type", fmt.Sprintf("%T", roles)))
+		return false
+	}
+
+	return slices.Contains(strings.Split(rolesSlice, ","), "admin")
+}
+
 const refreshCookieName = "refresh_token"
 
 func refreshToken(authAddr string, ctx *fasthttp.RequestCtx) (string, error) {
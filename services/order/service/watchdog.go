@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"order/config"
+	"order/db"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Watchdog следит за сагами, которые слишком долго ждут ответа на своем шаге,
+// и запускает для них компенсацию
+type Watchdog struct {
+	orchestrator *Orchestrator
+
+	checkInterval time.Duration
+	stepTimeouts  map[string]time.Duration
+}
+
+func NewWatchdog(config *config.Config, orchestrator *Orchestrator) *Watchdog {
+	return &Watchdog{
+		orchestrator:  orchestrator,
+		checkInterval: config.WatchdogConfig.CheckInterval,
+		stepTimeouts: map[string]time.Duration{
+			db.SagaStepCreated:           config.WatchdogConfig.CreatedTimeout,
+			db.SagaStepStockRemove:       config.WatchdogConfig.StockTimeout,
+			db.SagaStepPayment:           config.WatchdogConfig.PaymentTimeout,
+			db.SagaStepCourReserve:       config.WatchdogConfig.CourReserveTimeout,
+			db.SagaStepCapture:           config.WatchdogConfig.CaptureTimeout,
+			db.SagaStepRevertCourReserve: config.WatchdogConfig.RevertTimeout,
+			db.SagaStepRevertPayment:     config.WatchdogConfig.RevertTimeout,
+			db.SagaStepRevertStock:       config.WatchdogConfig.RevertTimeout,
+		},
+	}
+}
+
+// Run проверяет саги по таймеру, пока не отменен ctx
+func (w *Watchdog) Run(ctx context.Context) error {
+	zap.L().Info("watchdog started")
+
+	ticker := time.NewTicker(w.checkInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.check()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (w *Watchdog) check() {
+	for step, timeout := range w.stepTimeouts {
+		// нулевой таймаут отключает проверку шага
+		if timeout <= 0 {
+			continue
+		}
+
+		sagas, err := db.GetStuckSagas(step, time.Now().Add(-timeout))
+		if err != nil {
+			zap.L().Error("failed to get stuck sagas", zap.Error(err), zap.String("step", step))
+			continue
+		}
+
+		for i := range sagas {
+			zap.L().Warn("saga step timed out",
+				zap.Int64("order_id", sagas[i].OrderID),
+				zap.String("step", step),
+				zap.Time("mtime", sagas[i].MTime))
+
+			if err := skipStaleMessage(w.orchestrator.expireSagaStep(&sagas[i])); err != nil {
+				zap.L().Error("failed to expire saga step", zap.Error(err), zap.Int64("order_id", sagas[i].OrderID))
+			}
+		}
+	}
+}
+
+// expireSagaStep помечает запрос зависшего шага упавшим, чтобы участник его уже не обработал,
+// проставляет ошибку заказу и откатывает то, что успели сделать предыдущие шаги.
+// Пользователь получит уведомление об отмене заказа в конце цепочки компенсаций
+func (o *Orchestrator) expireSagaStep(saga *db.Saga) error {
+	switch saga.Step {
+	case db.SagaStepRevertCourReserve, db.SagaStepRevertPayment, db.SagaStepRevertStock:
+		// компенсацию не отменяем, а доводим до конца: применяем ответ или отправляем запрос повторно
+		return o.recoverSaga(saga)
+	}
+
+	reason := fmt.Sprintf("step '%s' timed out", saga.Step)
+
+	expired, canceled := false, false
+	if err := db.InTx(func(tx *sql.Tx) error {
+		locked, err := db.LockSaga(tx, saga.OrderID, saga.Step)
+		if err != nil {
+			return err
+		}
+
+		status := db.ParticipantStatusFailed
+		if locked.Step != db.SagaStepCreated {
+			if status, err = failPendingStep(tx, locked, reason); err != nil {
+				return err
+			}
+		}
+
+		// участник успел обработать запрос, значит потерялся только ответ
+		if status != db.ParticipantStatusFailed {
+			return nil
+		}
+
+		expired = true
+
+		if err := db.OrderSetError(tx, locked.OrderID, reason); err != nil {
+			return err
+		}
+
+		switch locked.Step {
+		case db.SagaStepPayment:
+			// деньги не списаны, возвращаем товары на склад
+			return o.revertStockChangesTx(tx, locked)
+		case db.SagaStepCourReserve:
+			// курьер не зарезервирован, снимаем заморозку и возвращаем товары
+			return o.revertPaymentTx(tx, locked)
+		case db.SagaStepCapture:
+			// деньги не списаны, освобождаем курьера, затем снимаем заморозку и возвращаем товары
+			return o.revertCourReserveTx(tx, locked)
+		default:
+			// со склада ничего не списано
+			canceled = true
+			return cancelOrderTx(tx, locked)
+		}
+	}); err != nil {
+		return err
+	}
+
+	if !expired {
+		return o.recoverSaga(saga)
+	}
+
+	if canceled {
+		go o.NotifyUser(context.Background(), saga.OrderID, OrderStatusCanceled)
+	}
+
+	return nil
+}
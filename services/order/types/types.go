@@ -1,30 +1,124 @@
 package types
 
-import "time"
+import (
+	"bus"
+	"money"
+	"time"
+)
 
 type HTTPError struct {
 	Error string `json:"error"`
 }
 
 type Order struct {
-	ID        int64     `json:"id,omitempty"`
-	Items     []Item    `json:"items"`
-	Status    string    `json:"status,omitempty"`
-	Address   string    `json:"address,omitempty"`
-	StartTime string    `json:"start_time"`
-	EndTime   string    `json:"end_time"`
-	Error     string    `json:"error,omitempty"`
-	CTime     time.Time `json:"ctime"`
-	MTime     time.Time `json:"mtime"`
+	ID        int64       `json:"id,omitempty"`
+	Items     []Item      `json:"items"`
+	Status    string      `json:"status,omitempty"`
+	Address   string      `json:"address,omitempty"`
+	StartTime string      `json:"start_time"`
+	EndTime   string      `json:"end_time"`
+	Error     string      `json:"error,omitempty"`
+	Subtotal  money.Money `json:"subtotal" swaggertype:"number"`
+	Total     money.Money `json:"total" swaggertype:"number"`
+	CTime     time.Time   `json:"ctime"`
+	MTime     time.Time   `json:"mtime"`
+	// токен из /quote, если передан, заказ создается только по ценам из расчета
+	QuoteToken string          `json:"quote_token,omitempty"`
+	Delivery   *DeliveryWindow `json:"delivery,omitempty"`
+}
+
+// DeliveryWindow желаемые дата и часы доставки, to_hour не включается
+type DeliveryWindow struct {
+	Date     string `json:"date"`
+	FromHour int    `json:"from_hour"`
+	ToHour   int    `json:"to_hour"`
+}
+
+type OrderQuote struct {
+	Items         []QuoteLine    `json:"items"`
+	Total         money.Money    `json:"total" swaggertype:"number"`
+	DeliverySlots []DeliverySlot `json:"delivery_slots"`
+	QuoteToken    string         `json:"quote_token"`
+	ExpiresAt     time.Time      `json:"expires_at"`
+}
+
+type QuoteLine struct {
+	ID       int64       `json:"id"`
+	Quantity int64       `json:"quantity"`
+	Price    money.Money `json:"price" swaggertype:"number"`
+	Amount   money.Money `json:"amount" swaggertype:"number"`
+}
+
+// DeliverySlot часы дня, на которые есть свободный курьер
+type DeliverySlot struct {
+	Date  string `json:"date"`
+	Hours []int  `json:"hours"`
+}
+
+// OrdersFilter параметры выборки get_orders, After - ключ последнего заказа предыдущей страницы
+type OrdersFilter struct {
+	Statuses []string
+	From     time.Time
+	To       time.Time
+	Desc     bool
+	Limit    int
+	After    *OrdersCursor
+}
+
+type OrdersCursor struct {
+	CTime time.Time `json:"ctime"`
+	ID    int64     `json:"id"`
+}
+
+type OrdersPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
 }
 
 type CreateOrderResponse struct {
 	ID int64 `json:"id"`
 }
 
+type CancelOrderResponse struct {
+	ID     int64  `json:"id"`
+	Status string `json:"status"`
+}
+
 type Item struct {
-	Id       int64 `json:"id"`
-	Quantity int64 `json:"quantity"`
-	StockID  int64 `json:"stock_id,omitempty"`
-	OrderID  int64 `json:"order_id,omitempty"`
+	Id       int64       `json:"id"`
+	Quantity int64       `json:"quantity"`
+	StockID  int64       `json:"stock_id,omitempty"`
+	OrderID  int64       `json:"order_id,omitempty"`
+	Price    money.Money `json:"price,omitzero" swaggertype:"number"`
+}
+
+// OrderDetails заказ с историей всех изменений склада, платежей и резервов курьера по нему
+type OrderDetails struct {
+	Order
+	UserID   int64           `json:"user_id"`
+	Timeline []TimelineEvent `json:"timeline"`
+}
+
+// TimelineEvent строка stock_changes, payments или courier_reservation по заказу
+type TimelineEvent struct {
+	Source    string      `json:"source"`
+	ID        int64       `json:"id"`
+	Action    string      `json:"action"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+	StockID   int64       `json:"stock_id,omitempty"`
+	Quantity  int64       `json:"quantity,omitempty"`
+	Amount    money.Money `json:"amount,omitzero" swaggertype:"number"`
+	CourierID int64       `json:"courier_id,omitempty"`
+	CTime     time.Time   `json:"ctime"`
+	MTime     time.Time   `json:"mtime"`
+}
+
+// DeadLetter сообщение из dead letter топика, описано в общем модуле bus
+type DeadLetter = bus.DeadLetter
+
+type RedriveDeadLetterRequest struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
 }
@@ -0,0 +1,167 @@
+package saga
+
+// Status статус запроса к участнику саги
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusOK      Status = "ok"
+	StatusFailed  Status = "failed"
+)
+
+func (s Status) valid() bool {
+	switch s {
+	case StatusPending, StatusOK, StatusFailed:
+		return true
+	}
+
+	return false
+}
+
+// StockAction действие со складом, совпадает с stock_changes.action
+type StockAction string
+
+const (
+	StockRemove StockAction = "remove"
+	StockAdd    StockAction = "add"
+)
+
+func (a StockAction) valid() bool {
+	return a == StockRemove || a == StockAdd
+}
+
+// PaymentAction действие с деньгами пользователя, совпадает с payments.action.
+// Pay только замораживает сумму на счете, списывает ее Capture после резерва курьера, Void снимает заморозку.
+// Deposit возвращает уже списанные деньги
+type PaymentAction string
+
+const (
+	PaymentPay     PaymentAction = "pay"
+	PaymentCapture PaymentAction = "capture"
+	PaymentVoid    PaymentAction = "void"
+	PaymentDeposit PaymentAction = "deposit"
+)
+
+func (a PaymentAction) valid() bool {
+	switch a {
+	case PaymentPay, PaymentCapture, PaymentVoid, PaymentDeposit:
+		return true
+	}
+
+	return false
+}
+
+// CourReserveAction действие с расписанием курьера
+type CourReserveAction string
+
+const (
+	CourReserve       CourReserveAction = "reserve"
+	CourReserveRevert CourReserveAction = "revert"
+)
+
+func (a CourReserveAction) valid() bool {
+	return a == CourReserve || a == CourReserveRevert
+}
+
+// StockChangeMessage запрос к складу и ответ склада
+type StockChangeMessage struct {
+	Header
+	OrderID        int64       `json:"order_id"`
+	StockChangeIDs []int64     `json:"stock_change_ids"`
+	Action         StockAction `json:"action"`
+	Status         Status      `json:"status"`
+}
+
+func (m *StockChangeMessage) Validate() error {
+	switch {
+	case m.MessageID == "":
+		return malformed("stock_change: no message_id")
+	case m.OrderID <= 0:
+		return malformed("stock_change: bad order_id %d", m.OrderID)
+	case len(m.StockChangeIDs) == 0:
+		return malformed("stock_change: no stock_change_ids")
+	case !m.Action.valid():
+		return malformed("stock_change: unknown action %q", m.Action)
+	case !m.Status.valid():
+		return malformed("stock_change: unknown status %q", m.Status)
+	}
+
+	return nil
+}
+
+// PaymentMessage запрос к биллингу и ответ биллинга
+type PaymentMessage struct {
+	Header
+	PaymentID      int64         `json:"payment_id"`
+	OrderID        int64         `json:"order_id"`
+	StockChangeIDs []int64       `json:"stock_change_ids"`
+	Action         PaymentAction `json:"action"`
+	Status         Status        `json:"status"`
+}
+
+func (m *PaymentMessage) Validate() error {
+	switch {
+	case m.MessageID == "":
+		return malformed("payment: no message_id")
+	case m.PaymentID <= 0:
+		return malformed("payment: bad payment_id %d", m.PaymentID)
+	case m.OrderID <= 0:
+		return malformed("payment: bad order_id %d", m.OrderID)
+	case !m.Action.valid():
+		return malformed("payment: unknown action %q", m.Action)
+	case !m.Status.valid():
+		return malformed("payment: unknown status %q", m.Status)
+	}
+
+	return nil
+}
+
+// CourReserveMessage запрос к доставке и ответ доставки
+type CourReserveMessage struct {
+	Header
+	PaymentID         int64             `json:"payment_id"`
+	OrderID           int64             `json:"order_id"`
+	StockChangeIDs    []int64           `json:"stock_change_ids"`
+	CourReservationID int64             `json:"cour_reservation_id"`
+	Action            CourReserveAction `json:"action"`
+	Status            Status            `json:"status"`
+	RetryCount        int               `json:"retry_count"`
+}
+
+func (m *CourReserveMessage) Validate() error {
+	switch {
+	case m.MessageID == "":
+		return malformed("cour_reserve: no message_id")
+	case m.CourReservationID <= 0:
+		return malformed("cour_reserve: bad cour_reservation_id %d", m.CourReservationID)
+	case m.OrderID <= 0:
+		return malformed("cour_reserve: bad order_id %d", m.OrderID)
+	case !m.Action.valid():
+		return malformed("cour_reserve: unknown action %q", m.Action)
+	case !m.Status.valid():
+		return malformed("cour_reserve: unknown status %q", m.Status)
+	case m.RetryCount < 0:
+		return malformed("cour_reserve: bad retry_count %d", m.RetryCount)
+	}
+
+	return nil
+}
+
+// NotificationMessage уведомление пользователя об изменении статуса заказа
+type NotificationMessage struct {
+	Header
+	UserID  int64  `json:"user_id"`
+	OrderID int64  `json:"order_id"`
+	Message string `json:"message"`
+}
+
+func (m *NotificationMessage) Validate() error {
+	switch {
+	case m.UserID <= 0:
+		return malformed("notification: bad user_id %d", m.UserID)
+	case m.Message == "":
+		return malformed("notification: empty message")
+	}
+
+	return nil
+}
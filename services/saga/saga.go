@@ -0,0 +1,76 @@
+// Package saga описывает контракт сообщений саги оформления заказа между сервисами:
+// типы сообщений, статусы и действия участников, версию схемы и кодирование.
+// Все сервисы кодируют и разбирают сообщения саги только через Encode и Decode
+package saga
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// SchemaVersion текущая версия схемы сообщений. Меняется при несовместимом изменении контракта,
+// сообщения других версий Decode отклоняет
+const SchemaVersion = 1
+
+var (
+	ErrMalformedMessage   = errors.New("malformed saga message")
+	ErrUnsupportedVersion = errors.New("unsupported saga message version")
+)
+
+// Header общие поля всех сообщений саги
+type Header struct {
+	Version   int    `json:"version"`
+	MessageID string `json:"message_id,omitempty"`
+}
+
+func (h *Header) header() *Header {
+	return h
+}
+
+// Message сообщение саги
+type Message interface {
+	header() *Header
+	// Validate проверяет обязательные поля и значения перечислений
+	Validate() error
+}
+
+// Encode проставляет версию схемы, проверяет сообщение и кодирует его в JSON
+func Encode(msg Message) ([]byte, error) {
+	msg.header().Version = SchemaVersion
+
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+
+	return data, nil
+}
+
+// Decode разбирает сообщение и отклоняет сообщения неизвестной версии и с некорректными полями
+func Decode(data []byte, msg Message) error {
+	if err := json.Unmarshal(data, msg); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+
+	if version := msg.header().Version; version != SchemaVersion {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	return msg.Validate()
+}
+
+// Key ключ сообщения в кафке. Все сообщения заказа попадают в одну партицию,
+// поэтому компенсация не обгонит шаг, который она откатывает
+func Key(orderID int64) string {
+	return strconv.FormatInt(orderID, 10)
+}
+
+func malformed(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrMalformedMessage, fmt.Sprintf(format, args...))
+}
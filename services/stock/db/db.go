@@ -1,7 +1,9 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"stock/config"
@@ -39,17 +41,22 @@ func getPassword() string {
 }
 
 func Init(config *config.DBConfig) error {
+	retryCount = config.Retry.Count
+	retryDelay = config.Retry.Delay
+
+	return Open(getConnStr(config))
+}
+
+// Open подключается к базе по строке подключения, так к тестовой базе подключаются тесты
+func Open(connStr string) error {
 	var err error
 	onceDB.Do(func() {
-		conn, err = sql.Open("postgres", getConnStr(config))
+		conn, err = sql.Open("postgres", connStr)
 		if err != nil {
 			return
 		}
 
 		err = conn.Ping()
-
-		retryCount = config.Retry.Count
-		retryDelay = config.Retry.Delay
 	})
 
 	return err
@@ -58,3 +65,27 @@ func Init(config *config.DBConfig) error {
 func GetConn() *sql.DB {
 	return conn
 }
+
+// Close закрывает пул соединений, вызывается при остановке сервиса
+func Close() error {
+	return conn.Close()
+}
+
+// InTx выполняет fn в транзакции, транзакция коммитится, если fn не вернула ошибку
+func InTx(fn func(tx *sql.Tx) error) error {
+	tx, err := GetConn().BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit tx: %w", err)
+	}
+
+	return nil
+}
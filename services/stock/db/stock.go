@@ -3,8 +3,10 @@ package db
 import (
 	"context"
 	"database/sql"
+	"dbutil"
 	"errors"
 	"fmt"
+	"saga"
 	"stock/types"
 	"strconv"
 	"strings"
@@ -14,11 +16,6 @@ import (
 	"go.uber.org/zap"
 )
 
-const (
-	StockChangeAdd = iota
-	StockChangeRemove
-)
-
 var (
 	ErrUnsupportedStockChangeAction = errors.New("unsupported stock change action")
 )
@@ -74,72 +71,84 @@ var (
 	ErrNotEnoughItems = errors.New("not enough items in stock")
 )
 
-func ProcessStockChangesAsync(stockChangeIDs []int64, action int8) error {
-	if action != StockChangeAdd && action != StockChangeRemove {
+// ProcessStockChangesAsync применяет изменения склада, подтверждает их и отмечает сообщение обработанным в одной транзакции.
+// Повторно доставленное сообщение вернет dbutil.ErrDuplicateMessage
+func ProcessStockChangesAsync(consumer, messageID string, stockChangeIDs []int64, action saga.StockAction) error {
+	if action != saga.StockAdd && action != saga.StockRemove {
 		return ErrUnsupportedStockChangeAction
 	}
 
-	changesStr := changesToStr(stockChangeIDs)
-	query := `select s.quantity, sc.quantity, s.id, s.mtime from stock s join stock_changes sc on sc.stock_id = s.id 
-		where sc.id in (%s) and sc.status = 'pending'`
-
 	backoff := retry.WithMaxRetries(retryCount, retry.NewConstant(retryDelay))
 	if err := retry.Do(context.Background(), backoff, func(ctx context.Context) error {
-		rows, err := GetConn().Query(fmt.Sprintf(query, strings.Join(changesStr, ",")))
-		if err != nil {
-			return fmt.Errorf("get stock_changes: %w", err)
-		}
-		defer rows.Close()
-
-		changes := make([]types.StockChange, 0, len(stockChangeIDs))
-		for rows.Next() {
-			var (
-				quantity int64
-				needed   int64
-				stockID  int64
-				mtime    time.Time
-			)
-
-			if err := rows.Scan(&quantity, &needed, &stockID, &mtime); err != nil {
-				return fmt.Errorf("get order items quantity: %w", err)
+		return InTx(func(tx *sql.Tx) error {
+			if err := dbutil.MarkMessageProcessed(tx, consumer, messageID); err != nil {
+				return err
 			}
 
-			if action == StockChangeRemove && needed > quantity {
-				return ErrNotEnoughItems
+			changes, err := getPendingStockChanges(tx, stockChangeIDs, action)
+			if err != nil {
+				return err
 			}
 
-			changes = append(changes, types.StockChange{
-				StockId:  stockID,
-				Quantity: needed,
-				MTime:    mtime,
-			})
-		}
+			// уменьшаем кол-во вещей на складе, если все ок, иначе возвращаем обратно
+			if err := processStockChanges(tx, changes, action); err != nil {
+				return retry.RetryableError(fmt.Errorf(string(action)+" stock items: %w", err))
+			}
 
-		if err := rows.Err(); err != nil {
-			return fmt.Errorf("rows scan: %w", err)
-		}
+			return approveStockChanges(tx, stockChangeIDs)
+		})
+	}); err != nil {
+		return err
+	}
+
+	zap.L().Info("processed stock changes", zap.Int64s("stock_change_ids", stockChangeIDs), zap.String("action", string(action)))
+
+	return nil
+}
+
+func getPendingStockChanges(tx *sql.Tx, stockChangeIDs []int64, action saga.StockAction) ([]types.StockChange, error) {
+	query := `select s.quantity, sc.quantity, s.id, s.mtime from stock s join stock_changes sc on sc.stock_id = s.id 
+		where sc.id in (%s) and sc.status = 'pending'`
+
+	rows, err := tx.Query(fmt.Sprintf(query, strings.Join(changesToStr(stockChangeIDs), ",")))
+	if err != nil {
+		return nil, fmt.Errorf("get stock_changes: %w", err)
+	}
+	defer rows.Close()
 
-		if len(changes) == 0 {
-			return sql.ErrNoRows
+	changes := make([]types.StockChange, 0, len(stockChangeIDs))
+	for rows.Next() {
+		var (
+			quantity int64
+			needed   int64
+			stockID  int64
+			mtime    time.Time
+		)
+
+		if err := rows.Scan(&quantity, &needed, &stockID, &mtime); err != nil {
+			return nil, fmt.Errorf("get order items quantity: %w", err)
 		}
 
-		// уменьшаем кол-во вещей на складе, если все ок, иначе возвращаем обратно
-		if err := processStockChanges(changes, action); err != nil {
-			actionName := "remove"
-			if action == StockChangeAdd {
-				actionName = "add"
-			}
-			return retry.RetryableError(fmt.Errorf(actionName+" stock items: %w", err))
+		if action == saga.StockRemove && needed > quantity {
+			return nil, ErrNotEnoughItems
 		}
 
-		return nil
-	}); err != nil {
-		return err
+		changes = append(changes, types.StockChange{
+			StockId:  stockID,
+			Quantity: needed,
+			MTime:    mtime,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows scan: %w", err)
 	}
 
-	zap.L().Info("processed stock changes", zap.Int64s("stock_change_ids", stockChangeIDs), zap.Int8("action", action))
+	if len(changes) == 0 {
+		return nil, sql.ErrNoRows
+	}
 
-	return nil
+	return changes, nil
 }
 
 func changesToStr(changes []int64) []string {
@@ -151,13 +160,13 @@ func changesToStr(changes []int64) []string {
 	return changesStr
 }
 
-func processStockChanges(changes []types.StockChange, action int8) error {
-	if action != StockChangeAdd && action != StockChangeRemove {
+func processStockChanges(tx *sql.Tx, changes []types.StockChange, action saga.StockAction) error {
+	if action != saga.StockAdd && action != saga.StockRemove {
 		return ErrUnsupportedStockChangeAction
 	}
 
 	operation := "+"
-	if action == StockChangeRemove {
+	if action == saga.StockRemove {
 		operation = "-"
 	}
 
@@ -186,12 +195,6 @@ func processStockChanges(changes []types.StockChange, action int8) error {
 		RETURNING id
 	`, strings.Join(caseParts, " "), strings.Join(ids, ","))
 
-	tx, err := GetConn().BeginTx(context.Background(), nil)
-	if err != nil {
-		return fmt.Errorf("begin tx for stock_changes: %w", err)
-	}
-	defer tx.Rollback()
-
 	rows, err := tx.Query(query, args...)
 	if err != nil {
 		return fmt.Errorf("process stock_changes: %w", err)
@@ -215,12 +218,7 @@ func processStockChanges(changes []types.StockChange, action int8) error {
 				missing = append(missing, ch.StockId)
 			}
 		}
-		return fmt.Errorf("optimistic lock conflict for stock ids: %v", missing)
-	}
-
-	// Если все обновились — коммитим
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit tx: %w", err)
+		return fmt.Errorf("%w: optimistic lock conflict for stock ids: %v", dbutil.ErrConcurrentUpdate, missing)
 	}
 
 	zap.L().Info("updated stock", zap.Any("stock_changes", changes))
@@ -228,27 +226,60 @@ func processStockChanges(changes []types.StockChange, action int8) error {
 	return nil
 }
 
-func ApproveStockChanges(stockChangeIDs []int64) {
+func approveStockChanges(tx *sql.Tx, stockChangeIDs []int64) error {
 	changes := changesToStr(stockChangeIDs)
-	if _, err := GetConn().Exec(
+	if _, err := tx.Exec(
 		fmt.Sprintf(`update stock_changes set status = 'ok', mtime = NOW() where id in (%s)`, strings.Join(changes, ","))); err != nil {
-		zap.L().Error("failed to approve stock remove", zap.Error(err))
-		return
+		return fmt.Errorf("approve stock changes: %w", err)
 	}
 
 	zap.L().Info("approved stock changes", zap.Int64s("stock_change_ids", stockChangeIDs))
+
+	return nil
 }
 
-func RejectStockChanges(stockChangeIDs []int64, reason string) {
+// RejectStockChanges отклоняет изменения склада и отмечает сообщение обработанным в одной транзакции
+func RejectStockChanges(consumer, messageID string, stockChangeIDs []int64, reason string) error {
 	changes := changesToStr(stockChangeIDs)
 	query := fmt.Sprintf(
 		`update stock_changes set status = 'failed', error = $1, mtime = NOW() where id in (%s)`, strings.Join(changes, ","))
-	if _, err := GetConn().Exec(query, reason); err != nil {
-		zap.L().Error("failed to reject stock_changes", zap.Error(err), zap.String("query", query))
-		return
+
+	if err := InTx(func(tx *sql.Tx) error {
+		if err := dbutil.MarkMessageProcessed(tx, consumer, messageID); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(query, reason); err != nil {
+			return fmt.Errorf("reject stock_changes: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
 
 	zap.L().Info("rejected stock changes", zap.Int64s("stock_change_ids", stockChangeIDs), zap.String("reason", reason))
+
+	return nil
+}
+
+// GetStockChangesStatus общий статус пачки изменений склада: failed если хоть одно отклонено, ok если применены все, иначе pending
+func GetStockChangesStatus(stockChangeIDs []int64) (string, error) {
+	var failed, ok, total int
+	if err := GetConn().QueryRow(fmt.Sprintf(
+		`select count(*) filter (where status = 'failed'), count(*) filter (where status = 'ok'), count(*)
+		from stock_changes where id in (%s)`, strings.Join(changesToStr(stockChangeIDs), ","))).Scan(&failed, &ok, &total); err != nil {
+		return "", fmt.Errorf("get stock_changes status: %w", err)
+	}
+
+	switch {
+	case failed > 0:
+		return "failed", nil
+	case total > 0 && ok == total:
+		return "ok", nil
+	default:
+		return "pending", nil
+	}
 }
 
 func GetAllStockChanges() ([]types.StockChange, error) {
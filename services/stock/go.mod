@@ -33,6 +33,9 @@ require (
 	github.com/rcrowley/go-metrics v0.0.0-20250401214520-65e299d6c5c9 // indirect
 	github.com/rogpeppe/go-internal v1.14.1 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.2.0 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
 	golang.org/x/crypto v0.42.0 // indirect
 	golang.org/x/mod v0.27.0 // indirect
@@ -53,3 +56,21 @@ require (
 	github.com/swaggo/swag v1.16.6
 	go.uber.org/zap v1.27.0
 )
+
+require (
+	bus v0.0.0
+	dbutil v0.0.0
+	kafka v0.0.0
+	lifecycle v0.0.0
+	money v0.0.0
+	saga v0.0.0
+)
+
+replace (
+	bus => ../bus
+	dbutil => ../dbutil
+	kafka => ../kafka
+	lifecycle => ../lifecycle
+	money => ../money
+	saga => ../saga
+)
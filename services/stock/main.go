@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"lifecycle"
 	"log"
 	"os"
 	"path/filepath"
@@ -42,11 +43,31 @@ func main() {
 
 	redis.Init(config.RedisConfig)
 
-	go func() {
-		service.NewStockChangesProcessor(config).Run()
-	}()
+	dlc := config.DeadLetterConfig
+	deadLetters := service.NewDeadLetters(config,
+		service.NewKafkaPublisher(dlc.Brokers, dlc.Version, &dlc.ClientConfig),
+		service.NewKafkaReader(dlc.Brokers, dlc.Version, &dlc.ClientConfig),
+		config.ConsumerConfig.Topic)
 
-	server := service.NewServer(config)
+	rtc := config.RetryTopicsConfig
+	retryTopics := service.NewRetryTopics(config, service.NewKafkaPublisher(rtc.Brokers, rtc.Version, &rtc.ClientConfig))
 
-	log.Fatalf("serve: %s", server.ListenAndServe(":"+config.ListenPort))
+	pc := config.ProducerConfig
+	stockChangesProcessor := service.NewStockChangesProcessor(config,
+		service.NewKafkaSubscriber(config.ConsumerConfig),
+		service.NewKafkaPublisher(pc.Brokers, pc.Version, &pc.ClientConfig),
+		retryTopics, deadLetters)
+
+	// компоненты останавливаются в порядке регистрации: HTTP-сервер, процессор, затем закрываются продюсеры ретраев и dead letters, БД и Redis
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config, deadLetters), ":"+config.ListenPort)
+	lc.Go("stock_changes processor", stockChangesProcessor.Run)
+	lc.OnStop("retry topics", retryTopics.Close)
+	lc.OnStop("dead letters", deadLetters.Close)
+	lc.OnStop("database", db.Close)
+	lc.OnStop("redis", redis.Close)
+
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
 }
@@ -71,7 +71,7 @@ func validateItem(item *types.Item) error {
 		return ErrNoItemName
 	case len(item.Description) == 0:
 		return ErrNoItemDesc
-	case item.Price < 0.01:
+	case !item.Price.IsPositive():
 		return ErrNoItemPrice
 	default:
 		return nil
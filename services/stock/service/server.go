@@ -1,6 +1,7 @@
 package service
 
 import (
+	"bus"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,7 +22,9 @@ var ErrAccessTokenExpired = errors.New("access-token expired")
 var ErrRedis = errors.New("redis error")
 var ErrParseAccessToken = errors.New("failed to parse access-token")
 
-func NewServer(config *config.Config) *fasthttp.Server {
+func NewServer(config *config.Config, deadLetters *bus.DeadLetters) *fasthttp.Server {
+	loadPublicKey()
+
 	basePath := strings.Trim(config.BasePath, "/")
 	s := &fasthttp.Server{
 		Handler: func(ctx *fasthttp.RequestCtx) {
@@ -39,7 +42,7 @@ func NewServer(config *config.Config) *fasthttp.Server {
 			switch parts[1] {
 			case "get_items":
 				handleGetItems(ctx)
-			case "add_item", "update_item", "stock_change", "get_stock_changes", "get_all_stock_changes":
+			case "add_item", "update_item", "stock_change", "get_stock_changes", "get_all_stock_changes", "dead_letters", "redrive_dead_letter":
 				var (
 					isAdmin bool
 					err     error
@@ -66,9 +69,17 @@ func NewServer(config *config.Config) *fasthttp.Server {
 					handleGetStockChanges(ctx)
 				case "get_all_stock_changes":
 					handleGetAllStockChanges(ctx)
+				case "dead_letters":
+					handleGetDeadLetters(deadLetters, ctx)
+				case "redrive_dead_letter":
+					handleRedriveDeadLetter(deadLetters, ctx)
 				}
 			case "health":
 				healthCheckHandler(ctx)
+			case "metrics":
+				// метрики продюсеров: {"producers": {...}}
+				ctx.SetContentType("application/json")
+				bus.WriteMetrics(ctx)
 			default:
 				ctx.Error("not found", fasthttp.StatusNotFound)
 			}
@@ -14,7 +14,9 @@ var publicKey *rsa.PublicKey
 var ErrTokenExpired = errors.New("access token expired")
 var ErrTokenInvalid = errors.New("invalid token")
 
-func init() {
+// loadPublicKey читает ключ проверки access-token, вызывается при создании HTTP-сервера,
+// чтобы процессоры сервиса можно было поднять без ключа
+func loadPublicKey() {
 	data, err := os.ReadFile("/keys/cert.pem.pub")
 	if err != nil {
 		log.Fatalf("failed to read public key: %v", err)
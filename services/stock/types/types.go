@@ -1,17 +1,21 @@
 package types
 
-import "time"
+import (
+	"bus"
+	"money"
+	"time"
+)
 
 type HTTPError struct {
 	Error string `json:"error"`
 }
 
 type Item struct {
-	Id          int64   `db:"id" json:"id,omitempty"`
-	Name        string  `db:"name" json:"name"`
-	Description string  `db:"description" json:"description"`
-	Price       float64 `db:"price" json:"price"`
-	Quantity    int64   `json:"quantity,omitempty"`
+	Id          int64       `db:"id" json:"id,omitempty"`
+	Name        string      `db:"name" json:"name"`
+	Description string      `db:"description" json:"description"`
+	Price       money.Money `db:"price" json:"price" swaggertype:"number"`
+	Quantity    int64       `json:"quantity,omitempty"`
 }
 
 type StockChange struct {
@@ -34,3 +38,12 @@ type StockChangesListRequest struct {
 type ItemsResponse struct {
 	Items []Item `json:"items"`
 }
+
+// DeadLetter сообщение из dead letter топика, описано в общем модуле bus
+type DeadLetter = bus.DeadLetter
+
+type RedriveDeadLetterRequest struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
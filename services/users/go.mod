@@ -37,3 +37,7 @@ require (
 	github.com/swaggo/swag v1.16.6
 	go.uber.org/zap v1.27.0
 )
+
+require lifecycle v0.0.0
+
+replace lifecycle => ../lifecycle
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"lifecycle"
 	"log"
 	"os"
 	"path/filepath"
@@ -42,7 +43,13 @@ func main() {
 
 	redis.Init(config.RedisConfig)
 
-	server := service.NewServer(config)
+	// при остановке сервер дорабатывает текущие запросы, затем закрываются БД и Redis
+	lc := lifecycle.New(config.ShutdownTimeout)
+	lc.Serve("http server", service.NewServer(config), ":"+config.ListenPort)
+	lc.OnStop("database", db.Close)
+	lc.OnStop("redis", redis.Close)
 
-	log.Fatalf("serve: %s", server.ListenAndServe(":"+config.ListenPort))
+	if err := lc.Run(); err != nil {
+		log.Fatalf("run: %s", err)
+	}
 }
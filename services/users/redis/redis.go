@@ -41,6 +41,11 @@ func Init(config *config.RedisConfig) {
 	})
 }
 
+// Close закрывает клиент, вызывается при остановке сервиса
+func Close() error {
+	return Client.redis.Close()
+}
+
 func getRedisPassword() string {
 	data, err := os.ReadFile("/secret/redis/password")
 	if err != nil {